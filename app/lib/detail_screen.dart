@@ -1,5 +1,6 @@
 import 'package:flutter/material.dart';
 
+import 'links.dart';
 import 'models.dart';
 
 String _fmt(DateTime dt) {
@@ -65,6 +66,20 @@ class DetailScreen extends StatelessWidget {
               n.text,
               style: Theme.of(context).textTheme.bodyLarge,
             ),
+            if (n.clickUrl.isNotEmpty) ...[
+              const SizedBox(height: 16),
+              TextButton.icon(
+                icon: const Icon(Icons.open_in_new),
+                label: Text(n.clickUrl, overflow: TextOverflow.ellipsis),
+                onPressed: () async {
+                  if (!await openLink(n.clickUrl) && context.mounted) {
+                    ScaffoldMessenger.of(context).showSnackBar(
+                      const SnackBar(content: Text('No app can open this link')),
+                    );
+                  }
+                },
+              ),
+            ],
           ],
         ),
       ),
@@ -103,7 +103,10 @@ class _HomeScreenState extends State<HomeScreen>
           if (_newNotifications.any((x) => x.id == n.id) ||
               _oldNotifications.any((x) => x.id == n.id)) break;
           notificationStore[n.id] = n;
-          setState(() => _newNotifications.insert(0, n));
+          // Keep the list in id (commit) order: a replayed or late frame can
+          // arrive after a newer one.
+          final at = _newNotifications.indexWhere((x) => x.id < n.id);
+          setState(() => _newNotifications.insert(at < 0 ? _newNotifications.length : at, n));
           _heartbeatKey.currentState?.addBeat(true);
         case 'history':
           final all = (msg['notifications'] as List? ?? [])
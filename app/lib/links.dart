@@ -0,0 +1,17 @@
+import 'package:flutter/services.dart';
+
+// Handled by MainActivity, which hands the URL to the browser.
+const _links = MethodChannel('andrnoti/links');
+
+/// Opens an http(s) link; false if it isn't one or nothing could open it.
+Future<bool> openLink(String url) async {
+  final uri = Uri.tryParse(url);
+  if (uri == null || !(uri.isScheme('http') || uri.isScheme('https'))) {
+    return false;
+  }
+  try {
+    return await _links.invokeMethod<bool>('open', {'url': url}) ?? false;
+  } on PlatformException {
+    return false;
+  }
+}
@@ -6,20 +6,23 @@ import 'config.dart';
 import 'home_screen.dart';
 import 'detail_screen.dart';
 import 'config_screen.dart';
+import 'links.dart';
 import 'notification_manager.dart';
 
 // Global key so onNotificationResponse can navigate from outside the widget tree.
 final GlobalKey<NavigatorState> navigatorKey = GlobalKey<NavigatorState>();
 
 // Receives taps on alert notifications (must be top-level, @pragma for tree-shaking).
+// A notification with a click_url opens it; otherwise, or if it can't be
+// opened, the tap shows the detail screen.
 @pragma('vm:entry-point')
-void onNotificationResponse(NotificationResponse response) {
+Future<void> onNotificationResponse(NotificationResponse response) async {
   final id = int.tryParse(response.payload ?? '');
   if (id == null) return;
   final n = notificationStore[id];
-  if (n != null) {
-    navigatorKey.currentState?.pushNamed('/detail', arguments: n);
-  }
+  if (n == null) return;
+  if (n.clickUrl.isNotEmpty && await openLink(n.clickUrl)) return;
+  navigatorKey.currentState?.pushNamed('/detail', arguments: n);
 }
 
 Future<void> main() async {
@@ -3,28 +3,43 @@ class AppNotification {
   final String title;
   final String text;
   final String source; // empty string when no source was set
+  final String clickUrl; // page to open on tap; empty when none
   final DateTime createdAt;
   final DateTime? seenAt;
+  // Presentation hints from extras.hints; empty when the sender gave none.
+  final String sound; // default, alarm or none
+  final String vibrate; // default, short, long or none
+  final String icon;
 
   const AppNotification({
     required this.id,
     required this.title,
     required this.text,
     this.source = '',
+    this.clickUrl = '',
     required this.createdAt,
     this.seenAt,
+    this.sound = '',
+    this.vibrate = '',
+    this.icon = '',
   });
 
   factory AppNotification.fromJson(Map<String, dynamic> json) {
+    final hints = (json['extras'] as Map<String, dynamic>?)?['hints']
+        as Map<String, dynamic>?;
     return AppNotification(
       id: (json['id'] as num).toInt(),
       title: (json['title'] as String?) ?? '',
       text: json['text'] as String,
       source: (json['source'] as String?) ?? '',
+      clickUrl: (json['click_url'] as String?) ?? '',
       createdAt: DateTime.parse(json['created_at'] as String),
       seenAt: json['seen_at'] != null
           ? DateTime.parse(json['seen_at'] as String)
           : null,
+      sound: (hints?['sound'] as String?) ?? '',
+      vibrate: (hints?['vibrate'] as String?) ?? '',
+      icon: (hints?['icon'] as String?) ?? '',
     );
   }
 
@@ -2,6 +2,7 @@ import 'dart:async';
 import 'dart:convert';
 import 'dart:io';
 import 'dart:math';
+import 'dart:typed_data';
 
 import 'package:flutter_foreground_task/flutter_foreground_task.dart';
 import 'package:flutter_local_notifications/flutter_local_notifications.dart';
@@ -21,6 +22,32 @@ const _androidChannel = AndroidNotificationChannel(
   importance: Importance.high,
 );
 
+// Android 8+ takes sound and vibration from the channel, not the
+// notification, so the sound hint picks one of these.
+final _pagesChannel = AndroidNotificationChannel(
+  'andrnoti_pages',
+  'andrNoti Pages',
+  description: 'Urgent notifications sent with the alarm sound hint',
+  importance: Importance.max,
+  audioAttributesUsage: AudioAttributesUsage.alarm,
+  vibrationPattern: _vibrations['long'],
+);
+
+const _quietChannel = AndroidNotificationChannel(
+  'andrnoti_quiet',
+  'andrNoti Quiet',
+  description: 'Notifications sent with the silent sound hint',
+  importance: Importance.low,
+  playSound: false,
+  enableVibration: false,
+);
+
+// Vibration patterns for the vibrate hint (off/on milliseconds).
+final _vibrations = {
+  'short': Int64List.fromList([0, 150]),
+  'long': Int64List.fromList([0, 600, 300, 600, 300, 600]),
+};
+
 final _localNotifications = FlutterLocalNotificationsPlugin();
 
 Future<void> initLocalNotifications({
@@ -33,10 +60,11 @@ Future<void> initLocalNotifications({
     initSettings,
     onDidReceiveNotificationResponse: onNotificationResponse,
   );
-  await _localNotifications
-      .resolvePlatformSpecificImplementation<
-          AndroidFlutterLocalNotificationsPlugin>()
-      ?.createNotificationChannel(_androidChannel);
+  final android = _localNotifications.resolvePlatformSpecificImplementation<
+      AndroidFlutterLocalNotificationsPlugin>();
+  for (final channel in [_androidChannel, _pagesChannel, _quietChannel]) {
+    await android?.createNotificationChannel(channel);
+  }
 }
 
 // ── Debug helper ──────────────────────────────────────────────────────────────
@@ -53,6 +81,7 @@ void _dbg(String msg) {
 class NotificationTaskHandler extends TaskHandler {
   WebSocket? _ws;
   int _retryDelay = 2;
+  final _rng = Random();
   bool _stopped = false;
   bool _connecting = false;
 
@@ -171,7 +200,11 @@ class NotificationTaskHandler extends TaskHandler {
       _ws!.listen(
         _onMessage,
         onError: (e) { _dbg('ws error: $e'); _scheduleReconnect(); },
-        onDone: () { _dbg('ws closed'); _scheduleReconnect(); },
+        onDone: () {
+          _dbg('ws closed: ${_ws?.closeCode} ${_ws?.closeReason}');
+          _applyRetryHint(_ws?.closeReason);
+          _scheduleReconnect();
+        },
         cancelOnError: true,
       );
     } catch (e) {
@@ -183,6 +216,14 @@ class NotificationTaskHandler extends TaskHandler {
     }
   }
 
+  // The server ends close reasons with "; retry_after=<seconds>" when it
+  // wants clients to hold off, e.g. while restarting; wait at least that long.
+  void _applyRetryHint(String? reason) {
+    final m = RegExp(r'retry_after=(\d+)').firstMatch(reason ?? '');
+    if (m == null) return;
+    _retryDelay = max(_retryDelay, int.parse(m.group(1)!));
+  }
+
   void _scheduleReconnect() {
     if (_stopped) return;
     _ws?.close().ignore(); // send close frame so the server drops us immediately
@@ -194,12 +235,13 @@ class NotificationTaskHandler extends TaskHandler {
       'connected': false,
       'ts': DateTime.now().millisecondsSinceEpoch,
     });
-    _dbg('reconnect in ${_retryDelay}s');
+    // Up to 50% jitter, so phones cut off together don't retry together.
+    final delay = _retryDelay + _rng.nextInt(_retryDelay ~/ 2 + 1);
+    _dbg('reconnect in ${delay}s');
     FlutterForegroundTask.updateService(
       notificationTitle: 'andrNoti',
-      notificationText: 'Reconnecting in ${_retryDelay}s…',
+      notificationText: 'Reconnecting in ${delay}s…',
     );
-    final delay = _retryDelay;
     _retryDelay = min(_retryDelay * 2, 60);
     Future.delayed(Duration(seconds: delay), () {
       if (!_stopped) _connect();
@@ -231,18 +273,33 @@ class NotificationTaskHandler extends TaskHandler {
     }
   }
 
+  // The vibrate hint only applies on the default channel, and on Android 8+
+  // only as far as the channel allows. The app has no icon set yet, so the
+  // icon hint is ignored.
   void _showAlert(AppNotification n) {
+    final channel = switch (n.sound) {
+      'alarm' => _pagesChannel,
+      'none' => _quietChannel,
+      _ => _androidChannel,
+    };
     _localNotifications.show(
       n.id.hashCode & 0x7FFFFFFF,
       n.title.isNotEmpty ? n.title : 'Notification',
       n.text,
       NotificationDetails(
         android: AndroidNotificationDetails(
-          _androidChannel.id,
-          _androidChannel.name,
-          channelDescription: _androidChannel.description,
-          importance: Importance.high,
-          priority: Priority.high,
+          channel.id,
+          channel.name,
+          channelDescription: channel.description,
+          importance: channel.importance,
+          priority: switch (n.sound) {
+            'alarm' => Priority.max,
+            'none' => Priority.low,
+            _ => Priority.high,
+          },
+          audioAttributesUsage: channel.audioAttributesUsage,
+          enableVibration: n.vibrate != 'none' && channel.enableVibration,
+          vibrationPattern: _vibrations[n.vibrate] ?? channel.vibrationPattern,
         ),
       ),
       payload: n.id.toString(),
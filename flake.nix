@@ -20,12 +20,15 @@
           };
 
           # ── Go server ──────────────────────────────────────────────────────
-          serverPkg = pkgs.buildGoModule {
+          serverPkg = pkgs.buildGoModule rec {
             pname   = "andr-noti";
             version = "0.4.5";
             src     = ./server;
+            ldflags = [ "-X main.serverVersion=${version}" ];
 
-            vendorHash = "sha256-M16ieYmUqzWJm5ZWFu4ISVD4553EHh31wT8oH1sJZX4=";
+            # The local api module is vendored through its replace directive,
+            # so this hash also changes whenever server/api changes.
+            vendorHash = "sha256-zjLlCzQAfGtTwG5gWjTNToUjrLP7YobJWtE8SJexs+Q=";
 
             postInstall = ''
               mv $out/bin/andrnoti $out/bin/andr-noti
@@ -210,6 +213,13 @@
                 description = "Number of missed beats before alerting on a remote source.";
               };
 
+              extraFlags = lib.mkOption {
+                type        = lib.types.listOf lib.types.str;
+                default     = [];
+                example     = [ "--oncall-topics" "ops,infra" ];
+                description = "Extra command-line flags passed to the server.";
+              };
+
               package = lib.mkOption {
                 type        = lib.types.package;
                 default     = self.packages.${pkgs.system}.default;
@@ -250,6 +260,36 @@
                   default     = null;
                   description = "Relay auth token as plain string. Prefer tokenFile for production.";
                 };
+
+                # Threshold alerts sent from this machine; null disables a check.
+                alerts = {
+                  disk = lib.mkOption {
+                    type        = lib.types.nullOr (lib.types.numbers.between 1 100);
+                    default     = null;
+                    example     = 90;
+                    description = "Alert when a filesystem in diskPaths is more than this percent full.";
+                  };
+
+                  diskPaths = lib.mkOption {
+                    type        = lib.types.listOf lib.types.str;
+                    default     = [ "/" ];
+                    description = "Paths whose filesystems the disk check covers.";
+                  };
+
+                  load = lib.mkOption {
+                    type        = lib.types.nullOr lib.types.number;
+                    default     = null;
+                    example     = 8;
+                    description = "Alert when the 1-minute load average exceeds this.";
+                  };
+
+                  temperature = lib.mkOption {
+                    type        = lib.types.nullOr lib.types.number;
+                    default     = null;
+                    example     = 85;
+                    description = "Alert when any temperature sensor exceeds this many °C.";
+                  };
+                };
               };
             };
 
@@ -281,7 +321,11 @@
                   wantedBy    = [ "multi-user.target" ];
 
                   serviceConfig = {
-                    Type           = "simple";
+                    # notify + NotifyAccess lets a handed-off process take
+                    # over as main PID; reload triggers the handoff.
+                    Type           = "notify";
+                    NotifyAccess   = "all";
+                    ExecReload     = "${pkgs.coreutils}/bin/kill -USR2 $MAINPID";
                     User           = "andr-noti";
                     Group          = "andr-noti";
                     StateDirectory = "andr-noti";
@@ -291,11 +335,14 @@
                         "--port ${toString cfg.port}"
                         "--db /var/lib/andr-noti/notifications.db"
                         "--heartbeat-missed ${toString cfg.heartbeatMissed}"
+                      ] ++ lib.optionals (cfg.hostname != null) [
+                        # nginx runs on the same host; trust its forwarded headers.
+                        "--trusted-proxies 127.0.0.1/32,::1/128"
                       ] ++ (
                         if cfg.tokenFile != null
                         then [ "--token-file ${cfg.tokenFile}" ]
                         else [ "--token ${cfg.token}" ]
-                      )
+                      ) ++ map lib.escapeShellArg cfg.extraFlags
                     );
                     Restart    = "always";
                     RestartSec = 5;
@@ -330,6 +377,8 @@
                       proxyPass   = "http://127.0.0.1:${toString cfg.port}";
                       extraConfig = ''
                         limit_req zone=andrnoti_ws burst=10 nodelay;
+                        proxy_set_header X-Forwarded-For   $remote_addr;
+                        proxy_set_header X-Forwarded-Proto $scheme;
                         proxy_http_version 1.1;
                         proxy_set_header Upgrade    $http_upgrade;
                         proxy_set_header Connection "upgrade";
@@ -363,21 +412,27 @@
                     NoNewPrivileges = true;
                     ProtectSystem   = "strict";
                     ProtectHome     = true;
+                    StateDirectory  = "andr-noti-heartbeat";
                     ExecStart       =
                       let
-                        tokenExpr =
-                          if cfg.heartbeat.tokenFile != null
-                          then ''$(cat ${cfg.heartbeat.tokenFile})''
-                          else cfg.heartbeat.token;
+                        hb = cfg.heartbeat;
+                        al = hb.alerts;
                       in
-                        pkgs.writeShellScript "andr-noti-heartbeat" ''
-                          ${pkgs.curl}/bin/curl -sf \
-                            -X POST "${cfg.heartbeat.relayUrl}/heartbeat" \
-                            -H "Authorization: Bearer ${tokenExpr}" \
-                            -H "Content-Type: application/json" \
-                            -d '{"source":"${cfg.heartbeat.source}","interval":${toString cfg.heartbeat.interval}}' \
-                            || true
-                        '';
+                        lib.concatStringsSep " " ([
+                          "${cfg.package}/bin/andr-noti agent"
+                          "-relay ${hb.relayUrl}"
+                          "-source ${lib.escapeShellArg hb.source}"
+                          "-interval ${toString hb.interval}"
+                          (if hb.tokenFile != null
+                           then "-token-file ${hb.tokenFile}"
+                           else "-token ${lib.escapeShellArg hb.token}")
+                        ]
+                        ++ lib.optionals (al.disk != null) [
+                          "-disk ${toString al.disk}"
+                          "-disk-paths ${lib.concatStringsSep "," al.diskPaths}"
+                        ]
+                        ++ lib.optional (al.load != null) "-load ${toString al.load}"
+                        ++ lib.optional (al.temperature != null) "-temperature ${toString al.temperature}");
                   };
                 };
 
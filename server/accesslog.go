@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ── Access Log ────────────────────────────────────────────────────────────────
+//
+// Every request is logged once it finishes — including ones refused by
+// authentication or the IP filter — with method, path, status, response
+// bytes, latency, the token or identity that authenticated (if any) and the
+// real client address. --access-log-format picks Common Log Format with the
+// latency appended, or one JSON object per line (with the trace id when
+// the request was traced). --access-log sends it to
+// the server log (-, the default), to a separate file, or nowhere (off).
+// A ?token= in the query string is replaced by "REDACTED"; a WebSocket
+// connection is logged when it closes, with its lifetime as the latency.
+
+const accessKey ctxKey = 1
+
+var accessOut *log.Logger // nil: access logging off
+
+type accessEntry struct {
+	Time      string  `json:"time"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`
+	LatencyMS float64 `json:"latency_ms"`
+	Auth      string  `json:"auth,omitempty"`
+	IP        string  `json:"ip"`
+	Proto     string  `json:"proto"`
+	TraceID   string  `json:"trace_id,omitempty"` // when the request was traced
+}
+
+// initAccessLog opens the access log destination.
+func initAccessLog(dest, format string) error {
+	switch format {
+	case "common", "json":
+	default:
+		return fmt.Errorf("unknown format %q (want common or json)", format)
+	}
+	switch dest {
+	case "off":
+	case "-":
+		accessOut = log.New(log.Writer(), "access: ", log.Flags())
+	default:
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+		if err != nil {
+			return err
+		}
+		accessOut = log.New(f, "", 0)
+	}
+	return nil
+}
+
+// noteAuth records who authenticated r for its access log line.
+func noteAuth(r *http.Request, a authInfo) {
+	if e, ok := r.Context().Value(accessKey).(*accessEntry); ok {
+		e.Auth = a.ID
+	}
+}
+
+// accessWriter counts what a handler writes.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Hijack lets WebSocket upgrades through.
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijack not supported")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (w *accessWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func accessLog(next http.Handler) http.Handler {
+	if accessOut == nil {
+		return next
+	}
+	format := *flagAccessLogFormat
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		e := &accessEntry{Method: r.Method, Path: redactedURI(r), IP: clientIP(r), Proto: r.Proto}
+		aw := &accessWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), accessKey, e)))
+
+		e.Status, e.Bytes = cmp.Or(aw.status, http.StatusOK), aw.bytes
+		e.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+		if format == "json" {
+			e.Time = start.UTC().Format(time.RFC3339Nano)
+			data, _ := json.Marshal(e)
+			accessOut.Print(string(data))
+			return
+		}
+		accessOut.Printf("%s - %s [%s] %q %d %d %.3fms",
+			e.IP, cmp.Or(e.Auth, "-"), start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+e.Path+" "+r.Proto, e.Status, e.Bytes, e.LatencyMS)
+	})
+}
+
+// redactedURI is the request path and query with any token hidden.
+func redactedURI(r *http.Request) string {
+	q := r.URL.Query()
+	if !q.Has("token") {
+		return r.URL.RequestURI()
+	}
+	q.Set("token", "REDACTED")
+	return r.URL.Path + "?" + q.Encode()
+}
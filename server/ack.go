@@ -0,0 +1,104 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// ── Acknowledgment ────────────────────────────────────────────────────────────
+//
+// Seen and acknowledged are different answers: seen is "I saw it", which
+// any device that displays a notification may report; acked is "I'm
+// handling it", said once, by one device, on purpose. POST
+// /notifications/{id}/ack records who took a notification on and when, in
+// acked_by and acked_at, which /history and the WebSocket history carry.
+// Acking marks it seen too if it wasn't, closes its incident, ends its
+// escalation and cancels a Pushover emergency. A second ack is refused with
+// 409 and the first acker's name, so two people don't both start on it.
+//
+// Connected clients that speak protocol 3 get an "acked" frame.
+
+func handleAck(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		var body struct {
+			Device string `json:"device"` // which device acknowledged; defaults to the caller
+			By     string `json:"by"`     // who, for the incident log
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body.Device = cmp.Or(body.Device, authFrom(r).ID)
+
+		n, err := getNotification(id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("ack %d: %v", id, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		now := time.Now()
+		res, err := db.Exec(`UPDATE notifications SET acked_at = ?, acked_by = ?, seen_at = COALESCE(seen_at, ?)
+			WHERE id = ? AND acked_at IS NULL`, sqliteTime(now), body.Device, sqliteTime(now), id)
+		if err != nil {
+			log.Printf("ack %d: %v", id, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if acked, _ := res.RowsAffected(); acked == 0 {
+			if n, err = getNotification(id); err == nil && n.AckedAt != nil {
+				http.Error(w, "already acknowledged by "+n.AckedBy+" at "+*n.AckedAt, http.StatusConflict)
+				return
+			}
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		by, at := cmp.Or(body.By, body.Device), now.UTC().Format(time.RFC3339)
+		if n.SeenAt == nil {
+			seen := []noteRef{{n.ID, n.Topic}}
+			recordReceipts([]int64{n.ID}, body.Device, body.By)
+			broadcastSeen(h, seen, body.Device, at)
+			publishSeen(seen, body.Device, at)
+		}
+		ackIncidents([]int64{n.ID}, by)
+		resolveEscalations([]int64{n.ID}, by)
+		cancelPushover([]int64{n.ID})
+		if n, err = getNotification(id); err != nil {
+			log.Printf("ack %d: %v", id, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		broadcastAcked(h, n)
+		busPublish(busEvent{Kind: busKindAcked, IDs: []int64{n.ID}})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(n)
+		log.Printf("ack: %d acknowledged by %s", id, by)
+	}
+}
+
+// broadcastAcked tells the clients that may see n who acknowledged it.
+func broadcastAcked(h *hub, n Notification) {
+	data, _ := json.Marshal(wsMessage{Type: api.TypeAcked, ID: n.ID, Device: n.AckedBy, AckedAt: n.AckedAt})
+	h.bcast <- envelope{data: data, to: func(c *client) bool { return c.speaks(3) && c.sees(n.Topic) }}
+}
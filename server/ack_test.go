@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// incidentAckedBy returns who acknowledged the incident notification id
+// opened, or "" while it is open.
+func incidentAckedBy(t *testing.T, id int64) string {
+	t.Helper()
+	var by *string
+	if err := db.QueryRow(`SELECT acked_by FROM incidents WHERE notification_id = ?`, id).Scan(&by); err != nil {
+		t.Fatal(err)
+	}
+	if by == nil {
+		return ""
+	}
+	return *by
+}
+
+func TestSeenLeavesIncidentOpenAckClosesIt(t *testing.T) {
+	testDB(t)
+	h := testHub(t)
+	n, err := publish(context.Background(), h, Notification{Title: "disk full", Text: "/ at 99%", Priority: priorityUrgent})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	body := `{"ids":[` + strconv.FormatInt(n.ID, 10) + `],"by":"alice","device":"pixel"}`
+	handleMarkSeen(h)(w, httptest.NewRequest(http.MethodPost, "/mark-seen", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("mark-seen: %d %s", w.Code, w.Body)
+	}
+	if by := incidentAckedBy(t, n.ID); by != "" {
+		t.Fatalf("seen acknowledged the incident as %q", by)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/notifications/x/ack", strings.NewReader(`{"device":"pixel","by":"alice"}`))
+	r.SetPathValue("id", strconv.FormatInt(n.ID, 10))
+	handleAck(h)(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("ack: %d %s", w.Code, w.Body)
+	}
+	if by := incidentAckedBy(t, n.ID); by != "alice" {
+		t.Fatalf("after ack, incident acked by %q, want alice", by)
+	}
+}
+
+// stepCounts counts each kind of step logged for notification id's
+// incident.
+func stepCounts(t *testing.T, id int64) map[string]int {
+	t.Helper()
+	rows, err := db.Query(`SELECT s.kind FROM incident_steps s JOIN incidents i ON i.id = s.incident_id
+		WHERE i.notification_id = ?`, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	steps := map[string]int{}
+	for rows.Next() {
+		var kind string
+		if err := rows.Scan(&kind); err != nil {
+			t.Fatal(err)
+		}
+		steps[kind]++
+	}
+	return steps
+}
+
+func TestIncidentStepsLoggedOnce(t *testing.T) {
+	testDB(t)
+	h := testHub(t)
+	first, err := publish(context.Background(), h, Notification{Title: "disk full", Priority: priorityUrgent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := publish(context.Background(), h, Notification{Title: "raid degraded", Priority: priorityUrgent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Opening first's incident again must not log on second's.
+	openIncident(first)
+	ackIncidents([]int64{second.ID}, "alice")
+	ackIncidents([]int64{second.ID}, "bob")
+	var incidentID int64
+	if err := db.QueryRow(`SELECT id FROM incidents WHERE notification_id = ?`, second.ID).Scan(&incidentID); err != nil {
+		t.Fatal(err)
+	}
+	if err := ackIncident(incidentID, "carol"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := stepCounts(t, first.ID); got["opened"] != 1 {
+		t.Errorf("first incident steps %v, want one opened", got)
+	}
+	if got := stepCounts(t, second.ID); got["opened"] != 1 || got["acked"] != 1 {
+		t.Errorf("second incident steps %v, want one opened and one acked", got)
+	}
+	if by := incidentAckedBy(t, second.ID); by != "alice" {
+		t.Errorf("incident acked by %q, want alice", by)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ── Ad-hoc Queries ────────────────────────────────────────────────────────────
+//
+// POST /admin/query runs one read-only SQL statement, for investigations
+// that would otherwise mean a shell on the host and sqlite3 against the live
+// file. It goes through its own connection pool with query_only set, so
+// SQLite itself refuses anything that writes, and only SELECT, WITH, VALUES
+// and EXPLAIN statements are accepted. A query is cut off after
+// queryTimeout (WAL readers don't block the writer, but a long one holds
+// back checkpoints) and returns at most "limit" rows. Tables holding
+// secrets — settings (the rotated primary token), api_tokens,
+// idempotency_keys (stored responses), chat_connectors (webhook URLs),
+// webpush_subscriptions (push keys) and up_registrations (distributor
+// tokens) — can't be named, and a statement whose compiled program opens
+// one of them anyway is refused. Encrypted values are decrypted when the
+// result column still has the stored column's name. Every query is
+// recorded in the audit log.
+
+const (
+	queryTimeout      = 5 * time.Second
+	queryDefaultLimit = 100
+	queryMaxLimit     = 1000
+	queryMaxSQL       = 16 << 10
+)
+
+var queryDeniedTables = []string{
+	"settings", "api_tokens", "idempotency_keys",
+	"chat_connectors", "webpush_subscriptions", "up_registrations",
+}
+
+var queryDB struct {
+	sync.Mutex
+	db *sql.DB
+}
+
+// queryPool opens the read-only pool on first use.
+func queryPool() (*sql.DB, error) {
+	queryDB.Lock()
+	defer queryDB.Unlock()
+	if queryDB.db != nil {
+		return queryDB.db, nil
+	}
+	qdb, err := sql.Open("sqlite", dbDSN(*flagDB, *flagDBBusyTimeout)+"&_pragma=query_only(1)")
+	if err != nil {
+		return nil, err
+	}
+	qdb.SetMaxOpenConns(2)
+	queryDB.db = qdb
+	return qdb, nil
+}
+
+type queryRequest struct {
+	SQL   string `json:"sql"`
+	Args  []any  `json:"args"`
+	Limit int    `json:"limit"`
+}
+
+type queryResult struct {
+	Columns   []string `json:"columns"`
+	Rows      [][]any  `json:"rows"`
+	Truncated bool     `json:"truncated"` // more rows matched than limit
+	ElapsedMS int64    `json:"elapsed_ms"`
+}
+
+func handleAdminQuery() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req queryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `body must be {"sql":"…","args":[…],"limit":N}`, http.StatusBadRequest)
+			return
+		}
+		if err := checkQuery(req.SQL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit := queryDefaultLimit
+		if req.Limit > 0 {
+			limit = min(req.Limit, queryMaxLimit)
+		}
+		qdb, err := queryPool()
+		if err != nil {
+			log.Printf("admin query: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		by := authFrom(r).ID
+		audit(by, "query", req.SQL, "")
+
+		ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+		defer cancel()
+		start := time.Now()
+		err = checkQueryTables(ctx, qdb, req.SQL, req.Args)
+		var res queryResult
+		if err == nil {
+			res, err = runQuery(ctx, qdb, req.SQL, req.Args, limit)
+		}
+		res.ElapsedMS = time.Since(start).Milliseconds()
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			http.Error(w, fmt.Sprintf("query took longer than %s", queryTimeout), http.StatusRequestTimeout)
+			return
+		case err != nil:
+			// SQL errors are the caller's to fix; they name no secrets.
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("admin query: %d rows in %dms by=%s", len(res.Rows), res.ElapsedMS, by)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// checkQuery accepts a single read statement that names no denied table.
+func checkQuery(q string) error {
+	if len(q) > queryMaxSQL {
+		return errors.New("sql too long")
+	}
+	words, statements := sqlWords(q)
+	if len(words) == 0 {
+		return errors.New("sql is required")
+	}
+	switch words[0] {
+	case "select", "with", "values", "explain":
+	default:
+		return errors.New("only SELECT, WITH, VALUES and EXPLAIN statements are allowed")
+	}
+	if statements > 1 {
+		return errors.New("one statement at a time")
+	}
+	for _, w := range words {
+		for _, t := range queryDeniedTables {
+			if w == t {
+				return fmt.Errorf("table %s is not queryable", t)
+			}
+		}
+	}
+	return nil
+}
+
+// sqlWords returns q's identifiers and keywords, lowercased and unquoted,
+// and how many statements they make up. Comments are skipped; single-quoted
+// strings are not, since SQLite reads 'name' as an identifier where one is
+// expected.
+func sqlWords(q string) ([]string, int) {
+	var words []string
+	statements, next := 0, true
+	word := func(w string) {
+		words = append(words, strings.ToLower(w))
+		if next {
+			statements, next = statements+1, false
+		}
+	}
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == '-' && strings.HasPrefix(q[i:], "--"):
+			end := strings.IndexByte(q[i:], '\n')
+			if end < 0 {
+				return words, statements
+			}
+			i += end
+		case c == '/' && strings.HasPrefix(q[i:], "/*"):
+			end := strings.Index(q[i+2:], "*/")
+			if end < 0 {
+				return words, statements
+			}
+			i += end + 4
+		case c == '\'' || c == '"' || c == '`':
+			var w string
+			w, i = sqlQuoted(q, i, c)
+			word(w)
+		case c == '[':
+			end := strings.IndexByte(q[i:], ']')
+			if end < 0 {
+				end = len(q) - i - 1
+			}
+			word(q[i+1 : i+end])
+			i += end + 1
+		case c == ';':
+			next = true
+			i++
+		case c == '_' || c >= 0x80 || ('a' <= c|0x20 && c|0x20 <= 'z'):
+			j := i
+			for j < len(q) && (q[j] == '_' || q[j] == '$' || q[j] >= 0x80 ||
+				('a' <= q[j]|0x20 && q[j]|0x20 <= 'z') || ('0' <= q[j] && q[j] <= '9')) {
+				j++
+			}
+			word(q[i:j])
+			i = j
+		default:
+			i++
+		}
+	}
+	return words, statements
+}
+
+// sqlQuoted reads a quoted token starting at q[i], where a doubled quote
+// stands for itself, and returns its content and the index after it.
+func sqlQuoted(q string, i int, quote byte) (string, int) {
+	var b strings.Builder
+	for j := i + 1; j < len(q); j++ {
+		if q[j] != quote {
+			b.WriteByte(q[j])
+			continue
+		}
+		if j+1 < len(q) && q[j+1] == quote {
+			b.WriteByte(quote)
+			j++
+			continue
+		}
+		return b.String(), j + 1
+	}
+	return b.String(), len(q)
+}
+
+// checkQueryTables compiles q with EXPLAIN and refuses it if the program
+// opens a denied table or one of its indexes, however the query spelled it.
+// Statements that are already EXPLAIN never read rows and aren't checked.
+func checkQueryTables(ctx context.Context, qdb *sql.DB, q string, args []any) error {
+	if words, _ := sqlWords(q); len(words) > 0 && words[0] == "explain" {
+		return nil
+	}
+	names := make([]any, len(queryDeniedTables))
+	for i, t := range queryDeniedTables {
+		names[i] = t
+	}
+	denied := map[int64]string{}
+	rows, err := qdb.QueryContext(ctx, `SELECT rootpage, tbl_name FROM sqlite_schema
+		WHERE rootpage > 0 AND tbl_name IN (?`+strings.Repeat(", ?", len(names)-1)+`)`, names...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var page int64
+		var table string
+		if err := rows.Scan(&page, &table); err != nil {
+			rows.Close()
+			return err
+		}
+		denied[page] = table
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = qdb.QueryContext(ctx, "EXPLAIN "+q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var addr, p1, p2, p3, p5 int64
+		var opcode string
+		var p4, comment sql.NullString
+		if err := rows.Scan(&addr, &opcode, &p1, &p2, &p3, &p4, &p5, &comment); err != nil {
+			return err
+		}
+		// p3 is the database: 0 is main, where the denied tables live.
+		if opcode == "OpenRead" && p3 == 0 {
+			if t, ok := denied[p2]; ok {
+				return fmt.Errorf("table %s is not queryable", t)
+			}
+		}
+	}
+	return rows.Err()
+}
+
+func runQuery(ctx context.Context, qdb *sql.DB, q string, args []any, limit int) (queryResult, error) {
+	res := queryResult{Rows: [][]any{}}
+	rows, err := qdb.QueryContext(ctx, q, args...)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+	if res.Columns, err = rows.Columns(); err != nil {
+		return res, err
+	}
+	for rows.Next() {
+		if len(res.Rows) == limit {
+			res.Truncated = true
+			break
+		}
+		vals := make([]any, len(res.Columns))
+		ptrs := make([]any, len(vals))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return res, err
+		}
+		for i, v := range vals {
+			vals[i] = queryValue(res.Columns[i], v)
+		}
+		res.Rows = append(res.Rows, vals)
+	}
+	return res, rows.Err()
+}
+
+// queryValue makes a scanned value JSON-friendly: text rather than base64
+// for readable blobs, and decrypted where the column name allows.
+func queryValue(column string, v any) any {
+	if b, ok := v.([]byte); ok && utf8.Valid(b) {
+		v = string(b)
+	}
+	if s, ok := v.(string); ok && strings.HasPrefix(s, sealedPrefix) {
+		if plain, err := openColumn(column, s); err == nil {
+			return plain
+		}
+	}
+	return v
+}
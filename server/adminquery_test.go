@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCheckQuery(t *testing.T) {
+	for _, tc := range []struct {
+		sql     string
+		refused bool
+	}{
+		{"SELECT * FROM notifications", false},
+		{"SELECT * FROM notifications WHERE title = 'x'", false},
+		{"SELECT * FROM settings", true},
+		{"SELECT * FROM 'settings'", true},
+		{"SELECT * FROM [settings]", true},
+		{`SELECT * FROM "settings"`, true},
+		{"SELECT * FROM `settings`", true},
+		{"SELECT * FROM main.settings", true},
+		{"SELECT * FROM main.'api_tokens'", true},
+		{"SELECT * FROM/**/SETTINGS", true},
+		{"SELECT * FROM -- comment\nidempotency_keys", true},
+		{"SELECT 'it''s' AS a, * FROM 'settings'", true},
+		{`SELECT "x" FROM 'set''tings'`, false},
+		{"SELECT url FROM chat_connectors", true},
+		{"SELECT auth, p256dh FROM webpush_subscriptions", true},
+		{"SELECT token FROM up_registrations", true},
+		{"SELECT 1; SELECT 2", true},
+		{"DELETE FROM notifications", true},
+	} {
+		if err := checkQuery(tc.sql); (err != nil) != tc.refused {
+			t.Errorf("checkQuery(%q) = %v, refused want %v", tc.sql, err, tc.refused)
+		}
+	}
+}
+
+func TestCheckQueryTables(t *testing.T) {
+	testDB(t)
+	if _, err := db.Exec(`CREATE VIEW everything AS SELECT * FROM settings`); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, tc := range []struct {
+		sql     string
+		refused bool
+	}{
+		{"SELECT * FROM notifications", false},
+		{"SELECT * FROM everything", true},
+		{"SELECT * FROM 'settings'", true},
+		{"WITH s AS (SELECT * FROM main.settings) SELECT * FROM s", true},
+		{"SELECT (SELECT COUNT(*) FROM api_tokens)", true},
+		{"SELECT * FROM notifications WHERE topic IN (SELECT url FROM 'chat_connectors')", true},
+		{"SELECT * FROM main.webpush_subscriptions", true},
+		{"SELECT * FROM \"up_registrations\"", true},
+		{"EXPLAIN SELECT * FROM everything", false},
+	} {
+		if err := checkQueryTables(ctx, db, tc.sql, nil); (err != nil) != tc.refused {
+			t.Errorf("checkQueryTables(%q) = %v, refused want %v", tc.sql, err, tc.refused)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ── Agent ─────────────────────────────────────────────────────────────────────
+//
+//	andr-noti agent -relay https://notify.example.com -token-file … [-source name]
+//	    [-interval 60] [-loop] [-disk 90 -disk-paths /,/var] [-load 8] [-temperature 85]
+//
+// The heartbeat sender for monitored machines, in place of curl. Each run
+// posts a heartbeat and, when thresholds are set, checks the host: disk use
+// (percent of each -disk-paths filesystem), the 1-minute load average and the
+// hottest temperature sensor. A check that crosses its threshold sends one
+// alert; once it is back under, one recovery. Which alerts are open is kept
+// in -state-file between runs, so a systemd timer or cron can run it once a
+// minute; -loop keeps it running instead, every -interval seconds, for hosts
+// without either. Disk works on Linux, macOS and Windows, load on Linux and
+// macOS, temperature on Linux; an unsupported check is skipped with a log
+// line.
+
+type agentConfig struct {
+	relay, token, source string
+	interval             time.Duration
+	diskPct              float64
+	diskPaths            []string
+	load, temperature    float64
+	stateFile            string
+}
+
+// agentCheck is one reading compared against its threshold.
+type agentCheck struct {
+	key   string // state key, e.g. "disk:/var"
+	what  string // e.g. "disk /var"
+	value float64
+	limit float64
+	prec  int    // decimals shown for value
+	unit  string // e.g. "%", " °C"
+}
+
+func runAgent(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	relay := fs.String("relay", "", "Relay base URL (required)")
+	tokenFile := fs.String("token-file", "", "Path to file containing the relay auth token")
+	token := fs.String("token", "", "Relay auth token (prefer -token-file)")
+	host, _ := os.Hostname()
+	source := fs.String("source", host, "Name of this machine in heartbeats and alerts")
+	interval := fs.Int("interval", 60, "Heartbeat interval in seconds; with -loop, also how often to run")
+	loop := fs.Bool("loop", false, "Keep running instead of exiting after one run")
+	diskPct := fs.Float64("disk", 0, "Alert when a filesystem is more than this percent full (0 = off)")
+	diskPaths := fs.String("disk-paths", "/", "Comma-separated paths whose filesystems -disk checks")
+	load := fs.Float64("load", 0, "Alert when the 1-minute load average exceeds this (0 = off)")
+	temperature := fs.Float64("temperature", 0, "Alert when any temperature sensor exceeds this many °C (0 = off)")
+	stateFile := fs.String("state-file", defaultAgentState(), "Where open alerts are remembered between runs")
+	fs.Parse(args)
+
+	if *relay == "" || *source == "" || *interval < 1 {
+		fmt.Fprintln(os.Stderr, "agent: -relay and -source are required and -interval must be positive")
+		os.Exit(2)
+	}
+	tok, err := loadToken(*tokenFile, *token)
+	if err != nil {
+		log.Fatalf("agent: %v", err)
+	}
+	cfg := agentConfig{
+		relay:       strings.TrimSuffix(*relay, "/"),
+		token:       tok,
+		source:      *source,
+		interval:    time.Duration(*interval) * time.Second,
+		diskPct:     *diskPct,
+		diskPaths:   splitList(*diskPaths),
+		load:        *load,
+		temperature: *temperature,
+		stateFile:   *stateFile,
+	}
+	if !*loop {
+		agentRun(cfg)
+		return
+	}
+	for {
+		agentRun(cfg)
+		time.Sleep(cfg.interval)
+	}
+}
+
+// defaultAgentState is under the systemd state directory when there is one,
+// else the user's cache directory.
+func defaultAgentState() string {
+	if d := os.Getenv("STATE_DIRECTORY"); d != "" {
+		return filepath.Join(strings.Split(d, ":")[0], "agent-state.json")
+	}
+	if d, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(d, "andr-noti", "agent-state.json")
+	}
+	return "andr-noti-agent-state.json"
+}
+
+func agentRun(cfg agentConfig) {
+	if err := agentPost(cfg, "/heartbeat", map[string]any{
+		"source":   cfg.source,
+		"interval": int(cfg.interval / time.Second),
+	}); err != nil {
+		log.Printf("agent: heartbeat: %v", err)
+	}
+
+	checks := agentChecks(cfg)
+	if len(checks) == 0 {
+		return
+	}
+	open := map[string]bool{}
+	if raw, err := os.ReadFile(cfg.stateFile); err == nil {
+		json.Unmarshal(raw, &open)
+	}
+	changed := false
+	for _, c := range checks {
+		over := c.value > c.limit
+		if over == open[c.key] {
+			continue
+		}
+		value := strconv.FormatFloat(c.value, 'f', c.prec, 64) + c.unit
+		limit := strconv.FormatFloat(c.limit, 'f', -1, 64) + c.unit
+		n := map[string]any{"source": cfg.source}
+		if over {
+			n["title"] = fmt.Sprintf("%s: %s at %s", cfg.source, c.what, value)
+			n["text"] = fmt.Sprintf("%s on %s is %s, over the %s threshold.", c.what, cfg.source, value, limit)
+			n["priority"] = priorityHigh
+		} else {
+			n["title"] = fmt.Sprintf("%s: %s back to %s", cfg.source, c.what, value)
+			n["text"] = fmt.Sprintf("%s on %s is %s, under the %s threshold again.", c.what, cfg.source, value, limit)
+		}
+		if err := agentPost(cfg, "/send", n); err != nil {
+			log.Printf("agent: %s: %v", c.what, err) // state unchanged: retried next run
+			continue
+		}
+		log.Printf("agent: %s", n["title"])
+		if over {
+			open[c.key] = true
+		} else {
+			delete(open, c.key)
+		}
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	data, _ := json.Marshal(open)
+	os.MkdirAll(filepath.Dir(cfg.stateFile), 0o700)
+	if err := os.WriteFile(cfg.stateFile, data, 0o600); err != nil {
+		log.Printf("agent: state: %v", err)
+	}
+}
+
+// agentChecks takes the readings for the thresholds that are set.
+func agentChecks(cfg agentConfig) []agentCheck {
+	var checks []agentCheck
+	skip := func(what string, err error) {
+		if errors.Is(err, errors.ErrUnsupported) {
+			log.Printf("agent: %s isn't available on this platform; skipping", what)
+		} else {
+			log.Printf("agent: %s: %v", what, err)
+		}
+	}
+	if cfg.diskPct > 0 {
+		for _, p := range cfg.diskPaths {
+			free, total, err := diskSpace(p)
+			if err == nil && total == 0 {
+				err = errors.New("filesystem reports no size")
+			}
+			if err != nil {
+				skip("disk "+p, err)
+				continue
+			}
+			used := 100 * (1 - float64(free)/float64(total))
+			checks = append(checks, agentCheck{"disk:" + p, "disk " + p, used, cfg.diskPct, 1, "%"})
+		}
+	}
+	if cfg.load > 0 {
+		if l, err := loadAverage(); err != nil {
+			skip("load average", err)
+		} else {
+			checks = append(checks, agentCheck{"load", "load average", l, cfg.load, 2, ""})
+		}
+	}
+	if cfg.temperature > 0 {
+		if t, err := hottestSensor(); err != nil {
+			skip("temperature", err)
+		} else {
+			checks = append(checks, agentCheck{"temperature", "temperature", t, cfg.temperature, 0, " °C"})
+		}
+	}
+	return checks
+}
+
+func agentPost(cfg agentConfig, path string, body any) error {
+	data, _ := json.Marshal(body)
+	req, err := http.NewRequest(http.MethodPost, cfg.relay+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := (&http.Client{Timeout: 15 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return nil
+}
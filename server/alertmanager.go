@@ -0,0 +1,222 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// ── Alertmanager ──────────────────────────────────────────────────────────────
+//
+// POST /ingest/alertmanager is a Prometheus Alertmanager webhook receiver.
+// Each webhook — one alert group — becomes one Markdown notification titled
+// the way Alertmanager's own templates do ("[FIRING:2] HighCPU (job=node)"),
+// listing the firing alerts, then the resolved ones, each by its summary
+// with the labels that set it apart from the rest of the group and a link
+// to its graph. Grafana's receiver (grafana.go) shares the formatting. The
+// priority comes from the highest severity label through
+// --alertmanager-priorities; a group whose alerts have all resolved is sent
+// at low priority. The topic is the --alertmanager-topic-label label, when
+// set and the group has it in common. Clicking opens Alertmanager.
+
+const amMaxAlerts = 20 // alerts listed before "… and N more"
+
+// amPriorities maps severity label values to priorities, from
+// --alertmanager-priorities.
+var amPriorities map[string]int
+
+type amWebhook struct {
+	Version           string            `json:"version"`
+	GroupKey          string            `json:"groupKey"`
+	TruncatedAlerts   int               `json:"truncatedAlerts"`
+	Status            string            `json:"status"`
+	Receiver          string            `json:"receiver"`
+	GroupLabels       map[string]string `json:"groupLabels"`
+	CommonLabels      map[string]string `json:"commonLabels"`
+	CommonAnnotations map[string]string `json:"commonAnnotations"`
+	ExternalURL       string            `json:"externalURL"`
+	Alerts            []amAlert         `json:"alerts"`
+
+	// Grafana's additions (see grafana.go).
+	Title   string `json:"title"`
+	State   string `json:"state"`
+	Message string `json:"message"`
+}
+
+type amAlert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+
+	// Grafana's additions.
+	Values       map[string]float64 `json:"values"`
+	PanelURL     string             `json:"panelURL"`
+	DashboardURL string             `json:"dashboardURL"`
+}
+
+// parsePriorityMap reads a name=priority,… flag such as
+// --alertmanager-priorities.
+func parsePriorityMap(s string) (map[string]int, error) {
+	kv, err := parseHeaders(s)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]int{}
+	for severity, v := range kv {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < priorityMin || p > priorityUrgent {
+			return nil, fmt.Errorf("%s: priority must be 1-5", severity)
+		}
+		out[strings.ToLower(severity)] = p
+	}
+	return out, nil
+}
+
+func parseAlertmanager(_ http.Header, payload []byte) (sendBody, error) {
+	var wh amWebhook
+	if err := json.Unmarshal(payload, &wh); err != nil {
+		return sendBody{}, err
+	}
+	if wh.Status == "" || len(wh.Alerts) == 0 {
+		return sendBody{}, errors.New("not an Alertmanager webhook (no status or alerts)")
+	}
+	return alertGroupBody(wh, "alertmanager"), nil
+}
+
+// alertGroupBody formats an Alertmanager-style alert group from system.
+func alertGroupBody(wh amWebhook, system string) sendBody {
+	var firing, resolved []amAlert
+	for _, a := range wh.Alerts {
+		if a.Status == "resolved" {
+			resolved = append(resolved, a)
+		} else {
+			firing = append(firing, a)
+		}
+	}
+
+	b := sendBody{
+		Title:    amTitle(wh, len(firing)),
+		Format:   formatMarkdown,
+		Source:   system,
+		Priority: priorityLow,
+		Extras:   &api.Extras{Source: &api.SourceMeta{System: system, ID: wh.GroupKey}},
+	}
+	for _, a := range firing {
+		if p, ok := amPriorities[strings.ToLower(a.Labels["severity"])]; ok && p > b.Priority {
+			b.Priority = p
+		} else if !ok {
+			b.Priority = max(b.Priority, priorityDefault)
+		}
+	}
+	if *flagAMTopicLabel != "" {
+		b.Topic = wh.CommonLabels[*flagAMTopicLabel]
+	}
+	if httpURL(wh.ExternalURL) {
+		b.ClickURL, b.Extras.Source.URL = wh.ExternalURL, wh.ExternalURL
+	}
+
+	var t strings.Builder
+	if s := cmp.Or(wh.CommonAnnotations["summary"], wh.CommonAnnotations["description"]); s != "" {
+		t.WriteString(s + "\n\n")
+	}
+	listed := 0
+	for _, group := range []struct {
+		heading string
+		alerts  []amAlert
+	}{{"Firing", firing}, {"Resolved", resolved}} {
+		if len(group.alerts) == 0 {
+			continue
+		}
+		fmt.Fprintf(&t, "**%s**\n\n", group.heading)
+		for _, a := range group.alerts {
+			if listed == amMaxAlerts {
+				break
+			}
+			t.WriteString(amAlertLine(wh, a) + "\n")
+			listed++
+		}
+		t.WriteString("\n")
+	}
+	if more := len(wh.Alerts) - listed + wh.TruncatedAlerts; more > 0 {
+		fmt.Fprintf(&t, "… and %d more alerts\n", more)
+	}
+	b.Text = strings.TrimSpace(t.String())
+	return b
+}
+
+// amTitle follows Alertmanager's default "[FIRING:N] alertname (labels)".
+func amTitle(wh amWebhook, firing int) string {
+	status := "[RESOLVED]"
+	if firing > 0 {
+		status = fmt.Sprintf("[FIRING:%d]", firing)
+	}
+	name := cmp.Or(wh.GroupLabels["alertname"], wh.CommonLabels["alertname"], "Alerts")
+	var rest []string
+	for _, k := range sortedKeys(wh.GroupLabels) {
+		if k != "alertname" {
+			rest = append(rest, k+"="+wh.GroupLabels[k])
+		}
+	}
+	title := status + " " + name
+	if len(rest) > 0 {
+		title += " (" + strings.Join(rest, ", ") + ")"
+	}
+	return title
+}
+
+// amAlertLine is one list item: what the alert says, the labels it doesn't
+// share with the group, the values that fired it (Grafana), since when, and
+// its panel or graph.
+func amAlertLine(wh amWebhook, a amAlert) string {
+	what := cmp.Or(a.Annotations["summary"], a.Annotations["description"], a.Labels["alertname"])
+	if what == wh.CommonAnnotations["summary"] || what == wh.CommonAnnotations["description"] {
+		what = "" // already said above the list
+	}
+	var own []string
+	for _, k := range sortedKeys(a.Labels) {
+		if _, common := wh.CommonLabels[k]; !common {
+			own = append(own, k+"="+a.Labels[k])
+		}
+	}
+	var parts []string
+	if what != "" {
+		parts = append(parts, what)
+	}
+	if len(own) > 0 {
+		parts = append(parts, "`"+strings.Join(own, " ")+"`")
+	}
+	if len(parts) == 0 {
+		parts = append(parts, a.Labels["alertname"])
+	}
+	if len(a.Values) > 0 {
+		var values []string
+		for _, k := range sortedKeys(a.Values) {
+			values = append(values, fmt.Sprintf("%s=%g", k, a.Values[k]))
+		}
+		parts = append(parts, "("+strings.Join(values, ", ")+")")
+	}
+	line := "- " + strings.Join(parts, " ")
+	if a.Status == "resolved" && !a.EndsAt.IsZero() {
+		line += " — resolved " + a.EndsAt.UTC().Format("15:04 MST")
+	} else if !a.StartsAt.IsZero() {
+		line += " — since " + a.StartsAt.UTC().Format("Jan 2 15:04 MST")
+	}
+	switch {
+	case httpURL(a.PanelURL):
+		line += " ([panel](" + a.PanelURL + "))"
+	case httpURL(a.GeneratorURL):
+		line += " ([graph](" + a.GeneratorURL + "))"
+	}
+	return line
+}
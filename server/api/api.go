@@ -0,0 +1,256 @@
+// Package api holds the wire types shared by the andrNoti server and its
+// clients: the notification model, WebSocket frames in both directions, and
+// the JSON error body.
+//
+// It is a separate module with no dependencies so SDKs and third-party tools
+// can import it without pulling in the server. It is versioned independently
+// with tags of the form api/vX.Y.Z; within a major version fields are only
+// ever added, never renamed or removed, and the numbers in their proto tags
+// (the protobuf encoding of the same types) never change.
+package api
+
+// Version is the version of this package's wire format.
+const Version = "1.15.0"
+
+// Priority levels. Zero in a request means PriorityDefault.
+const (
+	PriorityMin     = 1
+	PriorityLow     = 2
+	PriorityDefault = 3
+	PriorityHigh    = 4
+	PriorityUrgent  = 5
+)
+
+// Notification is a stored notification as returned by /history and carried
+// in WebSocket "history" frames.
+//
+// Text is always readable as plain text. For Format "markdown" the source is
+// in Markdown, and HTML holds a sanitized rendering for clients that asked
+// for it with ?html=1.
+type Notification struct {
+	ID        int64   `json:"id" proto:"1"`
+	Title     string  `json:"title" proto:"2"`
+	Text      string  `json:"text" proto:"3"`
+	Format    string  `json:"format,omitempty" proto:"4"` // "" (plain) or "markdown"
+	Markdown  string  `json:"markdown,omitempty" proto:"5"`
+	HTML      string  `json:"html,omitempty" proto:"6"`
+	Source    string  `json:"source" proto:"7"`
+	Topic     string  `json:"topic" proto:"8"`
+	Priority  int     `json:"priority" proto:"9"`
+	Assignee  string  `json:"assignee,omitempty" proto:"10"`
+	ClickURL  string  `json:"click_url,omitempty" proto:"11"` // http(s) page to open when the notification is tapped
+	Extras    *Extras `json:"extras,omitempty" proto:"12"`
+	CreatedAt string  `json:"created_at" proto:"13"`
+	SeenAt    *string `json:"seen_at" proto:"14"`
+
+	SnoozedUntil *string `json:"snoozed_until,omitempty" proto:"15"` // hidden until then, then unseen again
+	RequireAck   bool    `json:"require_ack,omitempty" proto:"16"`   // redelivered and escalated until seen
+	AckedAt      *string `json:"acked_at,omitempty" proto:"17"`      // when someone took it on; acked implies seen
+	AckedBy      string  `json:"acked_by,omitempty" proto:"18"`      // the device that acknowledged it
+}
+
+// Extras is optional structured data attached by the producer.
+type Extras struct {
+	Source *SourceMeta `json:"source,omitempty" proto:"1"`
+	Hints  *Hints      `json:"hints,omitempty" proto:"2"`
+	Origin *Origin     `json:"origin,omitempty" proto:"3"` // set by the server, never by a producer
+}
+
+// SourceMeta identifies what a notification was generated from, so clients
+// can link back to it: an alert in Alertmanager, a GitHub event, a syslog
+// line or a mail.
+type SourceMeta struct {
+	System string `json:"system" proto:"1"`            // e.g. "alertmanager", "github", "syslog", "smtp"
+	ID     string `json:"id,omitempty" proto:"2"`      // the item's ID in that system
+	URL    string `json:"url,omitempty" proto:"3"`     // http(s) link to the item
+	RawRef string `json:"raw_ref,omitempty" proto:"4"` // reference to the original payload
+}
+
+// Origin is where a notification forwarded by a federation peer was first
+// published. The origin instance signed it; the receiving server checked
+// the signature before storing it.
+type Origin struct {
+	Instance string   `json:"instance" proto:"1"`       // the origin's --federation-name
+	ID       int64    `json:"id" proto:"2"`             // the notification's ID there
+	Hops     []string `json:"hops,omitempty" proto:"3"` // instances it passed through, the origin first
+}
+
+// Hints tell clients how to present a notification, so an urgent page can
+// sound different from an informational message. They are suggestions: a
+// client applies what it supports and the user's settings still win.
+type Hints struct {
+	Sound   string `json:"sound,omitempty" proto:"1"`   // SoundDefault, SoundAlarm or SoundNone
+	Vibrate string `json:"vibrate,omitempty" proto:"2"` // VibrateDefault, VibrateShort, VibrateLong or VibrateNone
+	Icon    string `json:"icon,omitempty" proto:"3"`    // a name from the client's icon set, e.g. "server"; unknown names get the default icon
+}
+
+// Hint values.
+const (
+	SoundDefault = "default"
+	SoundAlarm   = "alarm" // played as an alarm, for pages
+	SoundNone    = "none"
+
+	VibrateDefault = "default"
+	VibrateShort   = "short"
+	VibrateLong    = "long"
+	VibrateNone    = "none"
+)
+
+// ── WebSocket ─────────────────────────────────────────────────────────────────
+
+// Server → client frame types.
+const (
+	TypeHistory       = "history"       // replaces the client's list
+	TypeNotification  = "notification"  // one new notification
+	TypeNotifications = "notifications" // several to add: a batch send or a ?since= replay
+	TypeSnoozed       = "snoozed"       // hide ID until SnoozedUntil
+	TypeSeen          = "seen"          // IDs were marked seen by Device
+	TypeStats         = "stats"
+	TypeConfig        = "config"
+	TypeReauth        = "reauth"
+	TypeUnifiedPush   = "unifiedpush" // a message for, or the end of, one of the device's UnifiedPush registrations
+	TypeHello         = "hello"       // both ways: the client's offer, and the server's answer in Hello
+	TypeDeleted       = "deleted"     // protocol 2: IDs were deleted; with no IDs, every notification up to ID
+	TypeUpdated       = "updated"     // protocol 2: Notifications changed or added quietly; replace by id, don't alert
+	TypeAcked         = "acked"       // protocol 3: ID was acknowledged by Device at AckedAt
+)
+
+// ProtocolVersion is the newest WebSocket protocol the server speaks. A
+// client that says hello with a protocol gets frames no newer than that;
+// one that never says hello gets protocol 1.
+//
+// Protocol 2 adds TypeDeleted and TypeUpdated; protocol 3 adds TypeAcked.
+const ProtocolVersion = 3
+
+// Features a client may ask for in its hello. The server's answer lists the
+// ones it grants on that connection.
+const (
+	FeatureAcks        = "acks"        // TypeAck moves the ?device= cursor
+	FeatureBatch       = "batch"       // TypeNotifications frames for batch sends, as ?batch=1
+	FeatureCompression = "compression" // permessage-deflate was negotiated
+	FeatureSinceID     = "since_id"    // ?since= and ?device= replay on connect
+	FeatureTopics      = "topics"      // live frames only for the hello's Topics
+)
+
+// Client → server frame types and streams.
+const (
+	TypeSubscribe   = "subscribe"
+	TypeUnsubscribe = "unsubscribe"
+	TypeAck         = "ack"
+	TypeUPAck       = "up_ack"
+	StreamStats     = "stats"
+)
+
+// Close codes the server uses beyond the RFC 6455 set.
+const (
+	CloseTokenExpired    = 4401 // the JWT the client connected with expired
+	CloseUpgradeRequired = 4426 // client is older than --min-client-version
+)
+
+// Message is the envelope of every server → client frame. Which fields are
+// set depends on Type; a "notification" frame carries the notification's
+// fields flattened into the envelope.
+type Message struct {
+	Type          string         `json:"type" proto:"1"`
+	Notifications []Notification `json:"notifications,omitempty" proto:"2"`
+	ID            int64          `json:"id,omitempty" proto:"3"`
+	Title         string         `json:"title,omitempty" proto:"4"`
+	Text          string         `json:"text,omitempty" proto:"5"`
+	Format        string         `json:"format,omitempty" proto:"6"`
+	Markdown      string         `json:"markdown,omitempty" proto:"7"`
+	HTML          string         `json:"html,omitempty" proto:"8"`
+	Source        string         `json:"source,omitempty" proto:"9"`
+	Topic         string         `json:"topic,omitempty" proto:"10"`
+	Priority      int            `json:"priority,omitempty" proto:"11"`
+	Assignee      string         `json:"assignee,omitempty" proto:"12"`
+	ClickURL      string         `json:"click_url,omitempty" proto:"13"`
+	Extras        *Extras        `json:"extras,omitempty" proto:"14"`
+	CreatedAt     string         `json:"created_at,omitempty" proto:"15"`
+	SeenAt        *string        `json:"seen_at,omitempty" proto:"16"`
+	SnoozedUntil  *string        `json:"snoozed_until,omitempty" proto:"17"`
+	IDs           []int64        `json:"ids,omitempty" proto:"18"`
+	Device        string         `json:"device,omitempty" proto:"19"`
+	Stats         *LiveStats     `json:"stats,omitempty" proto:"20"`
+	Config        *ClientConfig  `json:"config,omitempty" proto:"21"`
+	Reauth        *Reauth        `json:"reauth,omitempty" proto:"22"`
+	UnifiedPush   *UPMessage     `json:"unifiedpush,omitempty" proto:"23"`
+	Hello         *Hello         `json:"hello,omitempty" proto:"24"`
+	RequireAck    bool           `json:"require_ack,omitempty" proto:"25"`
+	AckedAt       *string        `json:"acked_at,omitempty" proto:"26"`
+}
+
+// ClientMessage is what clients may send over the socket.
+type ClientMessage struct {
+	Type   string `json:"type" proto:"1"`             // TypeSubscribe, TypeUnsubscribe, TypeAck, TypeUPAck or TypeHello
+	Stream string `json:"stream,omitempty" proto:"2"` // StreamStats
+	ID     int64  `json:"id,omitempty" proto:"3"`     // TypeAck: highest notification id the device has stored; TypeUPAck: highest UnifiedPush message id handed to its app
+
+	// TypeHello: the newest protocol the client speaks, the features it
+	// wants, and with FeatureTopics the topics it wants (none: all).
+	Protocol int      `json:"protocol,omitempty" proto:"4"`
+	Features []string `json:"features,omitempty" proto:"5"`
+	Topics   []string `json:"topics,omitempty" proto:"6"`
+}
+
+// UPMessage is the payload of a "unifiedpush" frame: a push message for an
+// app the device registered as a UnifiedPush distributor (the frame's ID is
+// what to ack), or, with Unregistered, word that the registration is gone.
+type UPMessage struct {
+	Token        string `json:"token" proto:"1"`                  // the registration
+	App          string `json:"app" proto:"2"`                    // the registered app's package name
+	Instance     string `json:"instance,omitempty" proto:"3"`     // the app's own token for the registration
+	Message      string `json:"message,omitempty" proto:"4"`      // the pushed bytes, base64 (standard, padded)
+	Unregistered bool   `json:"unregistered,omitempty" proto:"5"` // the registration was deleted; tell the app
+}
+
+// Hello is the payload of the server's "hello" frame, its answer to the
+// client's. Features are those the client asked for that this connection
+// has; anything else the client must do without.
+type Hello struct {
+	Protocol int      `json:"protocol" proto:"1"`         // the lower of the client's and ProtocolVersion
+	Server   string   `json:"server" proto:"2"`           // the server's version
+	API      string   `json:"api" proto:"3"`              // the server's api Version
+	Features []string `json:"features" proto:"4"`         // granted features
+	Topics   []string `json:"topics,omitempty" proto:"5"` // with FeatureTopics: the topics live frames are limited to
+}
+
+// LiveStats is the payload of a "stats" frame.
+type LiveStats struct {
+	Connected   int   `json:"connected" proto:"1"`
+	SendsPerMin int   `json:"sends_per_min" proto:"2"`
+	Unseen      int   `json:"unseen" proto:"3"`
+	Dropped     int64 `json:"dropped_total" proto:"4"`
+	At          int64 `json:"at" proto:"5"`
+}
+
+// ClientConfig holds fleet-wide hints pushed in "config" frames and served
+// by /client-config.
+type ClientConfig struct {
+	Topics        []string       `json:"topics" proto:"1"`
+	QuietHours    *QuietHours    `json:"quiet_hours,omitempty" proto:"2"`
+	MinAppVersion string         `json:"min_app_version,omitempty" proto:"3"`
+	Extra         map[string]any `json:"extra,omitempty" proto:"4"`
+}
+
+type QuietHours struct {
+	Start       string `json:"start" proto:"1"` // "22:00"
+	End         string `json:"end" proto:"2"`   // "07:00"
+	MinPriority int    `json:"min_priority,omitempty" proto:"3"`
+}
+
+// Reauth is the payload of a "reauth" frame, sent when the primary token is
+// rotated. Token is only included for clients that authenticated with the
+// primary token; everyone else must obtain new credentials out of band.
+type Reauth struct {
+	Reason             string `json:"reason" proto:"1"`
+	Token              string `json:"token,omitempty" proto:"2"`
+	PreviousValidUntil string `json:"previous_valid_until" proto:"3"` // RFC 3339
+}
+
+// ── Errors ────────────────────────────────────────────────────────────────────
+
+// Error is the JSON body of an error response. Older endpoints still answer
+// errors with plain text; endpoints added from api v1 on use this.
+type Error struct {
+	Error string `json:"error" proto:"1"`
+}
@@ -0,0 +1,3 @@
+module ilios.dev/andrnoti/api
+
+go 1.22
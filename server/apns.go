@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ── Apple Push Notification service ───────────────────────────────────────────
+//
+// An iOS client can't keep a WebSocket open in the background, so with
+// --apns-key-file the server also delivers through APNs. The client registers
+// the device token iOS gives it with POST /apns/devices, with the same
+// optional user, topics and min_priority filters as Web Push subscriptions,
+// and gets every matching notification as an alert while the app isn't
+// running.
+//
+// Authentication is token-based: the .p8 key from the Apple developer
+// account, with its --apns-key-id and --apns-team-id, signs a provider token
+// that is reused for 40 minutes (APNs refuses tokens older than an hour).
+// --apns-topic is the app's bundle ID. Devices running a development build
+// register with "sandbox": true, or all of them do with --apns-sandbox.
+//
+// Tokens APNs reports as unregistered or invalid are deleted. Other failures
+// are counted on the device and retried by the delivery queue.
+
+const (
+	apnsProduction   = "https://api.push.apple.com"
+	apnsSandbox      = "https://api.sandbox.push.apple.com"
+	apnsTimeout      = 10 * time.Second
+	apnsExpiry       = 24 * time.Hour
+	apnsTokenMaxAge  = 40 * time.Minute
+	apnsMaxPayload   = 4096
+	apnsPayloadField = "andrnoti"
+)
+
+var (
+	apnsKey  *ecdsa.PrivateKey
+	apnsHTTP = &http.Client{Timeout: apnsTimeout}
+
+	// apnsProvider caches the signed provider token.
+	apnsProvider struct {
+		sync.Mutex
+		token  string
+		issued time.Time
+	}
+)
+
+func initAPNsTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS apns_devices (
+			token        TEXT PRIMARY KEY,
+			device       TEXT NOT NULL DEFAULT '',
+			label        TEXT NOT NULL DEFAULT '',
+			user         TEXT NOT NULL DEFAULT '',
+			topics       TEXT NOT NULL DEFAULT '',
+			min_priority INTEGER NOT NULL DEFAULT 1,
+			sandbox      INTEGER NOT NULL DEFAULT 0,
+			created_by   TEXT NOT NULL DEFAULT '',
+			created_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			last_sent_at DATETIME,
+			sent         INTEGER NOT NULL DEFAULT 0,
+			failures     INTEGER NOT NULL DEFAULT 0,
+			last_error   TEXT NOT NULL DEFAULT ''
+		)
+	`)
+	return err
+}
+
+// loadAPNsKey reads the .p8 signing key. APNs stays off without one.
+func loadAPNsKey(file string) error {
+	if file == "" {
+		return nil
+	}
+	if *flagAPNsKeyID == "" || *flagAPNsTeamID == "" || *flagAPNsTopic == "" {
+		return errors.New("--apns-key-id, --apns-team-id and --apns-topic are required with --apns-key-file")
+	}
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return errors.New("no PEM block in APNs key file")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	k, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return errors.New("APNs key is not an EC private key")
+	}
+	apnsKey = k
+	return nil
+}
+
+func apnsEnabled() bool { return apnsKey != nil }
+
+// apnsProviderToken returns the cached provider token, signing a new one
+// when it is older than apnsTokenMaxAge or fresh is set.
+func apnsProviderToken(fresh bool) (string, error) {
+	apnsProvider.Lock()
+	defer apnsProvider.Unlock()
+	if !fresh && apnsProvider.token != "" && time.Since(apnsProvider.issued) < apnsTokenMaxAge {
+		return apnsProvider.token, nil
+	}
+	now := time.Now()
+	token, err := signES256(apnsKey, map[string]string{"kid": *flagAPNsKeyID},
+		map[string]any{"iss": *flagAPNsTeamID, "iat": now.Unix()})
+	if err != nil {
+		return "", err
+	}
+	apnsProvider.token, apnsProvider.issued = token, now
+	return token, nil
+}
+
+type apnsDevice struct {
+	Token  string `json:"token"`
+	Device string `json:"device,omitempty"`
+	Label  string `json:"label,omitempty"`
+	pushFilter
+	Sandbox    bool    `json:"sandbox"`
+	CreatedBy  string  `json:"created_by"`
+	CreatedAt  string  `json:"created_at"`
+	LastSentAt *string `json:"last_sent_at"`
+	Sent       int64   `json:"sent"`
+	Failures   int64   `json:"failures"`
+	LastError  string  `json:"last_error,omitempty"`
+}
+
+const apnsDeviceCols = `token, device, label, user, topics, min_priority, sandbox, created_by, created_at, last_sent_at, sent, failures, last_error`
+
+func scanAPNsDevice(s scanner) (apnsDevice, error) {
+	var d apnsDevice
+	var topics string
+	err := s.Scan(&d.Token, &d.Device, &d.Label, &d.User, &topics, &d.MinPriority, &d.Sandbox,
+		&d.CreatedBy, &d.CreatedAt, &d.LastSentAt, &d.Sent, &d.Failures, &d.LastError)
+	d.Topics = splitList(topics)
+	return d, err
+}
+
+func listAPNsDevices() ([]apnsDevice, error) {
+	rows, err := db.Query(`SELECT ` + apnsDeviceCols + ` FROM apns_devices ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []apnsDevice{}
+	for rows.Next() {
+		d, err := scanAPNsDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// ── Handlers ──
+
+// handleAPNsDevices lists (GET) or registers (POST) device tokens.
+// Registering a token again replaces its settings.
+func handleAPNsDevices() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			devices, err := listAPNsDevices()
+			if err != nil {
+				log.Printf("apns: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"devices": devices})
+		case http.MethodPost:
+			if !apnsEnabled() {
+				http.Error(w, "APNs is not configured (--apns-key-file)", http.StatusServiceUnavailable)
+				return
+			}
+			var body struct {
+				Token   string `json:"token"`
+				Device  string `json:"device"`
+				Label   string `json:"label"`
+				Sandbox *bool  `json:"sandbox"`
+				pushFilter
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			body.Token = strings.ToLower(body.Token)
+			if raw, err := hex.DecodeString(body.Token); err != nil || len(raw) == 0 || len(raw) > 100 {
+				http.Error(w, "token must be the device token in hex", http.StatusBadRequest)
+				return
+			}
+			if err := body.check(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if body.Device != "" && deviceRevoked(body.Device) {
+				http.Error(w, "device revoked", http.StatusForbidden)
+				return
+			}
+			sandbox := *flagAPNsSandbox
+			if body.Sandbox != nil {
+				sandbox = *body.Sandbox
+			}
+			by := authFrom(r).ID
+			_, err := db.Exec(`
+				INSERT INTO apns_devices (token, device, label, user, topics, min_priority, sandbox, created_by)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT(token) DO UPDATE SET device = excluded.device, label = excluded.label,
+					user = excluded.user, topics = excluded.topics, min_priority = excluded.min_priority,
+					sandbox = excluded.sandbox, created_by = excluded.created_by, failures = 0, last_error = ''`,
+				body.Token, body.Device, body.Label, body.User, strings.Join(body.Topics, ","),
+				body.MinPriority, sandbox, by)
+			var d apnsDevice
+			if err == nil {
+				d, err = scanAPNsDevice(db.QueryRow(`SELECT `+apnsDeviceCols+` FROM apns_devices WHERE token = ?`, body.Token))
+			}
+			if err != nil {
+				log.Printf("apns: register: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			audit(by, "apns.register", apnsShort(body.Token), body.Device)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(d)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleAPNsDevice unregisters a device token.
+func handleAPNsDevice() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := strings.ToLower(r.PathValue("token"))
+		res, err := db.Exec(`DELETE FROM apns_devices WHERE token = ?`, token)
+		if err != nil {
+			log.Printf("apns: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		audit(authFrom(r).ID, "apns.unregister", apnsShort(token), "")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// apnsShort is enough of a device token to tell devices apart in logs.
+func apnsShort(token string) string {
+	if len(token) > 8 {
+		return token[:8] + "…"
+	}
+	return token
+}
+
+// ── Delivery ──
+
+// apnsTargets lists the device tokens that want n.
+func apnsTargets(h *hub, n Notification) ([]string, error) {
+	devices, err := listAPNsDevices()
+	if err != nil {
+		return nil, err
+	}
+	var tokens []string
+	for _, d := range pushTargets(n, devices, func(d apnsDevice) pushFilter { return d.pushFilter }) {
+		tokens = append(tokens, d.Token)
+	}
+	return tokens, nil
+}
+
+func deliverAPNs(token string, n Notification) error {
+	d, err := scanAPNsDevice(db.QueryRow(`SELECT `+apnsDeviceCols+` FROM apns_devices WHERE token = ?`, token))
+	if err == sql.ErrNoRows {
+		return errTargetGone // unregistered since
+	}
+	if err != nil {
+		return err
+	}
+	err = sendAPNs(d, apnsPayload(n), n)
+	var gone apnsGone
+	switch {
+	case errors.As(err, &gone):
+		log.Printf("apns: device %s (%s): %v, removing", apnsShort(d.Token), d.Device, gone)
+		db.Exec(`DELETE FROM apns_devices WHERE token = ?`, d.Token)
+	case err != nil:
+		db.Exec(`UPDATE apns_devices SET failures = failures + 1, last_error = ? WHERE token = ?`, err.Error(), d.Token)
+	default:
+		db.Exec(`UPDATE apns_devices SET sent = sent + 1, last_sent_at = CURRENT_TIMESTAMP WHERE token = ?`, d.Token)
+	}
+	return err
+}
+
+// apnsPayload is the alert iOS shows, with the notification's fields under
+// apnsPayloadField for the app. Priority 4 and up plays the default sound,
+// 5 breaks through Focus as time-sensitive, and 1–2 arrive silently.
+func apnsPayload(n Notification) []byte {
+	aps := map[string]any{"thread-id": n.Topic}
+	switch {
+	case n.Priority >= priorityUrgent:
+		aps["sound"] = "default"
+		aps["interruption-level"] = "time-sensitive"
+	case n.Priority >= 4:
+		aps["sound"] = "default"
+	case n.Priority <= 2:
+		aps["interruption-level"] = "passive"
+	}
+	fields := map[string]any{
+		"id":       n.ID,
+		"source":   n.Source,
+		"topic":    n.Topic,
+		"priority": n.Priority,
+	}
+	if n.ClickURL != "" {
+		fields["click_url"] = n.ClickURL
+	}
+	return fitPayload(n.Text, apnsMaxPayload, func(text string) []byte {
+		aps["alert"] = map[string]string{"title": n.Title, "body": text}
+		data, _ := json.Marshal(map[string]any{"aps": aps, apnsPayloadField: fields})
+		return data
+	})
+}
+
+// apnsGone is APNs saying the device token will never work again.
+type apnsGone struct{ reason string }
+
+func (e apnsGone) Error() string { return "device token gone: " + e.reason }
+func (e apnsGone) Unwrap() error { return errTargetGone }
+
+func sendAPNs(d apnsDevice, payload []byte, n Notification) error {
+	for attempt := 0; ; attempt++ {
+		token, err := apnsProviderToken(attempt > 0)
+		if err != nil {
+			return err
+		}
+		host := apnsProduction
+		if d.Sandbox {
+			host = apnsSandbox
+		}
+		req, err := http.NewRequest(http.MethodPost, host+"/3/device/"+d.Token, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		prio := "10"
+		if n.Priority <= 2 {
+			prio = "5"
+		}
+		req.Header.Set("Authorization", "bearer "+token)
+		req.Header.Set("apns-topic", *flagAPNsTopic)
+		req.Header.Set("apns-push-type", "alert")
+		req.Header.Set("apns-priority", prio)
+		req.Header.Set("apns-expiration", strconv.FormatInt(time.Now().Add(apnsExpiry).Unix(), 10))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := apnsHTTP.Do(req)
+		if err != nil {
+			return err
+		}
+		var reply struct {
+			Reason string `json:"reason"`
+		}
+		json.NewDecoder(resp.Body).Decode(&reply)
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return nil
+		case resp.StatusCode == http.StatusGone || reply.Reason == "BadDeviceToken" || reply.Reason == "DeviceTokenNotForTopic":
+			return apnsGone{reply.Reason}
+		case reply.Reason == "ExpiredProviderToken" && attempt == 0:
+			continue // sign a fresh token and try once more
+		}
+		return httpDeliveryError(resp, reply.Reason)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// ── Encryption at Rest ────────────────────────────────────────────────────────
+//
+// With --encryption-key-file, notification titles, texts (and their Markdown
+// renderings), click URLs and extras (and the title copied into incidents)
+// are stored as AES-256-GCM ciphertext: "enc:v1:" + base64(nonce ‖ sealed).
+// The column name is the associated data, so a value can't be moved to
+// another column unnoticed. Values without the prefix are plaintext, which
+// lets a database be switched over in place: existing rows are encrypted at
+// startup, and secure_delete keeps deleted rows from lingering in free pages.
+
+const sealedPrefix = "enc:v1:"
+
+var atRest cipher.AEAD // nil: store plaintext
+
+// loadAtRestKey reads a 32-byte key given raw, as 64 hex digits or as base64.
+func loadAtRestKey(path string) error {
+	if path == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	key := raw
+	if len(key) != 32 {
+		s := strings.TrimSpace(string(raw))
+		if k, err := hex.DecodeString(s); err == nil {
+			key = k
+		} else if k, err := base64.StdEncoding.DecodeString(s); err == nil {
+			key = k
+		}
+	}
+	if len(key) != 32 {
+		return errors.New("key must be 32 bytes (raw, hex or base64)")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	atRest, err = cipher.NewGCM(block)
+	return err
+}
+
+// sealColumn encrypts a value for storage in column, if a key is configured.
+func sealColumn(column, plain string) string {
+	if atRest == nil || plain == "" {
+		return plain
+	}
+	nonce := make([]byte, atRest.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	sealed := atRest.Seal(nonce, nonce, []byte(plain), []byte(column))
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed)
+}
+
+// openColumn reverses sealColumn; plaintext values pass through unchanged.
+func openColumn(column, stored string) (string, error) {
+	if !strings.HasPrefix(stored, sealedPrefix) {
+		return stored, nil
+	}
+	if atRest == nil {
+		return "", errors.New("value is encrypted and no --encryption-key-file is set")
+	}
+	raw, err := base64.StdEncoding.DecodeString(stored[len(sealedPrefix):])
+	if err != nil || len(raw) < atRest.NonceSize() {
+		return "", fmt.Errorf("%s: malformed ciphertext", column)
+	}
+	n := atRest.NonceSize()
+	plain, err := atRest.Open(nil, raw[:n], raw[n:], []byte(column))
+	if err != nil {
+		return "", fmt.Errorf("%s: cannot decrypt (wrong key?)", column)
+	}
+	return string(plain), nil
+}
+
+// checkAtRest refuses to start with encrypted rows but no key or the wrong
+// key, then encrypts any rows still stored as plaintext.
+func checkAtRest() error {
+	var sample string
+	err := db.QueryRow(`SELECT text FROM notifications WHERE text LIKE ? LIMIT 1`, sealedPrefix+"%").Scan(&sample)
+	if err == nil {
+		if _, err := openColumn("text", sample); err != nil {
+			return err
+		}
+	}
+	if atRest == nil {
+		return nil
+	}
+
+	n, err := sealExisting(`notifications`, `id`, `title`, `text`, `click_url`, `extras`)
+	if err != nil {
+		return err
+	}
+	// NULL for plain texts, so those rows are left out.
+	if _, err := sealExisting(`notifications`, `id`, `rendered_text`, `rendered_html`); err != nil {
+		return err
+	}
+	m, err := sealExisting(`incidents`, `id`, `title`)
+	if err != nil {
+		return err
+	}
+	if _, err := sealExisting(`raw_payloads`, `notification_id`, `body`); err != nil {
+		return err
+	}
+	if _, err := sealExisting(`digest_events`, `id`, `body`); err != nil {
+		return err
+	}
+	if _, err := sealExisting(`digest_pending`, `id`, `body`); err != nil {
+		return err
+	}
+	if n+m == 0 {
+		return nil
+	}
+	log.Printf("encryption: encrypted %d existing notifications and %d incidents", n, m)
+	// The old plaintext is still in free pages and the WAL until these go.
+	if _, err := db.Exec(`VACUUM`); err != nil {
+		return err
+	}
+	_, err = db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`)
+	return err
+}
+
+// sealExisting encrypts the given columns of every row where any of them is
+// non-empty plaintext.
+func sealExisting(table, key string, columns ...string) (int, error) {
+	var where []string
+	for _, c := range columns {
+		where = append(where, fmt.Sprintf("(%s != '' AND %s NOT LIKE '%s%%')", c, c, sealedPrefix))
+	}
+	rows, err := db.Query(`SELECT ` + key + `, ` + strings.Join(columns, ", ") +
+		` FROM ` + table + ` WHERE ` + strings.Join(where, " OR "))
+	if err != nil {
+		return 0, err
+	}
+	type row struct {
+		id   int64
+		vals []string
+	}
+	var todo []row
+	for rows.Next() {
+		r := row{vals: make([]string, len(columns))}
+		dest := []any{&r.id}
+		for i := range r.vals {
+			dest = append(dest, &r.vals[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		todo = append(todo, r)
+	}
+	rows.Close()
+	if len(todo) == 0 {
+		return 0, nil
+	}
+
+	var set []string
+	for _, c := range columns {
+		set = append(set, c+" = ?")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`UPDATE ` + table + ` SET ` + strings.Join(set, ", ") + ` WHERE ` + key + ` = ?`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	for _, r := range todo {
+		args := make([]any, 0, len(columns)+1)
+		for i, c := range columns {
+			v := r.vals[i]
+			if !strings.HasPrefix(v, sealedPrefix) {
+				v = sealColumn(c, v)
+			}
+			args = append(args, v)
+		}
+		if _, err := stmt.Exec(append(args, r.id)...); err != nil {
+			return 0, err
+		}
+	}
+	return len(todo), tx.Commit()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// ── Audit Log ─────────────────────────────────────────────────────────────────
+//
+// Destructive admin actions are recorded in the database with who did them,
+// what was affected and, when something was exported first, where to. GET
+// /admin/audit lists the entries newest first (?limit=, default 100, max
+// 1000; ?before=<id> for the next page).
+
+const (
+	auditDefaultLimit = 100
+	auditMaxLimit     = 1000
+)
+
+type auditEntry struct {
+	ID      int64  `json:"id"`
+	At      string `json:"at"`
+	Actor   string `json:"actor"`
+	Action  string `json:"action"`
+	Detail  string `json:"detail"`
+	Archive string `json:"archive,omitempty"`
+}
+
+func initAuditTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id      INTEGER PRIMARY KEY AUTOINCREMENT,
+			at      DATETIME DEFAULT CURRENT_TIMESTAMP,
+			actor   TEXT NOT NULL DEFAULT '',
+			action  TEXT NOT NULL,
+			detail  TEXT NOT NULL DEFAULT '',
+			archive TEXT NOT NULL DEFAULT ''
+		)
+	`)
+	return err
+}
+
+// audit records an action. Failures are logged, not returned: the action
+// has already happened.
+func audit(actor, action, detail, archive string) {
+	if _, err := db.Exec(
+		`INSERT INTO audit_log (actor, action, detail, archive) VALUES (?, ?, ?, ?)`,
+		actor, action, detail, archive,
+	); err != nil {
+		log.Printf("audit: %s %s: %v", actor, action, err)
+	}
+}
+
+func handleAudit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limit := auditDefaultLimit
+		if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+			limit = min(n, auditMaxLimit)
+		}
+		before := int64(1<<63 - 1)
+		if n, err := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64); err == nil && n > 0 {
+			before = n
+		}
+		rows, err := db.Query(`
+			SELECT id, at, actor, action, detail, archive FROM audit_log
+			WHERE id < ? ORDER BY id DESC LIMIT ?`, before, limit)
+		if err != nil {
+			log.Printf("audit: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		out := []auditEntry{}
+		for rows.Next() {
+			var e auditEntry
+			if err := rows.Scan(&e.ID, &e.At, &e.Actor, &e.Action, &e.Detail, &e.Archive); err != nil {
+				log.Printf("audit: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, e)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
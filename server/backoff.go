@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+)
+
+// ── Reconnect Backoff ─────────────────────────────────────────────────────────
+//
+// When the server turns clients away — a 503, or a close frame during a
+// restart — it tells them how long to wait, so a fleet that was cut off at
+// once doesn't come back at once. The hint grows with load, from
+// retryAfterMin seconds on an idle server to retryAfterMax when it is full or
+// shedding, and each answer is a random point between that and twice that.
+// A restart scales it by how many clients are about to reconnect. 503s (and
+// the WebSocket per-address 429) carry it in Retry-After; close frames end
+// their reason with "; retry_after=<seconds>". Clients wait at least that
+// long and keep doubling from there on further failures.
+
+const (
+	retryAfterMin = 1  // seconds
+	retryAfterMax = 30 // seconds
+)
+
+// retryAfter returns a jittered wait in seconds for a load between 0 and 1.
+func retryAfter(load float64) int {
+	load = min(max(load, 0), 1)
+	base := retryAfterMin + load*(retryAfterMax-retryAfterMin)
+	return int(base + rand.Float64()*base)
+}
+
+// setRetryAfter sets the Retry-After header of a 503 from load.
+func setRetryAfter(w http.ResponseWriter, load float64) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter(load)))
+}
+
+// closeReason appends the reconnect hint to a close frame reason.
+func closeReason(reason string, load float64) string {
+	return reason + "; retry_after=" + strconv.Itoa(retryAfter(load))
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ── Export & Backups ──────────────────────────────────────────────────────────
+//
+// Copying the live database file can catch it mid-write. GET /export streams
+// either a JSONL dump of all notifications (one api.Notification per line,
+// read in a single transaction) or, with ?format=sqlite, a complete snapshot
+// made with VACUUM INTO. The same snapshot is written to --backup-dir every
+// --backup-interval, keeping the newest --backup-keep files.
+
+const backupPrefix = "andrnoti-"
+
+// snapshotDB writes a consistent copy of the database to path.
+func snapshotDB(path string) error {
+	_, err := db.Exec(`VACUUM INTO ?`, path)
+	return err
+}
+
+// exportJSONL writes every notification not on a hidden topic, oldest
+// first, from one read transaction so the dump is consistent.
+func exportJSONL(ctx context.Context, w io.Writer, hidden []string) (int, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	where, args := topicFilter(hidden)
+	rows, err := tx.QueryContext(ctx, `SELECT `+notificationCols+` FROM notifications WHERE 1`+where+` ORDER BY id`, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	enc := json.NewEncoder(w)
+	n := 0
+	for rows.Next() {
+		note, err := scanNotification(rows)
+		if err != nil {
+			return n, err
+		}
+		if err := enc.Encode(note); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+func handleExport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		stamp := time.Now().UTC().Format("20060102-150405")
+		hidden := hiddenTopics(authFrom(r))
+		switch r.URL.Query().Get("format") {
+		case "", "jsonl":
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+backupPrefix+stamp+`.jsonl"`)
+			n, err := exportJSONL(r.Context(), w, hidden)
+			if err != nil {
+				// Headers are gone; a truncated body is all we can signal.
+				log.Printf("export: after %d notifications: %v", n, err)
+				return
+			}
+			log.Printf("export: %d notifications as jsonl", n)
+		case "sqlite":
+			if len(hidden) > 0 {
+				http.Error(w, "the snapshot includes topics this credential can't read; use format=jsonl", http.StatusForbidden)
+				return
+			}
+			dir, err := os.MkdirTemp("", "andrnoti-export-")
+			if err != nil {
+				log.Printf("export: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "snapshot.db")
+			var f *os.File
+			if err = snapshotDB(path); err == nil {
+				f, err = os.Open(path)
+			}
+			if err != nil {
+				log.Printf("export: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			defer f.Close()
+			if fi, err := f.Stat(); err == nil {
+				w.Header().Set("Content-Length", fmt.Sprint(fi.Size()))
+			}
+			w.Header().Set("Content-Type", "application/vnd.sqlite3")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+backupPrefix+stamp+`.db"`)
+			io.Copy(w, f)
+			log.Printf("export: sqlite snapshot")
+		default:
+			http.Error(w, "format must be jsonl or sqlite", http.StatusBadRequest)
+		}
+	}
+}
+
+// backupJob snapshots the database into dir every interval and keeps the
+// newest keep files. Before its first scheduled run it counts from the newest
+// existing backup.
+func backupJob(dir string, interval time.Duration, keep int) *schedJob {
+	return &schedJob{
+		name:     "backup",
+		interval: interval,
+		lastRun: func() time.Time {
+			backups, err := listBackups(dir)
+			if err != nil || len(backups) == 0 {
+				return time.Time{}
+			}
+			fi, err := os.Stat(filepath.Join(dir, backups[len(backups)-1]))
+			if err != nil {
+				return time.Time{}
+			}
+			return fi.ModTime()
+		},
+		run: func() error { return runBackup(dir, keep) },
+	}
+}
+
+// listBackups returns the backup file names in dir, oldest first.
+func listBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), backupPrefix) && strings.HasSuffix(e.Name(), ".db") {
+			backups = append(backups, e.Name())
+		}
+	}
+	sort.Strings(backups) // timestamped names sort oldest first
+	return backups, nil
+}
+
+func runBackup(dir string, keep int) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	name := backupPrefix + time.Now().UTC().Format("20060102-150405") + ".db"
+	tmp := filepath.Join(dir, "."+name)
+	os.Remove(tmp)
+	start := time.Now()
+	if err := snapshotDB(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	log.Printf("backup: wrote %s in %s", name, time.Since(start).Round(time.Millisecond))
+
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		log.Printf("backup: removed %s", backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// ── Import ────────────────────────────────────────────────────────────────────
+//
+// POST /import reads the JSONL that /export writes and adds it to the live
+// database, so history can be restored or moved from another instance
+// without stopping the server. ?on_conflict picks what happens when an id is
+// already taken: skip (default) keeps the existing row, overwrite replaces
+// its contents in place, and reassign gives every imported row a new id.
+// Rows are committed in batches so producers aren't blocked for the whole
+// import; a bad line is reported and skipped.
+
+const (
+	importBatch     = 500
+	importMaxLine   = 16 << 20
+	importMaxErrors = 20
+)
+
+type importResult struct {
+	Imported    int      `json:"imported"`
+	Overwritten int      `json:"overwritten"`
+	Skipped     int      `json:"skipped"`
+	Failed      int      `json:"failed"`
+	Errors      []string `json:"errors,omitempty"` // first few, by line
+}
+
+func handleImport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if shedActive.Load() {
+			setRetryAfter(w, 1)
+			http.Error(w, "server is shedding load", http.StatusServiceUnavailable)
+			return
+		}
+		strategy := r.URL.Query().Get("on_conflict")
+		switch strategy {
+		case "":
+			strategy = "skip"
+		case "skip", "overwrite", "reassign":
+		default:
+			http.Error(w, "on_conflict must be skip, overwrite or reassign", http.StatusBadRequest)
+			return
+		}
+		res, err := importJSONL(r.Context(), r.Body, strategy)
+		if err != nil {
+			log.Printf("import: after %d rows: %v", res.Imported+res.Overwritten, err)
+			http.Error(w, "import failed after "+fmt.Sprint(res.Imported+res.Overwritten)+" rows: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if res.Imported+res.Overwritten > 0 {
+			if err := loadKnownTopics(); err != nil {
+				log.Printf("import: %v", err)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+		log.Printf("import: on_conflict=%s imported=%d overwritten=%d skipped=%d failed=%d by=%s",
+			strategy, res.Imported, res.Overwritten, res.Skipped, res.Failed, authFrom(r).ID)
+	}
+}
+
+// importJSONL reads one api.Notification per line. Rows committed before an
+// error stay imported; the counts say how far it got.
+func importJSONL(ctx context.Context, in io.Reader, strategy string) (importResult, error) {
+	var res importResult
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 64<<10), importMaxLine)
+
+	var tx *sql.Tx
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	pending := 0
+	for line := 1; sc.Scan(); line++ {
+		raw := bytes.TrimSpace(sc.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		n, err := decodeImported(raw)
+		if err != nil {
+			res.Failed++
+			if len(res.Errors) < importMaxErrors {
+				res.Errors = append(res.Errors, fmt.Sprintf("line %d: %v", line, err))
+			}
+			continue
+		}
+		if tx == nil {
+			if tx, err = db.BeginTx(ctx, nil); err != nil {
+				return res, err
+			}
+		}
+		outcome, err := importNotification(ctx, tx, n, strategy)
+		if err != nil {
+			return res, fmt.Errorf("line %d: %w", line, err)
+		}
+		switch outcome {
+		case "imported":
+			res.Imported++
+		case "overwritten":
+			res.Overwritten++
+		default:
+			res.Skipped++
+		}
+		if pending++; pending == importBatch {
+			if err := tx.Commit(); err != nil {
+				return res, err
+			}
+			tx, pending = nil, 0
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return res, err
+	}
+	if tx != nil {
+		err := tx.Commit()
+		tx = nil
+		return res, err
+	}
+	return res, nil
+}
+
+// decodeImported turns an exported line back into a row. Markdown
+// notifications are exported with their source in markdown and a plain
+// rendering in text; the source is what gets stored.
+func decodeImported(raw []byte) (Notification, error) {
+	var n Notification
+	if err := json.Unmarshal(raw, &n); err != nil {
+		return n, err
+	}
+	switch n.Format {
+	case "", formatPlain:
+		n.Format = ""
+	case formatMarkdown:
+		if n.Markdown != "" {
+			n.Text = n.Markdown
+		}
+	default:
+		return n, fmt.Errorf("unknown format %q", n.Format)
+	}
+	if strings.TrimSpace(n.Text) == "" {
+		return n, errors.New("text is required")
+	}
+	if e := checkSizes(n.Title, n.Text); e != nil {
+		return n, errors.New(e.Error)
+	}
+	if n.Priority == 0 {
+		n.Priority = priorityDefault
+	}
+	if n.Priority < 0 || n.Priority > priorityUrgent {
+		return n, errors.New("priority must be 1-5")
+	}
+	if err := checkExtras(n.Extras); err != nil {
+		return n, err
+	}
+	n.Extras = trimExtras(n.Extras)
+	if err := checkClickURL(n.ClickURL); err != nil {
+		return n, err
+	}
+	created := time.Now()
+	if n.CreatedAt != "" {
+		t, err := time.Parse(time.RFC3339, n.CreatedAt)
+		if err != nil {
+			return n, fmt.Errorf("created_at: %v", err)
+		}
+		created = t
+	}
+	n.CreatedAt = sqliteTime(created)
+	if n.SeenAt != nil {
+		t, err := time.Parse(time.RFC3339, *n.SeenAt)
+		if err != nil {
+			return n, fmt.Errorf("seen_at: %v", err)
+		}
+		s := sqliteTime(t)
+		n.SeenAt = &s
+	}
+	return n, nil
+}
+
+func importNotification(ctx context.Context, tx *sql.Tx, n Notification, strategy string) (string, error) {
+	var extras []byte
+	if n.Extras != nil {
+		extras, _ = json.Marshal(n.Extras)
+	}
+	plain, htmlOut := renderedColumns(n)
+	args := []any{
+		sealColumn("title", n.Title), sealColumn("text", n.Text), n.Format, n.Source, n.Topic,
+		n.Priority, n.Assignee, sealColumn("click_url", n.ClickURL), sealColumn("extras", string(extras)), n.CreatedAt, n.SeenAt,
+		plain, htmlOut,
+	}
+	const cols = `title, text, format, source, topic, priority, assignee, click_url, extras, created_at, seen_at, rendered_text, rendered_html`
+	if n.ID <= 0 || strategy == "reassign" {
+		_, err := tx.ExecContext(ctx, `INSERT INTO notifications (`+cols+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, args...)
+		return "imported", err
+	}
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM notifications WHERE id = ?)`, n.ID).Scan(&exists); err != nil {
+		return "", err
+	}
+	switch {
+	case !exists:
+		_, err := tx.ExecContext(ctx, `INSERT INTO notifications (id, `+cols+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			append([]any{n.ID}, args...)...)
+		return "imported", err
+	case strategy == "overwrite":
+		// Update in place: REPLACE would delete the row and cascade to its
+		// archived payload.
+		_, err := tx.ExecContext(ctx, `UPDATE notifications SET title = ?, text = ?, format = ?, source = ?, topic = ?,
+			priority = ?, assignee = ?, click_url = ?, extras = ?, created_at = ?, seen_at = ?, rendered_text = ?, rendered_html = ?
+			WHERE id = ?`, append(args, n.ID)...)
+		return "overwritten", err
+	default:
+		return "skipped", nil
+	}
+}
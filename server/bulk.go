@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ── Bulk Operations ───────────────────────────────────────────────────────────
+//
+// POST /admin/bulk/{op} applies one operation to everything matching a filter
+// as a background job, so cleaning up after an incident is one call rather
+// than hundreds. Every filter needs at least one condition; conditions are
+// ANDed.
+//
+//	delete-notifications  {"ids":[…],"topic":"…","source":"…","before":"RFC 3339","seen":true}
+//	ack-incidents         {"ids":[…],"topic":"…","before":"RFC 3339"}   (open incidents only)
+//	disconnect-clients    {"ids":[…],"users":[…],"auth":[…],"ips":[…]}  (WebSocket clients)
+
+const bulkChunk = 500
+
+type bulkFilter struct {
+	IDs    []int64  `json:"ids,omitempty"`
+	Topic  *string  `json:"topic,omitempty"`
+	Source *string  `json:"source,omitempty"`
+	Before string   `json:"before,omitempty"`
+	Seen   *bool    `json:"seen,omitempty"`
+	Users  []string `json:"users,omitempty"`
+	Auth   []string `json:"auth,omitempty"`
+	IPs    []string `json:"ips,omitempty"`
+}
+
+// where builds an SQL condition from the filter's id, topic, source, time
+// and seen fields, naming the time column timeCol.
+func (f bulkFilter) where(timeCol string) (string, []any, error) {
+	var conds []string
+	var args []any
+	if len(f.IDs) > 0 {
+		conds = append(conds, `id IN (`+placeholders(len(f.IDs))+`)`)
+		for _, id := range f.IDs {
+			args = append(args, id)
+		}
+	}
+	if f.Topic != nil {
+		conds = append(conds, `topic = ?`)
+		args = append(args, *f.Topic)
+	}
+	if f.Source != nil {
+		conds = append(conds, `source = ?`)
+		args = append(args, *f.Source)
+	}
+	if f.Before != "" {
+		t, err := time.Parse(time.RFC3339, f.Before)
+		if err != nil {
+			return "", nil, errors.New("before must be RFC 3339")
+		}
+		conds = append(conds, timeCol+` < ?`)
+		args = append(args, sqliteTime(t))
+	}
+	if f.Seen != nil {
+		if *f.Seen {
+			conds = append(conds, `seen_at IS NOT NULL`)
+		} else {
+			conds = append(conds, `seen_at IS NULL`)
+		}
+	}
+	if len(conds) == 0 {
+		return "", nil, errors.New("filter needs at least one condition")
+	}
+	return strings.Join(conds, " AND "), args, nil
+}
+
+func handleBulk(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var f bulkFilter
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		op, by := r.PathValue("op"), authFrom(r).ID
+		var run func(p *jobProgress) error
+		switch op {
+		case "delete-notifications":
+			if f.Users != nil || f.Auth != nil || f.IPs != nil {
+				http.Error(w, "users, auth and ips only apply to disconnect-clients", http.StatusBadRequest)
+				return
+			}
+			where, args, err := f.where("created_at")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			run = func(p *jobProgress) error { return bulkDelete(p, h, where, args, by) }
+		case "ack-incidents":
+			if f.Source != nil || f.Seen != nil || f.Users != nil || f.Auth != nil || f.IPs != nil {
+				http.Error(w, "ack-incidents filters by ids, topic and before", http.StatusBadRequest)
+				return
+			}
+			where, args, err := f.where("opened_at")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			run = func(p *jobProgress) error { return bulkAck(p, where, args, by) }
+		case "disconnect-clients":
+			if f.Topic != nil || f.Source != nil || f.Before != "" || f.Seen != nil {
+				http.Error(w, "disconnect-clients filters by ids, users, auth and ips", http.StatusBadRequest)
+				return
+			}
+			if len(f.IDs)+len(f.Users)+len(f.Auth)+len(f.IPs) == 0 {
+				http.Error(w, "filter needs at least one condition", http.StatusBadRequest)
+				return
+			}
+			run = func(p *jobProgress) error { return bulkDisconnect(p, h, f) }
+		default:
+			http.Error(w, "unknown operation "+op, http.StatusNotFound)
+			return
+		}
+		id, err := startJob("bulk:"+op, f, by, run)
+		if err != nil {
+			log.Printf("bulk %s: %v", op, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJobStarted(w, id)
+		log.Printf("bulk %s: job %d started by %s", op, id, by)
+	}
+}
+
+// selectIDs returns the ids of table rows matching where.
+func selectIDs(table, where string, args []any) ([]int64, error) {
+	rows, err := db.Query(`SELECT id FROM `+table+` WHERE `+where+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func bulkDelete(p *jobProgress, h *hub, where string, args []any, by string) error {
+	ids, err := selectIDs("notifications", where, args)
+	if err != nil {
+		return err
+	}
+	// Export exactly the selected rows: the filter may match differently by
+	// the time the held ones are read.
+	list, _ := json.Marshal(ids)
+	archive, held, err := exportHeld(context.Background(), "bulk-delete",
+		`id IN (SELECT value FROM json_each(?))`, []any{string(list)})
+	if err != nil {
+		return err
+	}
+	audit(by, "bulk-delete", fmt.Sprintf("%d notifications matched%s", len(ids), heldNote(archive, held)), archive)
+	p.setTotal(len(ids))
+	for len(ids) > 0 {
+		chunk := ids[:min(len(ids), bulkChunk)]
+		ids = ids[len(chunk):]
+		chunkArgs := make([]any, len(chunk))
+		for i, id := range chunk {
+			chunkArgs[i] = id
+		}
+		refs, err := noteRefs(chunk)
+		if err == nil {
+			_, err = db.Exec(`DELETE FROM notifications WHERE id IN (`+placeholders(len(chunk))+`)`, chunkArgs...)
+		}
+		if err == nil {
+			announceDeleted(h, refs, 0)
+		}
+		for range chunk {
+			p.step(err)
+		}
+	}
+	return nil
+}
+
+func bulkAck(p *jobProgress, where string, args []any, by string) error {
+	ids, err := selectIDs("incidents", `acked_at IS NULL AND `+where, args)
+	if err != nil {
+		return err
+	}
+	p.setTotal(len(ids))
+	for _, id := range ids {
+		if err := ackIncident(id, by); err != nil {
+			p.step(fmt.Errorf("incident %d: %v", id, err))
+			continue
+		}
+		p.step(nil)
+	}
+	return nil
+}
+
+func bulkDisconnect(p *jobProgress, h *hub, f bulkFilter) error {
+	match := func(c *client) bool {
+		return (len(f.IDs) == 0 || slices.Contains(f.IDs, c.id)) &&
+			(len(f.Users) == 0 || slices.Contains(f.Users, c.user)) &&
+			(len(f.Auth) == 0 || slices.Contains(f.Auth, c.auth.ID)) &&
+			(len(f.IPs) == 0 || slices.Contains(f.IPs, c.ip))
+	}
+	n := h.closeWhere(match, websocket.ClosePolicyViolation, "disconnected by administrator")
+	p.setTotal(n)
+	for range n {
+		p.step(nil)
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ── Multi-Instance Bus ────────────────────────────────────────────────────────
+//
+// With --redis-url, several server processes sharing one database can sit
+// behind a load balancer: whatever one instance broadcasts to its WebSocket
+// clients it also publishes on --redis-channel, and the others broadcast it
+// to theirs. A send accepted by instance A reaches clients connected to B,
+// and a deploy can start the new instances before stopping the old ones.
+//
+// Events carry ids, not notifications: the database is shared, so a
+// receiving instance loads what it needs and applies its own recipients,
+// topic ACLs and client options. New notifications (single and batch),
+// seen, deleted and updated frames, snoozes, UnifiedPush messages and
+// device preference changes are relayed. Push channels aren't — their
+// deliveries are queued in the shared database and sent by whichever
+// instance claims them.
+//
+// Publishing never blocks a request: events are queued and sent by one
+// connection, and dropped while Redis is unreachable. The subscriber
+// reconnects with backoff. Clients connected with ?device= catch up on
+// anything they missed the usual way, by replay on their next connect.
+
+const (
+	busQueue      = 1024
+	redisTimeout  = 5 * time.Second
+	redisPing     = 30 * time.Second
+	redisMaxBulk  = 8 << 20
+	redisRetryMin = time.Second
+	redisRetryMax = 30 * time.Second
+
+	busKindNote  = "notification"
+	busKindBatch = "batch"
+	busKindSeen  = "seen"
+	busKindFrame = "frame"
+
+	busKindDeleted = "deleted"
+	busKindUpdated = "updated"
+
+	busKindEscalated = "escalated"
+	busKindAcked     = "acked"
+
+	busKindPrefs = "prefs"
+)
+
+// busEvent is what instances tell each other.
+type busEvent struct {
+	Origin string  `json:"origin"`
+	Kind   string  `json:"kind"`
+	IDs    []int64 `json:"ids,omitempty"` // notification, batch, seen, deleted, updated, escalated, acked
+	// seen, deleted: the topic of each id; seen: who saw them when.
+	Topics []string `json:"topics,omitempty"`
+	SeenAt string   `json:"seen_at,omitempty"`
+	// frame: a frame sent as is, to the clients that may see Topic, or to
+	// Device's clients connected with credential Auth. prefs: Device's
+	// preferences changed.
+	Frame  json.RawMessage `json:"frame,omitempty"`
+	Topic  string          `json:"topic,omitempty"`
+	Device string          `json:"device,omitempty"`
+	Auth   string          `json:"auth,omitempty"`
+	// deleted: instead of IDs, every notification up to Through.
+	Through int64 `json:"through,omitempty"`
+}
+
+var bus struct {
+	id      string
+	out     chan busEvent
+	dropped atomic.Int64
+}
+
+// startBus connects the instance to the bus when --redis-url is set.
+func startBus(h *hub, rawURL, channel string) error {
+	if rawURL == "" {
+		return nil
+	}
+	if _, err := redisAddr(rawURL); err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	bus.id = fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(suffix))
+	bus.out = make(chan busEvent, busQueue)
+	go busPublisher(rawURL, channel)
+	go busSubscriber(h, rawURL, channel)
+	return nil
+}
+
+// busPublish queues e for the other instances. It never blocks.
+func busPublish(e busEvent) {
+	if bus.out == nil {
+		return
+	}
+	e.Origin = bus.id
+	select {
+	case bus.out <- e:
+	default:
+		if bus.dropped.Add(1) == 1 {
+			log.Printf("bus: publish queue full, dropping events")
+		}
+	}
+}
+
+func busPublisher(rawURL, channel string) {
+	var rc *redisConn
+	for e := range bus.out {
+		data, _ := json.Marshal(e)
+		for attempt := 0; attempt < 2; attempt++ {
+			var err error
+			if rc == nil {
+				if rc, err = dialRedis(rawURL); err != nil {
+					log.Printf("bus: publish: %v", err)
+					break
+				}
+			}
+			if _, err = rc.do("PUBLISH", channel, string(data)); err == nil {
+				break
+			}
+			log.Printf("bus: publish: %v", err)
+			rc.close()
+			rc = nil
+		}
+	}
+}
+
+func busSubscriber(h *hub, rawURL, channel string) {
+	wait := redisRetryMin
+	for {
+		err := busListen(h, rawURL, channel, func() { wait = redisRetryMin })
+		log.Printf("bus: subscription lost: %v; reconnecting in %s", err, wait)
+		time.Sleep(wait)
+		wait = min(wait*2, redisRetryMax)
+	}
+}
+
+// busListen subscribes to channel and applies events until the connection
+// fails. connected is called once the subscription is confirmed.
+func busListen(h *hub, rawURL, channel string, connected func()) error {
+	rc, err := dialRedis(rawURL)
+	if err != nil {
+		return err
+	}
+	defer rc.close()
+	if err := rc.send("SUBSCRIBE", channel); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// Pings keep replies coming, so a dead connection shows up as a
+		// read timeout.
+		t := time.NewTicker(redisPing)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if rc.send("PING") != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	for {
+		rc.conn.SetReadDeadline(time.Now().Add(2 * redisPing))
+		v, err := rc.read()
+		if err != nil {
+			return err
+		}
+		msg, _ := v.([]any)
+		if len(msg) < 2 {
+			continue
+		}
+		switch kind, _ := msg[0].(string); kind {
+		case "subscribe":
+			log.Printf("bus: subscribed to %q as %s", channel, bus.id)
+			connected()
+		case "message":
+			payload, _ := msg[len(msg)-1].(string)
+			var e busEvent
+			if err := json.Unmarshal([]byte(payload), &e); err != nil {
+				log.Printf("bus: bad event: %v", err)
+				continue
+			}
+			if e.Origin != bus.id {
+				e.apply(h)
+			}
+		}
+	}
+}
+
+// apply broadcasts an event from another instance to this one's clients.
+func (e busEvent) apply(h *hub) {
+	switch e.Kind {
+	case busKindNote, busKindBatch:
+		var notes []Notification
+		for _, id := range e.IDs {
+			n, err := getNotification(id)
+			if err != nil {
+				log.Printf("bus: notification %d: %v", id, err)
+				continue
+			}
+			notes = append(notes, n)
+		}
+		if e.Kind == busKindBatch {
+			broadcastNotifications(h, notes)
+			return
+		}
+		for _, n := range notes {
+			broadcastTo(h, n, recipients(h, n))
+		}
+	case busKindSeen:
+		if len(e.Topics) != len(e.IDs) {
+			return
+		}
+		notes := make([]noteRef, len(e.IDs))
+		for i, id := range e.IDs {
+			notes[i] = noteRef{id, e.Topics[i]}
+		}
+		broadcastSeen(h, notes, e.Device, e.SeenAt)
+	case busKindDeleted:
+		if len(e.Topics) != len(e.IDs) {
+			return
+		}
+		notes := make([]noteRef, len(e.IDs))
+		for i, id := range e.IDs {
+			notes[i] = noteRef{id, e.Topics[i]}
+		}
+		broadcastDeleted(h, notes, e.Through)
+	case busKindUpdated:
+		broadcastUpdated(h, loadNotifications(e.IDs))
+	case busKindEscalated:
+		for _, n := range loadNotifications(e.IDs) {
+			broadcastEscalated(h, n)
+		}
+	case busKindAcked:
+		for _, n := range loadNotifications(e.IDs) {
+			broadcastAcked(h, n)
+		}
+	case busKindPrefs:
+		reloadDevicePrefs(h, e.Device)
+	case busKindFrame:
+		h.bcast <- envelope{data: e.Frame, to: func(c *client) bool {
+			return (e.Topic == "" || c.sees(e.Topic)) &&
+				(e.Device == "" || c.device == e.Device && c.auth.ID == e.Auth)
+		}}
+	}
+}
+
+// publishSeen tells the other instances that notes were marked seen.
+func publishSeen(notes []noteRef, device, seenAt string) {
+	if len(notes) == 0 {
+		return
+	}
+	e := busEvent{Kind: busKindSeen, Device: device, SeenAt: seenAt}
+	for _, n := range notes {
+		e.IDs = append(e.IDs, n.id)
+		e.Topics = append(e.Topics, n.topic)
+	}
+	busPublish(e)
+}
+
+// ── Redis ──
+//
+// Just enough of RESP for PUBLISH and SUBSCRIBE.
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisAddr checks a redis:// or rediss:// URL and returns host:port.
+func redisAddr(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("--redis-url: %v", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return "", fmt.Errorf("--redis-url: unsupported scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), "6379"), nil
+	}
+	return u.Host, nil
+}
+
+// dialRedis connects and authenticates with the URL's user and password.
+func dialRedis(rawURL string) (*redisConn, error) {
+	addr, err := redisAddr(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(rawURL)
+	d := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	if u.Scheme == "rediss" {
+		conn, err = tls.DialWithDialer(d, "tcp", addr, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = d.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if pass, ok := u.User.Password(); ok {
+		args := []string{"AUTH", pass}
+		if name := u.User.Username(); name != "" {
+			args = []string{"AUTH", name, pass}
+		}
+		if _, err := rc.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+func (rc *redisConn) close() { rc.conn.Close() }
+
+// send writes a command without waiting for the reply.
+func (rc *redisConn) send(args ...string) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	rc.conn.SetWriteDeadline(time.Now().Add(redisTimeout))
+	_, err := rc.conn.Write(b.Bytes())
+	return err
+}
+
+// do sends a command and reads its reply.
+func (rc *redisConn) do(args ...string) (any, error) {
+	if err := rc.send(args...); err != nil {
+		return nil, err
+	}
+	rc.conn.SetReadDeadline(time.Now().Add(redisTimeout))
+	return rc.read()
+}
+
+// read parses one reply: a string, an int64, nil or a []any. Error replies
+// come back as a redisError.
+func (rc *redisConn) read() (any, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > redisMaxBulk {
+			return nil, fmt.Errorf("redis: bad bulk length %q", line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > 1024 {
+			return nil, fmt.Errorf("redis: bad array length %q", line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		out := make([]any, n)
+		for i := range out {
+			if out[i], err = rc.read(); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ── Chat Connectors ───────────────────────────────────────────────────────────
+//
+// Chat connectors mirror notifications into a Discord channel or a Slack
+// workspace through an incoming webhook, so alerts meant for a team reach it
+// where it already talks. Connectors are managed under /admin/chat with a
+// kind ("discord" or "slack"), the webhook URL and the topics to mirror.
+// Topics are required: a connector only ever gets the topics it lists, so
+// notifications on other topics stay on the phone. min_priority and user
+// (whose topic ACLs apply) narrow it further, as for push subscriptions.
+//
+// Each notification becomes one message: a Discord embed or a Slack
+// attachment with the title, the text, a colour for the priority, the click
+// URL as the title link and the source and topic underneath. Markdown text
+// is passed to Discord as is and rewritten into Slack's mrkdwn. Mentions are
+// never expanded, so a notification can't ping @everyone. Slack-compatible
+// webhooks (Mattermost, Rocket.Chat) work with kind "slack".
+//
+// Webhook URLs carry their credential, so listings show them with the last
+// path segment masked. POST /admin/chat/{name}/test sends a test message.
+
+const (
+	chatDiscord  = "discord"
+	chatSlack    = "slack"
+	chatTimeout  = 10 * time.Second
+	chatMaxTitle = 250
+	chatMaxText  = 3000
+)
+
+var chatHTTP = &http.Client{Timeout: chatTimeout}
+
+type chatConnector struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	URL  string `json:"url"` // masked when listed
+	pushFilter
+	LastSentAt *string `json:"last_sent_at"`
+	Sent       int64   `json:"sent"`
+	Failures   int64   `json:"failures"`
+	LastError  string  `json:"last_error,omitempty"`
+	UpdatedBy  string  `json:"updated_by"`
+}
+
+func initChatTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS chat_connectors (
+			name         TEXT PRIMARY KEY,
+			kind         TEXT NOT NULL,
+			url          TEXT NOT NULL,
+			user         TEXT NOT NULL DEFAULT '',
+			topics       TEXT NOT NULL,
+			min_priority INTEGER NOT NULL DEFAULT 1,
+			last_sent_at DATETIME,
+			sent         INTEGER NOT NULL DEFAULT 0,
+			failures     INTEGER NOT NULL DEFAULT 0,
+			last_error   TEXT NOT NULL DEFAULT '',
+			updated_by   TEXT NOT NULL DEFAULT ''
+		)
+	`)
+	return err
+}
+
+const chatCols = `name, kind, url, user, topics, min_priority, last_sent_at, sent, failures, last_error, updated_by`
+
+func scanChat(s scanner) (chatConnector, error) {
+	var c chatConnector
+	var topics string
+	err := s.Scan(&c.Name, &c.Kind, &c.URL, &c.User, &topics, &c.MinPriority, &c.LastSentAt,
+		&c.Sent, &c.Failures, &c.LastError, &c.UpdatedBy)
+	c.Topics = splitList(topics)
+	return c, err
+}
+
+func getChat(name string) (chatConnector, error) {
+	return scanChat(db.QueryRow(`SELECT `+chatCols+` FROM chat_connectors WHERE name = ?`, name))
+}
+
+func listChats() ([]chatConnector, error) {
+	rows, err := db.Query(`SELECT ` + chatCols + ` FROM chat_connectors ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []chatConnector{}
+	for rows.Next() {
+		c, err := scanChat(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// maskURL hides a webhook URL's last path segment, where Discord and Slack
+// put the token.
+func maskURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	path := u.EscapedPath()
+	if i := strings.LastIndex(path, "/"); i >= 0 && i < len(path)-1 {
+		path = path[:i+1] + "…"
+	}
+	return u.Scheme + "://" + u.Host + path
+}
+
+// ── Chat handlers ──
+
+func handleChats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		out, err := listChats()
+		if err != nil {
+			log.Printf("chat: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		for i := range out {
+			out[i].URL = maskURL(out[i].URL)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// handleChat shows (GET), stores (PUT) or deletes (DELETE) a connector.
+func handleChat() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, by := r.PathValue("name"), authFrom(r).ID
+		switch r.Method {
+		case http.MethodGet:
+			c, err := getChat(name)
+			if err == sql.ErrNoRows {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			} else if err != nil {
+				log.Printf("chat %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			c.URL = maskURL(c.URL)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(c)
+		case http.MethodPut:
+			var body struct {
+				Kind string `json:"kind"`
+				URL  string `json:"url"`
+				pushFilter
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			err := body.check()
+			switch {
+			case !templateNameRE.MatchString(name):
+				err = errors.New("name must be 1-64 letters, digits, '.', '_' or '-'")
+			case body.Kind != chatDiscord && body.Kind != chatSlack:
+				err = errors.New(`kind must be "discord" or "slack"`)
+			case !strings.HasPrefix(body.URL, "https://") || !httpURL(body.URL):
+				err = errors.New("url must be an https webhook URL")
+			case len(body.Topics) == 0:
+				err = errors.New("topics is required; a connector only mirrors the topics it lists")
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, err := db.Exec(`
+				INSERT INTO chat_connectors (name, kind, url, user, topics, min_priority, updated_by)
+				VALUES (?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT(name) DO UPDATE SET kind = excluded.kind, url = excluded.url, user = excluded.user,
+					topics = excluded.topics, min_priority = excluded.min_priority,
+					updated_by = excluded.updated_by, failures = 0, last_error = ''`,
+				name, body.Kind, body.URL, body.User, strings.Join(body.Topics, ","), body.MinPriority, by); err != nil {
+				log.Printf("chat %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("chat: %q (%s, topics %s) saved by %s", name, body.Kind, strings.Join(body.Topics, ","), by)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			res, err := db.Exec(`DELETE FROM chat_connectors WHERE name = ?`, name)
+			if err != nil {
+				log.Printf("chat %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("chat: %q deleted by %s", name, by)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleChatTest sends a test message through a connector, whatever its
+// topics.
+func handleChatTest() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.PathValue("name")
+		c, err := getChat(name)
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("chat %q: %v", name, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		n := Notification{
+			Title:     "andrNoti test",
+			Text:      "Notifications on " + strings.Join(c.Topics, ", ") + " will appear here.",
+			Source:    "andrnoti",
+			Priority:  priorityDefault,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		}
+		out := map[string]any{"ok": true}
+		if err := sendChat(c, n); err != nil {
+			out = map[string]any{"ok": false, "error": err.Error()}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// ── Delivery ──
+
+// chatTargets lists the connectors of a kind that want n.
+func chatTargets(kind string) func(h *hub, n Notification) ([]string, error) {
+	return func(h *hub, n Notification) ([]string, error) {
+		conns, err := listChats()
+		if err != nil {
+			return nil, err
+		}
+		// No assignee narrowing: a channel is the team's, not a person's.
+		var names []string
+		for _, c := range conns {
+			if c.Kind == kind && c.wants(n) {
+				names = append(names, c.Name)
+			}
+		}
+		return names, nil
+	}
+}
+
+func deliverChat(name string, n Notification) error {
+	c, err := getChat(name)
+	if err == sql.ErrNoRows {
+		return errTargetGone // deleted since
+	}
+	if err != nil {
+		return err
+	}
+	if err := sendChat(c, n); err != nil {
+		db.Exec(`UPDATE chat_connectors SET failures = failures + 1, last_error = ? WHERE name = ?`, err.Error(), c.Name)
+		return err
+	}
+	db.Exec(`UPDATE chat_connectors SET sent = sent + 1, last_sent_at = CURRENT_TIMESTAMP WHERE name = ?`, c.Name)
+	return nil
+}
+
+func sendChat(c chatConnector, n Notification) error {
+	var payload any
+	if c.Kind == chatDiscord {
+		payload = discordMessage(n)
+	} else {
+		payload = slackMessage(n)
+	}
+	data, _ := json.Marshal(payload)
+	req, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := chatHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return httpDeliveryError(resp, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// ── Formatting ──
+
+// chatColor is the side colour for a priority: red for urgent, orange for
+// high, blue for normal and grey below.
+func chatColor(priority int) int {
+	switch {
+	case priority >= priorityUrgent:
+		return 0xE01E5A
+	case priority == 4:
+		return 0xF2A33A
+	case priority == 3:
+		return 0x2F80ED
+	default:
+		return 0x9AA0A6
+	}
+}
+
+// chatFooter is "source · topic", whichever of them is set.
+func chatFooter(n Notification) string {
+	var parts []string
+	for _, s := range []string{n.Source, n.Topic} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, " · ")
+}
+
+func discordMessage(n Notification) map[string]any {
+	embed := map[string]any{
+		"title":     excerpt(n.Title, chatMaxTitle),
+		"color":     chatColor(n.Priority),
+		"timestamp": n.CreatedAt,
+	}
+	text := n.Text
+	if n.Format == formatMarkdown {
+		text = n.Markdown
+	}
+	if text != "" {
+		embed["description"] = excerpt(text, chatMaxText)
+	}
+	if n.ClickURL != "" {
+		embed["url"] = n.ClickURL
+	}
+	if f := chatFooter(n); f != "" {
+		embed["footer"] = map[string]string{"text": f}
+	}
+	return map[string]any{
+		"embeds":           []any{embed},
+		"allowed_mentions": map[string]any{"parse": []string{}},
+	}
+}
+
+func slackMessage(n Notification) map[string]any {
+	text := slackEscape(n.Text)
+	if n.Format == formatMarkdown {
+		text = slackMrkdwn(n.Markdown)
+	}
+	att := map[string]any{
+		"color":     fmt.Sprintf("#%06X", chatColor(n.Priority)),
+		"title":     excerpt(n.Title, chatMaxTitle),
+		"text":      excerpt(text, chatMaxText),
+		"mrkdwn_in": []string{"text"},
+	}
+	if n.ClickURL != "" {
+		att["title_link"] = n.ClickURL
+	}
+	if f := chatFooter(n); f != "" {
+		att["footer"] = f
+	}
+	if t, err := time.Parse(time.RFC3339, n.CreatedAt); err == nil {
+		att["ts"] = t.Unix()
+	}
+	return map[string]any{
+		"text":        slackEscape(excerpt(n.Title, chatMaxTitle)), // the notification preview
+		"attachments": []any{att},
+	}
+}
+
+// slackEscape escapes the characters Slack treats as markup, which also
+// keeps <!channel> and user mentions from being expanded.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+var (
+	mdLinkRE    = regexp.MustCompile(`\[([^\]]+)\]\((https?://[^)\s]+)\)`)
+	mdBoldRE    = regexp.MustCompile(`\*\*([^*\n]+)\*\*|__([^_\n]+)__`)
+	mdHeadingRE = regexp.MustCompile(`(?m)^#{1,6}\s+(.+)$`)
+	mdStrikeRE  = regexp.MustCompile(`~~([^~\n]+)~~`)
+)
+
+// slackMrkdwn rewrites the Markdown notifications use into Slack's mrkdwn:
+// links, bold, headings (as bold lines) and strikethrough. Italics, code and
+// lists read the same in both.
+func slackMrkdwn(s string) string {
+	s = slackEscape(s)
+	s = mdLinkRE.ReplaceAllString(s, "<$2|$1>")
+	s = mdBoldRE.ReplaceAllString(s, "*$1$2*")
+	s = mdHeadingRE.ReplaceAllString(s, "*$1*")
+	return mdStrikeRE.ReplaceAllString(s, "~$1~")
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"ilios.dev/andrnoti/api"
+)
+
+// ── Client Config Push ────────────────────────────────────────────────────────
+//
+// Fleet-wide hints for clients, stored in settings and pushed to every
+// WebSocket client as {"type":"config"} on connect and whenever they change.
+// Topics are the union of the configured list and every topic seen so far,
+// so a notification on a brand-new topic re-pushes the config.
+
+var knownTopics = struct {
+	sync.Mutex
+	set map[string]bool
+}{set: map[string]bool{}}
+
+func loadKnownTopics() error {
+	rows, err := db.Query(`SELECT DISTINCT topic FROM notifications WHERE topic != ''`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	knownTopics.Lock()
+	defer knownTopics.Unlock()
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			return err
+		}
+		knownTopics.set[t] = true
+	}
+	return rows.Err()
+}
+
+// noteTopic records topic and reports whether it was new.
+func noteTopic(topic string) bool {
+	if topic == "" {
+		return false
+	}
+	knownTopics.Lock()
+	defer knownTopics.Unlock()
+	if knownTopics.set[topic] {
+		return false
+	}
+	knownTopics.set[topic] = true
+	return true
+}
+
+// storedClientConfig is the admin-set config without derived topics.
+func storedClientConfig() clientConfig {
+	var cfg clientConfig
+	if v := getSetting("client_config"); v != "" {
+		if err := json.Unmarshal([]byte(v), &cfg); err != nil {
+			log.Printf("client config: %v", err)
+		}
+	}
+	return cfg
+}
+
+// currentClientConfig is what clients receive.
+func currentClientConfig() clientConfig {
+	cfg := storedClientConfig()
+	set := map[string]bool{}
+	for _, t := range cfg.Topics {
+		set[t] = true
+	}
+	knownTopics.Lock()
+	for t := range knownTopics.set {
+		set[t] = true
+	}
+	knownTopics.Unlock()
+	if cfg.MinAppVersion == "" {
+		cfg.MinAppVersion = *flagMinClientVersion
+	}
+	cfg.Topics = make([]string, 0, len(set))
+	for t := range set {
+		cfg.Topics = append(cfg.Topics, t)
+	}
+	sort.Strings(cfg.Topics)
+	return cfg
+}
+
+func clientConfigMessage() []byte {
+	cfg := currentClientConfig()
+	data, _ := json.Marshal(wsMessage{Type: "config", Config: &cfg})
+	return data
+}
+
+func pushClientConfig(h *hub) {
+	h.bcast <- envelope{data: clientConfigMessage()}
+}
+
+func handleClientConfig(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			if authFrom(r).Scope < scopeFull {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			var cfg clientConfig
+			if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			raw, _ := json.Marshal(cfg)
+			if err := setSetting("client_config", string(raw)); err != nil {
+				log.Printf("client config: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			pushClientConfig(h)
+			log.Printf("client config: updated and pushed to %d clients", h.connectedCount())
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(currentClientConfig())
+	}
+}
+
+// ── Minimum Client Version ────────────────────────────────────────────────────
+//
+// Clients report ?version= on /ws. When --min-client-version is set, older
+// clients receive one explanatory notification frame (never stored) and are
+// closed with api.CloseUpgradeRequired. Clients that don't report a version
+// predate the check and are let through.
+
+// compareVersions compares dotted numeric versions ("1.10.2" > "1.9").
+// Anything after '+' or '-' is ignored; missing parts count as 0.
+func compareVersions(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for len(pa) < len(pb) {
+		pa = append(pa, 0)
+	}
+	for len(pb) < len(pa) {
+		pb = append(pb, 0)
+	}
+	for i := range pa {
+		switch {
+		case pa[i] < pb[i]:
+			return -1
+		case pa[i] > pb[i]:
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionParts(v string) []int {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "+-"); i >= 0 {
+		v = v[:i]
+	}
+	var out []int
+	for _, p := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(p)
+		out = append(out, n)
+	}
+	return out
+}
+
+func validVersion(v string) bool {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "+-"); i >= 0 {
+		v = v[:i]
+	}
+	for _, p := range strings.Split(v, ".") {
+		if _, err := strconv.Atoi(p); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// rejectOldClient tells an outdated client why it is being dropped and closes
+// the connection. Called before the client is registered with the hub.
+func rejectOldClient(conn *websocket.Conn, version string, proto bool) {
+	text := fmt.Sprintf("This app (version %s) is older than the minimum supported version %s. "+
+		"Please update to keep receiving notifications.", version, *flagMinClientVersion)
+	msg := wsMessage{
+		Type:      "notification",
+		Title:     "Update required",
+		Text:      text,
+		Source:    "andrNoti",
+		Priority:  priorityHigh,
+		CreatedAt: sqliteTime(time.Now()),
+	}
+	data, _ := json.Marshal(msg)
+	kind := websocket.TextMessage
+	if proto {
+		kind, data = websocket.BinaryMessage, protoMarshal(msg)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	conn.SetWriteDeadline(deadline)
+	conn.WriteMessage(kind, data)
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(api.CloseUpgradeRequired, "upgrade required: minimum version "+*flagMinClientVersion),
+		deadline)
+	conn.Close()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// ── Clock Skew ────────────────────────────────────────────────────────────────
+//
+// Token expiry, signed-request windows, snoozes, digests, retention and the
+// scheduler all trust the system clock, and a Pi without a battery-backed
+// clock drifts or boots into the past. Two checks make that visible instead
+// of silently wrong:
+//
+//   - Sender timestamps are checked against --clock-tolerance: JWT exp and
+//     nbf get that much leeway, and a token issued (iat) further in the future
+//     than that is refused, since its issuer's clock is off. HMAC-signed
+//     requests keep their own --hmac-max-skew window; rejections say how far
+//     off the sender was, and /stats keeps the skew senders showed.
+//   - Every --ntp-check-interval the server asks --ntp-server (SNTP) for the
+//     time. A drift beyond --clock-tolerance marks /health degraded and sends
+//     a high-priority notification, and another once it is back in bounds.
+
+const ntpTimeout = 5 * time.Second
+
+// ntpEpochOffset is the seconds between the NTP era (1900) and Unix epochs.
+const ntpEpochOffset = 2208988800
+
+type clockStatus struct {
+	Server    string  `json:"server"`
+	OK        bool    `json:"ok"`
+	CheckedAt string  `json:"checked_at,omitempty"`
+	Drift     float64 `json:"drift_s"` // this clock minus the server's; positive = ahead
+	RTT       int64   `json:"rtt_ms"`
+	Tolerance string  `json:"tolerance"`
+	Error     string  `json:"error,omitempty"`
+}
+
+var clockState = struct {
+	sync.Mutex
+	status  *clockStatus // nil until the first check
+	drifted bool         // last successful check was out of tolerance
+
+	// Skew shown by HMAC-signed requests: sender clock minus ours.
+	lastSkew, maxSkew time.Duration
+	skewSeen          bool
+	rejected          int64
+}{}
+
+func ntpEnabled() bool { return *flagNTPServer != "" && *flagNTPInterval > 0 }
+
+// describeSkew says how far ahead or behind d is, rounded for a human.
+func describeSkew(d time.Duration) string {
+	dir := " ahead of"
+	if d < 0 {
+		dir = " behind"
+	}
+	d = d.Abs()
+	if d < time.Second {
+		return d.Round(time.Millisecond).String() + dir
+	}
+	return d.Round(time.Second).String() + dir
+}
+
+// seconds is d in seconds, to the millisecond.
+func seconds(d time.Duration) float64 { return math.Round(d.Seconds()*1000) / 1000 }
+
+// noteSenderSkew records the skew of an HMAC-signed request's timestamp.
+func noteSenderSkew(skew time.Duration, accepted bool) {
+	clockState.Lock()
+	defer clockState.Unlock()
+	clockState.lastSkew, clockState.skewSeen = skew, true
+	if skew.Abs() > clockState.maxSkew.Abs() {
+		clockState.maxSkew = skew
+	}
+	if !accepted {
+		clockState.rejected++
+	}
+}
+
+func clockStats() map[string]any {
+	clockState.Lock()
+	defer clockState.Unlock()
+	out := map[string]any{
+		"tolerance_s":   clockTolerance().Seconds(),
+		"hmac_rejected": clockState.rejected,
+	}
+	if clockState.skewSeen {
+		out["hmac_last_skew_s"] = seconds(clockState.lastSkew)
+		out["hmac_max_skew_s"] = seconds(clockState.maxSkew)
+	}
+	if clockState.status != nil {
+		out["ntp"] = *clockState.status
+	}
+	return out
+}
+
+// clockTolerance is --clock-tolerance, never negative.
+func clockTolerance() time.Duration { return max(*flagClockTolerance, 0) }
+
+// currentClockStatus is the last NTP check, or nil before the first.
+func currentClockStatus() *clockStatus {
+	clockState.Lock()
+	defer clockState.Unlock()
+	if clockState.status == nil {
+		return nil
+	}
+	s := *clockState.status
+	return &s
+}
+
+func ntpCheckJob(h *hub) *schedJob {
+	return &schedJob{
+		name:     "ntp-check",
+		interval: *flagNTPInterval,
+		run:      func() error { return checkClock(h) },
+	}
+}
+
+// checkClock compares the clock with --ntp-server, records the result and
+// notifies when it goes out of or comes back into tolerance.
+func checkClock(h *hub) error {
+	drift, rtt, err := ntpDrift(*flagNTPServer)
+	tolerance := clockTolerance()
+	s := &clockStatus{
+		Server:    *flagNTPServer,
+		OK:        err == nil && drift.Abs() <= tolerance,
+		CheckedAt: time.Now().UTC().Format(time.RFC3339),
+		Drift:     seconds(drift),
+		RTT:       rtt.Milliseconds(),
+		Tolerance: tolerance.String(),
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	clockState.Lock()
+	clockState.status = s
+	was := clockState.drifted
+	if err == nil {
+		clockState.drifted = !s.OK
+	}
+	now := clockState.drifted
+	clockState.Unlock()
+
+	switch {
+	case err != nil:
+		return err
+	case now && !was:
+		log.Printf("clock: %s %s (tolerance %s)", describeSkew(drift), *flagNTPServer, tolerance)
+		notifyClock(h, "System clock is off",
+			fmt.Sprintf("This server's clock is %s %s, beyond the %s tolerance. Token expiry, signed requests, snoozes and scheduled jobs may misbehave until it is fixed (is NTP running?).",
+				describeSkew(drift), *flagNTPServer, tolerance))
+	case !now && was:
+		log.Printf("clock: back within %s of %s", tolerance, *flagNTPServer)
+		notifyClock(h, "System clock back in sync",
+			fmt.Sprintf("This server's clock is %s %s, within the %s tolerance.", describeSkew(drift), *flagNTPServer, tolerance))
+	}
+	return nil
+}
+
+func notifyClock(h *hub, title, text string) {
+	if _, err := publish(context.Background(), h, Notification{
+		Title:    title,
+		Text:     text,
+		Source:   "andrNoti",
+		Priority: priorityHigh,
+	}); err != nil {
+		log.Printf("clock: notify: %v", err)
+	}
+}
+
+// ntpDrift asks an NTP server for the time (RFC 4330 SNTP) and returns how
+// far this clock is ahead of it, and the round trip.
+func ntpDrift(server string) (drift, rtt time.Duration, err error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, ntpTimeout)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ntpTimeout))
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // no leap warning, version 4, client mode
+	sent := time.Now()
+	stamp := toNTP(sent)
+	binary.BigEndian.PutUint64(req[40:], stamp) // echoed back as the originate time
+	if _, err := conn.Write(req); err != nil {
+		return 0, 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	received := time.Now()
+	if err != nil {
+		return 0, 0, err
+	}
+	switch {
+	case n < 48:
+		return 0, 0, errors.New("short NTP reply")
+	case resp[0]&0x07 != 4:
+		return 0, 0, errors.New("NTP reply is not in server mode")
+	case resp[1] == 0 || resp[1] > 15:
+		return 0, 0, fmt.Errorf("NTP server is unsynchronised or refused the query (stratum %d)", resp[1])
+	case binary.BigEndian.Uint64(resp[24:]) != stamp:
+		return 0, 0, errors.New("NTP reply does not match the query")
+	}
+	t2 := fromNTP(binary.BigEndian.Uint64(resp[32:]))
+	t3 := fromNTP(binary.BigEndian.Uint64(resp[40:]))
+	// Offset of the server from us: ((t2 - t1) + (t3 - t4)) / 2.
+	offset := (t2.Sub(sent.Round(0)) + t3.Sub(received.Round(0))) / 2
+	rtt = received.Sub(sent) - t3.Sub(t2)
+	return -offset, max(rtt, 0), nil
+}
+
+func toNTP(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	return secs<<32 | frac
+}
+
+func fromNTP(v uint64) time.Time {
+	secs := int64(v>>32) - ntpEpochOffset
+	nanos := int64((v & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(secs, nanos)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ── Database Maintenance ──────────────────────────────────────────────────────
+//
+// Every --db-maintenance-interval the database gets an integrity check,
+// ANALYZE and an incremental vacuum. Databases created before auto_vacuum was
+// enabled are converted with one full VACUUM on the first run. The last report
+// is kept in settings and shown on /health so a slowly degrading install is
+// visible from outside.
+
+type dbMaintReport struct {
+	At          string   `json:"at"`
+	DurationMS  int64    `json:"duration_ms"`
+	IntegrityOK bool     `json:"integrity_ok"`
+	Problems    []string `json:"problems,omitempty"`
+	FreedPages  int64    `json:"freed_pages"`
+	SizeBytes   int64    `json:"size_bytes"`
+	FreeBytes   int64    `json:"free_bytes"`
+	Error       string   `json:"error,omitempty"`
+}
+
+var dbMaint struct {
+	sync.Mutex
+	last *dbMaintReport
+}
+
+func loadDBMaintReport() {
+	v := getSetting("db_maintenance")
+	if v == "" {
+		return
+	}
+	var r dbMaintReport
+	if err := json.Unmarshal([]byte(v), &r); err != nil {
+		log.Printf("db maintenance: %v", err)
+		return
+	}
+	dbMaint.Lock()
+	dbMaint.last = &r
+	dbMaint.Unlock()
+}
+
+func lastDBMaintReport() *dbMaintReport {
+	dbMaint.Lock()
+	defer dbMaint.Unlock()
+	return dbMaint.last
+}
+
+// dbMaintJob runs maintenance every interval. Before its first scheduled run
+// it counts from the last report, so upgrading doesn't trigger it early.
+func dbMaintJob(interval time.Duration) *schedJob {
+	return &schedJob{
+		name:     "db-maintenance",
+		interval: interval,
+		first:    time.Minute,
+		lastRun: func() time.Time {
+			if r := lastDBMaintReport(); r != nil {
+				at, _ := time.Parse(time.RFC3339, r.At)
+				return at
+			}
+			return time.Time{}
+		},
+		run: runDBMaintenance,
+	}
+}
+
+func runDBMaintenance() error {
+	start := time.Now()
+	r := dbMaintReport{At: start.UTC().Format(time.RFC3339)}
+	if err := dbMaintain(&r); err != nil {
+		r.Error = err.Error()
+	}
+	r.DurationMS = time.Since(start).Milliseconds()
+
+	switch {
+	case r.Error != "":
+		log.Printf("db maintenance: %s", r.Error)
+	case !r.IntegrityOK:
+		log.Printf("db maintenance: INTEGRITY CHECK FAILED: %s", strings.Join(r.Problems, "; "))
+	default:
+		log.Printf("db maintenance: ok in %dms (freed %d pages, %d bytes, %d free)",
+			r.DurationMS, r.FreedPages, r.SizeBytes, r.FreeBytes)
+	}
+
+	dbMaint.Lock()
+	dbMaint.last = &r
+	dbMaint.Unlock()
+	if raw, err := json.Marshal(r); err == nil {
+		if err := setSetting("db_maintenance", string(raw)); err != nil {
+			log.Printf("db maintenance: %v", err)
+		}
+	}
+	switch {
+	case r.Error != "":
+		return errors.New(r.Error)
+	case !r.IntegrityOK:
+		return errors.New("integrity check failed")
+	}
+	return nil
+}
+
+// dbMaintain does the work on a single connection, since auto_vacuum and
+// VACUUM must run on the same one.
+func dbMaintain(r *dbMaintReport) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, `PRAGMA integrity_check(20)`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			rows.Close()
+			return err
+		}
+		if line != "ok" {
+			r.Problems = append(r.Problems, line)
+		}
+	}
+	rows.Close()
+	r.IntegrityOK = len(r.Problems) == 0
+	if !r.IntegrityOK {
+		return nil // leave a damaged file alone
+	}
+
+	if _, err := conn.ExecContext(ctx, `ANALYZE`); err != nil {
+		return err
+	}
+
+	var mode, before, after int64
+	conn.QueryRowContext(ctx, `PRAGMA auto_vacuum`).Scan(&mode)
+	conn.QueryRowContext(ctx, `PRAGMA freelist_count`).Scan(&before)
+	if mode != 2 {
+		log.Printf("db maintenance: converting to incremental auto_vacuum (one full VACUUM)")
+		if _, err := conn.ExecContext(ctx, `PRAGMA auto_vacuum = INCREMENTAL`); err != nil {
+			return err
+		}
+		if _, err := conn.ExecContext(ctx, `VACUUM`); err != nil {
+			return err
+		}
+	} else {
+		// incremental_vacuum frees one page per step, so drain its rows.
+		rows, err := conn.QueryContext(ctx, `PRAGMA incremental_vacuum`)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+		}
+		rows.Close()
+	}
+	conn.QueryRowContext(ctx, `PRAGMA freelist_count`).Scan(&after)
+	r.FreedPages = before - after
+
+	var pages, pageSize int64
+	conn.QueryRowContext(ctx, `PRAGMA page_count`).Scan(&pages)
+	conn.QueryRowContext(ctx, `PRAGMA page_size`).Scan(&pageSize)
+	r.SizeBytes, r.FreeBytes = pages*pageSize, after*pageSize
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ── Sync Debugging ────────────────────────────────────────────────────────────
+//
+// GET /debug/sync?device=X answers "why didn't my phone get it?". It shows
+// the server's side — the device's cursor, its open connections and their
+// drops, the notifications after the cursor and the unseen set, as the
+// device's user is allowed to see them — and, when the device's own view is
+// passed in, where the two disagree:
+//
+//	have=1-40,42,45   ids the device holds (ranges allowed)
+//	unseen=42,45      ids it shows as unseen
+//
+// missing lists what the server has from the device's oldest id on that the
+// device doesn't; unknown lists what the device has that the server doesn't
+// (deleted, merged or archived since). findings sums the gaps up in words.
+
+const (
+	debugSyncMaxIDs  = 10000 // ids accepted in have / unseen
+	debugSyncMaxList = 200   // ids listed per category
+)
+
+type syncIDs struct {
+	Count     int     `json:"count"`
+	IDs       []int64 `json:"ids"`
+	Truncated bool    `json:"truncated,omitempty"`
+}
+
+func newSyncIDs(ids []int64) syncIDs {
+	s := syncIDs{Count: len(ids), IDs: ids}
+	if s.IDs == nil {
+		s.IDs = []int64{}
+	}
+	if len(s.IDs) > debugSyncMaxList {
+		s.IDs, s.Truncated = s.IDs[:debugSyncMaxList], true
+	}
+	return s
+}
+
+type syncReport struct {
+	Device      string        `json:"device"`
+	User        string        `json:"user"`
+	Known       bool          `json:"known"` // the server has a cursor for the device
+	Revoked     bool          `json:"revoked,omitempty"`
+	Cursor      *int64        `json:"cursor"`
+	CursorAt    *string       `json:"cursor_updated_at"`
+	LatestID    int64         `json:"latest_id"`
+	Connections []clientStats `json:"connections"`
+	Behind      syncIDs       `json:"behind"` // visible, unsnoozed, after the cursor
+	Unseen      syncIDs       `json:"unseen"` // visible, unsnoozed, not seen
+
+	// Only with have=.
+	Missing *syncIDs `json:"missing,omitempty"`
+	Unknown *syncIDs `json:"unknown,omitempty"`
+	Snoozed *syncIDs `json:"snoozed,omitempty"` // held by the device, snoozed on the server
+	// Only with unseen=.
+	SeenOnServer   *syncIDs `json:"seen_on_server,omitempty"`   // unseen on the device
+	UnseenOnServer *syncIDs `json:"unseen_on_server,omitempty"` // held and shown as seen on the device
+
+	Findings []string `json:"findings"`
+}
+
+type syncRow struct {
+	id            int64
+	seen, snoozed bool
+}
+
+func handleDebugSync(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		device := q.Get("device")
+		if device == "" {
+			http.Error(w, "device is required", http.StatusBadRequest)
+			return
+		}
+		have, err := parseIDList(q.Get("have"))
+		if err != nil {
+			http.Error(w, "have: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		reportedUnseen, err := parseIDList(q.Get("unseen"))
+		if err != nil {
+			http.Error(w, "unseen: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		rep, err := syncState(h, device, q.Get("user"))
+		if err == nil {
+			err = compareSync(&rep, have, reportedUnseen, q.Has("have"), q.Has("unseen"))
+		}
+		if err != nil {
+			log.Printf("debug sync %q: %v", device, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rep)
+	}
+}
+
+// syncState fills in the server's view of device. user overrides the user
+// the device last acked as.
+func syncState(h *hub, device, user string) (syncReport, error) {
+	rep := syncReport{Device: device, Connections: []clientStats{}}
+	var cursor int64
+	var cursorAt, cursorUser string
+	err := db.QueryRow(`SELECT last_id, updated_at, user, revoked_at IS NOT NULL FROM device_cursors WHERE device = ?`, device).
+		Scan(&cursor, &cursorAt, &cursorUser, &rep.Revoked)
+	switch {
+	case err == nil:
+		rep.Known, rep.Cursor, rep.CursorAt = true, &cursor, &cursorAt
+	case !errors.Is(err, sql.ErrNoRows):
+		return rep, err
+	}
+	rep.User = cmp.Or(user, cursorUser)
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM notifications`).Scan(&rep.LatestID); err != nil {
+		return rep, err
+	}
+
+	h.mu.RLock()
+	for c := range h.clients {
+		if c.device == device {
+			rep.Connections = append(rep.Connections, c.stats())
+			if user == "" && c.user != "" {
+				rep.User = c.user
+			}
+		}
+	}
+	h.mu.RUnlock()
+	slices.SortFunc(rep.Connections, func(a, b clientStats) int { return int(a.ID - b.ID) })
+
+	if !rep.Known {
+		cursor = rep.LatestID // nothing to replay; it starts from the snapshot
+	}
+	var behind, unseen []int64
+	err = syncRows(rep.User, `(id > ? OR seen_at IS NULL) AND snoozed_until IS NULL`, []any{cursor}, func(n syncRow) {
+		if n.id > cursor {
+			behind = append(behind, n.id)
+		}
+		if !n.seen {
+			unseen = append(unseen, n.id)
+		}
+	})
+	rep.Behind, rep.Unseen = newSyncIDs(behind), newSyncIDs(unseen)
+
+	switch {
+	case !rep.Known:
+		rep.Findings = append(rep.Findings, "The server has no cursor for this device: it has never acked, so every connection starts from the history snapshot.")
+	case rep.Behind.Count > 0:
+		rep.Findings = append(rep.Findings, fmt.Sprintf(
+			"Waiting after the cursor (%d, acked %s), to be replayed on the next connect with ?device=: %s.",
+			cursor, cursorAt, idSummary(behind)))
+	}
+	if rep.Revoked {
+		rep.Findings = append(rep.Findings, "The device is revoked: its connections are refused.")
+	}
+	if len(rep.Connections) == 0 {
+		rep.Findings = append(rep.Findings, "No connection with this device name is open.")
+	}
+	for _, c := range rep.Connections {
+		if c.Dropped > 0 {
+			rep.Findings = append(rep.Findings, fmt.Sprintf(
+				"Connection %d has had %d frames dropped because its send buffer was full.", c.ID, c.Dropped))
+		}
+	}
+	return rep, err
+}
+
+// compareSync adds the differences between the device's report and the
+// server's view.
+func compareSync(rep *syncReport, have, reportedUnseen []int64, withHave, withUnseen bool) error {
+	if !withHave && !withUnseen {
+		return nil
+	}
+	held := map[int64]bool{}
+	for _, id := range have {
+		held[id] = true
+	}
+	shownUnseen := map[int64]bool{}
+	for _, id := range reportedUnseen {
+		shownUnseen[id] = true
+	}
+	from := int64(0)
+	if len(have) > 0 {
+		from = have[0]
+	}
+	if withUnseen && len(reportedUnseen) > 0 && (from == 0 || reportedUnseen[0] < from) {
+		from = reportedUnseen[0]
+	}
+
+	var missing, snoozed, seenOnServer, unseenOnServer []int64
+	onServer := map[int64]bool{}
+	err := syncRows(rep.User, `id >= ?`, []any{from}, func(n syncRow) {
+		onServer[n.id] = true
+		switch {
+		case n.snoozed && held[n.id]:
+			snoozed = append(snoozed, n.id)
+		case n.snoozed:
+		case withHave && !held[n.id] && len(have) > 0:
+			missing = append(missing, n.id)
+		}
+		if !withUnseen {
+			return
+		}
+		if n.seen && shownUnseen[n.id] {
+			seenOnServer = append(seenOnServer, n.id)
+		}
+		if !n.seen && !n.snoozed && held[n.id] && !shownUnseen[n.id] {
+			unseenOnServer = append(unseenOnServer, n.id)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	var unknown []int64
+	for _, id := range slices.Concat(have, reportedUnseen) {
+		if !onServer[id] && !slices.Contains(unknown, id) {
+			unknown = append(unknown, id)
+		}
+	}
+	slices.Sort(unknown)
+
+	set := func(ids []int64) *syncIDs { s := newSyncIDs(ids); return &s }
+	if withHave {
+		rep.Missing, rep.Unknown, rep.Snoozed = set(missing), set(unknown), set(snoozed)
+		if len(missing) > 0 {
+			rep.Findings = append(rep.Findings, fmt.Sprintf(
+				"Missing on the device (from id %d on): %s.", from, idSummary(missing)))
+		} else if len(have) > 0 {
+			rep.Findings = append(rep.Findings, fmt.Sprintf("The device has every notification from id %d on.", from))
+		}
+		if len(unknown) > 0 {
+			rep.Findings = append(rep.Findings, fmt.Sprintf(
+				"On the device but not on the server (deleted, merged or archived): %s.", idSummary(unknown)))
+		}
+	}
+	if withUnseen {
+		rep.SeenOnServer, rep.UnseenOnServer = set(seenOnServer), set(unseenOnServer)
+		if len(seenOnServer) > 0 {
+			rep.Findings = append(rep.Findings, fmt.Sprintf(
+				"Unseen on the device but seen on the server, so it missed their seen frames: %s.", idSummary(seenOnServer)))
+		}
+		if len(unseenOnServer) > 0 {
+			rep.Findings = append(rep.Findings, fmt.Sprintf(
+				"Seen on the device but unseen on the server, so its mark-seen calls didn't arrive: %s.", idSummary(unseenOnServer)))
+		}
+	}
+	return nil
+}
+
+// syncRows calls fn, oldest first, for each notification matching where
+// that user may see.
+func syncRows(user, where string, args []any, fn func(syncRow)) error {
+	rows, err := db.Query(`SELECT id, topic, seen_at IS NOT NULL, snoozed_until IS NOT NULL
+		FROM notifications WHERE `+where+` ORDER BY id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n syncRow
+		var topic string
+		if err := rows.Scan(&n.id, &topic, &n.seen, &n.snoozed); err != nil {
+			return err
+		}
+		if canSee(user, topic) {
+			fn(n)
+		}
+	}
+	return rows.Err()
+}
+
+// parseIDList reads "1-40,42,45" into sorted, distinct ids.
+func parseIDList(s string) ([]int64, error) {
+	var ids []int64
+	for _, part := range splitList(s) {
+		lo, hi, isRange := strings.Cut(part, "-")
+		a, err := strconv.ParseInt(lo, 10, 64)
+		b := a
+		if err == nil && isRange {
+			b, err = strconv.ParseInt(hi, 10, 64)
+		}
+		if err != nil || a < 1 || b < a {
+			return nil, fmt.Errorf("%q is not an id or id range", part)
+		}
+		if b-a >= debugSyncMaxIDs || len(ids)+int(b-a) >= debugSyncMaxIDs {
+			return nil, fmt.Errorf("more than %d ids", debugSyncMaxIDs)
+		}
+		for id := a; id <= b; id++ {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids), nil
+}
+
+// idSummary shows ids as ranges, the first few of them.
+func idSummary(ids []int64) string {
+	var parts []string
+	for i := 0; i < len(ids); {
+		j := i
+		for j+1 < len(ids) && ids[j+1] == ids[j]+1 {
+			j++
+		}
+		if len(parts) == 10 {
+			parts = append(parts, "…")
+			break
+		}
+		if i == j {
+			parts = append(parts, strconv.FormatInt(ids[i], 10))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", ids[i], ids[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}
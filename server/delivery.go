@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// ── Delivery Guarantees ───────────────────────────────────────────────────────
+//
+// A notification is committed to the database before it is broadcast, and its
+// id is assigned by AUTOINCREMENT, so ids only grow and are never reused. That
+// makes the notifications table the outbox and the id the sequence number:
+// whatever a client missed — a dropped connection, a full send buffer, a
+// server killed between commit and broadcast — is still there, in order.
+//
+// A client that remembers the highest id it has stored reconnects with
+// ?since=<id> and gets everything after it as one "notifications" frame
+// instead of the usual history snapshot. With ?device=<name> the server keeps
+// that cursor itself: the client sends {"type":"ack","id":N} once it has
+// stored up to N, and later connections with the same device name resume
+// from there. Delivery to a socket is at-least-once — a notification
+// committed while a client connects can arrive both in the replay and live —
+// so clients drop ids they already have. That gives each device every
+// notification exactly once, and sorting by id gives every client the same
+// timeline however its copies arrived. Push channels are at-least-once as
+// well, through the outbox in outbox.go.
+//
+// If more than wsReplayMax are missing the client gets the history snapshot
+// instead, as a fresh client would.
+//
+// GET /admin/devices lists the devices with their cursor and the credential
+// they last acked with. PATCH /admin/devices/{device} sets a label or revokes
+// the device name — its connections are closed with 4401 and new ones are
+// refused with 403 — and DELETE forgets the device and its cursor. A device
+// name isn't a secret, so to lock a device out for good also revoke its
+// token.
+
+const wsReplayMax = 1000
+
+func initDeliveryTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS device_cursors (
+			device     TEXT PRIMARY KEY,
+			user       TEXT NOT NULL DEFAULT '',
+			last_id    INTEGER NOT NULL,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, _ = db.Exec(`ALTER TABLE device_cursors ADD COLUMN auth TEXT NOT NULL DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE device_cursors ADD COLUMN label TEXT NOT NULL DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE device_cursors ADD COLUMN revoked_at DATETIME`)
+	return nil
+}
+
+// deviceRevoked reports whether device has been revoked.
+func deviceRevoked(device string) bool {
+	var revoked bool
+	db.QueryRow(`SELECT revoked_at IS NOT NULL FROM device_cursors WHERE device = ?`, device).Scan(&revoked)
+	return revoked
+}
+
+// replayStart resolves where a connecting client resumes: ?since= if given,
+// else the stored cursor of ?device=. ok is false for a fresh client.
+func replayStart(r *http.Request) (since int64, ok bool, err error) {
+	if s := r.URL.Query().Get("since"); s != "" {
+		since, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || since < 0 {
+			return 0, false, errors.New("since must be a notification id")
+		}
+		return since, true, nil
+	}
+	device := r.URL.Query().Get("device")
+	if device == "" {
+		return 0, false, nil
+	}
+	err = db.QueryRow(`SELECT last_id FROM device_cursors WHERE device = ?`, device).Scan(&since)
+	if err != nil {
+		return 0, false, nil // unknown device: start fresh
+	}
+	return since, true, nil
+}
+
+// notificationsSince returns up to limit notifications after id, oldest
+// first.
+func notificationsSince(id int64, limit int) ([]Notification, error) {
+	rows, err := db.Query(`SELECT `+notificationCols+` FROM notifications WHERE id > ? AND snoozed_until IS NULL ORDER BY id LIMIT ?`, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ns []Notification
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+	return ns, rows.Err()
+}
+
+// ackCursor moves a device's cursor forward to id; it never moves back.
+func ackCursor(device, user, auth string, id int64) {
+	if _, err := db.Exec(`
+		INSERT INTO device_cursors (device, user, auth, last_id) VALUES (?, ?, ?, ?)
+		ON CONFLICT(device) DO UPDATE SET user = excluded.user, auth = excluded.auth,
+			updated_at = CURRENT_TIMESTAMP, last_id = MAX(last_id, excluded.last_id)
+	`, device, user, auth, id); err != nil {
+		log.Printf("ws: ack from %s: %v", device, err)
+	}
+}
+
+type deviceCursor struct {
+	Device    string  `json:"device"`
+	User      string  `json:"user,omitempty"`
+	Auth      string  `json:"auth,omitempty"` // credential id of its last ack
+	Label     string  `json:"label,omitempty"`
+	LastID    int64   `json:"last_id"`
+	Behind    int     `json:"behind"` // notifications stored after last_id
+	UpdatedAt string  `json:"updated_at"`
+	RevokedAt *string `json:"revoked_at,omitempty"`
+}
+
+// handleDevices lists the stored device cursors and how far behind each is.
+func handleDevices() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rows, err := db.Query(`
+			SELECT d.device, d.user, d.auth, d.label, d.last_id, d.updated_at, d.revoked_at,
+				(SELECT COUNT(*) FROM notifications n WHERE n.id > d.last_id)
+			FROM device_cursors d ORDER BY d.device`)
+		if err != nil {
+			log.Printf("devices: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		out := []deviceCursor{}
+		for rows.Next() {
+			var d deviceCursor
+			if err := rows.Scan(&d.Device, &d.User, &d.Auth, &d.Label, &d.LastID, &d.UpdatedAt, &d.RevokedAt, &d.Behind); err != nil {
+				log.Printf("devices: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, d)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// handleDevice labels or revokes (PATCH) or forgets (DELETE) a device.
+func handleDevice(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		device, by := r.PathValue("device"), authFrom(r).ID
+		closeIt := false
+		switch r.Method {
+		case http.MethodPatch:
+			var body struct {
+				Label   *string `json:"label"`
+				Revoked *bool   `json:"revoked"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || (body.Label == nil && body.Revoked == nil) {
+				http.Error(w, `body must set "label" and/or "revoked"`, http.StatusBadRequest)
+				return
+			}
+			// A device can be labelled or revoked before it has acked anything.
+			_, err := db.Exec(`INSERT INTO device_cursors (device, last_id) VALUES (?, 0) ON CONFLICT(device) DO NOTHING`, device)
+			if err == nil && body.Label != nil {
+				_, err = db.Exec(`UPDATE device_cursors SET label = ? WHERE device = ?`, *body.Label, device)
+			}
+			if err == nil && body.Revoked != nil {
+				_, err = db.Exec(`UPDATE device_cursors SET revoked_at = CASE WHEN ? THEN COALESCE(revoked_at, CURRENT_TIMESTAMP) END WHERE device = ?`,
+					*body.Revoked, device)
+				closeIt = *body.Revoked
+				action := "device-restore"
+				if closeIt {
+					action = "device-revoke"
+				}
+				audit(by, action, device, "")
+			}
+			if err != nil {
+				log.Printf("device %q: %v", device, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+		case http.MethodDelete:
+			res, err := db.Exec(`DELETE FROM device_cursors WHERE device = ?`, device)
+			if err != nil {
+				log.Printf("device %q: %v", device, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			audit(by, "device-forget", device, "")
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if closeIt {
+			n := h.closeWhere(func(c *client) bool { return c.device == device }, api.CloseTokenExpired, "device revoked")
+			log.Printf("device %q: revoked by %s; %d clients closed", device, by, n)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
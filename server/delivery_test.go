@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// restartableDB opens the database at path, as a process starting up would.
+func restartableDB(t *testing.T, path string) {
+	t.Helper()
+	if err := initDB(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// wsDevice is a connected app: it acks every notification it stores and
+// keeps every id it was sent, duplicates included.
+type wsDevice struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+	got  []int64
+	done chan struct{}
+}
+
+func dialDevice(t *testing.T, srv *httptest.Server, device string) *wsDevice {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?token=T&device=" + device
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%w: %s", err, resp.Status)
+		}
+		t.Fatal(err)
+	}
+	d := &wsDevice{conn: conn, done: make(chan struct{})}
+	go d.read()
+	return d
+}
+
+func (d *wsDevice) read() {
+	defer close(d.done)
+	for {
+		_, data, err := d.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var m wsMessage
+		if json.Unmarshal(data, &m) != nil {
+			continue
+		}
+		var ids []int64
+		switch m.Type {
+		case api.TypeNotification:
+			ids = []int64{m.ID}
+		case api.TypeNotifications:
+			for _, n := range m.Notifications {
+				ids = append(ids, n.ID)
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		d.mu.Lock()
+		d.got = append(d.got, ids...)
+		d.mu.Unlock()
+		d.conn.WriteJSON(wsMessage{Type: api.TypeAck, ID: ids[len(ids)-1]})
+	}
+}
+
+// ids returns the ids d was sent, in order.
+func (d *wsDevice) ids() []int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]int64(nil), d.got...)
+}
+
+// covers reports whether ids include every id in want.
+func covers(ids, want []int64) bool {
+	seen := map[int64]bool{}
+	for _, id := range ids {
+		seen[id] = true
+	}
+	for _, id := range want {
+		if !seen[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestDeliveryAcrossRestart stops the server partway through publishing,
+// with some notifications stored but never broadcast and acks possibly lost,
+// and checks that each device gets every notification once it reconnects to
+// the restarted server. Replay may repeat one the device already has; the
+// app drops those by id.
+func TestDeliveryAcrossRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifications.db")
+	restartableDB(t, path)
+	primaryToken.Lock()
+	primaryToken.current = "T"
+	primaryToken.Unlock()
+	t.Cleanup(func() {
+		primaryToken.Lock()
+		primaryToken.current = ""
+		primaryToken.Unlock()
+	})
+	// Every device dials from the same address.
+	attempts, perIP := *flagWSAttemptsPerIP, *flagWSMaxPerIP
+	*flagWSAttemptsPerIP, *flagWSMaxPerIP = 0, 0
+	t.Cleanup(func() { *flagWSAttemptsPerIP, *flagWSMaxPerIP = attempts, perIP })
+
+	h := testHub(t)
+	srv := httptest.NewServer(handleWS(h))
+	devices := []string{"pixel", "tablet"}
+	var clients []*wsDevice
+	for _, name := range devices {
+		clients = append(clients, dialDevice(t, srv, name))
+	}
+	waitFor(t, "the devices to connect", func() bool { return h.connectedCount() == len(devices) })
+
+	var want []int64
+	for i := range 4 {
+		n, err := insertNotification(Notification{Title: fmt.Sprintf("before %d", i), Priority: priorityDefault})
+		if err != nil {
+			t.Fatal(err)
+		}
+		broadcastNotification(h, n)
+		want = append(want, n.ID)
+	}
+	for _, d := range clients {
+		waitFor(t, "the first notifications", func() bool { return covers(d.ids(), want) })
+	}
+	// Killed between storing these and broadcasting them.
+	for i := range 3 {
+		n, err := insertNotification(Notification{Title: fmt.Sprintf("stored %d", i), Priority: priorityDefault})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, n.ID)
+	}
+	// The connections drop with the process; acks in flight are lost.
+	for _, d := range clients {
+		d.conn.Close()
+		<-d.done
+	}
+	waitFor(t, "the devices to disconnect", func() bool { return h.connectedCount() == 0 })
+	srv.Close()
+	db.Close()
+
+	restartableDB(t, path)
+	t.Cleanup(func() { db.Close() })
+	h = testHub(t)
+	srv = httptest.NewServer(handleWS(h))
+	defer srv.Close()
+	// What each device stored before the restart.
+	stored := make([][]int64, len(clients))
+	for i, name := range devices {
+		stored[i] = clients[i].ids()
+		clients[i] = dialDevice(t, srv, name)
+		defer clients[i].conn.Close()
+	}
+	n, err := insertNotification(Notification{Title: "after", Priority: priorityDefault})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broadcastNotification(h, n)
+	want = append(want, n.ID)
+
+	for i, d := range clients {
+		all := func() []int64 { return append(slices.Clone(stored[i]), d.ids()...) }
+		waitFor(t, devices[i]+" to catch up", func() bool { return covers(all(), want) })
+		kept := map[int64]bool{}
+		for _, id := range all() {
+			kept[id] = true
+		}
+		if len(kept) != len(want) {
+			t.Errorf("%s stored %d notifications, want %d", devices[i], len(kept), len(want))
+		}
+	}
+}
+
+// TestFanOutAcrossRestart kills the server after it stored notifications
+// but before it queued their deliveries, and while a worker held a lease on
+// one that was queued. After a restart every target gets every
+// notification at least once.
+func TestFanOutAcrossRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifications.db")
+	restartableDB(t, path)
+
+	var mu sync.Mutex
+	delivered := map[string]int{}
+	saved := outChannels
+	outChannels = []outChannel{{
+		name:    "test",
+		targets: func(*hub, Notification) ([]string, error) { return []string{"a", "b"}, nil },
+		deliver: func(target string, n Notification) error {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered[fmt.Sprintf("%d/%s", n.ID, target)]++
+			return nil
+		},
+	}}
+	t.Cleanup(func() { outChannels = saved })
+
+	h := testHub(t)
+	var ids []int64
+	for i := range 2 {
+		n, err := insertNotification(Notification{Title: fmt.Sprintf("queued %d", i), Priority: priorityDefault})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fanOut(h, n)
+		ids = append(ids, n.ID)
+	}
+	// A worker claimed a delivery and was killed before sending it.
+	if claimed, err := claimDeliveries(1); err != nil || len(claimed) != 1 {
+		t.Fatalf("claimDeliveries = %v, %v", claimed, err)
+	}
+	// Killed between storing these and fanning them out.
+	for i := range 2 {
+		n, err := insertNotification(Notification{Title: fmt.Sprintf("stored %d", i), Priority: priorityDefault})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, n.ID)
+	}
+	db.Close()
+
+	restartableDB(t, path)
+	t.Cleanup(func() { db.Close() })
+	// As if the lease and the grace period ran out.
+	if _, err := db.Exec(`UPDATE deliveries SET lease_until = ? WHERE lease_until IS NOT NULL`,
+		sqliteTime(time.Now().Add(-time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	h = testHub(t)
+	if err := recoverFanOut(h, 0); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		due, err := claimDeliveries(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(due) == 0 {
+			break
+		}
+		for _, d := range due {
+			runDelivery(d)
+		}
+	}
+
+	for _, id := range ids {
+		for _, target := range []string{"a", "b"} {
+			if key := fmt.Sprintf("%d/%s", id, target); delivered[key] == 0 {
+				t.Errorf("id=%d never delivered to %s", id, target)
+			}
+		}
+	}
+	var pending int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM fanout_pending`).Scan(&pending); err != nil {
+		t.Fatal(err)
+	}
+	if pending != 0 {
+		t.Errorf("%d notifications still waiting for fan-out", pending)
+	}
+	// Recovered once: a second pass has nothing to do.
+	if err := recoverFanOut(h, 0); err != nil {
+		t.Fatal(err)
+	}
+	if due, _ := claimDeliveries(10); len(due) != 0 {
+		t.Errorf("%d deliveries queued again", len(due))
+	}
+}
+
+// TestFanOutKeepsMarkerOnTargetError checks that a channel whose targets
+// can't be listed leaves the notification for recovery instead of dropping
+// its deliveries.
+func TestFanOutKeepsMarkerOnTargetError(t *testing.T) {
+	testDB(t)
+	failing := true
+	var delivered []string
+	saved := outChannels
+	outChannels = []outChannel{{
+		name: "test",
+		targets: func(*hub, Notification) ([]string, error) {
+			if failing {
+				return nil, errors.New("database is locked")
+			}
+			return []string{"a"}, nil
+		},
+		deliver: func(target string, n Notification) error {
+			delivered = append(delivered, fmt.Sprintf("%d/%s", n.ID, target))
+			return nil
+		},
+	}}
+	t.Cleanup(func() { outChannels = saved })
+
+	h := testHub(t)
+	n, err := insertNotification(Notification{Title: "t", Priority: priorityDefault})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fanOut(h, n)
+	var pending int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM fanout_pending`).Scan(&pending); err != nil {
+		t.Fatal(err)
+	}
+	if pending != 1 {
+		t.Fatalf("fan-out marker cleared after a target error (%d pending)", pending)
+	}
+
+	failing = false
+	if err := recoverFanOut(h, 0); err != nil {
+		t.Fatal(err)
+	}
+	due, err := claimDeliveries(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range due {
+		runDelivery(d)
+	}
+	if want := []string{fmt.Sprintf("%d/a", n.ID)}; !slices.Equal(delivered, want) {
+		t.Errorf("delivered %v, want %v", delivered, want)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ── Delivery Status ───────────────────────────────────────────────────────────
+//
+// GET /notifications/{id}/deliveries answers "I never got that alert": one
+// entry per WebSocket device or connection and per push target, each
+// pending, delivered, acked or failed.
+//
+// For WebSocket clients the hub records every notification frame it hands
+// to a connection (delivered) or loses because the connection's send buffer
+// was full (failed), with the connection's device name, user and address. A
+// device whose cursor has reached the notification is acked, however it got
+// there; a known device that hasn't, and didn't get it live, is pending — it
+// is replayed when the device reconnects. Revoked devices, and those whose
+// user can't see the topic, are left out.
+//
+// Push targets show their row in the delivery queue: pending while queued or
+// being retried, delivered once sent, failed when dead-lettered, with the
+// attempts and the last error.
+//
+// The hub never waits on the database for this: records go through a buffer
+// to a writer that inserts them in batches, and are dropped if it falls
+// that far behind. They are deleted with their notification, or by
+// the delivery-prune job after wsDeliveryTTL.
+
+const (
+	wsDeliveryTTL    = 30 * 24 * time.Hour
+	wsDeliveryBuffer = 4096
+	wsDeliveryBatch  = 500
+	wsDeliveryFlush  = time.Second
+
+	statusPending   = "pending"
+	statusDelivered = "delivered"
+	statusAcked     = "acked"
+	statusFailed    = "failed"
+)
+
+type wsDeliveryRecord struct {
+	notificationID int64
+	clientID       int64
+	device         string
+	user           string
+	remote         string
+	state          string
+	detail         string
+	at             time.Time
+}
+
+var (
+	wsDeliveryLog  = make(chan wsDeliveryRecord, wsDeliveryBuffer)
+	wsDeliveryLost atomic.Int64
+)
+
+func initDeliveryStatusTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS ws_deliveries (
+			notification_id INTEGER NOT NULL REFERENCES notifications(id) ON DELETE CASCADE,
+			client_id       INTEGER NOT NULL,
+			device          TEXT NOT NULL DEFAULT '',
+			user            TEXT NOT NULL DEFAULT '',
+			remote          TEXT NOT NULL DEFAULT '',
+			state           TEXT NOT NULL,
+			detail          TEXT NOT NULL DEFAULT '',
+			at              DATETIME NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_ws_deliveries_notification ON ws_deliveries(notification_id)`)
+	return err
+}
+
+// logWSDelivery records what happened to the notifications ids in a frame
+// for client c. It is called from the hub loop and never blocks.
+func logWSDelivery(ids []int64, c *client, state, detail string) {
+	now := time.Now()
+	for _, id := range ids {
+		select {
+		case wsDeliveryLog <- wsDeliveryRecord{id, c.id, c.device, c.user, c.ip, state, detail, now}:
+		default:
+			if wsDeliveryLost.Add(1) == 1 {
+				log.Printf("delivery status: writer behind, dropping records")
+			}
+		}
+	}
+}
+
+// startWSDeliveryLog starts the writer that stores logged records.
+func startWSDeliveryLog() {
+	go func() {
+		var batch []wsDeliveryRecord
+		ticker := time.NewTicker(wsDeliveryFlush)
+		for {
+			select {
+			case r := <-wsDeliveryLog:
+				if batch = append(batch, r); len(batch) < wsDeliveryBatch {
+					continue
+				}
+			case <-ticker.C:
+				if len(batch) == 0 {
+					continue
+				}
+			}
+			if err := writeWSDeliveries(batch); err != nil {
+				log.Printf("delivery status: %v", err)
+			}
+			batch = batch[:0]
+		}
+	}()
+}
+
+func writeWSDeliveries(batch []wsDeliveryRecord) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// The notification may have been deleted since it was broadcast.
+	stmt, err := tx.Prepare(`INSERT INTO ws_deliveries (notification_id, client_id, device, user, remote, state, detail, at)
+		SELECT id, ?, ?, ?, ?, ?, ?, ? FROM notifications WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range batch {
+		if _, err := stmt.Exec(r.clientID, r.device, r.user, r.remote, r.state, r.detail, sqliteTime(r.at), r.notificationID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ── Handler ──
+
+type deliveryStatus struct {
+	Channel    string `json:"channel"`
+	Target     string `json:"target"` // device, "client <id>", subscription id, device token, connector or user key
+	User       string `json:"user,omitempty"`
+	Remote     string `json:"remote,omitempty"`
+	State      string `json:"state"`
+	Attempts   int    `json:"attempts,omitempty"`
+	Error      string `json:"error,omitempty"`
+	At         string `json:"at"`
+	DeliveryID int64  `json:"delivery_id,omitempty"` // push: the row in /admin/deliveries
+}
+
+// stateRank orders WebSocket states so a device connected twice shows its
+// best outcome.
+var stateRank = map[string]int{statusFailed: 0, statusDelivered: 1}
+
+func handleNotificationDeliveries() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		n, err := getNotification(id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("deliveries of %d: %v", id, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		out, err := wsDeliveryStatus(n)
+		if err == nil {
+			var push []deliveryStatus
+			push, err = pushDeliveryStatus(id)
+			out = append(out, push...)
+		}
+		if err != nil {
+			log.Printf("deliveries of %d: %v", id, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"notification_id": id, "deliveries": out})
+	}
+}
+
+// wsDeliveryStatus merges the hub's records for n with the device cursors.
+func wsDeliveryStatus(n Notification) ([]deliveryStatus, error) {
+	rows, err := db.Query(`SELECT client_id, device, user, remote, state, detail, at FROM ws_deliveries
+		WHERE notification_id = ? ORDER BY at, client_id`, n.ID)
+	if err != nil {
+		return nil, err
+	}
+	out := []deliveryStatus{}
+	devices := map[string]int{} // device → index in out
+	for rows.Next() {
+		var clientID int64
+		var device string
+		var s deliveryStatus
+		if err := rows.Scan(&clientID, &device, &s.User, &s.Remote, &s.State, &s.Error, &s.At); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		s.Channel, s.Target = channelWebSocket, device
+		if device == "" {
+			s.Target = "client " + strconv.FormatInt(clientID, 10)
+			out = append(out, s)
+			continue
+		}
+		if i, ok := devices[device]; ok {
+			if stateRank[s.State] >= stateRank[out[i].State] {
+				out[i] = s
+			}
+			continue
+		}
+		devices[device] = len(out)
+		out = append(out, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`SELECT device, user, last_id, updated_at FROM device_cursors WHERE revoked_at IS NULL ORDER BY device`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var device, user, at string
+		var lastID int64
+		if err := rows.Scan(&device, &user, &lastID, &at); err != nil {
+			return nil, err
+		}
+		if !canSee(user, n.Topic) {
+			continue
+		}
+		i, ok := devices[device]
+		switch {
+		case lastID >= n.ID && ok:
+			out[i].State, out[i].Error, out[i].At = statusAcked, "", at
+		case lastID >= n.ID:
+			out = append(out, deliveryStatus{Channel: channelWebSocket, Target: device, User: user, State: statusAcked, At: at})
+		case !ok:
+			out = append(out, deliveryStatus{Channel: channelWebSocket, Target: device, User: user, State: statusPending, At: at})
+		}
+	}
+	return out, rows.Err()
+}
+
+// pushDeliveryStatus lists n's rows in the delivery queue.
+func pushDeliveryStatus(id int64) ([]deliveryStatus, error) {
+	rows, err := db.Query(`SELECT id, channel, target, state, attempts, last_error, updated_at FROM deliveries
+		WHERE notification_id = ? ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []deliveryStatus
+	for rows.Next() {
+		var s deliveryStatus
+		if err := rows.Scan(&s.DeliveryID, &s.Channel, &s.Target, &s.State, &s.Attempts, &s.Error, &s.At); err != nil {
+			return nil, err
+		}
+		switch s.State {
+		case deliverySent:
+			s.State = statusDelivered
+		case deliveryDead:
+			s.State = statusFailed
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
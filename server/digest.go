@@ -0,0 +1,217 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ── Digests ───────────────────────────────────────────────────────────────────
+//
+// A routing rule with a "digest" window turns a chatty source — a CI system
+// posting hundreds of events a run — into one notification per window. The
+// first matching event opens a window for that rule and source; events are
+// held (in the database, so a restart doesn't lose them) until it closes,
+// then published as one notification with the count, the time span and the
+// distinct titles, most frequent first. It takes the highest priority and
+// the latest topic among them, and requires an ack if any of them did. A
+// window that caught a single event publishes that event unchanged. Since
+// rules can match on source, each ingest source can get its own window.
+// Held events are encrypted at rest like the notifications they become.
+
+const (
+	digestCheck     = 5 * time.Second
+	digestMaxWindow = 24 * time.Hour
+	digestTitles    = 20 // distinct titles listed before "… and N more titles"
+)
+
+func initDigestTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS digest_pending (
+			id      INTEGER PRIMARY KEY AUTOINCREMENT,
+			rule    TEXT NOT NULL,
+			source  TEXT NOT NULL,
+			due_at  DATETIME NOT NULL,
+			held_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			body    TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_digest_pending_key ON digest_pending (rule, source)
+	`)
+	return err
+}
+
+// holdForDigest adds n to the open window of rule for its source, opening
+// one if there is none. It returns how many events the window now holds and
+// when it closes.
+func holdForDigest(rule *routeRule, n Notification) (int, time.Time, error) {
+	body, _ := json.Marshal(n)
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer tx.Rollback()
+	var due string
+	if err := tx.QueryRow(
+		`SELECT COALESCE(MIN(due_at), ?) FROM digest_pending WHERE rule = ? AND source = ?`,
+		sqliteTime(time.Now().Add(rule.window)), rule.Name, n.Source,
+	).Scan(&due); err != nil {
+		return 0, time.Time{}, err
+	}
+	at, err := parseSQLiteTime(due)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO digest_pending (rule, source, due_at, body) VALUES (?, ?, ?, ?)`,
+		rule.Name, n.Source, sqliteTime(at), sealColumn("body", string(body)),
+	); err != nil {
+		return 0, time.Time{}, err
+	}
+	var count int
+	if err := tx.QueryRow(
+		`SELECT COUNT(*) FROM digest_pending WHERE rule = ? AND source = ?`, rule.Name, n.Source,
+	).Scan(&count); err != nil {
+		return 0, time.Time{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, time.Time{}, err
+	}
+	return count, at, nil
+}
+
+// startDigestFlusher publishes digests whose window has closed.
+func startDigestFlusher(h *hub) {
+	ticker := time.NewTicker(digestCheck)
+	for range ticker.C {
+		rows, err := db.Query(`
+			SELECT rule, source FROM digest_pending
+			GROUP BY rule, source HAVING MIN(due_at) <= ?`, sqliteTime(time.Now()))
+		if err != nil {
+			log.Printf("digest: %v", err)
+			continue
+		}
+		var due [][2]string
+		for rows.Next() {
+			var key [2]string
+			if rows.Scan(&key[0], &key[1]) == nil {
+				due = append(due, key)
+			}
+		}
+		rows.Close()
+		for _, key := range due {
+			if err := flushDigest(h, key[0], key[1]); err != nil {
+				log.Printf("digest: %s/%s: %v", key[0], key[1], err)
+			}
+		}
+	}
+}
+
+type heldEvent struct {
+	id     int64
+	heldAt string
+	n      Notification
+}
+
+// flushDigest takes everything held for rule and source and publishes it.
+// The delete claims the events, so a second process flushing at the same
+// time (during a handoff) finds nothing.
+func flushDigest(h *hub, rule, source string) error {
+	rows, err := db.Query(`DELETE FROM digest_pending WHERE rule = ? AND source = ? RETURNING id, held_at, body`, rule, source)
+	if err != nil {
+		return err
+	}
+	var events []heldEvent
+	for rows.Next() {
+		var e heldEvent
+		var body string
+		if err := rows.Scan(&e.id, &e.heldAt, &body); err != nil {
+			rows.Close()
+			return err
+		}
+		plain, err := openColumn("body", body)
+		if err == nil {
+			err = json.Unmarshal([]byte(plain), &e.n)
+		}
+		if err != nil {
+			log.Printf("digest: %s/%s: dropping unreadable event %d: %v", rule, source, e.id, err)
+			continue
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].id < events[j].id })
+	n, err := publish(context.Background(), h, digestOf(events))
+	if err != nil {
+		return err
+	}
+	if len(events) > 1 {
+		if err := keepDigestEvents(n.ID, events); err != nil {
+			log.Printf("digest: id=%d: keeping events for a split: %v", n.ID, err)
+		}
+	}
+	log.Printf("digest: id=%d rule=%q source=%q events=%d", n.ID, rule, source, len(events))
+	return nil
+}
+
+// digestOf folds held events, oldest first, into one notification.
+func digestOf(events []heldEvent) Notification {
+	if len(events) == 1 {
+		return events[0].n
+	}
+	last := events[len(events)-1].n
+	d := Notification{Source: last.Source, Topic: last.Topic}
+	for _, e := range events {
+		d.Priority = max(d.Priority, e.n.Priority)
+		d.RequireAck = d.RequireAck || e.n.RequireAck
+	}
+	who := cmp.Or(last.Source, last.Topic)
+	d.Title = fmt.Sprintf("%s: %d events", who, len(events))
+	d.Text = fmt.Sprintf("%d events from %s between %s and %s UTC.\n", len(events), who,
+		clockOf(events[0].heldAt), clockOf(events[len(events)-1].heldAt)) + titleSummary(events)
+	return d
+}
+
+// titleSummary lists the distinct titles of events, most frequent first,
+// one line each.
+func titleSummary(events []heldEvent) string {
+	counts := map[string]int{}
+	var titles []string
+	for _, e := range events {
+		line, _, _ := strings.Cut(e.n.Text, "\n")
+		title := cmp.Or(e.n.Title, line) // untitled events by their first line
+		if counts[title] == 0 {
+			titles = append(titles, title)
+		}
+		counts[title]++
+	}
+	sort.SliceStable(titles, func(i, j int) bool { return counts[titles[i]] > counts[titles[j]] })
+
+	var b strings.Builder
+	for i, t := range titles {
+		if i == digestTitles {
+			fmt.Fprintf(&b, "\n… and %d more titles", len(titles)-i)
+			break
+		}
+		fmt.Fprintf(&b, "\n%d× %s", counts[t], t)
+	}
+	return b.String()
+}
+
+// clockOf shortens a stored timestamp to its time of day.
+func clockOf(ts string) string {
+	if i := strings.IndexAny(ts, " T"); i >= 0 && len(ts) >= i+9 {
+		return ts[i+1 : i+9]
+	}
+	return ts
+}
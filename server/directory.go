@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ── Users & Topic ACLs ────────────────────────────────────────────────────────
+//
+// Users are either managed locally through the API or synced from LDAP/AD.
+// A topic with ACL entries is only delivered to WebSocket clients whose
+// ?user= belongs to one of the listed groups; topics without entries are open
+// to everyone. /history and /export apply the same ACLs to the credential's
+// user (a JWT's sub, a certificate's CN, a managed token's user). Only a
+// full-scope credential that names no user reads past them: it can edit
+// users and ACLs anyway.
+
+type user struct {
+	Name        string   `json:"name"`
+	DisplayName string   `json:"display_name"`
+	Email       string   `json:"email"`
+	Groups      []string `json:"groups"`
+	Origin      string   `json:"origin"` // "local" or "ldap"
+	SyncedAt    *string  `json:"synced_at,omitempty"`
+}
+
+// directory is an in-memory copy of users' groups and topic ACLs, consulted
+// on every broadcast. Reloaded whenever either table changes.
+var directory = struct {
+	sync.RWMutex
+	groups map[string]map[string]bool // user → set of groups
+	acls   map[string][]string        // topic → allowed groups
+}{}
+
+func initDirectoryTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS users (
+			name         TEXT PRIMARY KEY,
+			display_name TEXT NOT NULL DEFAULT '',
+			email        TEXT NOT NULL DEFAULT '',
+			groups       TEXT NOT NULL DEFAULT '',
+			origin       TEXT NOT NULL DEFAULT 'local',
+			synced_at    DATETIME
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS topic_acls (
+			topic TEXT NOT NULL,
+			grp   TEXT NOT NULL,
+			PRIMARY KEY (topic, grp)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	return reloadDirectory()
+}
+
+func reloadDirectory() error {
+	groups := map[string]map[string]bool{}
+	rows, err := db.Query(`SELECT name, groups FROM users`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name, gs string
+		if err := rows.Scan(&name, &gs); err != nil {
+			rows.Close()
+			return err
+		}
+		set := map[string]bool{}
+		for _, g := range splitList(gs) {
+			set[g] = true
+		}
+		groups[name] = set
+	}
+	rows.Close()
+
+	acls := map[string][]string{}
+	rows, err = db.Query(`SELECT topic, grp FROM topic_acls`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var topic, grp string
+		if err := rows.Scan(&topic, &grp); err != nil {
+			rows.Close()
+			return err
+		}
+		acls[topic] = append(acls[topic], grp)
+	}
+	rows.Close()
+
+	directory.Lock()
+	directory.groups, directory.acls = groups, acls
+	directory.Unlock()
+	return nil
+}
+
+// canSee reports whether a WebSocket client identified as username may
+// receive notifications on topic.
+func canSee(username, topic string) bool {
+	directory.RLock()
+	defer directory.RUnlock()
+	allowed, restricted := directory.acls[topic]
+	if !restricted {
+		return true
+	}
+	for _, g := range allowed {
+		if directory.groups[username][g] {
+			return true
+		}
+	}
+	return false
+}
+
+// seesAllTopics reports whether a reads past topic ACLs.
+func (a authInfo) seesAllTopics() bool {
+	return a.Scope == scopeFull && a.User == ""
+}
+
+// hiddenTopics lists the ACL'd topics a may not read over REST.
+func hiddenTopics(a authInfo) []string {
+	if a.seesAllTopics() {
+		return nil
+	}
+	directory.RLock()
+	defer directory.RUnlock()
+	var hidden []string
+	for topic, allowed := range directory.acls {
+		if !slices.ContainsFunc(allowed, func(g string) bool { return directory.groups[a.User][g] }) {
+			hidden = append(hidden, topic)
+		}
+	}
+	return hidden
+}
+
+// topicFilter is the SQL condition, with its arguments, that leaves out
+// hidden topics; empty when nothing is hidden.
+func topicFilter(hidden []string) (string, []any) {
+	if len(hidden) == 0 {
+		return "", nil
+	}
+	args := make([]any, len(hidden))
+	for i, t := range hidden {
+		args[i] = t
+	}
+	return ` AND topic NOT IN (` + placeholders(len(hidden)) + `)`, args
+}
+
+func listUsers() ([]user, error) {
+	rows, err := db.Query(`SELECT name, display_name, email, groups, origin, synced_at FROM users ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []user{}
+	for rows.Next() {
+		var u user
+		var gs string
+		if err := rows.Scan(&u.Name, &u.DisplayName, &u.Email, &gs, &u.Origin, &u.SyncedAt); err != nil {
+			return nil, err
+		}
+		u.Groups = splitList(gs)
+		if u.Groups == nil {
+			u.Groups = []string{}
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+// ── LDAP Sync ─────────────────────────────────────────────────────────────────
+
+var ldapSyncMu sync.Mutex
+
+// syncLDAP replaces all ldap-origin users with the current directory
+// contents. Local users are never touched.
+func syncLDAP() (int, error) {
+	ldapSyncMu.Lock()
+	defer ldapSyncMu.Unlock()
+
+	if *flagLDAPURL == "" {
+		return 0, errors.New("ldap sync not configured (--ldap-url)")
+	}
+	password := ""
+	if *flagLDAPPasswordFile != "" {
+		raw, err := os.ReadFile(*flagLDAPPasswordFile)
+		if err != nil {
+			return 0, err
+		}
+		password = strings.TrimSpace(string(raw))
+	}
+
+	conn, err := dialLDAP(*flagLDAPURL, *flagLDAPStartTLS, 30*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if *flagLDAPBindDN != "" {
+		if err := conn.Bind(*flagLDAPBindDN, password); err != nil {
+			return 0, err
+		}
+	}
+	entries, err := conn.Search(*flagLDAPBaseDN, *flagLDAPFilter,
+		[]string{*flagLDAPUserAttr, "displayName", "cn", "mail", *flagLDAPGroupAttr})
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM users WHERE origin = 'ldap'`); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		name := e.firstAttr(*flagLDAPUserAttr)
+		if name == "" {
+			continue
+		}
+		display := e.firstAttr("displayName")
+		if display == "" {
+			display = e.firstAttr("cn")
+		}
+		var groups []string
+		for _, g := range e.Attrs[strings.ToLower(*flagLDAPGroupAttr)] {
+			groups = append(groups, rdnValue(g))
+		}
+		sort.Strings(groups)
+		// A local user with the same name wins; LDAP never overwrites it.
+		res, err := tx.Exec(`
+			INSERT INTO users (name, display_name, email, groups, origin, synced_at)
+			VALUES (?, ?, ?, ?, 'ldap', CURRENT_TIMESTAMP)
+			ON CONFLICT(name) DO NOTHING
+		`, name, display, e.firstAttr("mail"), strings.Join(groups, ","))
+		if err != nil {
+			return 0, err
+		}
+		if c, _ := res.RowsAffected(); c > 0 {
+			n++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return n, reloadDirectory()
+}
+
+func ldapSyncJob(interval time.Duration) *schedJob {
+	return &schedJob{
+		name:     "ldap-sync",
+		interval: interval,
+		run: func() error {
+			n, err := syncLDAP()
+			if err == nil {
+				log.Printf("ldap sync: %d users", n)
+			}
+			return err
+		},
+	}
+}
+
+// ── Directory Handlers ────────────────────────────────────────────────────────
+
+func handleUsers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		us, err := listUsers()
+		if err != nil {
+			log.Printf("users: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(us)
+	}
+}
+
+// handleUser creates/updates (PUT) or deletes (DELETE) a local user.
+func handleUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		switch r.Method {
+		case http.MethodPut:
+			var body struct {
+				DisplayName string   `json:"display_name"`
+				Email       string   `json:"email"`
+				Groups      []string `json:"groups"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			_, err := db.Exec(`
+				INSERT INTO users (name, display_name, email, groups, origin) VALUES (?, ?, ?, ?, 'local')
+				ON CONFLICT(name) DO UPDATE SET
+					display_name = excluded.display_name,
+					email        = excluded.email,
+					groups       = excluded.groups,
+					origin       = 'local',
+					synced_at    = NULL
+			`, name, body.DisplayName, body.Email, strings.Join(body.Groups, ","))
+			if err != nil {
+				log.Printf("user %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("users: %q saved (groups=%v)", name, body.Groups)
+		case http.MethodDelete:
+			res, err := db.Exec(`DELETE FROM users WHERE name = ?`, name)
+			if err != nil {
+				log.Printf("user %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("users: %q deleted", name)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reloadDirectory(); err != nil {
+			log.Printf("directory reload: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleUserSync() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		n, err := syncLDAP()
+		if err != nil {
+			log.Printf("ldap sync: %v", err)
+			http.Error(w, "ldap sync failed: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"synced": n})
+		log.Printf("ldap sync: %d users (manual)", n)
+	}
+}
+
+func handleACLs() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		directory.RLock()
+		out := make(map[string][]string, len(directory.acls))
+		for t, gs := range directory.acls {
+			out[t] = append([]string(nil), gs...)
+		}
+		directory.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// handleACL replaces (PUT) or removes (DELETE) the group list for a topic.
+func handleACL() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		topic := r.PathValue("topic")
+		var groups []string
+		switch r.Method {
+		case http.MethodPut:
+			var body struct {
+				Groups []string `json:"groups"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Groups) == 0 {
+				http.Error(w, "groups is required", http.StatusBadRequest)
+				return
+			}
+			groups = body.Groups
+		case http.MethodDelete:
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("acl %q: %v", topic, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(`DELETE FROM topic_acls WHERE topic = ?`, topic); err != nil {
+			log.Printf("acl %q: %v", topic, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		for _, g := range groups {
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO topic_acls (topic, grp) VALUES (?, ?)`, topic, g); err != nil {
+				log.Printf("acl %q: %v", topic, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("acl %q: %v", topic, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if err := reloadDirectory(); err != nil {
+			log.Printf("directory reload: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		log.Printf("acl: topic %q → groups %v", topic, groups)
+	}
+}
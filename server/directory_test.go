@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// testACLs restricts topic "secret" to group "sec", which alice is in.
+func testACLs(t *testing.T) {
+	t.Helper()
+	for _, q := range []string{
+		`INSERT INTO users (name, groups) VALUES ('alice', 'sec'), ('bob', 'ops')`,
+		`INSERT INTO topic_acls (topic, grp) VALUES ('secret', 'sec')`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reloadDirectory(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHistoryAppliesTopicACLs(t *testing.T) {
+	testDB(t)
+	testACLs(t)
+	for _, topic := range []string{"open", "secret"} {
+		if _, err := insertNotification(Notification{Title: topic, Text: "x", Topic: topic, Priority: 3}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		auth authInfo
+		want []string
+	}{
+		{"primary", authInfo{ID: "primary", Scope: scopeFull}, []string{"secret", "open"}},
+		{"read-only", authInfo{ID: "readonly", Scope: scopeRead}, []string{"open"}},
+		{"alice", authInfo{ID: "jwt:alice", Scope: scopeRead, User: "alice"}, []string{"secret", "open"}},
+		{"bob, full scope", authInfo{ID: "jwt:bob", Scope: scopeFull, User: "bob"}, []string{"open"}},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/history", nil)
+		r = r.WithContext(context.WithValue(r.Context(), authKey, tc.auth))
+		w := httptest.NewRecorder()
+		handleHistory()(w, r)
+		var ns []Notification
+		if err := json.NewDecoder(w.Body).Decode(&ns); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		var got []string
+		for _, n := range ns {
+			got = append(got, n.Topic)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s: topics %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWSSharedReadTokenCantChooseUser(t *testing.T) {
+	testDB(t)
+	saved := readOnlyToken
+	readOnlyToken = "read-only-token"
+	t.Cleanup(func() { readOnlyToken = saved })
+	h := testHub(t)
+
+	w := httptest.NewRecorder()
+	handleWS(h)(w, httptest.NewRequest(http.MethodGet, "/ws?token=read-only-token&user=alice", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("?user=alice with the read-only token: status %d, want 403", w.Code)
+	}
+}
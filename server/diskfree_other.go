@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || windows)
+
+package main
+
+import "errors"
+
+// Free space isn't read elsewhere; /health and the agent report that instead.
+func diskSpace(path string) (free, total uint64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
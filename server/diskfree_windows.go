@@ -0,0 +1,23 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// diskSpace returns the bytes available to the server and the total size of
+// the volume holding path.
+func diskSpace(path string) (free, total uint64, err error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	r, _, err := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&free)), uintptr(unsafe.Pointer(&total)), 0)
+	if r == 0 {
+		return 0, 0, err
+	}
+	return free, total, nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ── Escalation ────────────────────────────────────────────────────────────────
+//
+// A notification sent with "require_ack":true is one somebody has to see.
+// Until it is marked seen it is delivered again after each of the
+// --ack-redeliver waits — a fresh "notification" frame, and another Web
+// Push, APNs or Pushover relay where those apply — and once --ack-deadline
+// passes it is escalated: sent to Pushover as an emergency, which repeats
+// until acknowledged there, and, if it went only to its on-call assignee,
+// broadcast to every client that may see its topic. Marking it seen, or
+// acknowledging it, ends the escalation and cancels the Pushover emergency.
+// While snoozed it is left alone; quiet hours never hold it.
+//
+// Redeliveries and the escalation are recorded as steps of the notification's
+// incident, if it opened one, and GET /escalations lists what is still
+// waiting for someone.
+
+const escalationCheck = 15 * time.Second
+
+// escalationWaits are the parsed --ack-redeliver waits.
+var escalationWaits []time.Duration
+
+type escalation struct {
+	NotificationID int64   `json:"notification_id"`
+	Title          string  `json:"title"`
+	Topic          string  `json:"topic"`
+	Priority       int     `json:"priority"`
+	Assignee       string  `json:"assignee,omitempty"`
+	Redeliveries   int     `json:"redeliveries"`
+	NextAt         *string `json:"next_redelivery_at"`
+	DeadlineAt     string  `json:"deadline_at"`
+	EscalatedAt    *string `json:"escalated_at"`
+	ResolvedAt     *string `json:"resolved_at,omitempty"`
+	ResolvedBy     string  `json:"resolved_by,omitempty"`
+}
+
+func initEscalationTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS escalations (
+			notification_id INTEGER PRIMARY KEY REFERENCES notifications(id) ON DELETE CASCADE,
+			redeliveries    INTEGER NOT NULL DEFAULT 0,
+			next_at         DATETIME,
+			deadline_at     DATETIME NOT NULL,
+			escalated_at    DATETIME,
+			resolved_at     DATETIME,
+			resolved_by     TEXT NOT NULL DEFAULT ''
+		)
+	`)
+	return err
+}
+
+// loadEscalation parses --ack-redeliver and checks --ack-deadline.
+func loadEscalation() error {
+	escalationWaits = nil
+	for _, s := range strings.Split(*flagAckRedeliver, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d < escalationCheck {
+			return fmt.Errorf("--ack-redeliver: %q is not a duration of at least %s", s, escalationCheck)
+		}
+		escalationWaits = append(escalationWaits, d)
+	}
+	if *flagAckDeadline < escalationCheck {
+		return fmt.Errorf("--ack-deadline must be at least %s", escalationCheck)
+	}
+	return nil
+}
+
+// startEscalation starts the clock on n, if it requires an ack.
+func startEscalation(n Notification) {
+	if !n.RequireAck || n.SeenAt != nil {
+		return
+	}
+	now := time.Now()
+	var next any
+	if len(escalationWaits) > 0 {
+		next = sqliteTime(now.Add(escalationWaits[0]))
+	}
+	if _, err := db.Exec(`INSERT OR IGNORE INTO escalations (notification_id, next_at, deadline_at) VALUES (?, ?, ?)`,
+		n.ID, next, sqliteTime(now.Add(*flagAckDeadline))); err != nil {
+		log.Printf("escalation: id=%d: %v", n.ID, err)
+	}
+}
+
+// resolveEscalations ends the escalations of ids, which were just seen.
+func resolveEscalations(ids []int64, by string) {
+	if len(ids) == 0 {
+		return
+	}
+	where, args := idsClause("notification_id", ids)
+	if _, err := db.Exec(`UPDATE escalations SET resolved_at = ?, resolved_by = ? WHERE resolved_at IS NULL AND `+where,
+		append([]any{sqliteTime(time.Now()), by}, args...)...); err != nil {
+		log.Printf("escalation: resolve: %v", err)
+	}
+}
+
+// startEscalator redelivers and escalates notifications nobody has seen.
+func startEscalator(h *hub) {
+	ticker := time.NewTicker(escalationCheck)
+	for range ticker.C {
+		if err := runEscalations(h); err != nil {
+			log.Printf("escalation: %v", err)
+		}
+	}
+}
+
+func runEscalations(h *hub) error {
+	now := sqliteTime(time.Now())
+	// Seen some other way than /mark-seen, or before the last check.
+	if _, err := db.Exec(`
+		UPDATE escalations SET resolved_at = (SELECT seen_at FROM notifications WHERE id = notification_id)
+		WHERE resolved_at IS NULL
+			AND (SELECT seen_at FROM notifications WHERE id = notification_id) IS NOT NULL`); err != nil {
+		return err
+	}
+	rows, err := db.Query(`
+		SELECT e.notification_id, e.redeliveries, e.next_at <= ? AND e.next_at IS NOT NULL,
+			e.escalated_at IS NULL AND e.deadline_at <= ?
+		FROM escalations e JOIN notifications n ON n.id = e.notification_id
+		WHERE e.resolved_at IS NULL AND n.snoozed_until IS NULL
+			AND ((e.next_at IS NOT NULL AND e.next_at <= ?) OR (e.escalated_at IS NULL AND e.deadline_at <= ?))`,
+		now, now, now, now)
+	if err != nil {
+		return err
+	}
+	type due struct {
+		id                  int64
+		redeliveries        int
+		redeliver, escalate bool
+	}
+	var work []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.redeliveries, &d.redeliver, &d.escalate); err != nil {
+			rows.Close()
+			return err
+		}
+		work = append(work, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, d := range work {
+		n, err := getNotification(d.id)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("id=%d: %w", d.id, err))
+			continue
+		}
+		if d.redeliver {
+			if err := redeliver(h, n, d.redeliveries); err != nil {
+				errs = append(errs, fmt.Errorf("id=%d: %w", d.id, err))
+			}
+		}
+		if d.escalate {
+			if err := escalate(h, n); err != nil {
+				errs = append(errs, fmt.Errorf("id=%d: %w", d.id, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// redeliver sends n again and schedules the next redelivery. The update
+// claims it, so an instance sharing the database that checks at the same
+// time doesn't send it twice.
+func redeliver(h *hub, n Notification, done int) error {
+	var next any
+	if done+1 < len(escalationWaits) {
+		next = sqliteTime(time.Now().Add(escalationWaits[done+1]))
+	}
+	res, err := db.Exec(`UPDATE escalations SET redeliveries = ?, next_at = ? WHERE notification_id = ? AND redeliveries = ?`,
+		done+1, next, n.ID, done)
+	if err != nil {
+		return err
+	}
+	if claimed, _ := res.RowsAffected(); claimed == 0 {
+		return nil
+	}
+	broadcastTo(h, n, recipients(h, n))
+	fanOutVia(h, n, redeliveryChannels())
+	busPublish(busEvent{Kind: busKindNote, IDs: []int64{n.ID}})
+	incidentStepFor(n.ID, "redelivered", fmt.Sprintf("not seen; delivered again (%d of %d)", done+1, len(escalationWaits)))
+	log.Printf("escalation: id=%d redelivered (%d of %d)", n.ID, done+1, len(escalationWaits))
+	return nil
+}
+
+// redeliveryChannels are the push channels that reach a person's devices.
+// Chat rooms, NATS and federation peers got n once; another copy there
+// would be a duplicate, not a reminder.
+func redeliveryChannels() []outChannel {
+	var out []outChannel
+	for _, c := range outChannels {
+		switch c.name {
+		case channelWebPush, channelAPNs, channelPushover:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// escalate sends n through the alternate channels: Pushover as an
+// emergency, and every client that may see it if it went only to its
+// assignee.
+func escalate(h *hub, n Notification) error {
+	res, err := db.Exec(`UPDATE escalations SET escalated_at = ? WHERE notification_id = ? AND escalated_at IS NULL`,
+		sqliteTime(time.Now()), n.ID)
+	if err != nil {
+		return err
+	}
+	if claimed, _ := res.RowsAffected(); claimed == 0 {
+		return nil
+	}
+	var via []string
+	if pushoverEnabled() {
+		queueDeliveries(n.ID, []deliveryJob{{channelEscalation, *flagPushoverUser}})
+		via = append(via, "Pushover emergency")
+	}
+	if n.Assignee != "" {
+		broadcastEscalated(h, n)
+		busPublish(busEvent{Kind: busKindEscalated, IDs: []int64{n.ID}})
+		via = append(via, "every client that may see it")
+	}
+	detail := "not seen by the deadline; nowhere else to send it"
+	if len(via) > 0 {
+		detail = "not seen by the deadline; sent to " + strings.Join(via, " and ")
+	}
+	incidentStepFor(n.ID, "escalated", detail)
+	log.Printf("escalation: id=%d escalated: %s", n.ID, detail)
+	return nil
+}
+
+// broadcastEscalated sends n to every client that may see its topic, not
+// only its assignee's.
+func broadcastEscalated(h *hub, n Notification) {
+	broadcastTo(h, n, func(c *client) bool { return c.sees(n.Topic) })
+}
+
+// escalationTargets names nobody: the emergency channel is only queued by
+// escalate.
+func escalationTargets(*hub, Notification) ([]string, error) { return nil, nil }
+
+// deliverEscalation sends n to Pushover as an emergency, whatever its
+// priority, unless it was seen while the delivery waited.
+func deliverEscalation(user string, n Notification) error {
+	if n.SeenAt != nil {
+		return nil
+	}
+	n.Priority = priorityUrgent
+	return sendPushover(user, n)
+}
+
+// incidentStepFor adds a step to the incident notification id opened, if any.
+func incidentStepFor(id int64, kind, detail string) {
+	var incident int64
+	err := db.QueryRow(`SELECT id FROM incidents WHERE notification_id = ?`, id).Scan(&incident)
+	if err == sql.ErrNoRows {
+		return
+	} else if err != nil {
+		log.Printf("incident: for id=%d: %v", id, err)
+		return
+	}
+	addIncidentStep(incident, kind, detail)
+}
+
+// ── Escalation handlers ──
+
+// handleEscalations lists escalations still waiting for someone, or with
+// ?all=1 the resolved ones too, newest first.
+func handleEscalations() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		where := `e.resolved_at IS NULL`
+		if r.URL.Query().Get("all") == "1" {
+			where = `1`
+		}
+		rows, err := db.Query(`
+			SELECT e.notification_id, n.title, n.topic, n.priority, n.assignee, e.redeliveries, e.next_at,
+				e.deadline_at, e.escalated_at, e.resolved_at, e.resolved_by
+			FROM escalations e JOIN notifications n ON n.id = e.notification_id
+			WHERE ` + where + ` ORDER BY e.notification_id DESC LIMIT 500`)
+		if err != nil {
+			log.Printf("escalations: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		out := []escalation{}
+		for rows.Next() {
+			var e escalation
+			err := rows.Scan(&e.NotificationID, &e.Title, &e.Topic, &e.Priority, &e.Assignee, &e.Redeliveries,
+				&e.NextAt, &e.DeadlineAt, &e.EscalatedAt, &e.ResolvedAt, &e.ResolvedBy)
+			if err == nil {
+				e.Title, err = openColumn("title", e.Title)
+			}
+			if err != nil {
+				log.Printf("escalations: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, e)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
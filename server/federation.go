@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// ── Federation ────────────────────────────────────────────────────────────────
+//
+// Instances can forward notifications to each other — a home server to a
+// relay on a VPS, say, so the phone gets them wherever it is. Each instance
+// has a name (--federation-name, the host name by default) and an Ed25519
+// key, generated on first start and kept in the database;
+// GET /federation/key shows both. Peers are managed under
+// /admin/federation/peers/{name}, named by their --federation-name:
+//
+//   - a peer with a url is downstream: notifications on the topics it lists
+//     (narrowed by min_priority and user, as for chat connectors) are POSTed
+//     to its /federation/receive, through the delivery queue;
+//   - a peer with a public_key is upstream: it may forward to us, and
+//     notifications that originated there are accepted.
+//
+// A peer can be both. /federation/receive takes no token: the forwarding
+// instance signs each request with its own key, and the receiver checks it
+// with the public key of the peer named as the last hop, so a peer's
+// credential opens this endpoint and nothing else. What is forwarded is the
+// notification as its origin published it, signed with the origin's key,
+// and the hops it has passed through. The receiver checks the signature
+// against the origin's public key — so an instance accepts only
+// notifications whose origin it knows, however many hops away — stores the
+// notification with extras.origin set, routes it with its own rules, and
+// forwards it on to its own downstream peers, signature intact.
+//
+// Loops are cut three ways: a notification is never forwarded to its origin
+// or an instance already in its hops; a receiver drops one that names it in
+// either; and each (origin, id) is stored only once, so one that reaches an
+// instance by two paths shows up once. Retries are safe for the same
+// reason. A notification passes through at most federationMaxHops
+// instances.
+
+const (
+	federationTimeout    = 10 * time.Second
+	federationMaxHops    = 8
+	federationKeySetting = "federation_key"
+	federationClaimTTL   = 30 * 24 * time.Hour
+	federationMaxSkew    = 5 * time.Minute
+)
+
+var (
+	federationName string
+	federationKey  ed25519.PrivateKey
+	federationHTTP = &http.Client{Timeout: federationTimeout}
+)
+
+type federationPeer struct {
+	Name      string `json:"name"`
+	URL       string `json:"url,omitempty"`
+	PublicKey string `json:"public_key,omitempty"`
+	pushFilter
+	LastSentAt     *string `json:"last_sent_at"`
+	Sent           int64   `json:"sent"`
+	Failures       int64   `json:"failures"`
+	LastError      string  `json:"last_error,omitempty"`
+	LastReceivedAt *string `json:"last_received_at"`
+	Received       int64   `json:"received"`
+	UpdatedBy      string  `json:"updated_by"`
+}
+
+// federatedNote is what an origin signs: the notification as it was
+// published there.
+type federatedNote struct {
+	Origin    string `json:"origin"`
+	OriginID  int64  `json:"origin_id"`
+	CreatedAt string `json:"created_at"`
+	sendBody
+}
+
+// federationEnvelope is the body of POST /federation/receive.
+type federationEnvelope struct {
+	Note      json.RawMessage `json:"note"`      // a federatedNote, exactly as signed
+	Signature string          `json:"signature"` // base64 Ed25519 signature of note by the origin
+	Hops      []string        `json:"hops"`      // the origin, then each instance that forwarded it
+}
+
+func initFederationTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS federation_peers (
+			name             TEXT PRIMARY KEY,
+			url              TEXT NOT NULL DEFAULT '',
+			public_key       TEXT NOT NULL DEFAULT '',
+			user             TEXT NOT NULL DEFAULT '',
+			topics           TEXT NOT NULL DEFAULT '',
+			min_priority     INTEGER NOT NULL DEFAULT 1,
+			last_sent_at     DATETIME,
+			sent             INTEGER NOT NULL DEFAULT 0,
+			failures         INTEGER NOT NULL DEFAULT 0,
+			last_error       TEXT NOT NULL DEFAULT '',
+			last_received_at DATETIME,
+			received         INTEGER NOT NULL DEFAULT 0,
+			updated_by       TEXT NOT NULL DEFAULT ''
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	// One row per notification received, kept with the notification (or, if
+	// a rule dropped it, for federationClaimTTL) to turn away copies and to
+	// forward it on as signed.
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS federation_received (
+			origin          TEXT NOT NULL,
+			origin_id       INTEGER NOT NULL,
+			notification_id INTEGER REFERENCES notifications(id) ON DELETE CASCADE,
+			note            TEXT NOT NULL,
+			signature       TEXT NOT NULL,
+			hops            TEXT NOT NULL,
+			received_at     DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (origin, origin_id)
+		)
+	`)
+	return err
+}
+
+// loadFederation settles the instance's name and loads its key, generating
+// one on first start.
+func loadFederation() error {
+	federationName = *flagFederationName
+	if federationName == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		federationName = strings.ToLower(host)
+	}
+	if !templateNameRE.MatchString(federationName) {
+		return fmt.Errorf("--federation-name: %q must be 1-64 letters, digits, '.', '_' or '-'", federationName)
+	}
+	if getSetting(federationKeySetting) == "" {
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		// Another process sharing the database may have stored one first.
+		if _, err := db.Exec(`INSERT OR IGNORE INTO settings (key, value) VALUES (?, ?)`,
+			federationKeySetting, base64.StdEncoding.EncodeToString(k.Seed())); err != nil {
+			return err
+		}
+	}
+	seed, err := base64.StdEncoding.DecodeString(getSetting(federationKeySetting))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return errors.New("stored federation key is malformed")
+	}
+	federationKey = ed25519.NewKeyFromSeed(seed)
+	return nil
+}
+
+func federationPublicKey() string {
+	return base64.StdEncoding.EncodeToString(federationKey.Public().(ed25519.PublicKey))
+}
+
+const peerCols = `name, url, public_key, user, topics, min_priority, last_sent_at, sent, failures, last_error,
+	last_received_at, received, updated_by`
+
+func scanPeer(s scanner) (federationPeer, error) {
+	var p federationPeer
+	var topics string
+	err := s.Scan(&p.Name, &p.URL, &p.PublicKey, &p.User, &topics, &p.MinPriority, &p.LastSentAt,
+		&p.Sent, &p.Failures, &p.LastError, &p.LastReceivedAt, &p.Received, &p.UpdatedBy)
+	p.Topics = splitList(topics)
+	return p, err
+}
+
+func getPeer(name string) (federationPeer, error) {
+	return scanPeer(db.QueryRow(`SELECT `+peerCols+` FROM federation_peers WHERE name = ?`, name))
+}
+
+func listPeers() ([]federationPeer, error) {
+	rows, err := db.Query(`SELECT ` + peerCols + ` FROM federation_peers ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []federationPeer{}
+	for rows.Next() {
+		p, err := scanPeer(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// federationPruneJob forgets received notifications that a rule dropped
+// or held for a digest; the rest go with their notification.
+func federationPruneJob() *schedJob {
+	return &schedJob{
+		name:     "federation-prune",
+		interval: 24 * time.Hour,
+		run: func() error {
+			_, err := db.Exec(`DELETE FROM federation_received WHERE notification_id IS NULL AND received_at < ?`,
+				sqliteTime(time.Now().Add(-federationClaimTTL)))
+			return err
+		},
+	}
+}
+
+// ── Forwarding ──
+
+// federationTargets lists the downstream peers that want n and haven't
+// seen it.
+func federationTargets(h *hub, n Notification) ([]string, error) {
+	peers, err := listPeers()
+	if err != nil {
+		return nil, err
+	}
+	var seen []string
+	if n.Extras != nil && n.Extras.Origin != nil {
+		seen = append([]string{n.Extras.Origin.Instance}, n.Extras.Origin.Hops...)
+	}
+	var names []string
+	for _, p := range peers {
+		if p.URL != "" && p.wants(n) && p.Name != federationName && !slices.Contains(seen, p.Name) {
+			names = append(names, p.Name)
+		}
+	}
+	return names, nil
+}
+
+func deliverFederation(name string, n Notification) error {
+	p, err := getPeer(name)
+	if err == sql.ErrNoRows || err == nil && p.URL == "" {
+		return errTargetGone // deleted or no longer downstream
+	}
+	if err != nil {
+		return err
+	}
+	env, err := federationEnvelopeFor(n)
+	if err != nil {
+		return err
+	}
+	if err := sendFederation(p, env); err != nil {
+		db.Exec(`UPDATE federation_peers SET failures = failures + 1, last_error = ? WHERE name = ?`, err.Error(), p.Name)
+		return err
+	}
+	db.Exec(`UPDATE federation_peers SET sent = sent + 1, last_sent_at = CURRENT_TIMESTAMP WHERE name = ?`, p.Name)
+	return nil
+}
+
+// federationEnvelopeFor signs n if it was published here, or passes on the
+// origin's signature if it was received.
+func federationEnvelopeFor(n Notification) (federationEnvelope, error) {
+	if n.Extras != nil && n.Extras.Origin != nil {
+		o := n.Extras.Origin
+		var env federationEnvelope
+		var note, hops string
+		err := db.QueryRow(`SELECT note, signature, hops FROM federation_received WHERE origin = ? AND origin_id = ?`,
+			o.Instance, o.ID).Scan(&note, &env.Signature, &hops)
+		if err == sql.ErrNoRows {
+			return env, permanentError(fmt.Errorf("no signed copy of %s/%d", o.Instance, o.ID))
+		}
+		if err != nil {
+			return env, err
+		}
+		env.Note = json.RawMessage(note)
+		json.Unmarshal([]byte(hops), &env.Hops)
+		env.Hops = append(env.Hops, federationName)
+		return env, nil
+	}
+	text := n.Text
+	if n.Format == formatMarkdown {
+		text = n.Markdown
+	}
+	note, _ := json.Marshal(federatedNote{
+		Origin:    federationName,
+		OriginID:  n.ID,
+		CreatedAt: n.CreatedAt,
+		sendBody: sendBody{
+			Title:    n.Title,
+			Text:     text,
+			Format:   n.Format,
+			Source:   n.Source,
+			Topic:    n.Topic,
+			Priority: n.Priority,
+			ClickURL: n.ClickURL,
+			Extras:   n.Extras,
+		},
+	})
+	return federationEnvelope{
+		Note:      note,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(federationKey, note)),
+		Hops:      []string{federationName},
+	}, nil
+}
+
+func sendFederation(p federationPeer, env federationEnvelope) error {
+	data, _ := json.Marshal(env)
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(p.URL, "/")+"/federation/receive", bytes.NewReader(data))
+	if err != nil {
+		return permanentError(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Federation-Timestamp", ts)
+	req.Header.Set("X-Federation-Signature", base64.StdEncoding.EncodeToString(ed25519.Sign(federationKey, []byte(ts+"."+string(data)))))
+	resp, err := federationHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return httpDeliveryError(resp, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// ── Handlers ──
+
+func handleFederationKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"name": federationName, "public_key": federationPublicKey()})
+	}
+}
+
+// handleFederationReceive takes a notification forwarded by a peer.
+func handleFederationReceive(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limitBody(w, r)
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			if !bodyTooLarge(w, err) {
+				http.Error(w, "bad request", http.StatusBadRequest)
+			}
+			return
+		}
+		var env federationEnvelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if len(env.Hops) == 0 {
+			http.Error(w, "hops must start with the origin", http.StatusBadRequest)
+			return
+		}
+		sender := env.Hops[len(env.Hops)-1]
+		if problem := verifyPeerRequest(r, sender, data, time.Now()); problem != "" {
+			http.Error(w, "Unauthorized: "+problem, http.StatusUnauthorized)
+			return
+		}
+		noteAuth(r, authInfo{ID: "peer:" + sender})
+		var raw bytes.Buffer
+		var note federatedNote
+		if err := json.Compact(&raw, env.Note); err != nil || json.Unmarshal(raw.Bytes(), &note) != nil {
+			http.Error(w, "note must be a JSON object", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case !templateNameRE.MatchString(note.Origin) || note.OriginID <= 0:
+			http.Error(w, "note must name its origin and origin_id", http.StatusBadRequest)
+			return
+		case env.Hops[0] != note.Origin:
+			http.Error(w, "hops must start with the origin", http.StatusBadRequest)
+			return
+		case len(env.Hops) > federationMaxHops:
+			http.Error(w, fmt.Sprintf("more than %d hops", federationMaxHops), http.StatusBadRequest)
+			return
+		case note.Origin == federationName || slices.Contains(env.Hops, federationName):
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"id": 0, "skipped": "loop"})
+			return
+		}
+		origin, err := getPeer(note.Origin)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("federation: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		pub, _ := base64.StdEncoding.DecodeString(origin.PublicKey)
+		sig, _ := base64.StdEncoding.DecodeString(env.Signature)
+		if len(pub) != ed25519.PublicKeySize {
+			http.Error(w, "unknown origin "+note.Origin, http.StatusForbidden)
+			return
+		}
+		if !ed25519.Verify(pub, raw.Bytes(), sig) {
+			http.Error(w, "signature does not verify with "+note.Origin+"'s key", http.StatusForbidden)
+			return
+		}
+
+		body := note.sendBody
+		if e, err := body.check(); e != nil {
+			writeLimitError(w, *e)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hops, _ := json.Marshal(env.Hops)
+		res, err := db.Exec(`INSERT INTO federation_received (origin, origin_id, note, signature, hops) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT DO NOTHING`, note.Origin, note.OriginID, raw.String(), env.Signature, string(hops))
+		if err != nil {
+			log.Printf("federation: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"id": 0, "skipped": "duplicate"})
+			return
+		}
+		id, err := publishFederated(h, body, note, env.Hops)
+		if err != nil {
+			db.Exec(`DELETE FROM federation_received WHERE origin = ? AND origin_id = ?`, note.Origin, note.OriginID)
+			log.Printf("federation: %s/%d: %v", note.Origin, note.OriginID, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		db.Exec(`UPDATE federation_peers SET received = received + 1, last_received_at = CURRENT_TIMESTAMP WHERE name = ?`, note.Origin)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"id": id})
+	}
+}
+
+// verifyPeerRequest checks that the request was signed, within
+// federationMaxSkew, by the upstream peer sender; it returns what is wrong.
+func verifyPeerRequest(r *http.Request, sender string, body []byte, now time.Time) string {
+	ts, err := strconv.ParseInt(r.Header.Get("X-Federation-Timestamp"), 10, 64)
+	if err != nil {
+		return "X-Federation-Timestamp must be unix seconds"
+	}
+	if skew := time.Unix(ts, 0).Sub(now); skew.Abs() > federationMaxSkew {
+		return fmt.Sprintf("timestamp outside allowed window: sender clock is %s ours", describeSkew(skew))
+	}
+	peer, err := getPeer(sender)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("federation: %v", err)
+	}
+	pub, _ := base64.StdEncoding.DecodeString(peer.PublicKey)
+	if len(pub) != ed25519.PublicKeySize {
+		return "unknown peer " + sender
+	}
+	sig, _ := base64.StdEncoding.DecodeString(r.Header.Get("X-Federation-Signature"))
+	if !ed25519.Verify(pub, []byte(strconv.FormatInt(ts, 10)+"."+string(body)), sig) {
+		return "request signature does not verify with " + sender + "'s key"
+	}
+	return ""
+}
+
+// publishFederated routes and publishes a received notification, returning
+// its ID here, or 0 when a rule suppressed it or held it for a digest.
+func publishFederated(h *hub, body sendBody, note federatedNote, hops []string) (int64, error) {
+	if body.Extras == nil {
+		body.Extras = &api.Extras{}
+	}
+	body.Extras.Origin = &api.Origin{Instance: note.Origin, ID: note.OriginID, Hops: hops}
+	n, matched, suppressedBy, digest := applyRoutes(nil, body.notification(authInfo{}))
+	recordRuleHits(ruleKindRoute, matched)
+	switch {
+	case suppressedBy != "":
+		log.Printf("federation: %s/%d suppressed by rule %q", note.Origin, note.OriginID, suppressedBy)
+		return 0, nil
+	case digest != nil:
+		_, _, err := holdForDigest(digest, n)
+		return 0, err
+	}
+	n, err := publish(context.Background(), h, n)
+	if err != nil {
+		return 0, err
+	}
+	db.Exec(`UPDATE federation_received SET notification_id = ? WHERE origin = ? AND origin_id = ?`, n.ID, note.Origin, note.OriginID)
+	log.Printf("federation: id=%d from %s/%d via %s topic=%q title=%q", n.ID, note.Origin, note.OriginID,
+		strings.Join(hops, ","), n.Topic, n.Title)
+	return n.ID, nil
+}
+
+func handlePeers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		out, err := listPeers()
+		if err != nil {
+			log.Printf("federation: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// handlePeer shows (GET), stores (PUT) or deletes (DELETE) a peer.
+func handlePeer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, by := r.PathValue("name"), authFrom(r).ID
+		switch r.Method {
+		case http.MethodGet:
+			p, err := getPeer(name)
+			if err == sql.ErrNoRows {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			} else if err != nil {
+				log.Printf("federation peer %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(p)
+		case http.MethodPut:
+			var body struct {
+				URL       string `json:"url"`
+				PublicKey string `json:"public_key"`
+				pushFilter
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			pub, _ := base64.StdEncoding.DecodeString(body.PublicKey)
+			err := body.check()
+			switch {
+			case !templateNameRE.MatchString(name):
+				err = errors.New("name must be the peer's --federation-name: 1-64 letters, digits, '.', '_' or '-'")
+			case name == federationName:
+				err = errors.New("name is this instance's own --federation-name")
+			case body.URL == "" && body.PublicKey == "":
+				err = errors.New("a peer needs a url to forward to, a public_key to accept from, or both")
+			case body.PublicKey != "" && len(pub) != ed25519.PublicKeySize:
+				err = errors.New("public_key must be a base64 Ed25519 public key, as GET /federation/key shows it")
+			case body.URL != "" && !httpURL(body.URL):
+				err = errors.New("url must be the peer's base http(s) URL")
+			case body.URL != "" && len(body.Topics) == 0:
+				err = errors.New("topics is required with url; a peer only gets the topics it lists")
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, err := db.Exec(`
+				INSERT INTO federation_peers (name, url, public_key, user, topics, min_priority, updated_by)
+				VALUES (?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT(name) DO UPDATE SET url = excluded.url, public_key = excluded.public_key,
+					user = excluded.user, topics = excluded.topics, min_priority = excluded.min_priority,
+					updated_by = excluded.updated_by, failures = 0, last_error = ''`,
+				name, body.URL, body.PublicKey, body.User, strings.Join(body.Topics, ","), body.MinPriority, by); err != nil {
+				log.Printf("federation peer %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("federation: peer %q saved by %s", name, by)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			res, err := db.Exec(`DELETE FROM federation_peers WHERE name = ?`, name)
+			if err != nil {
+				log.Printf("federation peer %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("federation: peer %q deleted by %s", name, by)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPeer is an instance that signs notes and requests with its own key.
+type testPeer struct {
+	name string
+	key  ed25519.PrivateKey
+}
+
+func newTestPeer(t *testing.T, name string) testPeer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testPeer{name, key}
+}
+
+func (p testPeer) publicKey() string {
+	return base64.StdEncoding.EncodeToString(p.key.Public().(ed25519.PublicKey))
+}
+
+// note signs a notification originating at p.
+func (p testPeer) note(id int64) (json.RawMessage, string) {
+	note, _ := json.Marshal(federatedNote{
+		Origin: p.name, OriginID: id, CreatedAt: sqliteTime(time.Now()),
+		sendBody: sendBody{Title: "disk full", Text: "sda1", Topic: "ops", Priority: 4},
+	})
+	return note, base64.StdEncoding.EncodeToString(ed25519.Sign(p.key, note))
+}
+
+// request is p forwarding env, signed with p's key.
+func (p testPeer) request(env federationEnvelope) *http.Request {
+	data, _ := json.Marshal(env)
+	r := httptest.NewRequest(http.MethodPost, "/federation/receive", bytes.NewReader(data))
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	r.Header.Set("X-Federation-Timestamp", ts)
+	r.Header.Set("X-Federation-Signature", base64.StdEncoding.EncodeToString(ed25519.Sign(p.key, []byte(ts+"."+string(data)))))
+	return r
+}
+
+func TestFederationReceive(t *testing.T) {
+	testDB(t)
+	savedName, savedKey := federationName, federationKey
+	federationName = "relay"
+	_, federationKey, _ = ed25519.GenerateKey(rand.Reader)
+	t.Cleanup(func() { federationName, federationKey = savedName, savedKey })
+
+	home, stranger := newTestPeer(t, "home"), newTestPeer(t, "stranger")
+	if _, err := db.Exec(`INSERT INTO federation_peers (name, public_key) VALUES (?, ?)`, home.name, home.publicKey()); err != nil {
+		t.Fatal(err)
+	}
+	h := testHub(t)
+	receive := func(r *http.Request) (int, string) {
+		w := httptest.NewRecorder()
+		handleFederationReceive(h)(w, r)
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+
+	note, sig := home.note(1)
+	env := federationEnvelope{Note: note, Signature: sig, Hops: []string{"home"}}
+	if code, body := receive(home.request(env)); code != http.StatusOK || strings.Contains(body, "skipped") {
+		t.Fatalf("valid note: %d %s", code, body)
+	}
+
+	unsigned := home.request(env)
+	unsigned.Header.Del("X-Federation-Signature")
+	strangerNote, strangerSig := stranger.note(1)
+	_, otherSig := home.note(2)
+	for _, tc := range []struct {
+		name string
+		r    *http.Request
+		code int
+		body string
+	}{
+		{"unsigned request", unsigned, http.StatusUnauthorized, "does not verify"},
+		{"request from an unknown peer", stranger.request(federationEnvelope{Note: strangerNote, Signature: strangerSig, Hops: []string{"stranger"}}),
+			http.StatusUnauthorized, "unknown peer"},
+		{"bad signature", home.request(federationEnvelope{Note: note, Signature: otherSig, Hops: []string{"home"}}),
+			http.StatusForbidden, "does not verify"},
+		{"unknown origin", home.request(federationEnvelope{Note: strangerNote, Signature: strangerSig, Hops: []string{"stranger", "home"}}),
+			http.StatusForbidden, "unknown origin"},
+		{"loop", home.request(federationEnvelope{Note: note, Signature: sig, Hops: []string{"home", "relay", "home"}}),
+			http.StatusOK, `"skipped":"loop"`},
+		{"duplicate", home.request(env), http.StatusOK, `"skipped":"duplicate"`},
+	} {
+		code, body := receive(tc.r)
+		if code != tc.code || !strings.Contains(body, tc.body) {
+			t.Errorf("%s: %d %s, want %d with %q", tc.name, code, body, tc.code, tc.body)
+		}
+	}
+
+	var stored int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM notifications`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 1 {
+		t.Errorf("%d notifications stored, want 1", stored)
+	}
+}
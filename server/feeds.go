@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// ── Feeds ─────────────────────────────────────────────────────────────────────
+//
+// The feed poller turns new RSS or Atom entries — release announcements,
+// status pages — into notifications. Feeds are managed under /admin/feeds
+// with a URL, a polling interval and the topic and priority to send at;
+// every --feed-poll-interval the scheduler polls the feeds that are due,
+// with conditional requests so unchanged feeds cost a 304. Entries are
+// remembered by GUID (or link) in feed_entries: the first poll of a feed
+// only records what is there, and later polls notify about entries not seen
+// before. A burst of more than feedMaxNotify new entries is sent as one
+// summary instead. Notifications are routed like a /send, with source
+// "feed:<name>", so rules can digest or reroute them.
+
+const (
+	feedMinInterval = time.Minute
+	feedTimeout     = 30 * time.Second
+	feedMaxBytes    = 10 << 20
+	feedMaxNotify   = 5                   // new entries sent one by one; more are summarised
+	feedMaxListed   = 20                  // entries listed in a summary
+	feedEntryTTL    = 30 * 24 * time.Hour // forget entries gone from the feed this long
+)
+
+type feed struct {
+	Name         string  `json:"name"`
+	URL          string  `json:"url"`
+	Interval     string  `json:"interval"`
+	Topic        string  `json:"topic,omitempty"`
+	Priority     int     `json:"priority,omitempty"`
+	Title        string  `json:"title,omitempty"` // the feed's own, from the last poll
+	LastPolledAt *string `json:"last_polled_at"`
+	NextPollAt   string  `json:"next_poll_at"`
+	LastError    string  `json:"last_error,omitempty"`
+	Entries      int     `json:"entries"`
+	UpdatedBy    string  `json:"updated_by"`
+
+	interval           time.Duration
+	etag, lastModified string
+	seeded             bool // entries have been recorded once
+}
+
+func initFeedTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS feeds (
+			name           TEXT PRIMARY KEY,
+			url            TEXT NOT NULL,
+			interval_s     INTEGER NOT NULL,
+			topic          TEXT NOT NULL DEFAULT '',
+			priority       INTEGER NOT NULL DEFAULT 0,
+			title          TEXT NOT NULL DEFAULT '',
+			etag           TEXT NOT NULL DEFAULT '',
+			last_modified  TEXT NOT NULL DEFAULT '',
+			last_polled_at DATETIME,
+			next_poll_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			last_error     TEXT NOT NULL DEFAULT '',
+			seeded         INTEGER NOT NULL DEFAULT 0,
+			updated_by     TEXT NOT NULL DEFAULT ''
+		);
+		CREATE TABLE IF NOT EXISTS feed_entries (
+			feed          TEXT NOT NULL,
+			guid          TEXT NOT NULL,
+			first_seen_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			last_seen_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (feed, guid)
+		);
+	`)
+	return err
+}
+
+const feedCols = `name, url, interval_s, topic, priority, title, etag, last_modified, last_polled_at, next_poll_at, last_error, seeded, updated_by,
+	(SELECT COUNT(*) FROM feed_entries WHERE feed = feeds.name)`
+
+func scanFeed(s interface{ Scan(...any) error }) (feed, error) {
+	var f feed
+	var secs int64
+	err := s.Scan(&f.Name, &f.URL, &secs, &f.Topic, &f.Priority, &f.Title, &f.etag, &f.lastModified,
+		&f.LastPolledAt, &f.NextPollAt, &f.LastError, &f.seeded, &f.UpdatedBy, &f.Entries)
+	f.interval = time.Duration(secs) * time.Second
+	f.Interval = f.interval.String()
+	return f, err
+}
+
+func getFeed(name string) (feed, error) {
+	return scanFeed(db.QueryRow(`SELECT `+feedCols+` FROM feeds WHERE name = ?`, name))
+}
+
+func feedPollJob(interval time.Duration, h *hub) *schedJob {
+	return &schedJob{
+		name:     "feed-poll",
+		interval: interval,
+		run:      func() error { return pollDueFeeds(h) },
+	}
+}
+
+// pollDueFeeds polls every feed whose next poll has come.
+func pollDueFeeds(h *hub) error {
+	if currentMaintenance().Enabled {
+		return nil // entries wait for the next poll after maintenance
+	}
+	rows, err := db.Query(`SELECT `+feedCols+` FROM feeds WHERE next_poll_at <= ? ORDER BY next_poll_at`, sqliteTime(time.Now()))
+	if err != nil {
+		return err
+	}
+	var due []feed
+	for rows.Next() {
+		f, err := scanFeed(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, f)
+	}
+	rows.Close()
+	var errs []error
+	for _, f := range due {
+		if _, err := pollFeed(h, f); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// pollFeed fetches f, notifies about new entries and records the outcome.
+// It returns how many entries were new.
+func pollFeed(h *hub, f feed) (int, error) {
+	fresh, err := fetchFeed(h, f)
+	next := sqliteTime(time.Now().Add(f.interval))
+	if err != nil {
+		log.Printf("feeds: %s: %v", f.Name, err)
+		db.Exec(`UPDATE feeds SET last_polled_at = CURRENT_TIMESTAMP, next_poll_at = ?, last_error = ? WHERE name = ?`,
+			next, err.Error(), f.Name)
+		return 0, err
+	}
+	_, err = db.Exec(`UPDATE feeds SET last_polled_at = CURRENT_TIMESTAMP, next_poll_at = ?, last_error = '' WHERE name = ?`, next, f.Name)
+	return fresh, err
+}
+
+type feedEntry struct {
+	guid, title, link, summary string
+}
+
+func fetchFeed(h *hub, f feed) (int, error) {
+	req, err := http.NewRequest(http.MethodGet, f.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", "andrNoti/"+serverVersion+" (feed poller)")
+	req.Header.Set("Accept", "application/rss+xml, application/atom+xml, application/xml;q=0.9, */*;q=0.8")
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	if f.lastModified != "" {
+		req.Header.Set("If-Modified-Since", f.lastModified)
+	}
+	resp, err := (&http.Client{Timeout: feedTimeout}).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return 0, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return 0, fmt.Errorf("GET %s: %s", f.URL, resp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, feedMaxBytes+1))
+	if err != nil {
+		return 0, err
+	}
+	if len(raw) > feedMaxBytes {
+		return 0, fmt.Errorf("feed is larger than %d MB", feedMaxBytes>>20)
+	}
+	title, entries, err := parseFeed(raw)
+	if err != nil {
+		return 0, err
+	}
+
+	fresh, err := recordFeedEntries(f.Name, entries)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := db.Exec(`UPDATE feeds SET title = ?, etag = ?, last_modified = ?, seeded = 1 WHERE name = ?`,
+		title, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), f.Name); err != nil {
+		return 0, err
+	}
+
+	if !f.seeded {
+		log.Printf("feeds: %s: first poll, recorded the %d entries already there", f.Name, len(entries))
+		return 0, nil
+	}
+	f.Title = cmp.Or(title, f.Name)
+	if len(fresh) > feedMaxNotify {
+		_, err := publishPolled(h, feedSummary(f, fresh), "feeds")
+		return len(fresh), err
+	}
+	// Feeds list the newest first; notify in the order they appeared.
+	for i := len(fresh) - 1; i >= 0; i-- {
+		if _, err := publishPolled(h, feedNotification(f, fresh[i]), "feeds"); err != nil {
+			return len(fresh), err
+		}
+	}
+	return len(fresh), nil
+}
+
+// recordFeedEntries remembers entries and returns those not seen before,
+// forgetting entries that have been gone from the feed for feedEntryTTL.
+func recordFeedEntries(name string, entries []feedEntry) ([]feedEntry, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var fresh []feedEntry
+	for _, e := range entries {
+		res, err := tx.Exec(`INSERT OR IGNORE INTO feed_entries (feed, guid) VALUES (?, ?)`, name, e.guid)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			fresh = append(fresh, e)
+		} else if _, err := tx.Exec(`UPDATE feed_entries SET last_seen_at = CURRENT_TIMESTAMP WHERE feed = ? AND guid = ?`, name, e.guid); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM feed_entries WHERE feed = ? AND last_seen_at < ?`,
+		name, sqliteTime(time.Now().Add(-feedEntryTTL))); err != nil {
+		return nil, err
+	}
+	return fresh, tx.Commit()
+}
+
+func feedBody(f feed) sendBody {
+	return sendBody{
+		Source:   "feed:" + f.Name,
+		Topic:    f.Topic,
+		Priority: f.Priority,
+		Extras:   &api.Extras{Source: &api.SourceMeta{System: "feed"}},
+	}
+}
+
+func feedNotification(f feed, e feedEntry) sendBody {
+	b := feedBody(f)
+	b.Title = f.Title + ": " + cmp.Or(e.title, "(untitled)")
+	b.Text = cmp.Or(excerpt(e.summary, 500), e.title, e.link, "(no content)")
+	if httpURL(e.link) {
+		b.ClickURL, b.Extras.Source.URL = e.link, e.link
+	}
+	if len(e.guid) <= 256 {
+		b.Extras.Source.ID = e.guid
+	}
+	return b
+}
+
+func feedSummary(f feed, entries []feedEntry) sendBody {
+	b := feedBody(f)
+	b.Title = fmt.Sprintf("%s: %d new entries", f.Title, len(entries))
+	b.Format = formatMarkdown
+	var t strings.Builder
+	for i, e := range entries {
+		if i == feedMaxListed {
+			fmt.Fprintf(&t, "… and %d more\n", len(entries)-i)
+			break
+		}
+		title := strings.NewReplacer("[", "(", "]", ")").Replace(cmp.Or(e.title, e.link, "(untitled)"))
+		if httpURL(e.link) {
+			fmt.Fprintf(&t, "- [%s](%s)\n", title, e.link)
+		} else {
+			fmt.Fprintf(&t, "- %s\n", title)
+		}
+	}
+	b.Text = strings.TrimSpace(t.String())
+	return b
+}
+
+// ── Feed parsing ──
+
+type feedDoc struct {
+	XMLName xml.Name
+	Channel struct {
+		Title string    `xml:"title"`
+		Items []rssItem `xml:"item"`
+	} `xml:"channel"`
+	Items []rssItem `xml:"item"` // RSS 1.0 keeps items beside the channel
+
+	// Atom
+	Title   string      `xml:"title"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	GUID        string `xml:"guid"`
+	About       string `xml:"about,attr"` // RSS 1.0 rdf:about
+	Description string `xml:"description"`
+	PubDate     string `xml:"pubDate"`
+}
+
+type atomText struct {
+	Type  string `xml:"type,attr"`
+	Text  string `xml:",chardata"`
+	Inner string `xml:",innerxml"`
+}
+
+// html is the text as HTML, whatever the type.
+func (t atomText) html() string {
+	switch t.Type {
+	case "xhtml":
+		return t.Inner
+	case "html":
+		return t.Text
+	}
+	return html.EscapeString(t.Text)
+}
+
+type atomEntry struct {
+	Title atomText `xml:"title"`
+	ID    string   `xml:"id"`
+	Links []struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+	} `xml:"link"`
+	Summary atomText `xml:"summary"`
+	Content atomText `xml:"content"`
+	Updated string   `xml:"updated"`
+}
+
+// parseFeed reads an RSS 2.0, RSS 1.0 or Atom document.
+func parseFeed(raw []byte) (title string, entries []feedEntry, err error) {
+	var doc feedDoc
+	dec := xml.NewDecoder(bytes.NewReader(raw))
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+	dec.CharsetReader = charsetReader
+	if err := dec.Decode(&doc); err != nil {
+		return "", nil, fmt.Errorf("not an RSS or Atom feed: %v", err)
+	}
+	switch strings.ToLower(doc.XMLName.Local) {
+	case "rss", "rdf":
+		for _, it := range append(doc.Channel.Items, doc.Items...) {
+			e := feedEntry{
+				title:   htmlText(it.Title),
+				link:    strings.TrimSpace(it.Link),
+				summary: htmlText(it.Description),
+			}
+			e.guid = feedGUID(strings.TrimSpace(cmp.Or(it.GUID, it.About)), e.link, e.title+"\n"+it.PubDate)
+			entries = append(entries, e)
+		}
+		return strings.TrimSpace(doc.Channel.Title), entries, nil
+	case "feed":
+		for _, en := range doc.Entries {
+			e := feedEntry{
+				title:   htmlText(en.Title.html()),
+				summary: htmlText(cmp.Or(en.Summary.html(), en.Content.html())),
+			}
+			for _, l := range en.Links {
+				if l.Rel == "" || l.Rel == "alternate" {
+					e.link = strings.TrimSpace(l.Href)
+					break
+				}
+			}
+			e.guid = feedGUID(strings.TrimSpace(en.ID), e.link, e.title+"\n"+en.Updated)
+			entries = append(entries, e)
+		}
+		return strings.TrimSpace(doc.Title), entries, nil
+	}
+	return "", nil, fmt.Errorf("not an RSS or Atom feed: root element <%s>", doc.XMLName.Local)
+}
+
+// feedGUID is the entry's id, else its link, else a hash of what it says.
+func feedGUID(id, link, fallback string) string {
+	if v := cmp.Or(id, link); v != "" {
+		return v
+	}
+	sum := sha256.Sum256([]byte(fallback))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// charsetReader decodes the single-byte charsets feeds and mail still use;
+// UTF-8 needs no reader.
+func charsetReader(charset string, in io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "latin-1", "us-ascii", "windows-1252", "cp1252":
+		raw, err := io.ReadAll(in)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]byte, 0, len(raw))
+		for _, b := range raw {
+			out = utf8.AppendRune(out, rune(b))
+		}
+		return bytes.NewReader(out), nil
+	}
+	return nil, fmt.Errorf("unsupported charset %q", charset)
+}
+
+var (
+	htmlDropRE  = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)>|<!--.*?-->`)
+	htmlBreakRE = regexp.MustCompile(`(?i)<(br|/p|/div|/li|/h[1-6]|/tr)\b[^>]*>`)
+	htmlTagRE   = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankRE     = regexp.MustCompile(`[ \t\r\f\v]+`)
+	blankLineRE = regexp.MustCompile(`\n\s*\n+`)
+)
+
+// htmlText is the readable text of an HTML fragment.
+func htmlText(s string) string {
+	s = htmlDropRE.ReplaceAllString(s, "")
+	s = htmlBreakRE.ReplaceAllString(s, "\n")
+	s = html.UnescapeString(htmlTagRE.ReplaceAllString(s, ""))
+	s = blankRE.ReplaceAllString(s, " ")
+	s = blankLineRE.ReplaceAllString(s, "\n\n")
+	var lines []string
+	for _, l := range strings.Split(s, "\n") {
+		lines = append(lines, strings.TrimSpace(l))
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// ── Feed handlers ──
+
+func handleFeeds() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rows, err := db.Query(`SELECT ` + feedCols + ` FROM feeds ORDER BY name`)
+		if err != nil {
+			log.Printf("feeds: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		out := []feed{}
+		for rows.Next() {
+			f, err := scanFeed(rows)
+			if err != nil {
+				log.Printf("feeds: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, f)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// handleFeed shows (GET), stores (PUT) or deletes (DELETE) a feed.
+func handleFeed() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, by := r.PathValue("name"), authFrom(r).ID
+		switch r.Method {
+		case http.MethodGet:
+			f, err := getFeed(name)
+			if err == sql.ErrNoRows {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			} else if err != nil {
+				log.Printf("feed %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(f)
+		case http.MethodPut:
+			var body struct {
+				URL      string `json:"url"`
+				Interval string `json:"interval"`
+				Topic    string `json:"topic"`
+				Priority int    `json:"priority"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			interval, err := time.ParseDuration(cmp.Or(body.Interval, "15m"))
+			switch {
+			case !templateNameRE.MatchString(name):
+				err = errors.New("name must be 1-64 letters, digits, '.', '_' or '-'")
+			case !httpURL(body.URL):
+				err = errors.New("url must be an absolute http(s) URL")
+			case err != nil || interval < feedMinInterval:
+				err = fmt.Errorf("interval must be a Go duration of at least %s", feedMinInterval)
+			case body.Priority < 0 || body.Priority > priorityUrgent:
+				err = errors.New("priority must be 1-5")
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			tx, err := db.Begin()
+			if err != nil {
+				log.Printf("feed %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			defer tx.Rollback()
+			// A new URL is a new feed: forget its entries so the next poll
+			// records rather than announces them.
+			_, err = tx.Exec(`DELETE FROM feed_entries WHERE feed = ? AND NOT EXISTS (
+				SELECT 1 FROM feeds WHERE name = ? AND url = ?)`, name, name, body.URL)
+			if err == nil {
+				_, err = tx.Exec(`
+					INSERT INTO feeds (name, url, interval_s, topic, priority, updated_by) VALUES (?, ?, ?, ?, ?, ?)
+					ON CONFLICT(name) DO UPDATE SET
+						etag = CASE WHEN url = excluded.url THEN etag ELSE '' END,
+						last_modified = CASE WHEN url = excluded.url THEN last_modified ELSE '' END,
+						last_polled_at = CASE WHEN url = excluded.url THEN last_polled_at END,
+						seeded = CASE WHEN url = excluded.url THEN seeded ELSE 0 END,
+						next_poll_at = CURRENT_TIMESTAMP,
+						url = excluded.url, interval_s = excluded.interval_s, topic = excluded.topic,
+						priority = excluded.priority, updated_by = excluded.updated_by`,
+					name, body.URL, int64(interval/time.Second), body.Topic, body.Priority, by)
+			}
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				log.Printf("feed %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("feeds: %q (%s every %s) saved by %s", name, body.URL, interval, by)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			res, err := db.Exec(`DELETE FROM feeds WHERE name = ?`, name)
+			if err == nil {
+				_, err = db.Exec(`DELETE FROM feed_entries WHERE feed = ?`, name)
+			}
+			if err != nil {
+				log.Printf("feed %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("feeds: %q deleted by %s", name, by)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleFeedPoll polls a feed now, regardless of its schedule.
+func handleFeedPoll(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.PathValue("name")
+		f, err := getFeed(name)
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("feed %q: %v", name, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		n, err := pollFeed(h, f)
+		out := map[string]any{"new": n}
+		if err != nil {
+			out["error"] = err.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// ── Client Model Generation ───────────────────────────────────────────────────
+//
+//	andr-noti gen-clients [-kotlin Models.kt] [-kotlin-package pkg] [-ts models.ts] [-proto andrnoti.proto]
+//
+// Emits Kotlin data classes (kotlinx.serialization) and TypeScript interfaces
+// for the types published in /schema/notification, so app and dashboard
+// models can be regenerated whenever the api module changes, and the .proto
+// for clients of the protobuf subprotocol. With no output flags the Kotlin
+// and TypeScript are written to stdout.
+
+func runGenClients(args []string) {
+	fs := flag.NewFlagSet("gen-clients", flag.ExitOnError)
+	kotlinOut := fs.String("kotlin", "", "Write Kotlin data classes to this file")
+	kotlinPkg := fs.String("kotlin-package", "dev.ilios.andrnoti.api", "Kotlin package name")
+	tsOut := fs.String("ts", "", "Write TypeScript interfaces to this file")
+	protoOut := fs.String("proto", "", "Write the protobuf schema to this file")
+	fs.Parse(args)
+
+	kt, ts := genKotlin(*kotlinPkg), genTypeScript()
+	if *kotlinOut == "" && *tsOut == "" && *protoOut == "" {
+		os.Stdout.Write(kt)
+		fmt.Println()
+		os.Stdout.Write(ts)
+		return
+	}
+	for _, out := range []struct {
+		path string
+		data []byte
+	}{{*kotlinOut, kt}, {*tsOut, ts}, {*protoOut, genProto()}} {
+		if out.path == "" {
+			continue
+		}
+		if err := os.WriteFile(out.path, out.data, 0o644); err != nil {
+			log.Fatalf("gen-clients: %v", err)
+		}
+		log.Printf("gen-clients: wrote %s", out.path)
+	}
+}
+
+// genField is one struct field as the generators see it.
+type genField struct {
+	json     string
+	typ      reflect.Type
+	optional bool // omitempty: may be absent
+	nullable bool // pointer without omitempty: present but may be null
+	enum     []string
+}
+
+func genFields(t reflect.Type, schemaName string) []genField {
+	var out []genField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		g := genField{json: name, typ: f.Type, optional: strings.Contains(opts, "omitempty")}
+		if g.typ.Kind() == reflect.Pointer {
+			g.typ = g.typ.Elem()
+			g.nullable = !g.optional
+		}
+		g.enum = schemaEnums[schemaName+"."+name]
+		out = append(out, g)
+	}
+	return out
+}
+
+func schemaNameOf(t reflect.Type) string {
+	for _, st := range schemaTypes {
+		if reflect.TypeOf(st.v) == t {
+			return st.name
+		}
+	}
+	return t.Name()
+}
+
+// camel turns snake_case into lowerCamelCase.
+func camel(s string) string {
+	parts := strings.Split(s, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			r := []rune(parts[i])
+			r[0] = unicode.ToUpper(r[0])
+			parts[i] = string(r)
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+const genHeader = "Generated by `andr-noti gen-clients` from the server's api types. Do not edit."
+
+// ── Kotlin ────────────────────────────────────────────────────────────────────
+
+func genKotlin(pkg string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// %s\n\npackage %s\n\n", genHeader, pkg)
+	b.WriteString("import kotlinx.serialization.SerialName\n")
+	b.WriteString("import kotlinx.serialization.Serializable\n")
+	b.WriteString("import kotlinx.serialization.json.JsonElement\n")
+	for _, st := range schemaTypes {
+		t := reflect.TypeOf(st.v)
+		fmt.Fprintf(&b, "\n@Serializable\ndata class %s(\n", st.name)
+		for _, f := range genFields(t, st.name) {
+			typ := kotlinType(f.typ)
+			def := ""
+			if f.optional || f.nullable {
+				typ += "?"
+				def = " = null"
+			}
+			if len(f.enum) > 0 {
+				fmt.Fprintf(&b, "    /** One of: %s */\n", strings.Join(f.enum, ", "))
+			}
+			fmt.Fprintf(&b, "    @SerialName(%q) val %s: %s%s,\n", f.json, camel(f.json), typ, def)
+		}
+		b.WriteString(")\n")
+	}
+	return b.Bytes()
+}
+
+func kotlinType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "String"
+	case reflect.Bool:
+		return "Boolean"
+	case reflect.Int64, reflect.Uint64, reflect.Uint32:
+		return "Long"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16:
+		return "Int"
+	case reflect.Float32, reflect.Float64:
+		return "Double"
+	case reflect.Slice, reflect.Array:
+		return "List<" + kotlinType(t.Elem()) + ">"
+	case reflect.Map:
+		return "Map<String, " + kotlinType(t.Elem()) + ">"
+	case reflect.Pointer:
+		return kotlinType(t.Elem()) + "?"
+	case reflect.Struct:
+		return schemaNameOf(t)
+	}
+	return "JsonElement"
+}
+
+// ── TypeScript ────────────────────────────────────────────────────────────────
+
+func genTypeScript() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// %s\n", genHeader)
+	for _, st := range schemaTypes {
+		t := reflect.TypeOf(st.v)
+		fmt.Fprintf(&b, "\nexport interface %s {\n", st.name)
+		for _, f := range genFields(t, st.name) {
+			typ := tsType(f.typ)
+			if len(f.enum) > 0 {
+				typ = `"` + strings.Join(f.enum, `" | "`) + `"`
+				if f.typ.Kind() == reflect.Slice {
+					typ = "(" + typ + ")[]"
+				}
+			}
+			if f.nullable {
+				typ += " | null"
+			}
+			opt := ""
+			if f.optional {
+				opt = "?"
+			}
+			fmt.Fprintf(&b, "  %s%s: %s;\n", f.json, opt, typ)
+		}
+		b.WriteString("}\n")
+	}
+	return b.Bytes()
+}
+
+func tsType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return tsType(t.Elem()) + "[]"
+	case reflect.Map:
+		return "Record<string, " + tsType(t.Elem()) + ">"
+	case reflect.Pointer:
+		return tsType(t.Elem()) + " | null"
+	case reflect.Struct:
+		return schemaNameOf(t)
+	}
+	return "unknown"
+}
+
+// ── Protobuf ──────────────────────────────────────────────────────────────────
+
+// genProto writes the .proto file for the published types.
+func genProto() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// %s\n\nsyntax = \"proto3\";\n\npackage %s;\n", genHeader, protoPackage)
+	for _, st := range schemaTypes {
+		t := reflect.TypeOf(st.v)
+		name := st.name
+		if name == "ServerMessage" {
+			fmt.Fprintf(&b, "\n// Every frame on an %s WebSocket.", wsProtoSubprotocol)
+		}
+		fmt.Fprintf(&b, "\nmessage %s {\n", name)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			num := protoNum(f)
+			if num == 0 {
+				continue
+			}
+			field, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			typ, note := protoType(f.Type)
+			if enum := schemaEnums[name+"."+field]; len(enum) > 0 {
+				note = "one of: " + strings.Join(enum, ", ")
+			}
+			fmt.Fprintf(&b, "  %s %s = %d;", typ, field, num)
+			if note != "" {
+				fmt.Fprintf(&b, " // %s", note)
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("}\n")
+	}
+	return b.Bytes()
+}
+
+// protoType is the field type for t, with a note for the reader.
+func protoType(t reflect.Type) (string, string) {
+	switch t.Kind() {
+	case reflect.Pointer:
+		if t.Elem().Kind() == reflect.Struct {
+			return protoType(t.Elem())
+		}
+		typ, note := protoType(t.Elem())
+		return "optional " + typ, note
+	case reflect.String:
+		return "string", ""
+	case reflect.Bool:
+		return "bool", ""
+	case reflect.Int, reflect.Int32:
+		return "int32", ""
+	case reflect.Int64:
+		return "int64", ""
+	case reflect.Slice:
+		typ, note := protoType(t.Elem())
+		return "repeated " + typ, note
+	case reflect.Map:
+		return "string", "JSON object"
+	case reflect.Struct:
+		return schemaNameOf(t), ""
+	}
+	return "bytes", ""
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// ── GitHub ────────────────────────────────────────────────────────────────────
+//
+// POST /ingest/github is a GitHub repository or organization webhook. GitHub
+// can't send a bearer token, but it signs each delivery with the webhook's
+// secret (X-Hub-Signature-256); with --github-secret-file set, a correctly
+// signed delivery is accepted in its place. The X-GitHub-Delivery id stands
+// in for an Idempotency-Key, so redelivering an event doesn't notify twice.
+//
+// Four kinds of event become notifications:
+//
+//	push              commits or a tag pushed (low priority)
+//	issues            an issue opened, closed or reopened
+//	review_requested  a pull request review requested
+//	workflow_failure  a workflow run that failed or timed out (high priority)
+//
+// --github-events picks which, per repository: "kind" selects it for every
+// repository, "owner/repo:kind" or "owner/*:kind" for some, and "*" stands
+// for every kind. Everything else, ping included, is answered 202 and dropped.
+
+const githubMaxCommits = 10 // commits listed for a push
+
+var githubKinds = []string{"push", "issues", "review_requested", "workflow_failure"}
+
+// githubSecret is the webhook secret, from --github-secret-file.
+var githubSecret string
+
+// githubFilter selects an event kind for the repositories matching repo
+// (a path.Match pattern; empty for all).
+type githubFilter struct{ repo, kind string }
+
+// githubEvents is --github-events.
+var githubEvents []githubFilter
+
+func parseGitHubEvents(s string) ([]githubFilter, error) {
+	var out []githubFilter
+	for _, entry := range splitList(s) {
+		f := githubFilter{kind: entry}
+		if repo, kind, ok := strings.Cut(entry, ":"); ok {
+			f = githubFilter{repo: repo, kind: kind}
+			if _, err := path.Match(repo, ""); err != nil || !strings.Contains(repo, "/") {
+				return nil, fmt.Errorf("%q: repository must be owner/repo (globs allowed)", entry)
+			}
+		}
+		if f.kind != "*" && !slices.Contains(githubKinds, f.kind) {
+			return nil, fmt.Errorf("%q: event must be one of %s or *", entry, strings.Join(githubKinds, ", "))
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// githubSelected reports whether --github-events wants kind from repo.
+func githubSelected(repo, kind string) bool {
+	for _, f := range githubEvents {
+		if f.kind != "*" && f.kind != kind {
+			continue
+		}
+		if ok, _ := path.Match(f.repo, repo); f.repo == "" || ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowGitHubSigned accepts a delivery signed with the GitHub webhook secret
+// in place of a Bearer token; unsigned requests fall through to
+// requireBearer.
+func allowGitHubSigned(next http.HandlerFunc) http.HandlerFunc {
+	bearer := requireBearer(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		sig := r.Header.Get("X-Hub-Signature-256")
+		if sig == "" || githubSecret == "" {
+			bearer(w, r)
+			return
+		}
+		want, err := hex.DecodeString(strings.TrimPrefix(sig, "sha256="))
+		if err != nil || !strings.HasPrefix(sig, "sha256=") {
+			http.Error(w, "Unauthorized: X-Hub-Signature-256 must be sha256=<hex>", http.StatusUnauthorized)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, *flagMaxBody+1))
+		if err != nil || int64(len(body)) > *flagMaxBody {
+			http.Error(w, "Unauthorized: unreadable or oversized body", http.StatusUnauthorized)
+			return
+		}
+		mac := hmac.New(sha256.New, []byte(githubSecret))
+		mac.Write(body)
+		if !hmac.Equal(mac.Sum(nil), want) {
+			http.Error(w, "Unauthorized: bad signature", http.StatusUnauthorized)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if id := r.Header.Get("X-GitHub-Delivery"); id != "" && r.Header.Get("Idempotency-Key") == "" {
+			r.Header.Set("Idempotency-Key", id)
+		}
+		a := authInfo{ID: "github", Scope: scopeFull}
+		noteAuth(r, a)
+		next(w, r.WithContext(context.WithValue(r.Context(), authKey, a)))
+	}
+}
+
+type ghUser struct {
+	Login string `json:"login"`
+}
+
+type ghIssue struct {
+	Number  int    `json:"number"`
+	Title   string `json:"title"`
+	Body    string `json:"body"`
+	HTMLURL string `json:"html_url"`
+	User    ghUser `json:"user"`
+	Labels  []struct {
+		Name string `json:"name"`
+	} `json:"labels"`
+}
+
+type ghEvent struct {
+	Action     string `json:"action"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Sender ghUser `json:"sender"`
+
+	// push
+	Ref     string `json:"ref"`
+	Compare string `json:"compare"`
+	Deleted bool   `json:"deleted"`
+	Forced  bool   `json:"forced"`
+	Commits []struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+		URL     string `json:"url"`
+		Author  struct {
+			Name string `json:"name"`
+		} `json:"author"`
+	} `json:"commits"`
+
+	// issues, pull_request
+	Issue             *ghIssue `json:"issue"`
+	PullRequest       *ghIssue `json:"pull_request"`
+	RequestedReviewer *ghUser  `json:"requested_reviewer"`
+	RequestedTeam     *struct {
+		Name string `json:"name"`
+	} `json:"requested_team"`
+
+	// workflow_run
+	WorkflowRun *struct {
+		ID         int64  `json:"id"`
+		Name       string `json:"name"`
+		RunNumber  int    `json:"run_number"`
+		Event      string `json:"event"`
+		HeadBranch string `json:"head_branch"`
+		HeadSHA    string `json:"head_sha"`
+		Conclusion string `json:"conclusion"`
+		HTMLURL    string `json:"html_url"`
+		Actor      ghUser `json:"actor"`
+	} `json:"workflow_run"`
+}
+
+func parseGitHub(header http.Header, payload []byte) (sendBody, error) {
+	event := header.Get("X-GitHub-Event")
+	if event == "" {
+		return sendBody{}, errors.New("X-GitHub-Event header is required")
+	}
+	// The webhook's default content type wraps the JSON in a form field.
+	if ct, _, _ := mime.ParseMediaType(header.Get("Content-Type")); ct == "application/x-www-form-urlencoded" {
+		form, err := url.ParseQuery(string(payload))
+		if err != nil {
+			return sendBody{}, err
+		}
+		payload = []byte(form.Get("payload"))
+	}
+	var ev ghEvent
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		return sendBody{}, err
+	}
+	repo := ev.Repository.FullName
+
+	var kind string
+	switch {
+	case event == "push" && !ev.Deleted:
+		kind = "push"
+	case event == "issues" && slices.Contains([]string{"opened", "closed", "reopened"}, ev.Action) && ev.Issue != nil:
+		kind = "issues"
+	case event == "pull_request" && ev.Action == "review_requested" && ev.PullRequest != nil:
+		kind = "review_requested"
+	case event == "workflow_run" && ev.Action == "completed" && ev.WorkflowRun != nil &&
+		slices.Contains([]string{"failure", "timed_out", "startup_failure"}, ev.WorkflowRun.Conclusion):
+		kind = "workflow_failure"
+	default:
+		return sendBody{}, fmt.Errorf("%w: %s event not handled", errIngestIgnored, ghEventName(event, ev.Action))
+	}
+	if !githubSelected(repo, kind) {
+		return sendBody{}, fmt.Errorf("%w: %s from %s not selected by --github-events", errIngestIgnored, kind, repo)
+	}
+
+	b := sendBody{
+		Format:   formatMarkdown,
+		Source:   "github",
+		Priority: priorityDefault,
+		Extras:   &api.Extras{Source: &api.SourceMeta{System: "github"}},
+	}
+	src := b.Extras.Source
+	var t strings.Builder
+	switch kind {
+	case "push":
+		b.Priority = priorityLow
+		ref := strings.TrimPrefix(ev.Ref, "refs/heads/")
+		if tag, ok := strings.CutPrefix(ev.Ref, "refs/tags/"); ok {
+			b.Title = fmt.Sprintf("%s: tag %s pushed", repo, tag)
+			fmt.Fprintf(&t, "**%s** pushed tag `%s`.", ev.Sender.Login, tag)
+			src.ID = repo + "@" + tag
+		} else {
+			verb := "pushed"
+			if ev.Forced {
+				verb = "force-pushed"
+			}
+			b.Title = fmt.Sprintf("%s: %s to %s", repo, plural(len(ev.Commits), "commit"), ref)
+			fmt.Fprintf(&t, "**%s** %s to `%s`:\n\n", ev.Sender.Login, verb, ref)
+			for i, c := range ev.Commits {
+				if i == githubMaxCommits {
+					fmt.Fprintf(&t, "… and %d more\n", len(ev.Commits)-i)
+					break
+				}
+				subject, _, _ := strings.Cut(c.Message, "\n")
+				fmt.Fprintf(&t, "- [`%.7s`](%s) %s — %s\n", c.ID, c.URL, subject, c.Author.Name)
+			}
+			if n := len(ev.Commits); n > 0 {
+				src.ID = repo + "@" + ev.Commits[n-1].ID
+			}
+		}
+		src.URL = ev.Compare
+	case "issues":
+		is := ev.Issue
+		b.Title = fmt.Sprintf("%s #%d %s: %s", repo, is.Number, ev.Action, is.Title)
+		fmt.Fprintf(&t, "[#%d %s](%s) %s by **%s**", is.Number, is.Title, is.HTMLURL, ev.Action, ev.Sender.Login)
+		var labels []string
+		for _, l := range is.Labels {
+			labels = append(labels, "`"+l.Name+"`")
+		}
+		if len(labels) > 0 {
+			t.WriteString(" · " + strings.Join(labels, " "))
+		}
+		if ev.Action == "opened" && strings.TrimSpace(is.Body) != "" {
+			t.WriteString("\n\n" + excerpt(is.Body, 500))
+		}
+		src.ID, src.URL = fmt.Sprintf("%s#%d", repo, is.Number), is.HTMLURL
+	case "review_requested":
+		pr := ev.PullRequest
+		reviewer := "you"
+		if ev.RequestedReviewer != nil {
+			reviewer = ev.RequestedReviewer.Login
+		} else if ev.RequestedTeam != nil {
+			reviewer = "team " + ev.RequestedTeam.Name
+		}
+		b.Title = fmt.Sprintf("%s #%d: review requested from %s", repo, pr.Number, reviewer)
+		fmt.Fprintf(&t, "**%s** requested a review from %s on [#%d %s](%s) by %s.",
+			ev.Sender.Login, reviewer, pr.Number, pr.Title, pr.HTMLURL, pr.User.Login)
+		src.ID, src.URL = fmt.Sprintf("%s#%d", repo, pr.Number), pr.HTMLURL
+	case "workflow_failure":
+		run := ev.WorkflowRun
+		b.Priority = priorityHigh
+		outcome := strings.ReplaceAll(run.Conclusion, "_", " ")
+		if run.Conclusion == "failure" {
+			outcome = "failed"
+		}
+		b.Title = fmt.Sprintf("%s: %s %s on %s", repo, run.Name, outcome, run.HeadBranch)
+		fmt.Fprintf(&t, "Run [#%d](%s) of **%s** on `%s` at `%.7s` (%s by %s) %s.",
+			run.RunNumber, run.HTMLURL, run.Name, run.HeadBranch, run.HeadSHA, run.Event, run.Actor.Login, outcome)
+		src.ID, src.URL = fmt.Sprintf("%s/runs/%d", repo, run.ID), run.HTMLURL
+	}
+	if !httpURL(src.URL) {
+		src.URL = ""
+	}
+	b.ClickURL = src.URL
+	b.Text = strings.TrimSpace(t.String())
+	return b, nil
+}
+
+// ghEventName names an event with its action, if any ("issues.labeled").
+func ghEventName(event, action string) string {
+	if action == "" {
+		return event
+	}
+	return event + "." + action
+}
+
+// excerpt cuts s to about n runes at a line or word boundary.
+func excerpt(s string, n int) string {
+	s = strings.TrimSpace(strings.ReplaceAll(s, "\r\n", "\n"))
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	cut := string(r[:n])
+	if i := strings.LastIndexAny(cut, "\n "); i > n/2 {
+		cut = cut[:i]
+	}
+	return strings.TrimSpace(cut) + " …"
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
@@ -4,6 +4,7 @@ go 1.22
 
 require (
 	github.com/gorilla/websocket v1.5.3
+	ilios.dev/andrnoti/api v1.0.0
 	modernc.org/sqlite v1.30.1
 )
 
@@ -22,3 +23,5 @@ require (
 	modernc.org/strutil v1.2.0 // indirect
 	modernc.org/token v1.1.0 // indirect
 )
+
+replace ilios.dev/andrnoti/api => ./api
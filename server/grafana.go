@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// ── Grafana ───────────────────────────────────────────────────────────────────
+//
+// POST /ingest/grafana is a Grafana unified alerting webhook contact point.
+// Grafana's payload is Alertmanager's with additions, so a notification is
+// built the same way (see alertmanager.go) — same severity mapping through
+// --alertmanager-priorities and topic label — with Grafana's touches: the
+// title is the one Grafana rendered for the contact point, each alert lists
+// the query values that fired it ("B=93.2, C=1") and links to its panel, and
+// clicking the notification opens the panel of the first firing alert (or
+// its dashboard) rather than Grafana's front page.
+
+func parseGrafana(_ http.Header, payload []byte) (sendBody, error) {
+	var wh amWebhook
+	if err := json.Unmarshal(payload, &wh); err != nil {
+		return sendBody{}, err
+	}
+	if wh.Status == "" || len(wh.Alerts) == 0 {
+		return sendBody{}, errors.New("not a Grafana alerting webhook (no status or alerts)")
+	}
+	b := alertGroupBody(wh, "grafana")
+	if wh.Title != "" {
+		b.Title = wh.Title
+	}
+	if u := grafanaClickURL(wh.Alerts); u != "" {
+		b.ClickURL = u
+	}
+	return b, nil
+}
+
+// grafanaClickURL is the panel or dashboard of the first firing alert, or
+// of the first alert when all have resolved.
+func grafanaClickURL(alerts []amAlert) string {
+	var first string
+	for _, a := range alerts {
+		u := a.PanelURL
+		if !httpURL(u) {
+			u = a.DashboardURL
+		}
+		if !httpURL(u) {
+			continue
+		}
+		if a.Status != "resolved" {
+			return u
+		}
+		if first == "" {
+			first = u
+		}
+	}
+	return first
+}
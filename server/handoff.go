@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ── Socket Handoff ────────────────────────────────────────────────────────────
+//
+// SIGUSR2 starts the server binary again as a child, passing it the listening
+// socket (fd 3) and a readiness pipe (fd 4). Once the child has opened the
+// database and is serving, the old process stops accepting, finishes in-flight
+// requests and closes its WebSocket clients one by one over --drain-period, so
+// phones reconnect to the new process gradually instead of all at once.
+// If the child fails before it is ready, the old process keeps serving.
+// Side listeners (mail, syslog) are not passed on: the old process closes
+// them when it drains and the child binds them again, retrying until then.
+
+const (
+	envListenFD = "ANDRNOTI_LISTEN_FD"
+	envReadyFD  = "ANDRNOTI_READY_FD"
+
+	handoffReadyTimeout = 30 * time.Second
+	sideBindRetry       = 2 * time.Second
+)
+
+var (
+	handoffBusy atomic.Bool // a handoff is in progress
+	draining    atomic.Bool // the child is ready; this process is on its way out
+)
+
+// sideListeners are closed by drain.
+var sideListeners = struct {
+	sync.Mutex
+	list   []io.Closer
+	closed bool
+}{}
+
+// bindSide calls bind until it succeeds and registers what it opened to be
+// closed on drain. A port still held by the process being handed off from
+// fails to bind, so failures are retried; ok is false if this process began
+// draining first.
+func bindSide[T io.Closer](name string, bind func() (T, error)) (T, bool) {
+	for logged := false; ; logged = true {
+		ln, err := bind()
+		if err == nil {
+			sideListeners.Lock()
+			defer sideListeners.Unlock()
+			if sideListeners.closed {
+				ln.Close()
+				return ln, false
+			}
+			sideListeners.list = append(sideListeners.list, ln)
+			return ln, true
+		}
+		if draining.Load() {
+			return ln, false
+		}
+		if !logged {
+			log.Printf("%s: %v; retrying", name, err)
+		}
+		time.Sleep(sideBindRetry)
+	}
+}
+
+// closeSideListeners lets a handed-off process bind the side ports.
+// Connections already accepted carry on.
+func closeSideListeners() {
+	sideListeners.Lock()
+	defer sideListeners.Unlock()
+	sideListeners.closed = true
+	for _, c := range sideListeners.list {
+		c.Close()
+	}
+}
+
+// listen returns the socket inherited from a parent process, or a new one.
+func listen(lc net.ListenConfig, addr string) (net.Listener, error) {
+	v := os.Getenv(envListenFD)
+	if v == "" {
+		return lc.Listen(context.Background(), "tcp", addr)
+	}
+	os.Unsetenv(envListenFD)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s=%q: %w", envListenFD, v, err)
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited listener: %w", err)
+	}
+	log.Printf("handoff: using listener inherited from pid %d", os.Getppid())
+	return ln, nil
+}
+
+// signalReady tells the parent (on a handoff) and systemd (Type=notify) that
+// this process is serving.
+func signalReady() {
+	if v := os.Getenv(envReadyFD); v != "" {
+		os.Unsetenv(envReadyFD)
+		if fd, err := strconv.Atoi(v); err == nil {
+			f := os.NewFile(uintptr(fd), "ready")
+			f.Write([]byte{1})
+			f.Close()
+		}
+	}
+	sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+}
+
+// sdNotify sends a state string to systemd's notify socket, if there is one.
+// MAINPID lets a handed-off child take over as the service's main process.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		log.Printf("sd_notify: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
+
+// watchHandoff performs a handoff on every handoff signal until one succeeds,
+// then drains this process and closes done.
+func watchHandoff(h *hub, srv *http.Server, ln net.Listener, done chan<- struct{}) {
+	sigs := handoffSignals()
+	if len(sigs) == 0 {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	for range ch {
+		if !handoffBusy.CompareAndSwap(false, true) {
+			log.Printf("handoff: already in progress")
+			continue
+		}
+		pid, err := startChild(ln)
+		if err != nil {
+			log.Printf("handoff: %v; still serving", err)
+			handoffBusy.Store(false)
+			continue
+		}
+		signal.Stop(ch)
+		log.Printf("handoff: pid %d is serving; draining", pid)
+		drain(h, srv)
+		close(done)
+		return
+	}
+}
+
+// startChild re-executes the current binary with the same arguments and waits
+// until it reports ready.
+func startChild(ln net.Listener) (int, error) {
+	fl, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return 0, fmt.Errorf("listener %T cannot be passed on", ln)
+	}
+	lf, err := fl.File()
+	if err != nil {
+		return 0, err
+	}
+	defer lf.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readyR.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return 0, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{lf, readyW}
+	cmd.Env = append(os.Environ(), envListenFD+"=3", envReadyFD+"=4")
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return 0, err
+	}
+	go cmd.Wait()
+
+	// The pipe yields a byte once the child is serving, or EOF if it exits
+	// first.
+	readyR.SetReadDeadline(time.Now().Add(handoffReadyTimeout))
+	buf := make([]byte, 1)
+	if n, _ := readyR.Read(buf); n == 0 {
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("pid %d did not become ready", cmd.Process.Pid)
+	}
+	return cmd.Process.Pid, nil
+}
+
+// drain stops accepting connections and scheduled jobs, lets in-flight
+// requests finish and closes WebSocket clients spread over --drain-period.
+func drain(h *hub, srv *http.Server) {
+	draining.Store(true)
+	releaseLease() // the new process takes over scheduled jobs
+	closeSideListeners()
+	shutdown := make(chan struct{})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), *flagDrainPeriod+10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("handoff: shutdown: %v", err)
+		}
+		close(shutdown)
+	}()
+
+	h.mu.RLock()
+	clients := make([]*client, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mu.RUnlock()
+	var gap time.Duration
+	if len(clients) > 0 {
+		gap = *flagDrainPeriod / time.Duration(len(clients))
+	}
+	// The new process starts out empty, so the hint scales with how many
+	// clients are about to reconnect to it rather than with this one's state.
+	load := float64(len(clients)) / float64(max(*flagMaxClients, 1))
+	for _, c := range clients {
+		c.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseServiceRestart, closeReason("server restarting", load)),
+			time.Now().Add(5*time.Second))
+		c.conn.Close()
+		time.Sleep(gap)
+	}
+	<-shutdown
+	log.Printf("handoff: drained %d WebSocket clients", len(clients))
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Socket handoff relies on fd inheritance and SIGUSR2; elsewhere the server
+// simply runs until it is stopped.
+func handoffSignals() []os.Signal { return nil }
@@ -0,0 +1,10 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func handoffSignals() []os.Signal { return []os.Signal{syscall.SIGUSR2} }
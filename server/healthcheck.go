@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// ── Health ────────────────────────────────────────────────────────────────────
+//
+// /health checks what the server depends on and explains itself: the
+// database answers a ping, the hub loop that fans out broadcasts is still
+// turning, and the filesystem holding the database has at least
+// --health-min-disk-mb free. status is "ok", "degraded" (serving, but
+// something needs attention: low disk, failed maintenance, load shedding, a
+// drifting clock) or "down" (the database or hub doesn't answer), and
+// reasons lists why.
+// "down" answers 503 so uptime monitors alert; otherwise it answers 200.
+
+const healthTimeout = 2 * time.Second
+
+type healthCheck struct {
+	OK      bool   `json:"ok"`
+	Latency string `json:"latency,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type diskCheck struct {
+	OK      bool   `json:"ok"`
+	Path    string `json:"path"`
+	FreeMB  uint64 `json:"free_mb"`
+	TotalMB uint64 `json:"total_mb"`
+	Error   string `json:"error,omitempty"`
+}
+
+func handleHealth(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var down, degraded []string
+
+		dbc := healthCheck{OK: true}
+		ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+		start := time.Now()
+		err := db.PingContext(ctx)
+		cancel()
+		dbc.Latency = time.Since(start).Round(time.Microsecond).String()
+		if err != nil {
+			dbc.OK, dbc.Error = false, err.Error()
+			down = append(down, "database: "+err.Error())
+		}
+
+		hubc := healthCheck{OK: true}
+		start = time.Now()
+		if !h.alive(healthTimeout) {
+			hubc.OK, hubc.Error = false, "hub loop did not answer within "+healthTimeout.String()
+			down = append(down, "hub: not responding")
+		}
+		hubc.Latency = time.Since(start).Round(time.Microsecond).String()
+
+		disk := diskCheck{OK: true, Path: filepath.Dir(*flagDB)}
+		free, total, err := diskSpace(disk.Path)
+		switch {
+		case err != nil:
+			disk.Error = err.Error()
+		case free < uint64(*flagHealthMinDiskMB)<<20:
+			disk.OK = false
+			degraded = append(degraded, fmt.Sprintf("disk: %d MB free, below %d MB", free>>20, *flagHealthMinDiskMB))
+		}
+		disk.FreeMB, disk.TotalMB = free>>20, total>>20
+
+		report := lastDBMaintReport()
+		if report != nil && (!report.IntegrityOK || report.Error != "") {
+			degraded = append(degraded, "database maintenance failed")
+		}
+		out := map[string]any{
+			"version":        serverVersion,
+			"database":       dbc,
+			"hub":            hubc,
+			"disk":           disk,
+			"db_maintenance": report,
+		}
+		if ntpEnabled() {
+			c := currentClockStatus()
+			if c != nil && c.Error == "" && !c.OK {
+				degraded = append(degraded, fmt.Sprintf("clock: %.0fs off %s, beyond %s", math.Abs(c.Drift), c.Server, c.Tolerance))
+			}
+			out["clock"] = c
+		}
+		if shedEnabled() {
+			s := currentShedStatus()
+			if s.Active {
+				degraded = append(degraded, "load shedding: "+s.Reason)
+			}
+			out["load_shedding"] = s
+		}
+
+		status, code := "ok", http.StatusOK
+		switch {
+		case len(down) > 0:
+			status, code = "down", http.StatusServiceUnavailable
+		case len(degraded) > 0:
+			status = "degraded"
+		}
+		out["status"] = status
+		out["reasons"] = append(append([]string{}, down...), degraded...)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// ── Liveness and Readiness ────────────────────────────────────────────────────
+//
+// /healthz is the liveness probe: 200 while the process can still do its job
+// at all, which only fails if the hub loop has stopped turning — restarting
+// is the fix for that, but not for a database outage. /readyz is the
+// readiness probe: 200 once startup has finished (database open, migrations
+// run, hub and background jobs started), while the database and hub answer
+// and the server is not draining after a socket handoff, so load balancers
+// and probes only route to an instance that can serve. Both answer plain
+// text naming what failed.
+
+// started is set once main has finished initialising.
+var started atomic.Bool
+
+func handleHealthz(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.alive(healthTimeout) {
+			http.Error(w, "hub: not responding", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+func handleReadyz(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		notReady := func(reason string) {
+			setRetryAfter(w, 1)
+			http.Error(w, reason, http.StatusServiceUnavailable)
+		}
+		if !started.Load() {
+			notReady("starting")
+			return
+		}
+		if draining.Load() {
+			notReady("draining")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+		defer cancel()
+		if err := db.PingContext(ctx); err != nil {
+			notReady("database: " + err.Error())
+			return
+		}
+		if !h.alive(healthTimeout) {
+			notReady("hub: not responding")
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	}
+}
+
+// ── Healthcheck Command ───────────────────────────────────────────────────────
+//
+//	andr-noti healthcheck [--url http://127.0.0.1:8086] [--timeout 5s] [--insecure]
+//
+// Exits 0 when /readyz answers 200 and 1 otherwise, for Docker HEALTHCHECK
+// and Kubernetes exec probes in images without curl. A URL without a path
+// gets /readyz appended.
+
+func runHealthcheck(args []string) {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	rawURL := fs.String("url", "http://127.0.0.1:8086", "Server URL, or the full /readyz URL")
+	timeout := fs.Duration("timeout", 5*time.Second, "Give up after this long")
+	insecure := fs.Bool("insecure", false, "Skip TLS certificate verification")
+	fs.Parse(args)
+
+	u, err := url.Parse(*rawURL)
+	if err != nil || u.Host == "" {
+		fmt.Fprintf(os.Stderr, "healthcheck: bad --url %q\n", *rawURL)
+		os.Exit(1)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/readyz"
+	}
+	hc := &http.Client{Timeout: *timeout}
+	if *insecure {
+		hc.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	resp, err := hc.Get(u.String())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "healthcheck: %v\n", err)
+		os.Exit(1)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "healthcheck: %s: %s\n", u, resp.Status)
+		os.Exit(1)
+	}
+}
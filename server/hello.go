@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// ── Protocol Negotiation ──────────────────────────────────────────────────────
+//
+// A client may open with {"type":"hello"}: the newest protocol it speaks,
+// the features it wants and, with "topics", the topics it wants. The server
+// answers with a "hello" frame giving the protocol both sides will use and
+// the features granted on this connection — those it has that the client
+// asked for. A client can say hello again to change its topics.
+//
+// This is how the frame schema evolves without breaking old clients: a
+// frame type or field that protocol 1 clients wouldn't understand goes only
+// to clients whose hello agreed on a newer protocol. Clients that never say
+// hello are protocol 1 clients, and get exactly what they always got.
+//
+// Hello only narrows or switches on what the connection can do; it can't
+// reach back before it arrived. Replay (since_id) and compression are
+// settled by the connect URL and handshake, so the answer only confirms
+// them, and the history snapshot is sent before any hello — topics apply to
+// live frames from the answer on.
+
+// wsFeatures are the features the server knows, in the order it lists them.
+var wsFeatures = []string{api.FeatureAcks, api.FeatureBatch, api.FeatureCompression, api.FeatureSinceID, api.FeatureTopics}
+
+// wsCompressed reports whether the upgrade of r negotiates permessage-deflate.
+func wsCompressed(r *http.Request) bool {
+	return upgrader.EnableCompression &&
+		strings.Contains(strings.Join(r.Header.Values("Sec-WebSocket-Extensions"), ","), "permessage-deflate")
+}
+
+// hello applies a client's hello and returns the answer frame.
+func (c *client) hello(m wsClientMessage) []byte {
+	protocol := min(max(m.Protocol, 1), api.ProtocolVersion)
+	granted := []string{}
+	for _, f := range wsFeatures {
+		if !slices.Contains(m.Features, f) {
+			continue
+		}
+		switch f {
+		case api.FeatureAcks:
+			if c.device == "" {
+				continue // nothing to move without ?device=
+			}
+		case api.FeatureCompression:
+			if !c.compressed {
+				continue
+			}
+		case api.FeatureBatch:
+			c.batch.Store(true)
+		}
+		granted = append(granted, f)
+	}
+	var topics []string
+	if slices.Contains(granted, api.FeatureTopics) && len(m.Topics) > 0 {
+		topics = slices.Clone(m.Topics)
+		slices.Sort(topics)
+		topics = slices.Compact(topics)
+	}
+	c.topics.Store(&topics)
+	c.features.Store(&granted)
+	c.protocol.Store(int32(protocol))
+	log.Printf("ws: client %d said hello: protocol %d, features %v, topics %v", c.id, protocol, granted, topics)
+	data, _ := json.Marshal(wsMessage{Type: api.TypeHello, Hello: &api.Hello{
+		Protocol: protocol,
+		Server:   serverVersion,
+		API:      api.Version,
+		Features: granted,
+		Topics:   topics,
+	}})
+	return data
+}
+
+// speaks reports whether c agreed on protocol or newer in its hello.
+func (c *client) speaks(protocol int) bool {
+	return int(c.protocol.Load()) >= protocol
+}
+
+// sees reports whether live frames about topic go to c: the topic's ACL lets
+// its user see it, and it is one of the topics its hello asked for, if any.
+func (c *client) sees(topic string) bool {
+	if !canSee(c.user, topic) {
+		return false
+	}
+	topics := c.topics.Load()
+	return topics == nil || len(*topics) == 0 || slices.Contains(*topics, topic)
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// ── Generic Webhooks ──────────────────────────────────────────────────────────
+//
+// For services without a receiver of their own, PUT /admin/hooks/{name}
+// stores a mapping from that service's JSON to a notification: title, text,
+// topic, priority, click_url and skip are Go text/templates run against the
+// decoded payload, so {{.issue.title}} reads a field. POST /ingest/hook/{name}
+// then accepts the service's webhooks as they are and sends what the mapping
+// renders, through the same path as the other /ingest receivers. A skip
+// template that renders "true" drops the payload (202), so one hook can
+// ignore the events it doesn't care about. POST /admin/hooks/{name}/preview
+// renders a sample payload without sending it.
+//
+// A missing key renders empty, but reading through one is an error; get
+// follows a dotted path that may be missing
+// ({{get . "pull_request.user.login"}}). Numbers keep the payload's own
+// spelling (an id stays 1700000000, not 1.7e+09), and num turns one into a
+// float for comparisons with float literals ({{if gt (num .value) 90.0}}).
+// default replaces an empty value and json re-encodes one.
+//
+// Like templates, every save and delete is recorded in the rule version
+// store (rules.go), so a mapping can be reverted like a rule.
+
+const ruleKindHook = "hook"
+
+type ingestHook struct {
+	Name      string `json:"name"`
+	Title     string `json:"title"`
+	Text      string `json:"text"`
+	Format    string `json:"format,omitempty"`
+	Topic     string `json:"topic,omitempty"`
+	Priority  string `json:"priority,omitempty"` // template rendering 1-5
+	ClickURL  string `json:"click_url,omitempty"`
+	Skip      string `json:"skip,omitempty"` // template; "true" drops the payload
+	UpdatedBy string `json:"updated_by,omitempty"`
+	UpdatedAt string `json:"updated_at,omitempty"`
+}
+
+func initHookTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS ingest_hooks (
+			name       TEXT PRIMARY KEY,
+			title      TEXT NOT NULL DEFAULT '',
+			text       TEXT NOT NULL,
+			format     TEXT NOT NULL DEFAULT '',
+			topic      TEXT NOT NULL DEFAULT '',
+			priority   TEXT NOT NULL DEFAULT '',
+			click_url  TEXT NOT NULL DEFAULT '',
+			skip       TEXT NOT NULL DEFAULT '',
+			updated_by TEXT NOT NULL DEFAULT '',
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	return err
+}
+
+const hookCols = `name, title, text, format, topic, priority, click_url, skip, updated_by, updated_at`
+
+func scanHook(s interface{ Scan(...any) error }) (ingestHook, error) {
+	var k ingestHook
+	err := s.Scan(&k.Name, &k.Title, &k.Text, &k.Format, &k.Topic, &k.Priority, &k.ClickURL, &k.Skip, &k.UpdatedBy, &k.UpdatedAt)
+	return k, err
+}
+
+func getHook(name string) (ingestHook, error) {
+	return scanHook(db.QueryRow(`SELECT `+hookCols+` FROM ingest_hooks WHERE name = ?`, name))
+}
+
+// upsertHook stores k, replacing any mapping of the same name.
+func upsertHook(k ingestHook, by string) error {
+	_, err := db.Exec(`
+		INSERT INTO ingest_hooks (name, title, text, format, topic, priority, click_url, skip, updated_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET title = excluded.title, text = excluded.text, format = excluded.format,
+			topic = excluded.topic, priority = excluded.priority, click_url = excluded.click_url,
+			skip = excluded.skip, updated_by = excluded.updated_by, updated_at = CURRENT_TIMESTAMP`,
+		k.Name, k.Title, k.Text, k.Format, k.Topic, k.Priority, k.ClickURL, k.Skip, by)
+	return err
+}
+
+// hookVersion is the body recorded for a save, without the fields the
+// version carries itself.
+func hookVersion(k ingestHook) string {
+	k.UpdatedBy, k.UpdatedAt = "", ""
+	raw, _ := json.Marshal(k)
+	return string(raw)
+}
+
+// applyHook puts a reverted version of a mapping in force.
+func applyHook(name, body, by string) error {
+	if body == "" {
+		_, err := db.Exec(`DELETE FROM ingest_hooks WHERE name = ?`, name)
+		return err
+	}
+	var k ingestHook
+	if err := json.Unmarshal([]byte(body), &k); err != nil {
+		return err
+	}
+	k.Name = name
+	return upsertHook(k, by)
+}
+
+var hookFuncs = template.FuncMap{
+	"get": hookGet,
+	"default": func(def string, v any) any {
+		if v == nil || fmt.Sprint(v) == "" {
+			return def
+		}
+		return v
+	},
+	"num": func(v any) (float64, error) {
+		switch n := v.(type) {
+		case json.Number:
+			return n.Float64()
+		case string:
+			return strconv.ParseFloat(n, 64)
+		case nil:
+			return 0, nil
+		}
+		return 0, fmt.Errorf("num: %v is not a number", v)
+	},
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// hookGet follows a dotted path of object keys and array indexes, returning
+// nil where it runs out.
+func hookGet(v any, path string) any {
+	for _, key := range strings.Split(path, ".") {
+		switch c := v.(type) {
+		case map[string]any:
+			v = c[key]
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil
+			}
+			v = c[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// parse compiles the templated fields, in the order render fills them.
+func (k ingestHook) parse() ([]*template.Template, error) {
+	var out []*template.Template
+	for _, f := range []struct{ name, src string }{
+		{"skip", k.Skip}, {"title", k.Title}, {"text", k.Text},
+		{"topic", k.Topic}, {"priority", k.Priority}, {"click_url", k.ClickURL},
+	} {
+		t, err := template.New(f.name).Option("missingkey=zero").Funcs(hookFuncs).Parse(f.src)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.name, err)
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// render maps payload to a notification, or errIngestIgnored when skip
+// says so.
+func (k ingestHook) render(payload []byte) (sendBody, error) {
+	tmpls, err := k.parse()
+	if err != nil {
+		return sendBody{}, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var data any
+	if err := dec.Decode(&data); err != nil {
+		return sendBody{}, err
+	}
+	out := make([]string, len(tmpls))
+	for i, t := range tmpls {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return sendBody{}, err
+		}
+		// A missing key prints as "<no value>"; treat it as empty.
+		out[i] = strings.TrimSpace(strings.ReplaceAll(buf.String(), "<no value>", ""))
+		if i == 0 && out[0] == "true" {
+			return sendBody{}, fmt.Errorf("%w: skip rendered true", errIngestIgnored)
+		}
+	}
+	b := sendBody{
+		Title:    out[1],
+		Text:     out[2],
+		Format:   k.Format,
+		Source:   k.Name,
+		Topic:    out[3],
+		ClickURL: out[5],
+		Extras:   &api.Extras{Source: &api.SourceMeta{System: k.Name}},
+	}
+	if out[4] != "" {
+		p, err := strconv.Atoi(out[4])
+		if err != nil || p < priorityMin || p > priorityUrgent {
+			return sendBody{}, fmt.Errorf("priority rendered %q, want 1-5", out[4])
+		}
+		b.Priority = p
+	}
+	if b.ClickURL != "" && !httpURL(b.ClickURL) {
+		return sendBody{}, fmt.Errorf("click_url rendered %q, want an http(s) URL", b.ClickURL)
+	}
+	b.Extras.Source.URL = b.ClickURL
+	return b, nil
+}
+
+func checkHook(name string, k ingestHook) error {
+	if !templateNameRE.MatchString(name) {
+		return errors.New("name must be 1-64 letters, digits, '.', '_' or '-'")
+	}
+	if strings.TrimSpace(k.Text) == "" {
+		return errors.New("text is required")
+	}
+	switch k.Format {
+	case "", formatPlain, formatMarkdown:
+	default:
+		return errors.New("format must be plain or markdown")
+	}
+	_, err := k.parse()
+	return err
+}
+
+// handleHookIngest receives a webhook for the stored hook named in the path.
+func handleHookIngest(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		k, err := getHook(name)
+		if err == sql.ErrNoRows {
+			http.Error(w, "no such hook", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("hook %q: %v", name, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		handleIngest(h, "hook "+name, func(_ http.Header, payload []byte) (sendBody, error) {
+			return k.render(payload)
+		})(w, r)
+	}
+}
+
+func handleHooks() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rows, err := db.Query(`SELECT ` + hookCols + ` FROM ingest_hooks ORDER BY name`)
+		if err != nil {
+			log.Printf("hooks: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		out := []ingestHook{}
+		for rows.Next() {
+			k, err := scanHook(rows)
+			if err != nil {
+				log.Printf("hooks: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, k)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// handleHook shows (GET), stores (PUT) or deletes (DELETE) a hook.
+func handleHook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, by := r.PathValue("name"), authFrom(r).ID
+		switch r.Method {
+		case http.MethodGet:
+			k, err := getHook(name)
+			if err == sql.ErrNoRows {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			} else if err != nil {
+				log.Printf("hook %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(k)
+		case http.MethodPut:
+			var k ingestHook
+			if err := json.NewDecoder(r.Body).Decode(&k); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			if err := checkHook(name, k); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			k.Name = name
+			err := upsertHook(k, by)
+			var version int
+			if err == nil {
+				version, err = saveRuleVersion(ruleKindHook, name, hookVersion(k), false, by)
+			}
+			if err != nil {
+				log.Printf("hook %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("hooks: %q saved by %s (version %d)", name, by, version)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			res, err := db.Exec(`DELETE FROM ingest_hooks WHERE name = ?`, name)
+			if err != nil {
+				log.Printf("hook %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			version, err := saveRuleVersion(ruleKindHook, name, "", true, by)
+			if err != nil {
+				log.Printf("hook %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("hooks: %q deleted by %s (version %d)", name, by, version)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleHookPreview renders a sample payload with a stored hook and returns
+// the notification it would send.
+func handleHookPreview() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.PathValue("name")
+		k, err := getHook(name)
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("hook %q: %v", name, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		limitBody(w, r)
+		var payload bytes.Buffer
+		if _, err := payload.ReadFrom(r.Body); err != nil {
+			if !bodyTooLarge(w, err) {
+				http.Error(w, "bad request", http.StatusBadRequest)
+			}
+			return
+		}
+		out := struct {
+			Skipped      bool      `json:"skipped"`
+			Notification *sendBody `json:"notification,omitempty"`
+			Error        string    `json:"error,omitempty"`
+		}{}
+		b, err := k.render(payload.Bytes())
+		switch {
+		case errors.Is(err, errIngestIgnored):
+			out.Skipped = true
+		case err != nil:
+			out.Error = err.Error()
+		default:
+			if le, cerr := b.check(); le != nil {
+				out.Error = le.Error
+			} else if cerr != nil {
+				out.Error = cerr.Error()
+			}
+			out.Notification = &b
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
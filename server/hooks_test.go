@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestHookHistoryAndRevert(t *testing.T) {
+	testDB(t)
+	hook := handleHook()
+	for _, body := range []string{`{"text":"{{.v1}}"}`, `{"text":"{{.v2}}"}`} {
+		if w := adminCall(hook, http.MethodPut, "uptime", body); w.Code != http.StatusNoContent {
+			t.Fatalf("PUT %s: %d %s", body, w.Code, w.Body)
+		}
+	}
+
+	var versions []ruleVersion
+	json.NewDecoder(adminCall(handleRuleHistory(ruleKindHook), http.MethodGet, "uptime", "").Body).Decode(&versions)
+	if len(versions) != 2 {
+		t.Fatalf("history: %+v", versions)
+	}
+	if w := adminCall(handleRuleRevert(ruleKindHook, applyHook), http.MethodPost, "uptime", `{"version":1}`); w.Code != http.StatusOK {
+		t.Fatalf("revert: %d %s", w.Code, w.Body)
+	}
+	if k, err := getHook("uptime"); err != nil || k.Text != "{{.v1}}" {
+		t.Errorf("after reverting to version 1: %+v %v", k, err)
+	}
+}
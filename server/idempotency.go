@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ── Idempotency Keys ──────────────────────────────────────────────────────────
+//
+// A producer that retries a send after a timeout can't tell whether the first
+// attempt was stored. With an Idempotency-Key header, the first request with a
+// key runs normally and its response is kept for --idempotency-ttl; repeating
+// the key returns that response (with Idempotent-Replayed: true) instead of
+// sending again. Keys are scoped to the caller. Reusing a key with a different
+// body is refused with 422, and a repeat while the first is still running
+// with 409. Server errors aren't kept, so those can be retried, and neither
+// are 429s (quota, rate limit) or a request whose handler panicked: a retry
+// after Retry-After must run, not replay the refusal. One still in progress
+// after idempotencyAbandoned was cut off by a crash or restart, and the next
+// request with its key runs afresh.
+
+const (
+	idempotencyMaxKey    = 255
+	idempotencyAbandoned = time.Minute
+)
+
+func initIdempotencyTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS idempotency_keys (
+			caller       TEXT NOT NULL,
+			key          TEXT NOT NULL,
+			body_hash    TEXT NOT NULL,
+			status       INTEGER NOT NULL DEFAULT 0, -- 0 while in progress
+			content_type TEXT NOT NULL DEFAULT '',
+			response     BLOB,
+			created_at   DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (caller, key)
+		)
+	`)
+	return err
+}
+
+// recordingWriter passes a response through while keeping a copy.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// idempotent wraps a send handler with Idempotency-Key handling. It must run
+// inside the auth middleware, since keys belong to the caller.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || *flagIdempotencyTTL <= 0 || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if len(key) > idempotencyMaxKey {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+		// Read one byte past the limit so the handler still sees an
+		// oversized body and answers 413.
+		body, err := io.ReadAll(io.LimitReader(r.Body, *flagMaxBody+1))
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(r.URL.Path+"\n"), body...))
+		hash := hex.EncodeToString(sum[:])
+		caller := authFrom(r).ID
+
+		now := time.Now()
+		if _, err := db.Exec(`DELETE FROM idempotency_keys WHERE caller = ? AND key = ?
+			AND (created_at < ? OR status = 0 AND created_at < ?)`,
+			caller, key, sqliteTime(now.Add(-*flagIdempotencyTTL)), sqliteTime(now.Add(-idempotencyAbandoned))); err != nil {
+			log.Printf("idempotency: %v", err)
+		}
+		res, err := db.Exec(`INSERT OR IGNORE INTO idempotency_keys (caller, key, body_hash) VALUES (?, ?, ?)`,
+			caller, key, hash)
+		if err != nil {
+			log.Printf("idempotency: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			replayIdempotent(w, caller, key, hash)
+			return
+		}
+
+		rw := &recordingWriter{ResponseWriter: w}
+		kept := false
+		defer func() {
+			if !kept {
+				db.Exec(`DELETE FROM idempotency_keys WHERE caller = ? AND key = ?`, caller, key)
+			}
+		}()
+		next(rw, r)
+		if !keepIdempotent(rw.status) {
+			return
+		}
+		kept = true
+		if _, err := db.Exec(`UPDATE idempotency_keys SET status = ?, content_type = ?, response = ? WHERE caller = ? AND key = ?`,
+			rw.status, rw.Header().Get("Content-Type"), rw.body.Bytes(), caller, key); err != nil {
+			log.Printf("idempotency: %v", err)
+		}
+	}
+}
+
+// keepIdempotent reports whether a response with status is replayed to
+// later requests with the same key. Refusals that say "try again later" —
+// 429 and every 5xx, 503 included — are not.
+func keepIdempotent(status int) bool {
+	return status != 0 && status != http.StatusTooManyRequests && status < 500
+}
+
+func replayIdempotent(w http.ResponseWriter, caller, key, hash string) {
+	var storedHash, contentType string
+	var status int
+	var response []byte
+	err := db.QueryRow(`SELECT body_hash, status, content_type, response FROM idempotency_keys WHERE caller = ? AND key = ?`,
+		caller, key).Scan(&storedHash, &status, &contentType, &response)
+	switch {
+	case err != nil:
+		log.Printf("idempotency: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	case storedHash != hash:
+		http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+	case status == 0:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "a request with this Idempotency-Key is in progress", http.StatusConflict)
+	default:
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(status)
+		w.Write(response)
+		log.Printf("idempotency: replayed %s for %s", key, caller)
+	}
+}
+
+// idempotencyPruneJob forgets keys past the TTL every hour.
+func idempotencyPruneJob() *schedJob {
+	return &schedJob{
+		name:     "idempotency-prune",
+		interval: time.Hour,
+		run: func() error {
+			_, err := db.Exec(`DELETE FROM idempotency_keys WHERE created_at < ?`,
+				sqliteTime(time.Now().Add(-*flagIdempotencyTTL)))
+			return err
+		},
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keyedSend runs handler for a /send with Idempotency-Key k, as caller
+// "primary".
+func keyedSend(handler http.HandlerFunc, k string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(`{"title":"t","text":"x"}`))
+	r.Header.Set("Idempotency-Key", k)
+	r = r.WithContext(context.WithValue(r.Context(), authKey, authInfo{ID: "primary", Scope: scopeFull}))
+	w := httptest.NewRecorder()
+	idempotent(handler)(w, r)
+	return w
+}
+
+func TestIdempotencyKeyFreedAfterPanic(t *testing.T) {
+	testDB(t)
+	func() {
+		defer func() { recover() }()
+		keyedSend(func(http.ResponseWriter, *http.Request) { panic("boom") }, "k1")
+	}()
+	w := keyedSend(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusCreated) }, "k1")
+	if w.Code != http.StatusCreated {
+		t.Errorf("retry after a panic: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestIdempotencyKeyAbandoned(t *testing.T) {
+	testDB(t)
+	// Left in progress by a process that died mid-request.
+	if _, err := db.Exec(`INSERT INTO idempotency_keys (caller, key, body_hash, created_at) VALUES ('primary', 'k1', 'x', ?)`,
+		sqliteTime(time.Now().Add(-2*idempotencyAbandoned))); err != nil {
+		t.Fatal(err)
+	}
+	w := keyedSend(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusCreated) }, "k1")
+	if w.Code != http.StatusCreated {
+		t.Errorf("retry of an abandoned request: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestIdempotencyKeyFreedAfterQuota(t *testing.T) {
+	testDB(t)
+	h := testHub(t)
+	if _, err := db.Exec(`INSERT INTO token_quotas (token_id, daily_limit) VALUES ('primary', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	if w := keyedSend(handleSend(h), "k1"); w.Code != http.StatusOK {
+		t.Fatalf("first send: %d %s", w.Code, w.Body)
+	}
+	if w := keyedSend(handleSend(h), "k2"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("send over quota: %d %s", w.Code, w.Body)
+	}
+	// Midnight UTC: the day's count starts over.
+	if _, err := db.Exec(`DELETE FROM token_usage`); err != nil {
+		t.Fatal(err)
+	}
+	w := keyedSend(handleSend(h), "k2")
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry after the quota reset: %d replayed=%q %s", w.Code, w.Header().Get("Idempotent-Replayed"), w.Body)
+	}
+}
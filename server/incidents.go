@@ -0,0 +1,344 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ── Incident Log ──────────────────────────────────────────────────────────────
+//
+// Every notification at or above --incident-min-priority opens an incident.
+// Each thing that happens to it afterwards (assignment, escalation, ack) is
+// appended as a step, so the path an alert took can be reviewed later.
+
+type incidentStep struct {
+	At     string `json:"at"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+type incident struct {
+	ID             int64          `json:"id"`
+	NotificationID int64          `json:"notification_id"`
+	Title          string         `json:"title"`
+	Topic          string         `json:"topic"`
+	Priority       int            `json:"priority"`
+	Assignee       string         `json:"assignee"`
+	OpenedAt       string         `json:"opened_at"`
+	AckedBy        *string        `json:"acked_by"`
+	AckedAt        *string        `json:"acked_at"`
+	TimeToAck      *int64         `json:"time_to_ack_seconds"`
+	Steps          []incidentStep `json:"steps,omitempty"`
+}
+
+func initIncidentTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS incidents (
+			id              INTEGER PRIMARY KEY AUTOINCREMENT,
+			notification_id INTEGER NOT NULL UNIQUE,
+			title           TEXT NOT NULL DEFAULT '',
+			topic           TEXT NOT NULL DEFAULT '',
+			priority        INTEGER NOT NULL,
+			assignee        TEXT NOT NULL DEFAULT '',
+			opened_at       DATETIME DEFAULT CURRENT_TIMESTAMP,
+			acked_by        TEXT,
+			acked_at        DATETIME
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS incident_steps (
+			incident_id INTEGER NOT NULL,
+			at          DATETIME DEFAULT CURRENT_TIMESTAMP,
+			kind        TEXT NOT NULL,
+			detail      TEXT NOT NULL DEFAULT ''
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS incident_steps_incident ON incident_steps (incident_id)`)
+	return err
+}
+
+// openIncident records an incident for n if it is urgent enough.
+func openIncident(n Notification) {
+	if n.Priority < *flagIncidentPriority {
+		return
+	}
+	res, err := db.Exec(
+		`INSERT OR IGNORE INTO incidents (notification_id, title, topic, priority, assignee) VALUES (?, ?, ?, ?, ?)`,
+		n.ID, sealColumn("title", n.Title), n.Topic, n.Priority, n.Assignee,
+	)
+	if err != nil {
+		log.Printf("incident: open for id=%d: %v", n.ID, err)
+		return
+	}
+	// Already open: LastInsertId would name whatever row came before.
+	if n, _ := res.RowsAffected(); n == 0 {
+		return
+	}
+	id, _ := res.LastInsertId()
+	detail := "broadcast to all clients"
+	if n.Assignee != "" {
+		detail = "assigned to " + n.Assignee + " (on call)"
+	}
+	addIncidentStep(id, "opened", detail)
+}
+
+func addIncidentStep(incidentID int64, kind, detail string) {
+	if _, err := db.Exec(
+		`INSERT INTO incident_steps (incident_id, kind, detail) VALUES (?, ?, ?)`,
+		incidentID, kind, detail,
+	); err != nil {
+		log.Printf("incident: step %s for %d: %v", kind, incidentID, err)
+	}
+}
+
+// ackIncidents acknowledges open incidents for the given notification IDs,
+// or all open incidents when ids is empty.
+func ackIncidents(ids []int64, by string) {
+	if by == "" {
+		by = "unknown"
+	}
+	query := `SELECT id FROM incidents WHERE acked_at IS NULL`
+	var args []any
+	if len(ids) > 0 {
+		query += ` AND notification_id IN (` + placeholders(len(ids)) + `)`
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("incident: ack: %v", err)
+		return
+	}
+	var open []int64
+	for rows.Next() {
+		var id int64
+		if rows.Scan(&id) == nil {
+			open = append(open, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range open {
+		if err := ackIncident(id, by); err != nil {
+			log.Printf("incident: ack %d: %v", id, err)
+		}
+	}
+}
+
+// ackIncident acknowledges one open incident by its id. Only the ack that
+// closes it logs a step, so concurrent acks don't repeat it.
+func ackIncident(id int64, by string) error {
+	res, err := db.Exec(
+		`UPDATE incidents SET acked_by = ?, acked_at = CURRENT_TIMESTAMP WHERE id = ? AND acked_at IS NULL`,
+		by, id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		addIncidentStep(id, "acked", "acknowledged by "+by)
+	}
+	return nil
+}
+
+// placeholders returns "?,?,…" with n entries.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+const incidentCols = `id, notification_id, title, topic, priority, assignee, opened_at, acked_by, acked_at,
+	CAST(ROUND((julianday(acked_at) - julianday(opened_at)) * 86400) AS INTEGER)`
+
+func scanIncident(s scanner) (incident, error) {
+	var i incident
+	err := s.Scan(&i.ID, &i.NotificationID, &i.Title, &i.Topic, &i.Priority, &i.Assignee,
+		&i.OpenedAt, &i.AckedBy, &i.AckedAt, &i.TimeToAck)
+	if err == nil {
+		i.Title, err = openColumn("title", i.Title)
+	}
+	return i, err
+}
+
+func incidentSteps(id int64) ([]incidentStep, error) {
+	rows, err := db.Query(`SELECT at, kind, detail FROM incident_steps WHERE incident_id = ? ORDER BY rowid`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	steps := []incidentStep{}
+	for rows.Next() {
+		var s incidentStep
+		if err := rows.Scan(&s.At, &s.Kind, &s.Detail); err != nil {
+			return nil, err
+		}
+		steps = append(steps, s)
+	}
+	return steps, rows.Err()
+}
+
+// ── Incident Handlers ─────────────────────────────────────────────────────────
+
+func handleIncidents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		limit, offset := 50, 0
+		if v := q.Get("limit"); v != "" {
+			fmt.Sscan(v, &limit)
+		}
+		if v := q.Get("offset"); v != "" {
+			fmt.Sscan(v, &offset)
+		}
+		if limit < 1 {
+			limit = 50
+		}
+
+		where := []string{"1=1"}
+		var args []any
+		switch q.Get("state") {
+		case "open":
+			where = append(where, "acked_at IS NULL")
+		case "acked":
+			where = append(where, "acked_at IS NOT NULL")
+		}
+		if v := q.Get("topic"); v != "" {
+			where = append(where, "topic = ?")
+			args = append(args, v)
+		}
+		if v := q.Get("since"); v != "" {
+			where = append(where, "opened_at >= ?")
+			args = append(args, v)
+		}
+		args = append(args, limit, offset)
+
+		rows, err := db.Query(
+			`SELECT `+incidentCols+` FROM incidents WHERE `+strings.Join(where, " AND ")+`
+			 ORDER BY id DESC LIMIT ? OFFSET ?`, args...,
+		)
+		if err != nil {
+			log.Printf("incidents: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		out := []incident{}
+		for rows.Next() {
+			i, err := scanIncident(rows)
+			if err != nil {
+				log.Printf("incidents: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, i)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+func handleIncident() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		i, err := scanIncident(db.QueryRow(`SELECT `+incidentCols+` FROM incidents WHERE id = ?`, id))
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			i.Steps, err = incidentSteps(id)
+		}
+		if err != nil {
+			log.Printf("incident %d: %v", id, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(i)
+	}
+}
+
+// handleIncidentLeaderboard summarises who acknowledged what and how fast.
+func handleIncidentLeaderboard() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		since := r.URL.Query().Get("since")
+		if since == "" {
+			since = "0000-00-00"
+		}
+		const tta = `(julianday(acked_at) - julianday(opened_at)) * 86400`
+
+		var total, open int
+		var meanTTA sql.NullFloat64
+		err := db.QueryRow(
+			`SELECT COUNT(*), COUNT(*) - COUNT(acked_at), ROUND(AVG(`+tta+`), 1) FROM incidents WHERE opened_at >= ?`, since,
+		).Scan(&total, &open, &meanTTA)
+		if err != nil {
+			log.Printf("incident leaderboard: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT acked_by, COUNT(*), ROUND(AVG(`+tta+`), 1), ROUND(MIN(`+tta+`), 1), ROUND(MAX(`+tta+`), 1)
+			FROM incidents WHERE acked_at IS NOT NULL AND opened_at >= ?
+			GROUP BY acked_by ORDER BY COUNT(*) DESC, AVG(`+tta+`)
+		`, since)
+		if err != nil {
+			log.Printf("incident leaderboard: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		type entry struct {
+			User       string  `json:"user"`
+			Acked      int     `json:"acked"`
+			MeanTTA    float64 `json:"mean_time_to_ack_seconds"`
+			FastestTTA float64 `json:"fastest_seconds"`
+			SlowestTTA float64 `json:"slowest_seconds"`
+		}
+		board := []entry{}
+		for rows.Next() {
+			var e entry
+			if err := rows.Scan(&e.User, &e.Acked, &e.MeanTTA, &e.FastestTTA, &e.SlowestTTA); err != nil {
+				log.Printf("incident leaderboard: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			board = append(board, e)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"total":                    total,
+			"open":                     open,
+			"mean_time_to_ack_seconds": meanTTA.Float64,
+			"leaderboard":              board,
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// ── Ingest ────────────────────────────────────────────────────────────────────
+//
+// Webhook receivers under /ingest/ accept another system's payload as it is
+// and turn it into a notification, which then takes the same path as a
+// /send: size limits, routing rules, quotas, idempotency keys and the raw
+// payload archive. Each receiver maps the payload's own notion of topic and
+// severity; ?topic= and ?priority= on the webhook URL override the mapping,
+// so the sending side can point different routes at different topics.
+// Receivers authenticate like /send (bearer token or a signed request). A
+// payload the receiver is configured to drop is answered 202 with the reason.
+// Pollers, which fetch instead of being sent to, hand what they find to
+// publishPolled.
+
+// ingestParser turns a payload into a notification to send.
+type ingestParser func(header http.Header, payload []byte) (sendBody, error)
+
+// errIngestIgnored wraps the reason a payload is dropped without sending.
+var errIngestIgnored = errors.New("ignored")
+
+func handleIngest(h *hub, system string, parse ingestParser) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limitBody(w, r)
+		payload, err := io.ReadAll(r.Body)
+		if err != nil {
+			if !bodyTooLarge(w, err) {
+				http.Error(w, "bad request", http.StatusBadRequest)
+			}
+			return
+		}
+		body, err := parse(r.Header, payload)
+		if errors.Is(err, errIngestIgnored) {
+			w.WriteHeader(http.StatusAccepted)
+			io.WriteString(w, err.Error()+"\n")
+			return
+		}
+		if err != nil {
+			http.Error(w, system+" payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		q := r.URL.Query()
+		if v := q.Get("topic"); v != "" {
+			body.Topic = v
+		}
+		if v := q.Get("priority"); v != "" {
+			p, err := strconv.Atoi(v)
+			if err != nil || p < priorityMin || p > priorityUrgent {
+				http.Error(w, "priority must be 1-5", http.StatusBadRequest)
+				return
+			}
+			body.Priority = p
+		}
+		if body.Source == "" {
+			body.Source = system
+		}
+		sendNotification(w, r, h, body, payload)
+	}
+}
+
+// publishPolled sends a notification a poller produced on behalf of by:
+// checked, routed and digested like a /send, without the quota or load
+// shedding that push back on a caller. It returns the stored notification's
+// ID, or 0 when a rule suppressed it or held it for a digest.
+func publishPolled(h *hub, body sendBody, by string) (int64, error) {
+	if e, err := body.check(); e != nil {
+		return 0, errors.New(e.Error)
+	} else if err != nil {
+		return 0, err
+	}
+	n, matched, suppressedBy, digest := applyRoutes(nil, body.notification(authInfo{ID: by}))
+	recordRuleHits(ruleKindRoute, matched)
+	switch {
+	case suppressedBy != "":
+		log.Printf("%s: suppressed by rule %q title=%q", by, suppressedBy, n.Title)
+		return 0, nil
+	case digest != nil:
+		_, _, err := holdForDigest(digest, n)
+		return 0, err
+	}
+	n, err := publish(context.Background(), h, n)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("%s: id=%d source=%q topic=%q title=%q", by, n.ID, n.Source, n.Topic, n.Title)
+	return n.ID, nil
+}
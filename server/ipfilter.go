@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ── IP Allow/Deny Lists ───────────────────────────────────────────────────────
+//
+// Endpoints fall into groups so the producer and consumer sides can be exposed
+// differently, e.g. only the LAN may publish while /ws is open to the world:
+//
+//	--ip-allow 'publish=192.168.0.0/16,10.0.0.0/8'
+//
+// Rules are matched against the real client IP (see clientIP). A deny match
+// always wins; if a group has an allow list the IP must be on it. Rules for
+// "all" apply to every group. What the app does besides reading — marking
+// seen, deleting, acking, snoozing, device preferences — is "consumer", so
+// an admin allowlist doesn't lock phones out off the LAN. Peer instances
+// delivering federated topics have a group of their own, so they can be
+// pinned without opening publish.
+
+var ipGroups = []string{"all", "publish", "read", "consumer", "ws", "federation", "admin"}
+
+type ipRules struct {
+	allow map[string][]*net.IPNet
+	deny  map[string][]*net.IPNet
+}
+
+var ipPolicy ipRules
+
+// parseIPRules parses "group=cidr,cidr;group=cidr".
+func parseIPRules(spec string) (map[string][]*net.IPNet, error) {
+	out := map[string][]*net.IPNet{}
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		group, cidrs, ok := strings.Cut(part, "=")
+		group = strings.TrimSpace(group)
+		if !ok {
+			return nil, fmt.Errorf("%q: want group=cidr,…", part)
+		}
+		known := false
+		for _, g := range ipGroups {
+			known = known || g == group
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown endpoint group %q (want one of %s)", group, strings.Join(ipGroups, ", "))
+		}
+		nets, err := parseCIDRs(cidrs)
+		if err != nil {
+			return nil, err
+		}
+		out[group] = append(out[group], nets...)
+	}
+	return out, nil
+}
+
+// endpointGroup classifies a request path.
+func endpointGroup(path string) string {
+	switch {
+	case path == "/send" || path == "/send/batch" || path == "/heartbeat" || strings.HasPrefix(path, "/send/template/") ||
+		strings.HasPrefix(path, "/ingest/") || strings.HasPrefix(path, "/up/") || path == "/_matrix/push/v1/notify":
+		return "publish"
+	case path == "/ws":
+		return "ws"
+	case path == "/federation/receive":
+		return "federation"
+	case path == "/history" || path == "/stats" || path == "/metrics" || path == "/client-config" ||
+		path == "/health" || path == "/healthz" || path == "/readyz" || strings.HasPrefix(path, "/schema/"):
+		return "read"
+	case path == "/mark-seen" || path == "/notifications" || consumerPath(path):
+		return "consumer"
+	}
+	return "admin"
+}
+
+// consumerPath matches the per-notification and per-device endpoints the
+// app calls: /notifications/{id}/ack|snooze|deliveries|receipts and
+// /devices/{device}/preferences.
+func consumerPath(path string) bool {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 3 || parts[1] == "" {
+		return false
+	}
+	switch parts[0] {
+	case "notifications":
+		switch parts[2] {
+		case "ack", "snooze", "deliveries", "receipts":
+			return true
+		}
+	case "devices":
+		return parts[2] == "preferences"
+	}
+	return false
+}
+
+func (p ipRules) allowed(ip net.IP, group string) bool {
+	if ip == nil {
+		return len(p.allow) == 0
+	}
+	for _, g := range []string{"all", group} {
+		if ipInNets(ip, p.deny[g]) {
+			return false
+		}
+	}
+	for _, g := range []string{"all", group} {
+		if len(p.allow[g]) > 0 && !ipInNets(ip, p.allow[g]) {
+			return false
+		}
+	}
+	return true
+}
+
+// ipFilter applies ipPolicy to every request before routing.
+func ipFilter(next http.Handler) http.Handler {
+	if len(ipPolicy.allow) == 0 && len(ipPolicy.deny) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		group := endpointGroup(r.URL.Path)
+		if !ipPolicy.allowed(net.ParseIP(ip), group) {
+			log.Printf("ip filter: %s denied for %s (%s)", ip, r.URL.Path, group)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
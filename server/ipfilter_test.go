@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEndpointGroup(t *testing.T) {
+	for path, want := range map[string]string{
+		"/send":                       "publish",
+		"/send/batch":                 "publish",
+		"/send/template/deploy":       "publish",
+		"/ingest/alertmanager":        "publish",
+		"/heartbeat":                  "publish",
+		"/up/abc123":                  "publish",
+		"/_matrix/push/v1/notify":     "publish",
+		"/ws":                         "ws",
+		"/federation/receive":         "federation",
+		"/federation/key":             "admin",
+		"/history":                    "read",
+		"/schema/notification":        "read",
+		"/admin/rules":                "admin",
+		"/unifiedpush/registrations":  "admin",
+		"/up":                         "admin",
+		"/mark-seen":                  "consumer",
+		"/notifications":              "consumer",
+		"/notifications/7/ack":        "consumer",
+		"/notifications/7/snooze":     "consumer",
+		"/notifications/7/deliveries": "consumer",
+		"/notifications/7/receipts":   "consumer",
+		"/notifications/7/raw":        "admin",
+		"/devices/pixel/preferences":  "consumer",
+		"/admin/devices/pixel":        "admin",
+	} {
+		if got := endpointGroup(path); got != want {
+			t.Errorf("endpointGroup(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestIPRulesPublishAllowlist(t *testing.T) {
+	allow, err := parseIPRules("admin=192.168.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ipRules{allow: allow}
+	app := net.ParseIP("203.0.113.7")
+	// An admin-only allowlist must not keep UnifiedPush app servers and
+	// Matrix gateways from publishing.
+	for _, path := range []string{"/up/abc123", "/_matrix/push/v1/notify", "/send"} {
+		if !p.allowed(app, endpointGroup(path)) {
+			t.Errorf("%s from %s denied by an admin allowlist", path, app)
+		}
+	}
+	if p.allowed(app, endpointGroup("/admin/rules")) {
+		t.Errorf("/admin/rules from %s allowed", app)
+	}
+
+	deny, err := parseIPRules("publish=203.0.113.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = ipRules{deny: deny}
+	for _, path := range []string{"/up/abc123", "/_matrix/push/v1/notify"} {
+		if p.allowed(app, endpointGroup(path)) {
+			t.Errorf("%s from %s allowed despite a publish deny", path, app)
+		}
+	}
+}
+
+func TestIPRulesConsumerOffLAN(t *testing.T) {
+	allow, err := parseIPRules("admin=192.168.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ipRules{allow: allow}
+	phone := net.ParseIP("203.0.113.7")
+	for _, path := range []string{"/mark-seen", "/notifications", "/notifications/7/ack", "/devices/pixel/preferences"} {
+		if !p.allowed(phone, endpointGroup(path)) {
+			t.Errorf("%s from %s denied by an admin allowlist", path, phone)
+		}
+	}
+}
+
+func TestIPRulesFederation(t *testing.T) {
+	allow, err := parseIPRules("admin=192.168.1.0/24;federation=198.51.100.10/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ipRules{allow: allow}
+	group := endpointGroup("/federation/receive")
+	if !p.allowed(net.ParseIP("198.51.100.10"), group) {
+		t.Error("peer denied by an admin allowlist")
+	}
+	if p.allowed(net.ParseIP("198.51.100.11"), group) {
+		t.Error("non-peer allowed past the federation allowlist")
+	}
+}
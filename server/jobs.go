@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ── Jobs ──────────────────────────────────────────────────────────────────────
+//
+// Long-running admin work runs in the background as a job. Starting one
+// answers 202 with its id right away; GET /admin/jobs/{id} reports status and
+// progress (total, done, failed) and the first errors. Jobs are kept in the
+// database, so results survive a restart; a job still running when the
+// server stops is marked failed at the next start.
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+
+	jobMaxErrors = 20
+)
+
+type adminJob struct {
+	ID         int64           `json:"id"`
+	Kind       string          `json:"kind"`
+	Status     string          `json:"status"`
+	Params     json.RawMessage `json:"params,omitempty"`
+	Total      int             `json:"total"`
+	Done       int             `json:"done"`
+	Failed     int             `json:"failed"`
+	Errors     []string        `json:"errors,omitempty"`
+	CreatedBy  string          `json:"created_by"`
+	CreatedAt  string          `json:"created_at"`
+	StartedAt  *string         `json:"started_at"`
+	FinishedAt *string         `json:"finished_at"`
+}
+
+func initJobTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS admin_jobs (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind        TEXT NOT NULL,
+			status      TEXT NOT NULL,
+			params      TEXT NOT NULL DEFAULT '',
+			total       INTEGER NOT NULL DEFAULT 0,
+			done        INTEGER NOT NULL DEFAULT 0,
+			failed      INTEGER NOT NULL DEFAULT 0,
+			errors      TEXT NOT NULL DEFAULT '',
+			created_by  TEXT NOT NULL DEFAULT '',
+			created_at  DATETIME DEFAULT CURRENT_TIMESTAMP,
+			started_at  DATETIME,
+			finished_at DATETIME
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE admin_jobs SET status = ?, finished_at = CURRENT_TIMESTAMP,
+		errors = '["interrupted by server restart"]' WHERE status IN (?, ?)`, jobFailed, jobQueued, jobRunning)
+	return err
+}
+
+// jobProgress is handed to a running job to report how far it is.
+type jobProgress struct {
+	id     int64
+	mu     sync.Mutex
+	total  int
+	done   int
+	failed int
+	errors []string
+	saved  time.Time
+}
+
+func (p *jobProgress) setTotal(n int) {
+	p.mu.Lock()
+	p.total = n
+	p.mu.Unlock()
+	p.save(true)
+}
+
+// step records one item; a non-nil err counts it as failed.
+func (p *jobProgress) step(err error) {
+	p.mu.Lock()
+	if err != nil {
+		p.failed++
+		if len(p.errors) < jobMaxErrors {
+			p.errors = append(p.errors, err.Error())
+		}
+	} else {
+		p.done++
+	}
+	p.mu.Unlock()
+	p.save(false)
+}
+
+// save writes progress, at most once a second unless forced.
+func (p *jobProgress) save(force bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !force && time.Since(p.saved) < time.Second {
+		return
+	}
+	p.saved = time.Now()
+	errs, _ := json.Marshal(p.errors)
+	if _, err := db.Exec(`UPDATE admin_jobs SET total = ?, done = ?, failed = ?, errors = ? WHERE id = ?`,
+		p.total, p.done, p.failed, string(errs), p.id); err != nil {
+		log.Printf("job %d: %v", p.id, err)
+	}
+}
+
+// startJob records a job and runs fn in the background. A returned error
+// fails the job as a whole.
+func startJob(kind string, params any, by string, fn func(p *jobProgress) error) (int64, error) {
+	raw, _ := json.Marshal(params)
+	res, err := db.Exec(`INSERT INTO admin_jobs (kind, status, params, created_by) VALUES (?, ?, ?, ?)`,
+		kind, jobQueued, string(raw), by)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := res.LastInsertId()
+	go func() {
+		p := &jobProgress{id: id}
+		db.Exec(`UPDATE admin_jobs SET status = ?, started_at = CURRENT_TIMESTAMP WHERE id = ?`, jobRunning, id)
+		start := time.Now()
+		err := fn(p)
+		status := jobDone
+		if err != nil {
+			status = jobFailed
+			p.mu.Lock()
+			p.errors = append(p.errors, err.Error())
+			p.mu.Unlock()
+		}
+		p.save(true)
+		db.Exec(`UPDATE admin_jobs SET status = ?, finished_at = CURRENT_TIMESTAMP WHERE id = ?`, status, id)
+		log.Printf("job %d (%s): %s in %s: %d done, %d failed", id, kind, status,
+			time.Since(start).Round(time.Millisecond), p.done, p.failed)
+	}()
+	return id, nil
+}
+
+const adminJobCols = `id, kind, status, params, total, done, failed, errors, created_by, created_at, started_at, finished_at`
+
+func scanAdminJob(s scanner) (adminJob, error) {
+	var j adminJob
+	var params, errs string
+	err := s.Scan(&j.ID, &j.Kind, &j.Status, &params, &j.Total, &j.Done, &j.Failed, &errs,
+		&j.CreatedBy, &j.CreatedAt, &j.StartedAt, &j.FinishedAt)
+	if params != "" {
+		j.Params = json.RawMessage(params)
+	}
+	if errs != "" {
+		json.Unmarshal([]byte(errs), &j.Errors)
+	}
+	return j, err
+}
+
+// writeJobStarted answers 202 pointing at the new job.
+func writeJobStarted(w http.ResponseWriter, id int64) {
+	url := "/admin/jobs/" + strconv.FormatInt(id, 10)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", url)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{"job": id, "status_url": url})
+}
+
+// handleJobs lists the scheduled jobs and the most recent admin jobs, newest
+// first.
+func handleJobs() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rows, err := db.Query(`SELECT ` + adminJobCols + ` FROM admin_jobs ORDER BY id DESC LIMIT 50`)
+		if err != nil {
+			log.Printf("jobs: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		out := []adminJob{}
+		for rows.Next() {
+			j, err := scanAdminJob(rows)
+			if err != nil {
+				log.Printf("jobs: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, j)
+		}
+		scheduled, err := scheduledJobs()
+		if err != nil {
+			log.Printf("jobs: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"scheduled": scheduled, "recent": out})
+	}
+}
+
+func handleJob() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		j, err := scanAdminJob(db.QueryRow(`SELECT `+adminJobCols+` FROM admin_jobs WHERE id = ?`, id))
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("job %d: %v", id, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(j)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ── JWT Authentication ────────────────────────────────────────────────────────
+//
+// Short-lived device tokens: a JWT signed with the configured HS256 secret or
+// RS256 key is accepted anywhere a token is (Bearer header or /ws?token=).
+// exp is required and aud must match --jwt-audience when set. The "scope"
+// claim ("read" or "full") picks the access level, read by default; "sub"
+// names the caller and is the WebSocket user: a different ?user= is refused.
+// After POST /admin/tokens/revoke-all, tokens issued (iat) before it are
+// refused, as are tokens without iat. exp, nbf and iat are allowed
+// --clock-tolerance of skew between the issuer's clock and ours.
+
+var (
+	jwtHMACKey []byte
+	jwtRSAKey  *rsa.PublicKey
+)
+
+type jwtClaims struct {
+	Sub   string          `json:"sub"`
+	Aud   json.RawMessage `json:"aud"` // string or array of strings
+	Exp   *float64        `json:"exp"`
+	Nbf   *float64        `json:"nbf"`
+	Iat   *float64        `json:"iat"`
+	Scope string          `json:"scope"`
+}
+
+func (c jwtClaims) hasAudience(want string) bool {
+	var one string
+	if json.Unmarshal(c.Aud, &one) == nil {
+		return one == want
+	}
+	var many []string
+	if json.Unmarshal(c.Aud, &many) == nil {
+		for _, a := range many {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loadJWTKeys reads the configured verification keys; neither is required.
+func loadJWTKeys() error {
+	if *flagJWTSecretFile != "" {
+		secret, err := loadToken(*flagJWTSecretFile, "")
+		if err != nil {
+			return err
+		}
+		if len(secret) < 32 {
+			return errors.New("HS256 secret must be at least 32 bytes")
+		}
+		jwtHMACKey = []byte(secret)
+	}
+	if *flagJWTPublicKey != "" {
+		raw, err := os.ReadFile(*flagJWTPublicKey)
+		if err != nil {
+			return err
+		}
+		block, _ := pem.Decode(raw)
+		if block == nil {
+			return errors.New("no PEM block in RS256 public key file")
+		}
+		var pub any
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return err
+			}
+			pub = cert.PublicKey
+		case "RSA PUBLIC KEY":
+			pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		default:
+			pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		}
+		if err != nil {
+			return err
+		}
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("RS256 key is not an RSA public key")
+		}
+		jwtRSAKey = key
+	}
+	return nil
+}
+
+func jwtEnabled() bool { return jwtHMACKey != nil || jwtRSAKey != nil }
+
+// verifyJWT checks signature, expiry and audience and maps claims to an
+// authInfo. Expires is set so long-lived connections can be cut off.
+func verifyJWT(token string, now time.Time) (authInfo, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return authInfo{}, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return authInfo{}, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return authInfo{}, errors.New("malformed signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case header.Alg == "HS256" && jwtHMACKey != nil:
+		mac := hmac.New(sha256.New, jwtHMACKey)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return authInfo{}, errors.New("bad signature")
+		}
+	case header.Alg == "RS256" && jwtRSAKey != nil:
+		sum := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(jwtRSAKey, crypto.SHA256, sum[:], sig); err != nil {
+			return authInfo{}, errors.New("bad signature")
+		}
+	default:
+		return authInfo{}, fmt.Errorf("unsupported alg %q", header.Alg)
+	}
+
+	var c jwtClaims
+	if err := decodeJWTPart(parts[1], &c); err != nil {
+		return authInfo{}, err
+	}
+	if c.Exp == nil {
+		return authInfo{}, errors.New("exp is required")
+	}
+	leeway := clockTolerance()
+	exp := time.Unix(int64(*c.Exp), 0).Add(leeway)
+	if now.After(exp) {
+		return authInfo{}, errors.New("token expired")
+	}
+	if c.Nbf != nil && now.Add(leeway).Before(time.Unix(int64(*c.Nbf), 0)) {
+		return authInfo{}, errors.New("token not yet valid")
+	}
+	if c.Iat != nil {
+		if skew := time.Unix(int64(*c.Iat), 0).Sub(now); skew > leeway {
+			return authInfo{}, fmt.Errorf("token issued in the future: issuer clock is %s ours", describeSkew(skew))
+		}
+	}
+	if cut := jwtRevokedBefore.Load(); cut > 0 && (c.Iat == nil || int64(*c.Iat) < cut) {
+		return authInfo{}, errors.New("token revoked (issued before the last revoke-all)")
+	}
+	if *flagJWTAudience != "" && !c.hasAudience(*flagJWTAudience) {
+		return authInfo{}, errors.New("wrong audience")
+	}
+
+	a := authInfo{ID: "jwt:" + c.Sub, User: c.Sub, Scope: scopeRead, Expires: exp}
+	switch c.Scope {
+	case "", "read":
+	case "full":
+		a.Scope = scopeFull
+	default:
+		return authInfo{}, fmt.Errorf("unknown scope %q", c.Scope)
+	}
+	return a, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// hs256 signs claims with key the way a token issuer would.
+func hs256(key []byte, claims string) string {
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return signed + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestWSUserBoundToJWTSubject(t *testing.T) {
+	saved := jwtHMACKey
+	jwtHMACKey = []byte("0123456789abcdef0123456789abcdef")
+	t.Cleanup(func() { jwtHMACKey = saved })
+
+	now := time.Now().Unix()
+	token := hs256(jwtHMACKey, `{"sub":"alice","exp":`+strconv.FormatInt(now+60, 10)+`,"iat":`+strconv.FormatInt(now, 10)+`}`)
+	h := testHub(t)
+
+	w := httptest.NewRecorder()
+	handleWS(h)(w, httptest.NewRequest(http.MethodGet, "/ws?token="+token+"&user=bob", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("?user=bob with alice's token: status %d, want 403", w.Code)
+	}
+}
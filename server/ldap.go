@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ── LDAP Client ───────────────────────────────────────────────────────────────
+//
+// Just enough of RFC 4511 to bind and run a subtree search: BER encoding,
+// simple bind, StartTLS and the string filter syntax from RFC 4515. Pulling in
+// a full LDAP library for one periodic query isn't worth the dependency.
+
+const (
+	berClassApplication = 0x40
+	berClassContext     = 0x80
+	berConstructed      = 0x20
+
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berBoolean     = 0x01
+	berSequence    = 0x10 | berConstructed
+
+	// berMaxLength caps what one element may claim to hold, so a broken or
+	// hostile directory can't make us allocate gigabytes. Each search entry
+	// is its own message, and none comes close.
+	berMaxLength = 1 << 20
+)
+
+type berPacket struct {
+	tag      byte
+	value    []byte      // primitive content
+	children []berPacket // constructed content
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func (p berPacket) bytes() []byte {
+	content := p.value
+	if p.tag&berConstructed != 0 {
+		var buf bytes.Buffer
+		for _, c := range p.children {
+			buf.Write(c.bytes())
+		}
+		content = buf.Bytes()
+	}
+	out := append([]byte{p.tag}, berLength(len(content))...)
+	return append(out, content...)
+}
+
+func berInt(tag byte, v int64) berPacket {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+		if (v == 0 && b[0]&0x80 == 0) || (v == -1 && b[0]&0x80 != 0) {
+			break
+		}
+	}
+	return berPacket{tag: tag, value: b}
+}
+
+func berString(tag byte, s string) berPacket {
+	return berPacket{tag: tag, value: []byte(s)}
+}
+
+func berSeq(tag byte, children ...berPacket) berPacket {
+	return berPacket{tag: tag | berConstructed, children: children}
+}
+
+func readBER(r *bufio.Reader) (berPacket, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berPacket{}, err
+	}
+	l, err := r.ReadByte()
+	if err != nil {
+		return berPacket{}, err
+	}
+	length := int(l)
+	if l&0x80 != 0 {
+		n := int(l & 0x7f)
+		if n == 0 || n > 4 {
+			return berPacket{}, errors.New("ldap: unsupported BER length")
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return berPacket{}, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > berMaxLength {
+		return berPacket{}, fmt.Errorf("ldap: BER element of %d bytes exceeds %d", length, berMaxLength)
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return berPacket{}, err
+	}
+	p := berPacket{tag: tag}
+	if tag&berConstructed == 0 {
+		p.value = content
+		return p, nil
+	}
+	cr := bufio.NewReader(bytes.NewReader(content))
+	for {
+		c, err := readBER(cr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return berPacket{}, err
+		}
+		p.children = append(p.children, c)
+	}
+	return p, nil
+}
+
+func (p berPacket) int() int64 {
+	var v int64
+	for i, b := range p.value {
+		if i == 0 && b&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int64(b)
+	}
+	return v
+}
+
+// ── Filters (RFC 4515) ────────────────────────────────────────────────────────
+
+func parseLDAPFilter(s string) (berPacket, error) {
+	p, rest, err := parseFilterAt(strings.TrimSpace(s))
+	if err != nil {
+		return berPacket{}, err
+	}
+	if rest != "" {
+		return berPacket{}, fmt.Errorf("ldap filter: trailing %q", rest)
+	}
+	return p, nil
+}
+
+func parseFilterAt(s string) (berPacket, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return berPacket{}, "", fmt.Errorf("ldap filter: expected ( at %q", s)
+	}
+	s = s[1:]
+	if s == "" {
+		return berPacket{}, "", errors.New("ldap filter: unexpected end")
+	}
+	switch s[0] {
+	case '&', '|':
+		tag := byte(berClassContext | berConstructed)
+		if s[0] == '|' {
+			tag |= 1
+		}
+		s = s[1:]
+		set := berPacket{tag: tag}
+		for strings.HasPrefix(s, "(") {
+			c, rest, err := parseFilterAt(s)
+			if err != nil {
+				return berPacket{}, "", err
+			}
+			set.children = append(set.children, c)
+			s = rest
+		}
+		if !strings.HasPrefix(s, ")") {
+			return berPacket{}, "", errors.New("ldap filter: missing )")
+		}
+		return set, s[1:], nil
+	case '!':
+		c, rest, err := parseFilterAt(s[1:])
+		if err != nil {
+			return berPacket{}, "", err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return berPacket{}, "", errors.New("ldap filter: missing )")
+		}
+		return berPacket{tag: berClassContext | berConstructed | 2, children: []berPacket{c}}, rest[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return berPacket{}, "", errors.New("ldap filter: missing )")
+	}
+	item, rest := s[:end], s[end+1:]
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return berPacket{}, "", fmt.Errorf("ldap filter: bad item %q", item)
+	}
+	attr, val := item[:eq], item[eq+1:]
+	ava := func(tag byte, attr, val string) (berPacket, string, error) {
+		v, err := unescapeFilterValue(val)
+		if err != nil {
+			return berPacket{}, "", err
+		}
+		return berSeq(berClassContext|tag, berString(berOctetString, attr), berString(berOctetString, v)), rest, nil
+	}
+	switch {
+	case strings.HasSuffix(attr, ">"):
+		return ava(5, attr[:len(attr)-1], val)
+	case strings.HasSuffix(attr, "<"):
+		return ava(6, attr[:len(attr)-1], val)
+	case strings.HasSuffix(attr, "~"):
+		return ava(8, attr[:len(attr)-1], val)
+	case val == "*":
+		return berString(berClassContext|7, attr), rest, nil
+	case strings.Contains(val, "*"):
+		parts := strings.Split(val, "*")
+		subs := berSeq(berSequence)
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			v, err := unescapeFilterValue(part)
+			if err != nil {
+				return berPacket{}, "", err
+			}
+			tag := byte(berClassContext | 1) // any
+			if i == 0 {
+				tag = berClassContext // initial
+			} else if i == len(parts)-1 {
+				tag = berClassContext | 2 // final
+			}
+			subs.children = append(subs.children, berString(tag, v))
+		}
+		return berSeq(berClassContext|4, berString(berOctetString, attr), subs), rest, nil
+	}
+	return ava(3, attr, val)
+}
+
+func unescapeFilterValue(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", fmt.Errorf("ldap filter: bad escape in %q", s)
+		}
+		v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("ldap filter: bad escape in %q", s)
+		}
+		b.WriteByte(byte(v))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// ── Connection ────────────────────────────────────────────────────────────────
+
+type ldapConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	msgID int64
+}
+
+type ldapEntry struct {
+	DN    string
+	Attrs map[string][]string
+}
+
+// dialLDAP connects to an ldap:// or ldaps:// URL, upgrading plain
+// connections with StartTLS when startTLS is set.
+func dialLDAP(rawURL string, startTLS bool, timeout time.Duration) (*ldapConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	d := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldaps":
+		if u.Port() == "" {
+			host += ":636"
+		}
+		conn, err = tls.DialWithDialer(d, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	case "ldap":
+		if u.Port() == "" {
+			host += ":389"
+		}
+		conn, err = d.Dial("tcp", host)
+	default:
+		return nil, fmt.Errorf("ldap: unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	lc := &ldapConn{conn: conn, r: bufio.NewReader(conn)}
+	if startTLS && u.Scheme == "ldap" {
+		op := berSeq(berClassApplication|23, berString(berClassContext, "1.3.6.1.4.1.1466.20037"))
+		resp, err := lc.roundTrip(op)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := ldapResultErr(resp); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap starttls: %w", err)
+		}
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		lc.conn, lc.r = tc, bufio.NewReader(tc)
+	}
+	return lc, nil
+}
+
+func (c *ldapConn) Close() error {
+	c.send(berPacket{tag: berClassApplication | 2}) // UnbindRequest
+	return c.conn.Close()
+}
+
+func (c *ldapConn) send(op berPacket) (int64, error) {
+	c.msgID++
+	msg := berSeq(berSequence, berInt(berInteger, c.msgID), op)
+	_, err := c.conn.Write(msg.bytes())
+	return c.msgID, err
+}
+
+func (c *ldapConn) read() (berPacket, error) {
+	p, err := readBER(c.r)
+	if err != nil {
+		return berPacket{}, err
+	}
+	if len(p.children) < 2 {
+		return berPacket{}, errors.New("ldap: malformed message")
+	}
+	return p.children[1], nil
+}
+
+func (c *ldapConn) roundTrip(op berPacket) (berPacket, error) {
+	if _, err := c.send(op); err != nil {
+		return berPacket{}, err
+	}
+	return c.read()
+}
+
+// ldapResultErr turns a non-success LDAPResult into an error.
+func ldapResultErr(p berPacket) error {
+	if len(p.children) < 3 {
+		return errors.New("ldap: malformed result")
+	}
+	if code := p.children[0].int(); code != 0 {
+		return fmt.Errorf("ldap result %d: %s", code, p.children[2].value)
+	}
+	return nil
+}
+
+func (c *ldapConn) Bind(dn, password string) error {
+	op := berSeq(berClassApplication|0,
+		berInt(berInteger, 3),
+		berString(berOctetString, dn),
+		berString(berClassContext|0, password),
+	)
+	resp, err := c.roundTrip(op)
+	if err != nil {
+		return err
+	}
+	return ldapResultErr(resp)
+}
+
+// Search runs a subtree search and returns every entry.
+func (c *ldapConn) Search(baseDN, filter string, attrs []string) ([]ldapEntry, error) {
+	f, err := parseLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	attrList := berSeq(berSequence)
+	for _, a := range attrs {
+		attrList.children = append(attrList.children, berString(berOctetString, a))
+	}
+	op := berSeq(berClassApplication|3,
+		berString(berOctetString, baseDN),
+		berInt(berEnumerated, 2), // wholeSubtree
+		berInt(berEnumerated, 0), // neverDerefAliases
+		berInt(berInteger, 0),    // no size limit
+		berInt(berInteger, 0),    // no time limit
+		berPacket{tag: berBoolean, value: []byte{0}},
+		f,
+		attrList,
+	)
+	if _, err := c.send(op); err != nil {
+		return nil, err
+	}
+
+	var entries []ldapEntry
+	for {
+		resp, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.tag &^ berConstructed {
+		case berClassApplication | 4: // SearchResultEntry
+			if len(resp.children) < 2 {
+				continue
+			}
+			e := ldapEntry{DN: string(resp.children[0].value), Attrs: map[string][]string{}}
+			for _, a := range resp.children[1].children {
+				if len(a.children) < 2 {
+					continue
+				}
+				name := strings.ToLower(string(a.children[0].value))
+				for _, v := range a.children[1].children {
+					e.Attrs[name] = append(e.Attrs[name], string(v.value))
+				}
+			}
+			entries = append(entries, e)
+		case berClassApplication | 5: // SearchResultDone
+			return entries, ldapResultErr(resp)
+		}
+		// SearchResultReference (19) and anything else: ignore.
+	}
+}
+
+// firstAttr returns the first value of attr, or "".
+func (e ldapEntry) firstAttr(attr string) string {
+	if vs := e.Attrs[strings.ToLower(attr)]; len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// rdnValue extracts "ops" from "cn=ops,ou=groups,dc=example,dc=com". Values
+// that aren't DNs are returned unchanged.
+func rdnValue(dn string) string {
+	first := strings.SplitN(dn, ",", 2)[0]
+	if i := strings.IndexByte(first, '='); i >= 0 {
+		return first[i+1:]
+	}
+	return dn
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadBERRoundTrip(t *testing.T) {
+	want := berSeq(berSequence, berInt(berInteger, 7), berString(berOctetString, strings.Repeat("x", 300)))
+	got, err := readBER(bufio.NewReader(bytes.NewReader(want.bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.bytes(), want.bytes()) {
+		t.Errorf("round trip changed the packet: % x", got.bytes())
+	}
+}
+
+func TestReadBERHugeLength(t *testing.T) {
+	for _, header := range [][]byte{
+		{berSequence, 0x84, 0x7f, 0xff, 0xff, 0xff}, // ~2 GiB
+		{berOctetString, 0x83, 0x10, 0x00, 0x01},    // 1 MiB + 1
+	} {
+		// Only the header: the length must be refused before reading (or
+		// allocating) the content.
+		_, err := readBER(bufio.NewReader(bytes.NewReader(header)))
+		if err == nil || !strings.Contains(err.Error(), "exceeds") {
+			t.Errorf("% x: err = %v, want a length error", header, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ── Legal Hold ────────────────────────────────────────────────────────────────
+//
+// Notifications on --hold-topics are never deleted without a copy. Before
+// DELETE /notifications or a bulk delete-notifications job removes anything,
+// the held notifications among what it is about to remove are written to an
+// archive — gzip-compressed JSONL in the /export format, encrypted with
+// --encryption-key-file — and the delete only goes ahead once that has
+// succeeded. Archives go to --hold-export-dir if set, else to the S3 bucket
+// under <s3-prefix>holds/ when one is configured, else to holds/ next to the
+// database. The archive path is recorded in the audit log with the delete.
+// The S3 archive job already uploads before it deletes; its batches that
+// contain held notifications are audited too.
+
+var holdTopics = map[string]bool{}
+
+// holdClause restricts a query to held topics; false when there are none.
+func holdClause() (string, []any, bool) {
+	if len(holdTopics) == 0 {
+		return "", nil, false
+	}
+	var args []any
+	for t := range holdTopics {
+		args = append(args, t)
+	}
+	return `topic IN (` + placeholders(len(args)) + `)`, args, true
+}
+
+// exportHeld archives the held notifications matching where and returns the
+// archive's location and how many it holds; "" and 0 if there were none.
+func exportHeld(ctx context.Context, reason, where string, args []any) (string, int, error) {
+	held, heldArgs, ok := holdClause()
+	if !ok {
+		return "", 0, nil
+	}
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+notificationCols+` FROM notifications WHERE (`+where+`) AND `+held+` ORDER BY id`,
+		append(append([]any{}, args...), heldArgs...)...)
+	if err != nil {
+		return "", 0, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	count := 0
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			rows.Close()
+			return "", 0, err
+		}
+		enc.Encode(n)
+		count++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || count == 0 {
+		return "", 0, err
+	}
+	zw.Close()
+	body := buf.Bytes()
+	if atRest != nil {
+		body = []byte(sealColumn("archive", string(body)))
+	}
+
+	name := fmt.Sprintf("hold-%s-%s.jsonl.gz", time.Now().UTC().Format("20060102-150405.000"), reason)
+	if *flagHoldExportDir == "" && archiveStore != nil {
+		key := *flagS3Prefix + "holds/" + name
+		if err := archiveStore.put(ctx, key, body, "application/octet-stream"); err != nil {
+			return "", 0, fmt.Errorf("export held notifications: %w", err)
+		}
+		return "s3://" + *flagS3Bucket + "/" + key, count, nil
+	}
+	dir := *flagHoldExportDir
+	if dir == "" {
+		dir = filepath.Join(filepath.Dir(*flagDB), "holds")
+	}
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", 0, fmt.Errorf("export held notifications: %w", err)
+	}
+	if err := writeFileSync(path, body); err != nil {
+		return "", 0, fmt.Errorf("export held notifications: %w", err)
+	}
+	return path, count, nil
+}
+
+// writeFileSync writes a new file and flushes it to disk, so the rows it
+// copies can be deleted safely.
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// heldNote describes an export for log and audit lines.
+func heldNote(archive string, n int) string {
+	if archive == "" {
+		return ""
+	}
+	return fmt.Sprintf("; %d held notifications exported to %s", n, archive)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ── Payload Limits ────────────────────────────────────────────────────────────
+//
+// Every notification is pushed to every WebSocket client and kept in their
+// history, so one oversized text costs all of them. /send and /heartbeat
+// bodies are capped at --max-body-bytes and titles and texts at
+// --max-title-bytes and --max-text-bytes. Anything larger is refused with 413
+// and a JSON body naming the limit, so the producer knows what to trim.
+
+type limitError struct {
+	Error string `json:"error"`
+	Field string `json:"field"`
+	Limit int64  `json:"limit"`
+	Size  int64  `json:"size,omitempty"` // unknown for a truncated body
+}
+
+// limitBody caps what can be read from r.Body.
+func limitBody(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, *flagMaxBody)
+}
+
+// bodyTooLarge reports whether err came from hitting the limitBody cap, and
+// if so answers 413.
+func bodyTooLarge(w http.ResponseWriter, err error) bool {
+	var mbe *http.MaxBytesError
+	if !errors.As(err, &mbe) {
+		return false
+	}
+	writeLimitError(w, limitError{
+		Error: fmt.Sprintf("request body exceeds %d bytes", mbe.Limit),
+		Field: "body",
+		Limit: mbe.Limit,
+	})
+	return true
+}
+
+// checkSizes returns a limitError for the first field over its limit.
+func checkSizes(title, text string) *limitError {
+	for _, f := range []struct {
+		name  string
+		value string
+		limit int
+	}{{"title", title, *flagMaxTitle}, {"text", text, *flagMaxText}} {
+		if f.limit > 0 && len(f.value) > f.limit {
+			return &limitError{
+				Error: fmt.Sprintf("%s is %d bytes; the limit is %d", f.name, len(f.value), f.limit),
+				Field: f.name,
+				Limit: int64(f.limit),
+				Size:  int64(len(f.value)),
+			}
+		}
+	}
+	return nil
+}
+
+func writeLimitError(w http.ResponseWriter, e limitError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(e)
+}
@@ -1,65 +1,260 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"ilios.dev/andrnoti/api"
 	_ "modernc.org/sqlite"
 )
 
 // ── Config ────────────────────────────────────────────────────────────────────
 
 var (
-	flagPort            = flag.String("port", "8086", "TCP port to listen on")
-	flagTokenFile       = flag.String("token-file", "", "Path to file containing the auth token")
-	flagToken           = flag.String("token", "", "Auth token as a plain string (alternative to --token-file)")
-	flagDB              = flag.String("db", "notifications.db", "Path to SQLite database file")
-	flagHeartbeatMissed = flag.Int("heartbeat-missed", 3, "Missed beats before alerting on a remote source")
+	flagPort             = flag.String("port", "8086", "TCP port to listen on")
+	flagTokenFile        = flag.String("token-file", "", "Path to file containing the auth token")
+	flagToken            = flag.String("token", "", "Auth token as a plain string (alternative to --token-file)")
+	flagDB               = flag.String("db", "notifications.db", "Path to SQLite database file")
+	flagReadOnlyFile     = flag.String("readonly-token-file", "", "Path to file containing a read-only token (history, stats, WebSocket)")
+	flagReadOnlyToken    = flag.String("readonly-token", "", "Read-only token as a plain string (alternative to --readonly-token-file)")
+	flagJWTSecretFile    = flag.String("jwt-hs256-secret-file", "", "Path to file containing the HS256 secret for verifying JWTs")
+	flagJWTPublicKey     = flag.String("jwt-rs256-public-key", "", "Path to PEM RSA public key (or certificate) for verifying RS256 JWTs")
+	flagJWTAudience      = flag.String("jwt-audience", "", "Required aud claim for JWTs (unchecked if empty)")
+	flagTLSCert          = flag.String("tls-cert", "", "PEM certificate to serve HTTPS/WSS directly")
+	flagTLSKey           = flag.String("tls-key", "", "PEM private key for --tls-cert")
+	flagClientCA         = flag.String("client-ca", "", "PEM CA bundle; clients presenting a certificate it signed are authenticated by certificate (mTLS)")
+	flagClientCertReq    = flag.Bool("client-cert-required", false, "Refuse TLS connections without a valid client certificate")
+	flagClientCertScope  = flag.String("client-cert-scope", "read", "Access granted to certificate-authenticated clients: read or full")
+	flagBind             = flag.String("bind", "127.0.0.1", "Address to listen on")
+	flagTokensFile       = flag.String("tokens-file", "", "Path to file of named tokens, one \"name token [read|full]\" per line")
+	flagDailyQuota       = flag.Int("daily-quota", 0, "Default sends per token per UTC day (0 = unlimited)")
+	flagTokenGrace       = flag.Duration("token-rotation-grace", 24*time.Hour, "Default time the old primary token stays valid after POST /admin/token/rotate")
+	flagHMACSecretFile   = flag.String("hmac-secret-file", "", "Path to file containing a shared secret for X-Signature HMAC-signed /send and /heartbeat requests")
+	flagHMACMaxSkew      = flag.Duration("hmac-max-skew", 5*time.Minute, "Maximum age (either direction) of an HMAC-signed request's X-Timestamp")
+	flagTrustedProxies   = flag.String("trusted-proxies", "", "Comma-separated CIDRs of reverse proxies whose X-Forwarded-For/X-Real-IP headers are trusted")
+	flagIPAllow          = flag.String("ip-allow", "", "Per endpoint group CIDR allow lists: 'group=cidr,…;…' (groups: all, publish, read, ws, federation, admin)")
+	flagIPDeny           = flag.String("ip-deny", "", "Per endpoint group CIDR deny lists, same syntax as --ip-allow")
+	flagHeartbeatMissed  = flag.Int("heartbeat-missed", 3, "Missed beats before alerting on a remote source")
+	flagOnCallTopics     = flag.String("oncall-topics", "", "Comma-separated topics whose urgent notifications route to the on-call user")
+	flagOnCallPriority   = flag.Int("oncall-min-priority", priorityUrgent, "Minimum priority that routes to the on-call user")
+	flagIncidentPriority = flag.Int("incident-min-priority", priorityUrgent, "Minimum priority that opens an incident")
+	flagMaxClients       = flag.Int("max-clients", 15, "Maximum concurrent WebSocket clients")
+	flagClientBuffer     = flag.Int("client-buffer", 64, "Per-client send buffer size (messages)")
+	flagBroadcastBuffer  = flag.Int("broadcast-buffer", 256, "Hub broadcast queue size (messages)")
+	flagSlowClient       = flag.String("slow-client-policy", "drop-newest", "What to do when a client's send buffer is full: drop-newest, drop-oldest or disconnect")
+	flagLDAPURL          = flag.String("ldap-url", "", "LDAP/AD server to sync users from, e.g. ldaps://dc.example.com")
+	flagLDAPStartTLS     = flag.Bool("ldap-starttls", false, "Upgrade ldap:// connections with StartTLS")
+	flagLDAPBindDN       = flag.String("ldap-bind-dn", "", "DN to bind as for the user search (empty for anonymous)")
+	flagLDAPPasswordFile = flag.String("ldap-bind-password-file", "", "Path to file containing the bind password")
+	flagLDAPBaseDN       = flag.String("ldap-base-dn", "", "Search base for users")
+	flagLDAPFilter       = flag.String("ldap-user-filter", "(objectClass=person)", "LDAP filter selecting users to sync")
+	flagLDAPUserAttr     = flag.String("ldap-user-attr", "uid", "Attribute holding the user name (sAMAccountName on AD)")
+	flagLDAPGroupAttr    = flag.String("ldap-group-attr", "memberOf", "Attribute listing the user's groups")
+	flagLDAPInterval     = flag.Duration("ldap-sync-interval", 15*time.Minute, "How often to re-sync users from LDAP")
+	flagStatsInterval    = flag.Duration("stats-interval", 5*time.Second, "Period of the WebSocket stats stream for subscribed clients")
+	flagWSCompression    = flag.Bool("ws-compression", true, "Negotiate permessage-deflate compression on WebSocket connections")
+	flagPingInterval     = flag.Duration("ping-interval", 30*time.Second, "Default WebSocket ping interval")
+	flagPingMin          = flag.Duration("ping-min", 15*time.Second, "Shortest ping interval a client may request with ?ping=")
+	flagPingMax          = flag.Duration("ping-max", 10*time.Minute, "Longest ping interval a client may request with ?ping=")
+	flagTCPKeepAlive     = flag.Duration("tcp-keepalive", 0, "TCP keep-alive period for accepted connections (0 = Go default, negative disables)")
+	flagMinClientVersion = flag.String("min-client-version", "", "Close WebSocket clients reporting an older ?version= with an upgrade-required code")
+	flagWSCompressLevel  = flag.Int("ws-compression-level", 6, "Deflate level for WebSocket compression (1 fastest – 9 smallest)")
+	flagPIDFile          = flag.String("pid-file", "", "Write the server's pid here (used by self-update to trigger a handoff)")
+	flagBackupDir        = flag.String("backup-dir", "", "Write a database snapshot here every --backup-interval")
+	flagBackupInterval   = flag.Duration("backup-interval", 24*time.Hour, "How often to write a backup to --backup-dir")
+	flagBackupKeep       = flag.Int("backup-keep", 7, "Number of backups to keep in --backup-dir")
+	flagRawRetention     = flag.Duration("raw-archive-retention", 0, "Keep the raw request body of each notification this long (0 = don't archive)")
+	flagEncryptKeyFile   = flag.String("encryption-key-file", "", "Encrypt stored notification text with the 32-byte AES key in this file")
+	flagDBBusyTimeout    = flag.Duration("db-busy-timeout", 5*time.Second, "How long a database write waits for a lock before failing")
+	flagDBMaintInterval  = flag.Duration("db-maintenance-interval", 24*time.Hour, "How often to run integrity check, ANALYZE and incremental vacuum (0 disables)")
+	flagS3Endpoint       = flag.String("s3-endpoint", "https://s3.amazonaws.com", "S3-compatible endpoint for the notification archive")
+	flagS3Bucket         = flag.String("s3-bucket", "", "Move old notifications to this bucket (empty = keep everything in SQLite)")
+	flagS3Region         = flag.String("s3-region", "us-east-1", "Region used to sign S3 requests")
+	flagS3Prefix         = flag.String("s3-prefix", "andrnoti/", "Key prefix for archived objects")
+	flagS3CredsFile      = flag.String("s3-credentials-file", "", "File containing \"ACCESS_KEY SECRET_KEY\" (default: AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY)")
+	flagS3ArchiveAfter   = flag.Duration("s3-archive-after", 90*24*time.Hour, "Age at which notifications move to --s3-bucket")
+	flagHoldTopics       = flag.String("hold-topics", "", "Comma-separated topics whose notifications are exported to an archive before any delete removes them")
+	flagHoldExportDir    = flag.String("hold-export-dir", "", "Where held notifications are exported before deletion (default: the S3 bucket if set, else holds/ next to the database)")
+	flagS3ExpireDays     = flag.Int("s3-expire-days", 0, "Install a bucket lifecycle rule deleting archived objects after this many days (0 = keep)")
+	flagMaxBody          = flag.Int64("max-body-bytes", 1<<20, "Largest /send or /heartbeat request body accepted")
+	flagMaxTitle         = flag.Int("max-title-bytes", 1024, "Longest notification title accepted (0 = unlimited)")
+	flagMaxText          = flag.Int("max-text-bytes", 64<<10, "Longest notification text accepted (0 = unlimited)")
+	flagIdempotencyTTL   = flag.Duration("idempotency-ttl", 24*time.Hour, "How long a repeated Idempotency-Key returns the original response (0 = ignore the header)")
+	flagShedMemoryMB     = flag.Int("shed-memory-mb", 0, "Shed load while the Go heap exceeds this many MB (0 = off)")
+	flagShedDBLatency    = flag.Duration("shed-db-latency", 0, "Shed load while database latency exceeds this (0 = off)")
+	flagWSMaxPerIP       = flag.Int("ws-max-per-ip", 5, "Most WebSocket connections from one client address (0 = unlimited)")
+	flagWSAttemptsPerIP  = flag.Int("ws-attempts-per-ip", 30, "Most WebSocket connection attempts per client address and minute (0 = unlimited)")
+	flagWSMaxHandshakes  = flag.Int("ws-max-handshakes", 16, "Most WebSocket upgrade handshakes in progress at once (0 = unlimited)")
+	flagShedMinPriority  = flag.Int("shed-min-priority", priorityHigh, "Lowest send priority still accepted while shedding load")
+	flagAccessLog        = flag.String("access-log", "-", "Where to log every HTTP request: - (the server log), a file path, or off")
+	flagAccessLogFormat  = flag.String("access-log-format", "common", "Access log format: common or json")
+	flagOTLPEndpoint     = flag.String("otlp-endpoint", "", "Export traces to this OpenTelemetry collector (OTLP/HTTP base URL, e.g. http://localhost:4318)")
+	flagOTLPHeaders      = flag.String("otlp-headers", "", "Extra headers for trace export, as key=value,key=value")
+	flagTraceSample      = flag.Float64("trace-sample", 1, "Fraction of new traces to keep, 0-1")
+	flagHealthMinDiskMB  = flag.Int("health-min-disk-mb", 256, "Report /health as degraded when the database's filesystem has less free space than this")
+	flagSLOTarget        = flag.Float64("slo-target", 0, "Percentage of sends that must be stored and broadcast within --slo-latency, e.g. 99 (0 = no SLO)")
+	flagSLOLatency       = flag.Duration("slo-latency", 500*time.Millisecond, "Send latency the SLO allows")
+	flagSLOWindow        = flag.Duration("slo-window", 30*24*time.Hour, "Period the SLO error budget covers")
+	flagSLOBurnRate      = flag.Float64("slo-burn-rate", 14.4, "Alert when the error budget burns this many times faster than sustainable over both the last hour and the last 5 minutes")
+	flagMetricsTopics    = flag.Int("metrics-max-topics", 50, "Topics with their own series on /metrics; later topics are counted as _other")
+	flagMetricsLabels    = flag.String("metrics-labels", "", "Constant labels added to every /metrics series, as key=value,key=value")
+	flagAMPriorities     = flag.String("alertmanager-priorities", "critical=5,error=4,high=4,warning=3,info=2", "Priority for each Alertmanager or Grafana severity label value, as severity=priority,…")
+	flagAMTopicLabel     = flag.String("alertmanager-topic-label", "", "Alertmanager or Grafana label whose value becomes the notification topic (empty = no topic)")
+	flagGitHubSecretFile = flag.String("github-secret-file", "", "Path to file containing the GitHub webhook secret; deliveries signed with it (X-Hub-Signature-256) need no token")
+	flagGitHubEvents     = flag.String("github-events", "push,issues,review_requested,workflow_failure", "GitHub events to notify about, as kind or owner/repo:kind (globs allowed, * = every kind),…")
+	flagClockTolerance   = flag.Duration("clock-tolerance", time.Minute, "Allowed difference between this clock and JWT issuers' or the NTP server's")
+	flagNTPServer        = flag.String("ntp-server", "pool.ntp.org", "NTP server to check the system clock against (empty = no check)")
+	flagNTPInterval      = flag.Duration("ntp-check-interval", time.Hour, "How often to check the system clock against --ntp-server (0 = never)")
+	flagFeedPoll         = flag.Duration("feed-poll-interval", time.Minute, "How often to look for RSS/Atom feeds due a poll (0 = never poll)")
+	flagSMTPListen       = flag.String("smtp-listen", "", "Accept mail on this address (e.g. :2525) and turn each message into a notification (empty = off)")
+	flagSMTPAllowNets    = flag.String("smtp-allow-nets", "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7", "Comma-separated CIDRs allowed to send mail to --smtp-listen")
+	flagSMTPAllowFrom    = flag.String("smtp-allow-from", "", "Comma-separated envelope sender globs to accept mail from, e.g. *@nas.lan (empty = any)")
+	flagSMTPMaxSize      = flag.Int64("smtp-max-size", 10<<20, "Largest message accepted on --smtp-listen, attachments included")
+	flagSyslogListen     = flag.String("syslog-listen", "", "Accept syslog over UDP and TCP on this address (e.g. :5514) and turn matching lines into notifications (empty = off)")
+	flagSyslogAllowNets  = flag.String("syslog-allow-nets", "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7", "Comma-separated CIDRs allowed to send syslog to --syslog-listen")
+	flagSyslogPriorities = flag.String("syslog-priorities", "emerg=5,alert=5,crit=5,err=4,warning=3", "Priority for each syslog severity, as severity=priority,…; lines of other severities are dropped")
+	flagSyslogMatch      = flag.String("syslog-match", "", "Only notify about syslog lines whose tag and message (\"sshd: Failed password…\") match this regexp")
+	flagSyslogIgnore     = flag.String("syslog-ignore", "", "Drop syslog lines whose tag and message match this regexp")
+	flagPublicURL        = flag.String("public-url", "", "Base URL clients reach the server at, e.g. https://notify.example.com, used in UnifiedPush endpoints (empty = from each request)")
+	flagVAPIDKeyFile     = flag.String("vapid-key-file", "", "PEM file with the P-256 VAPID key for Web Push (empty = generate one and keep it in the database)")
+	flagVAPIDSubject     = flag.String("vapid-subject", "", "Contact sent to push services with Web Push, a mailto: or https: URL")
+	flagAPNsKeyFile      = flag.String("apns-key-file", "", "Path to the .p8 APNs auth key; enables delivery to iOS devices")
+	flagAPNsKeyID        = flag.String("apns-key-id", "", "Key ID of --apns-key-file")
+	flagAPNsTeamID       = flag.String("apns-team-id", "", "Apple developer team ID")
+	flagAPNsTopic        = flag.String("apns-topic", "", "Bundle ID of the iOS app")
+	flagAPNsSandbox      = flag.Bool("apns-sandbox", false, "Register devices with the APNs sandbox unless they say otherwise, for development builds")
+	flagPushoverToken    = flag.String("pushover-token-file", "", "Path to file containing a Pushover application token; enables the Pushover fallback")
+	flagPushoverUser     = flag.String("pushover-user", "", "Pushover user or group key to relay to")
+	flagPushoverDevice   = flag.String("pushover-device", "", "Pushover device name to relay to (empty = all of the user's devices)")
+	flagPushoverPriority = flag.Int("pushover-min-priority", 4, "Minimum priority relayed to Pushover when no client is connected")
+	flagPushoverRetry    = flag.Duration("pushover-retry", time.Minute, "How often Pushover repeats an emergency (priority 5) notification until acknowledged")
+	flagPushoverExpire   = flag.Duration("pushover-expire", time.Hour, "How long Pushover keeps repeating an emergency notification (at most 3h)")
+	flagAckRedeliver     = flag.String("ack-redeliver", "2m,5m,10m", "Comma-separated waits between redeliveries of an unseen require_ack notification")
+	flagAckDeadline      = flag.Duration("ack-deadline", 15*time.Minute, "How long a require_ack notification may go unseen before it is escalated")
+	flagDeliveryAttempts = flag.Int("delivery-max-attempts", 10, "Attempts at a push delivery before it is dead-lettered")
+	flagDeadLetterKeep   = flag.Duration("dead-letter-retention", 7*24*time.Hour, "How long dead-lettered push deliveries are kept")
+	flagRedisURL         = flag.String("redis-url", "", "redis:// or rediss:// URL of a Redis server relaying broadcasts between instances that share the database (empty = single instance)")
+	flagRedisChannel     = flag.String("redis-channel", "andrnoti", "Redis pub/sub channel the instances share")
+	flagNATSURL          = flag.String("nats-url", "", "nats:// or tls:// URL of a NATS server with JetStream to publish notifications to and consume them from (empty = off)")
+	flagNATSSubject      = flag.String("nats-subject", "", "Publish each new notification to JetStream on this subject, with the topic appended (empty = don't publish)")
+	flagNATSStream       = flag.String("nats-stream", "", "JetStream stream to consume notifications from (empty = don't consume)")
+	flagNATSConsumer     = flag.String("nats-consumer", "andrnoti", "Durable pull consumer on --nats-stream; created, starting with new messages, if missing")
+	flagNATSFilter       = flag.String("nats-filter", "", "Only consume messages on --nats-stream whose subject matches this, e.g. alerts.> (empty = all)")
+	flagFederationName   = flag.String("federation-name", "", "This instance's name to federation peers, in the origin and hops of what it forwards (empty = the host name)")
+	flagDrainPeriod      = flag.Duration("drain-period", 15*time.Second, "After a SIGUSR2 socket handoff, spread the old process's WebSocket disconnects over this long")
 )
 
-var authToken string
+var readOnlyToken string
 
-// ── Models ────────────────────────────────────────────────────────────────────
-
-type Notification struct {
-	ID        int64   `json:"id"`
-	Title     string  `json:"title"`
-	Text      string  `json:"text"`
-	Source    string  `json:"source"`
-	CreatedAt string  `json:"created_at"`
-	SeenAt    *string `json:"seen_at"`
+// loadToken reads a token from file or plain flag value; "" if neither is set.
+func loadToken(file, plain string) (string, error) {
+	if file == "" {
+		return plain, nil
+	}
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	tok := strings.TrimSpace(string(raw))
+	if tok == "" {
+		return "", fmt.Errorf("token file %s is empty", file)
+	}
+	return tok, nil
 }
 
-type wsMessage struct {
-	Type          string         `json:"type"`
-	Notifications []Notification `json:"notifications,omitempty"`
-	ID            int64          `json:"id,omitempty"`
-	Title         string         `json:"title,omitempty"`
-	Text          string         `json:"text,omitempty"`
-	Source        string         `json:"source,omitempty"`
-	CreatedAt     string         `json:"created_at,omitempty"`
-	SeenAt        *string        `json:"seen_at,omitempty"`
+// splitList parses a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
 }
 
+// ── Models ────────────────────────────────────────────────────────────────────
+
+// Wire types live in the api module so clients can share them; the aliases
+// keep the server's own names.
+type (
+	Notification    = api.Notification
+	wsMessage       = api.Message
+	wsClientMessage = api.ClientMessage
+	liveStats       = api.LiveStats
+	clientConfig    = api.ClientConfig
+	quietHoursHint  = api.QuietHours
+)
+
+// Priorities follow the usual 1–5 scale; 0 in a request means "default".
+const (
+	priorityMin     = api.PriorityMin
+	priorityLow     = api.PriorityLow
+	priorityDefault = api.PriorityDefault
+	priorityHigh    = api.PriorityHigh
+	priorityUrgent  = api.PriorityUrgent
+)
+
 // ── Database ──────────────────────────────────────────────────────────────────
 
 var db *sql.DB
 
+// Prepared statements for the hot paths, ready after initDB.
+var (
+	stmtInsertNotification *sql.Stmt
+	stmtGetNotification    *sql.Stmt
+	stmtHistory            *sql.Stmt
+)
+
+// dbDSN adds connection pragmas to path. The driver applies them to every
+// connection the pool opens: WAL so readers don't block the writer,
+// busy_timeout so concurrent writers wait instead of failing with "database
+// is locked", and foreign key enforcement.
+func dbDSN(path string, busy time.Duration) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	dsn := fmt.Sprintf("%s%s_pragma=journal_mode(WAL)&_pragma=busy_timeout(%d)&_pragma=foreign_keys(1)",
+		path, sep, busy.Milliseconds())
+	if atRest != nil {
+		dsn += "&_pragma=secure_delete(1)"
+	}
+	return dsn
+}
+
 func initDB(path string) error {
 	var err error
-	db, err = sql.Open("sqlite", path)
+	db, err = sql.Open("sqlite", dbDSN(path, *flagDBBusyTimeout))
 	if err != nil {
 		return fmt.Errorf("open sqlite: %w", err)
 	}
+	// Only takes effect on a new file; older ones are converted by the first
+	// database maintenance run.
+	_, _ = db.Exec(`PRAGMA auto_vacuum = INCREMENTAL`)
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS notifications (
 			id         INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -76,6 +271,21 @@ func initDB(path string) error {
 	// Safe migrations — silently ignored if columns already exist.
 	_, _ = db.Exec(`ALTER TABLE notifications ADD COLUMN seen_at DATETIME`)
 	_, _ = db.Exec(`ALTER TABLE notifications ADD COLUMN source TEXT NOT NULL DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE notifications ADD COLUMN topic TEXT NOT NULL DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE notifications ADD COLUMN priority INTEGER NOT NULL DEFAULT 3`)
+	_, _ = db.Exec(`ALTER TABLE notifications ADD COLUMN assignee TEXT NOT NULL DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE notifications ADD COLUMN format TEXT NOT NULL DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE notifications ADD COLUMN extras TEXT NOT NULL DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE notifications ADD COLUMN snoozed_until DATETIME`)
+	_, _ = db.Exec(`ALTER TABLE notifications ADD COLUMN click_url TEXT NOT NULL DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE notifications ADD COLUMN require_ack INTEGER NOT NULL DEFAULT 0`)
+	_, _ = db.Exec(`ALTER TABLE notifications ADD COLUMN acked_at DATETIME`)
+	_, _ = db.Exec(`ALTER TABLE notifications ADD COLUMN acked_by TEXT NOT NULL DEFAULT ''`)
+	// Renderings of a Markdown text, NULL for plain ones and rows stored
+	// before these columns existed.
+	_, _ = db.Exec(`ALTER TABLE notifications ADD COLUMN rendered_text TEXT`)
+	_, _ = db.Exec(`ALTER TABLE notifications ADD COLUMN rendered_html TEXT`)
+	_, _ = db.Exec(`CREATE INDEX IF NOT EXISTS idx_notifications_source ON notifications (source)`)
 
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS heartbeats (
@@ -85,40 +295,294 @@ func initDB(path string) error {
 			alerted   INTEGER NOT NULL DEFAULT 0
 		)
 	`)
-	return err
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS settings (
+			key   TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	if err := initOnCallTables(); err != nil {
+		return err
+	}
+	if err := initIncidentTables(); err != nil {
+		return err
+	}
+	if err := initDirectoryTables(); err != nil {
+		return err
+	}
+	if err := initUsageTables(); err != nil {
+		return err
+	}
+	if err := initRawArchiveTables(); err != nil {
+		return err
+	}
+	if err := initRuleTables(); err != nil {
+		return err
+	}
+	if err := initDigestTables(); err != nil {
+		return err
+	}
+	if err := initAuditTables(); err != nil {
+		return err
+	}
+	if err := initTokenTables(); err != nil {
+		return err
+	}
+	if err := initSLOTables(); err != nil {
+		return err
+	}
+	if err := initArchiveTables(); err != nil {
+		return err
+	}
+	if err := initJobTables(); err != nil {
+		return err
+	}
+	if err := initSchedulerTables(); err != nil {
+		return err
+	}
+	if err := initIdempotencyTables(); err != nil {
+		return err
+	}
+	if err := initDeliveryTables(); err != nil {
+		return err
+	}
+	if err := initReceiptTables(); err != nil {
+		return err
+	}
+	if err := initMergeTables(); err != nil {
+		return err
+	}
+	if err := initTemplateTables(); err != nil {
+		return err
+	}
+	if err := initHookTables(); err != nil {
+		return err
+	}
+	if err := initFeedTables(); err != nil {
+		return err
+	}
+	if err := initUnifiedPushTables(); err != nil {
+		return err
+	}
+	if err := initWebPushTables(); err != nil {
+		return err
+	}
+	if err := initAPNsTables(); err != nil {
+		return err
+	}
+	if err := initChatTables(); err != nil {
+		return err
+	}
+	if err := initPushoverTables(); err != nil {
+		return err
+	}
+	if err := initDeliveryQueueTables(); err != nil {
+		return err
+	}
+	if err := initDeliveryStatusTables(); err != nil {
+		return err
+	}
+	if err := initFederationTables(); err != nil {
+		return err
+	}
+	if err := initQuietHoursTables(); err != nil {
+		return err
+	}
+	if err := initReminderTables(); err != nil {
+		return err
+	}
+	if err := initEscalationTables(); err != nil {
+		return err
+	}
+	if err := initDevicePrefsTables(); err != nil {
+		return err
+	}
+	if err := prepareStatements(); err != nil {
+		return err
+	}
+	return loadKnownTopics()
 }
 
-func insertNotification(title, text, source string) (Notification, error) {
-	res, err := db.Exec(
-		`INSERT INTO notifications (title, text, source) VALUES (?, ?, ?)`,
-		title, text, source,
+func prepareStatements() error {
+	var err error
+	if stmtInsertNotification, err = db.Prepare(
+		`INSERT INTO notifications (title, text, format, source, topic, priority, assignee, click_url, extras, require_ack, rendered_text, rendered_html) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	); err != nil {
+		return err
+	}
+	if stmtGetNotification, err = db.Prepare(
+		`SELECT ` + notificationCols + ` FROM notifications WHERE id = ?`,
+	); err != nil {
+		return err
+	}
+	stmtHistory, err = db.Prepare(
+		`SELECT ` + notificationCols + ` FROM notifications WHERE snoozed_until IS NULL ORDER BY id DESC LIMIT ? OFFSET ?`,
 	)
+	return err
+}
+
+// getSetting returns the stored value for key, or "" if unset.
+func getSetting(key string) string {
+	var v string
+	db.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&v)
+	return v
+}
+
+func setSetting(key, value string) error {
+	_, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES (?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value
+	`, key, value)
+	return err
+}
+
+// notificationCols is the column list matching scanNotification.
+const notificationCols = `id, title, text, format, source, topic, priority, assignee, click_url, extras, created_at, seen_at, snoozed_until, require_ack, acked_at, acked_by, rendered_text`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanNotification(s scanner) (Notification, error) {
+	var n Notification
+	var extras string
+	var rendered sql.NullString
+	err := s.Scan(&n.ID, &n.Title, &n.Text, &n.Format, &n.Source, &n.Topic, &n.Priority, &n.Assignee, &n.ClickURL, &extras, &n.CreatedAt, &n.SeenAt, &n.SnoozedUntil, &n.RequireAck, &n.AckedAt, &n.AckedBy, &rendered)
+	if err != nil {
+		return n, err
+	}
+	if n.Title, err = openColumn("title", n.Title); err != nil {
+		return n, err
+	}
+	if n.Text, err = openColumn("text", n.Text); err != nil {
+		return n, err
+	}
+	if n.ClickURL, err = openColumn("click_url", n.ClickURL); err != nil {
+		return n, err
+	}
+	if extras, err = openColumn("extras", extras); err != nil {
+		return n, err
+	}
+	if extras != "" {
+		n.Extras = new(api.Extras)
+		if json.Unmarshal([]byte(extras), n.Extras) != nil {
+			n.Extras = nil
+		}
+	}
+	if n.Format == formatMarkdown {
+		// text holds the source; clients get a plain rendering in text.
+		n.Markdown = n.Text
+		if !rendered.Valid {
+			_, n.Text = renderMarkdown(n.Markdown)
+		} else if n.Text, err = openColumn("rendered_text", rendered.String); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// withHTML adds the sanitized HTML rendering to a Markdown notification.
+func withHTML(n Notification) Notification {
+	if n.Format != formatMarkdown {
+		return n
+	}
+	var stored sql.NullString
+	err := db.QueryRow(`SELECT rendered_html FROM notifications WHERE id = ?`, n.ID).Scan(&stored)
+	if err == nil && stored.Valid {
+		if n.HTML, err = openColumn("rendered_html", stored.String); err == nil {
+			return n
+		}
+	}
+	n.HTML, _ = renderMarkdown(n.Markdown)
+	return n
+}
+
+// renderedColumns renders a Markdown text once, for storage; plain texts
+// store NULL.
+func renderedColumns(n Notification) (plain, htmlOut any) {
+	if n.Format != formatMarkdown {
+		return nil, nil
+	}
+	h, p := renderMarkdown(n.Text)
+	return sealColumn("rendered_text", p), sealColumn("rendered_html", h)
+}
+
+// insertNotification stores n, marked for fan-out (see outbox.go).
+func insertNotification(n Notification) (Notification, error) {
+	tx, err := db.Begin()
 	if err != nil {
 		return Notification{}, err
 	}
-	id, _ := res.LastInsertId()
-	var n Notification
-	row := db.QueryRow(
-		`SELECT id, title, text, source, created_at, seen_at FROM notifications WHERE id = ?`, id,
-	)
-	err = row.Scan(&n.ID, &n.Title, &n.Text, &n.Source, &n.CreatedAt, &n.SeenAt)
-	return n, err
+	defer tx.Rollback()
+	id, err := execInsertNotification(tx.Stmt(stmtInsertNotification), n)
+	if err != nil {
+		return Notification{}, err
+	}
+	if err := markFanOut(tx, id); err != nil {
+		return Notification{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Notification{}, err
+	}
+	return getNotification(id)
 }
 
-func queryHistory(limit, offset int) ([]Notification, error) {
-	rows, err := db.Query(
-		`SELECT id, title, text, source, created_at, seen_at FROM notifications
-		 ORDER BY id DESC LIMIT ? OFFSET ?`,
-		limit, offset,
+// execInsertNotification runs the insert statement, or a transaction's copy
+// of it, and returns the new id.
+func execInsertNotification(stmt *sql.Stmt, n Notification) (int64, error) {
+	var extras []byte
+	if n.Extras != nil {
+		extras, _ = json.Marshal(n.Extras)
+	}
+	plain, htmlOut := renderedColumns(n)
+	start := time.Now()
+	defer func() { observeDBLatency(time.Since(start)) }()
+	res, err := stmt.Exec(
+		sealColumn("title", n.Title), sealColumn("text", n.Text), n.Format, n.Source, n.Topic, n.Priority, n.Assignee,
+		sealColumn("click_url", n.ClickURL), sealColumn("extras", string(extras)), n.RequireAck, plain, htmlOut,
 	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func getNotification(id int64) (Notification, error) {
+	return scanNotification(stmtGetNotification.QueryRow(id))
+}
+
+// queryHistory pages through unsnoozed notifications, newest first, only
+// those from source when it is set and none on hidden topics.
+func queryHistory(limit, offset int, source string, hidden []string) ([]Notification, error) {
+	var rows *sql.Rows
+	var err error
+	if source == "" && len(hidden) == 0 {
+		rows, err = stmtHistory.Query(limit, offset)
+	} else {
+		where, args := topicFilter(hidden)
+		if source != "" {
+			where += ` AND source = ?`
+			args = append(args, source)
+		}
+		rows, err = db.Query(
+			`SELECT `+notificationCols+` FROM notifications WHERE snoozed_until IS NULL`+where+` ORDER BY id DESC LIMIT ? OFFSET ?`,
+			append(args, limit, offset)...)
+	}
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var ns []Notification
 	for rows.Next() {
-		var n Notification
-		if err := rows.Scan(&n.ID, &n.Title, &n.Text, &n.Source, &n.CreatedAt, &n.SeenAt); err != nil {
+		n, err := scanNotification(rows)
+		if err != nil {
 			return nil, err
 		}
 		ns = append(ns, n)
@@ -126,11 +590,87 @@ func queryHistory(limit, offset int) ([]Notification, error) {
 	return ns, rows.Err()
 }
 
+// sqliteTime formats t the way CURRENT_TIMESTAMP does, so stored values
+// compare correctly as strings.
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
 // ── WebSocket Hub ─────────────────────────────────────────────────────────────
 
 type client struct {
-	conn *websocket.Conn
-	send chan []byte
+	id          int64
+	conn        *websocket.Conn
+	send        chan []byte
+	user        string        // optional ?user= identity, used for on-call routing
+	ip          string        // real client address (see clientIP)
+	version     string        // optional ?version= the client reported
+	html        bool          // ?html=1: include rendered HTML for Markdown notifications
+	proto       bool          // negotiated the protobuf subprotocol (see proto.go)
+	batch       atomic.Bool   // ?batch=1 or hello: /send/batch arrives as one "notifications" frame
+	device      string        // optional ?device= whose cursor acks move (see delivery.go)
+	ping        time.Duration // server ping interval; 0 = client opted out
+	auth        authInfo
+	connectedAt time.Time
+	dropped     atomic.Int64 // messages lost because send was full
+	statsSub    atomic.Bool  // subscribed to the stats stream
+	compressed  bool         // permessage-deflate was negotiated
+
+	// Set by the client's hello (see hello.go).
+	protocol atomic.Int32
+	features atomic.Pointer[[]string]
+	topics   atomic.Pointer[[]string] // nil or empty: all it may see
+
+	prefs atomic.Pointer[devicePrefs] // its device's preferences (see prefs.go); nil: none
+
+	// The hub closes send when it drops the client; sendMu and closed keep
+	// anyone else from sending on it afterwards (see trySend).
+	sendMu sync.Mutex
+	closed bool
+}
+
+// trySend queues msg for c unless its buffer is full or the hub has dropped
+// it, and reports whether it did. Everything outside the hub goroutine
+// sends to a client this way.
+func (c *client) trySend(msg []byte) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.closed {
+		return false
+	}
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeSend closes c.send, once; writePump then exits and closes the
+// connection. Only the hub goroutine calls it.
+func (c *client) closeSend() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
+// Slow-client policies: what the hub does when a client's send buffer is full.
+const (
+	slowDropNewest = "drop-newest"
+	slowDropOldest = "drop-oldest"
+	slowDisconnect = "disconnect"
+)
+
+// envelope is a broadcast frame plus an optional recipient filter.
+type envelope struct {
+	data   []byte
+	to     func(*client) bool // nil means every client
+	topics []string           // notification frames: the topics they carry, for /metrics
+	ids    []int64            // and their ids, for delivery status
+	since  time.Time          // when those notifications were stored
 }
 
 type hub struct {
@@ -138,15 +678,23 @@ type hub struct {
 	clients map[*client]struct{}
 	reg     chan *client
 	unreg   chan *client
-	bcast   chan []byte
+	bcast   chan envelope
+	probe   chan chan struct{} // liveness checks from /health
+	policy  string
+
+	nextID          atomic.Int64
+	droppedTotal    atomic.Int64
+	slowDisconnects atomic.Int64
 }
 
-func newHub() *hub {
+func newHub(policy string, bcastBuffer int) *hub {
 	return &hub{
 		clients: make(map[*client]struct{}),
 		reg:     make(chan *client, 16),
 		unreg:   make(chan *client, 16),
-		bcast:   make(chan []byte, 256),
+		bcast:   make(chan envelope, bcastBuffer),
+		probe:   make(chan chan struct{}),
+		policy:  policy,
 	}
 }
 
@@ -162,22 +710,92 @@ func (h *hub) run() {
 			h.mu.Lock()
 			if _, ok := h.clients[c]; ok {
 				delete(h.clients, c)
-				close(c.send)
+				c.closeSend()
 			}
 			h.mu.Unlock()
 
-		case msg := <-h.bcast:
+		case env := <-h.bcast:
+			var slow []*client
+			sent := 0
 			h.mu.RLock()
 			for c := range h.clients {
+				if env.to != nil && !env.to(c) {
+					continue
+				}
 				select {
-				case c.send <- msg:
+				case c.send <- env.data:
+					sent++
+					logWSDelivery(env.ids, c, statusDelivered, "")
 				default:
-					// slow client — drop message
+					slow = append(slow, c)
 				}
 			}
 			h.mu.RUnlock()
+			for _, c := range slow {
+				if h.handleSlow(c, env.data) {
+					logWSDelivery(env.ids, c, statusDelivered, "")
+				} else {
+					logWSDelivery(env.ids, c, statusFailed, "send buffer full ("+h.policy+")")
+				}
+			}
+			if env.topics != nil {
+				promMetrics.delivered(env.topics, channelWebSocket, env.since, sent, len(slow))
+			}
+
+		case done := <-h.probe:
+			close(done)
+		}
+	}
+}
+
+// alive reports whether the hub loop answers within timeout.
+func (h *hub) alive(timeout time.Duration) bool {
+	done := make(chan struct{})
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case h.probe <- done:
+	case <-t.C:
+		return false
+	}
+	<-done
+	return true
+}
+
+// handleSlow applies the slow-client policy to a client whose buffer was
+// full, and reports whether msg was queued after all.
+func (h *hub) handleSlow(c *client, msg []byte) bool {
+	switch h.policy {
+	case slowDisconnect:
+		h.mu.Lock()
+		if _, ok := h.clients[c]; ok {
+			delete(h.clients, c)
+			c.closeSend()
+			h.slowDisconnects.Add(1)
+			log.Printf("ws: client %d (%s) disconnected: send buffer full", c.id, c.ip)
 		}
+		h.mu.Unlock()
+		return false
 	}
+	queued := false
+	if h.policy == slowDropOldest {
+		// Make room by discarding the oldest queued frame; if the writer
+		// drained it meanwhile, the retry simply succeeds.
+		select {
+		case <-c.send:
+		default:
+		}
+		select {
+		case c.send <- msg:
+			queued = true
+		default:
+		}
+	}
+	if c.dropped.Add(1) == 1 {
+		log.Printf("ws: client %d (%s) is slow, dropping messages (%s)", c.id, c.ip, h.policy)
+	}
+	h.droppedTotal.Add(1)
+	return queued
 }
 
 func (h *hub) connectedCount() int {
@@ -186,18 +804,98 @@ func (h *hub) connectedCount() int {
 	return len(h.clients)
 }
 
+type clientStats struct {
+	ID          int64    `json:"id"`
+	Remote      string   `json:"remote"`
+	User        string   `json:"user,omitempty"`
+	Version     string   `json:"version,omitempty"`
+	PingSeconds int      `json:"ping_seconds"`
+	ConnectedAt string   `json:"connected_at"`
+	Queued      int      `json:"queued"`
+	Dropped     int64    `json:"dropped"`
+	Protocol    int      `json:"protocol,omitempty"` // 0: never said hello
+	Features    []string `json:"features,omitempty"`
+}
+
+func (h *hub) clientStats() []clientStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make([]clientStats, 0, len(h.clients))
+	for c := range h.clients {
+		out = append(out, c.stats())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+func (c *client) stats() clientStats {
+	s := clientStats{
+		ID:          c.id,
+		Remote:      c.ip,
+		User:        c.user,
+		Version:     c.version,
+		PingSeconds: int(c.ping / time.Second),
+		ConnectedAt: c.connectedAt.UTC().Format(time.RFC3339),
+		Queued:      len(c.send),
+		Dropped:     c.dropped.Load(),
+		Protocol:    int(c.protocol.Load()),
+	}
+	if f := c.features.Load(); f != nil {
+		s.Features = *f
+	}
+	return s
+}
+
+// anyConnected reports whether any connected client passes to.
+func (h *hub) anyConnected(to func(*client) bool) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.clients {
+		if to(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// userConnected reports whether any client identified as user is connected.
+func (h *hub) userConnected(user string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.clients {
+		if c.user == user {
+			return true
+		}
+	}
+	return false
+}
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin:      func(r *http.Request) bool { return true },
 	ReadBufferSize:   1024,
 	WriteBufferSize:  4096,
 	HandshakeTimeout: 10 * time.Second,
+	Subprotocols:     []string{wsProtoSubprotocol},
 }
 
+// Frames smaller than this aren't worth the deflate overhead.
+const wsCompressMinBytes = 256
+
 func writePump(c *client) {
 	defer c.conn.Close()
 	for msg := range c.send {
+		kind := websocket.TextMessage
+		if c.proto {
+			data, err := protoFrame(msg)
+			if err != nil {
+				log.Printf("ws: client %d: proto frame: %v", c.id, err)
+				continue
+			}
+			kind, msg = websocket.BinaryMessage, data
+		}
 		c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-		if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		c.conn.EnableWriteCompression(len(msg) >= wsCompressMinBytes)
+		if err := c.conn.WriteMessage(kind, msg); err != nil {
 			return
 		}
 	}
@@ -208,25 +906,90 @@ func readPump(h *hub, c *client) {
 		h.unreg <- c
 		c.conn.Close()
 	}()
-	c.conn.SetReadLimit(512)
-	c.conn.SetReadDeadline(time.Now().Add(70 * time.Second))
+	c.conn.SetReadLimit(4096) // room for a hello with a topic list
+	// Any traffic from the client proves it is alive. Clients that opted out
+	// of pings have no read deadline; TCP keep-alive reaps dead peers.
+	extend := func() {
+		if c.ping > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.ping + pongGrace))
+		}
+	}
+	extend()
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(70 * time.Second))
+		extend()
 		return nil
 	})
+	c.conn.SetPingHandler(func(data string) error {
+		extend()
+		err := c.conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(10*time.Second))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
 	for {
-		if _, _, err := c.conn.ReadMessage(); err != nil {
+		kind, data, err := c.conn.ReadMessage()
+		if err != nil {
 			return
 		}
+		extend()
+		var m wsClientMessage
+		if kind == websocket.BinaryMessage {
+			err = protoUnmarshal(data, &m)
+		} else {
+			err = json.Unmarshal(data, &m)
+		}
+		if err != nil {
+			continue
+		}
+		switch {
+		case m.Type == "subscribe" && m.Stream == "stats":
+			c.statsSub.Store(true)
+		case m.Type == "unsubscribe" && m.Stream == "stats":
+			c.statsSub.Store(false)
+		case m.Type == api.TypeAck && c.device != "" && m.ID > 0:
+			ackCursor(c.device, c.user, c.auth.ID, m.ID)
+		case m.Type == api.TypeUPAck && c.device != "" && m.ID > 0:
+			ackUP(c.device, c.auth.ID, m.ID)
+		case m.Type == api.TypeHello:
+			// Straight to c: its registration may still be queued at the hub.
+			if !c.trySend(c.hello(m)) {
+				log.Printf("ws: client %d: hello answer dropped, send buffer full", c.id)
+			}
+		}
+	}
+}
+
+// pongGrace is how long past a ping interval the server waits for traffic
+// before treating the client as gone.
+const pongGrace = 40 * time.Second
+
+// pingInterval resolves a client's ?ping= request (seconds) against the
+// configured default and bounds. "0" opts out of server pings entirely, for
+// clients that are woken by push and reconnect on their own.
+func pingInterval(req string) (time.Duration, error) {
+	if req == "" {
+		return *flagPingInterval, nil
+	}
+	secs, err := strconv.Atoi(req)
+	if err != nil || secs < 0 {
+		return 0, fmt.Errorf("ping must be a number of seconds")
+	}
+	if secs == 0 {
+		return 0, nil
 	}
+	d := time.Duration(secs) * time.Second
+	return min(max(d, *flagPingMin), *flagPingMax), nil
 }
 
 func pingPump(c *client) {
-	ticker := time.NewTicker(30 * time.Second)
+	if c.ping == 0 {
+		return
+	}
+	ticker := time.NewTicker(c.ping)
 	defer ticker.Stop()
 	for range ticker.C {
-		c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-		if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+		if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
 			return
 		}
 	}
@@ -247,17 +1010,89 @@ func parseSQLiteTime(s string) (time.Time, error) {
 	return time.Time{}, fmt.Errorf("unrecognised time format: %q", s)
 }
 
+// recipients selects the clients that receive n. Topic ACLs always apply.
+// Assigned notifications go only to the assignee's clients — unless none are
+// connected, in which case everyone allowed gets it rather than no one.
+func recipients(h *hub, n Notification) func(*client) bool {
+	if n.Assignee != "" && h.userConnected(n.Assignee) {
+		return func(c *client) bool { return c.user == n.Assignee && c.sees(n.Topic) }
+	}
+	return func(c *client) bool { return c.sees(n.Topic) }
+}
+
 func broadcastNotification(h *hub, n Notification) {
+	broadcastTo(h, n, recipients(h, n))
+	fanOut(h, n)
+	busPublish(busEvent{Kind: busKindNote, IDs: []int64{n.ID}})
+}
+
+// broadcastTo sends n as a "notification" frame to the clients to accepts
+// whose device preferences want it.
+func broadcastTo(h *hub, n Notification, accepts func(*client) bool) {
+	to := func(c *client) bool { return accepts(c) && c.wants(n) }
 	msg := wsMessage{
-		Type:      "notification",
-		ID:        n.ID,
-		Title:     n.Title,
-		Text:      n.Text,
-		Source:    n.Source,
-		CreatedAt: n.CreatedAt,
+		Type:       "notification",
+		ID:         n.ID,
+		Title:      n.Title,
+		Text:       n.Text,
+		Format:     n.Format,
+		Markdown:   n.Markdown,
+		Source:     n.Source,
+		Topic:      n.Topic,
+		Priority:   n.Priority,
+		Assignee:   n.Assignee,
+		ClickURL:   n.ClickURL,
+		Extras:     n.Extras,
+		CreatedAt:  n.CreatedAt,
+		RequireAck: n.RequireAck,
 	}
 	data, _ := json.Marshal(msg)
-	h.bcast <- data
+	topics, ids, now := []string{n.Topic}, []int64{n.ID}, time.Now()
+	if n.Format != formatMarkdown {
+		h.bcast <- envelope{data: data, to: to, topics: topics, ids: ids, since: now}
+		return
+	}
+	msg.HTML = withHTML(n).HTML
+	withHTMLData, _ := json.Marshal(msg)
+	h.bcast <- envelope{data: data, to: func(c *client) bool { return !c.html && to(c) }, topics: topics, ids: ids, since: now}
+	h.bcast <- envelope{data: withHTMLData, to: func(c *client) bool { return c.html && to(c) }, topics: topics, ids: ids, since: now}
+}
+
+// publish routes, stores and broadcasts a notification. Every producer
+// (/send, heartbeat alerts, on-call handoffs) goes through here, or through
+// publishBatch for /send/batch. ctx carries the caller's trace, if any.
+func publish(ctx context.Context, h *hub, n Notification) (Notification, error) {
+	ctx, s := startSpan(ctx, "publish", spanInternal)
+	defer s.end()
+	start := time.Now()
+	if n.Priority == 0 {
+		n.Priority = priorityDefault
+	}
+	if n.Assignee == "" {
+		n.Assignee = onCallAssignee(n)
+	}
+	err := traceDB(ctx, "insert notification", func() (err error) {
+		n, err = insertNotification(n)
+		return err
+	})
+	promMetrics.stored(n.Topic, err)
+	if err != nil {
+		observeSLO(time.Since(start), err)
+		s.fail(err)
+		return Notification{}, err
+	}
+	s.set("notification.id", n.ID)
+	if !quietHold(n) {
+		traceBroadcast(ctx, 1, func() { broadcastNotification(h, n) })
+	}
+	observeSLO(time.Since(start), nil)
+	sendRate.add(1)
+	openIncident(n)
+	startEscalation(n)
+	if noteTopic(n.Topic) {
+		pushClientConfig(h)
+	}
+	return n, nil
 }
 
 func startHeartbeatChecker(h *hub, missedThreshold int) {
@@ -268,6 +1103,9 @@ func startHeartbeatChecker(h *hub, missedThreshold int) {
 }
 
 func checkHeartbeats(h *hub, missedThreshold int) {
+	if currentMaintenance().Enabled || draining.Load() {
+		return
+	}
 	rows, err := db.Query(
 		`SELECT source, interval, last_seen, alerted FROM heartbeats`,
 	)
@@ -308,42 +1146,277 @@ func checkHeartbeats(h *hub, missedThreshold int) {
 		})
 	}
 
-	for _, hb := range sources {
-		deadline := hb.lastSeen.Add(time.Duration(hb.interval*missedThreshold) * time.Second)
-		isDown := time.Now().UTC().After(deadline)
+	for _, hb := range sources {
+		deadline := hb.lastSeen.Add(time.Duration(hb.interval*missedThreshold) * time.Second)
+		isDown := time.Now().UTC().After(deadline)
+
+		if isDown && !hb.alerted {
+			silence := time.Since(hb.lastSeen).Round(time.Second)
+			_, err := publish(context.Background(), h, Notification{
+				Title:    hb.source + " unreachable",
+				Text:     fmt.Sprintf("No heartbeat for %s (%d missed × %ds interval).", silence, missedThreshold, hb.interval),
+				Source:   "andrNoti",
+				Priority: priorityHigh,
+			})
+			if err != nil {
+				log.Printf("heartbeat: insert alert for %q: %v", hb.source, err)
+			} else {
+				log.Printf("heartbeat: source=%q alerted (silent for %s)", hb.source, silence)
+			}
+			db.Exec(`UPDATE heartbeats SET alerted=1 WHERE source=?`, hb.source)
+		}
+	}
+}
+
+// ── Auth Middleware ────────────────────────────────────────────────────────────
+
+// scope is what a credential may do. Higher scopes include lower ones.
+type scope int
+
+const (
+	scopeRead scope = iota + 1 // history, stats, WebSocket
+	scopeFull                  // everything
+)
+
+// authInfo identifies the caller. ID is safe to log; it is never the secret.
+type authInfo struct {
+	ID      string
+	Scope   scope
+	User    string    // identity carried by the credential (JWT sub)
+	Expires time.Time // zero for static tokens
+}
+
+type ctxKey int
+
+const authKey ctxKey = 0
+
+func tokenEqual(a, b string) bool {
+	return b != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// authenticate maps a presented token to the caller's identity.
+func authenticate(token string) (authInfo, bool) {
+	if a, ok := matchPrimary(token); ok {
+		return a, true
+	}
+	if a, ok := matchNamedToken(token); ok {
+		return a, true
+	}
+	if a, ok := matchManagedToken(token); ok {
+		return a, true
+	}
+	switch {
+	case tokenEqual(token, readOnlyToken):
+		return authInfo{ID: "readonly", Scope: scopeRead}, true
+	case jwtEnabled() && strings.Count(token, ".") == 2:
+		a, err := verifyJWT(token, time.Now())
+		if err != nil {
+			log.Printf("auth: jwt rejected: %v", err)
+			return authInfo{}, false
+		}
+		return a, true
+	}
+	return authInfo{}, false
+}
+
+// authFrom returns the identity requireScope attached to the request.
+func authFrom(r *http.Request) authInfo {
+	a, _ := r.Context().Value(authKey).(authInfo)
+	return a
+}
+
+// requestAuth authenticates a request by token if one is presented,
+// otherwise by client certificate.
+func requestAuth(r *http.Request, token string) (authInfo, bool) {
+	if token != "" {
+		return authenticate(token)
+	}
+	return certAuth(r)
+}
+
+func requireScope(need scope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := r.Header.Get("Authorization")
+		if v != "" && !strings.HasPrefix(v, "Bearer ") {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		a, ok := requestAuth(r, strings.TrimPrefix(v, "Bearer "))
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if a.Scope < need {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		noteAuth(r, a)
+		next(w, r.WithContext(context.WithValue(r.Context(), authKey, a)))
+	}
+}
+
+func requireBearer(next http.HandlerFunc) http.HandlerFunc {
+	return requireScope(scopeFull, next)
+}
+
+func requireRead(next http.HandlerFunc) http.HandlerFunc {
+	return requireScope(scopeRead, next)
+}
+
+// ── Handlers ──────────────────────────────────────────────────────────────────
+
+// checkExtras validates producer-supplied extras. Source links are shown to
+// users as-is, so only absolute http(s) URLs are accepted.
+func checkExtras(e *api.Extras) error {
+	if e == nil {
+		return nil
+	}
+	if e.Origin != nil {
+		return errors.New("extras.origin is set by federation, not by senders")
+	}
+	if err := checkHints(e.Hints); err != nil {
+		return err
+	}
+	if e.Source == nil {
+		return nil
+	}
+	s := e.Source
+	if strings.TrimSpace(s.System) == "" {
+		return errors.New("extras.source.system is required")
+	}
+	if len(s.System) > 64 || len(s.ID) > 256 || len(s.URL) > 2048 || len(s.RawRef) > 512 {
+		return errors.New("extras.source field too long")
+	}
+	if s.URL != "" && !httpURL(s.URL) {
+		return errors.New("extras.source.url must be an absolute http(s) URL")
+	}
+	return nil
+}
+
+// checkClickURL validates a notification's click_url, which clients open
+// when it is tapped.
+func checkClickURL(s string) error {
+	if s == "" {
+		return nil
+	}
+	if len(s) > 2048 {
+		return errors.New("click_url too long")
+	}
+	if !httpURL(s) {
+		return errors.New("click_url must be an absolute http(s) URL")
+	}
+	return nil
+}
+
+func httpURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// trimExtras drops empty parts of e, and e itself once nothing is left.
+func trimExtras(e *api.Extras) *api.Extras {
+	if e != nil && e.Hints != nil && *e.Hints == (api.Hints{}) {
+		e.Hints = nil
+	}
+	if e == nil || (e.Source == nil && e.Hints == nil && e.Origin == nil) {
+		return nil
+	}
+	return e
+}
+
+var iconName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
 
-		if isDown && !hb.alerted {
-			silence := time.Since(hb.lastSeen).Round(time.Second)
-			n, err := insertNotification(
-				hb.source+" unreachable",
-				fmt.Sprintf("No heartbeat for %s (%d missed × %ds interval).", silence, missedThreshold, hb.interval),
-				"andrNoti",
-			)
-			if err != nil {
-				log.Printf("heartbeat: insert alert for %q: %v", hb.source, err)
-			} else {
-				broadcastNotification(h, n)
-				log.Printf("heartbeat: source=%q alerted (silent for %s)", hb.source, silence)
-			}
-			db.Exec(`UPDATE heartbeats SET alerted=1 WHERE source=?`, hb.source)
-		}
+// checkHints accepts the hint values clients know, and icon names.
+func checkHints(h *api.Hints) error {
+	if h == nil {
+		return nil
+	}
+	switch h.Sound {
+	case "", api.SoundDefault, api.SoundAlarm, api.SoundNone:
+	default:
+		return errors.New("extras.hints.sound must be default, alarm or none")
+	}
+	switch h.Vibrate {
+	case "", api.VibrateDefault, api.VibrateShort, api.VibrateLong, api.VibrateNone:
+	default:
+		return errors.New("extras.hints.vibrate must be default, short, long or none")
+	}
+	if h.Icon != "" && !iconName.MatchString(h.Icon) {
+		return errors.New("extras.hints.icon must be a lowercase name (a-z, 0-9, - and _, at most 64)")
 	}
+	return nil
 }
 
-// ── Auth Middleware ────────────────────────────────────────────────────────────
+// sendBody is one notification as posted to /send or /send/batch.
+type sendBody struct {
+	Title      string      `json:"title"`
+	Text       string      `json:"text"`
+	Format     string      `json:"format"`
+	Source     string      `json:"source"`
+	Topic      string      `json:"topic"`
+	Priority   int         `json:"priority"`
+	ClickURL   string      `json:"click_url"`
+	Extras     *api.Extras `json:"extras"`
+	RequireAck bool        `json:"require_ack"`
+}
 
-func requireBearer(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		v := r.Header.Get("Authorization")
-		if !strings.HasPrefix(v, "Bearer ") || strings.TrimPrefix(v, "Bearer ") != authToken {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		next(w, r)
+// check validates and normalizes b. A size violation is returned as a
+// limitError so it can be answered with 413; anything else is an error.
+func (b *sendBody) check() (*limitError, error) {
+	if err := checkExtras(b.Extras); err != nil {
+		return nil, err
+	}
+	b.Extras = trimExtras(b.Extras)
+	if err := checkClickURL(b.ClickURL); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(b.Text) == "" {
+		return nil, errors.New("text is required")
+	}
+	if e := checkSizes(b.Title, b.Text); e != nil {
+		return e, nil
+	}
+	switch b.Format {
+	case "", formatPlain:
+		b.Format = ""
+	case formatMarkdown:
+	default:
+		return nil, errors.New("format must be plain or markdown")
+	}
+	if b.Priority < 0 || b.Priority > priorityUrgent {
+		return nil, errors.New("priority must be 1-5")
 	}
+	return nil, nil
 }
 
-// ── Handlers ──────────────────────────────────────────────────────────────────
+// notification builds the notification to store for a request by a, which
+// names the source when the body doesn't.
+func (b *sendBody) notification(a authInfo) Notification {
+	return Notification{
+		Title:      b.Title,
+		Text:       b.Text,
+		Format:     b.Format,
+		Source:     cmp.Or(b.Source, callerSource(a)),
+		Topic:      b.Topic,
+		Priority:   b.Priority,
+		ClickURL:   b.ClickURL,
+		Extras:     b.Extras,
+		RequireAck: b.RequireAck,
+	}
+}
+
+// callerSource is the default source for what a caller sends: the name of a
+// --tokens-file or managed token, or the common name of a client
+// certificate. Shared credentials (the primary token, HMAC signing) name no
+// sender and give none.
+func callerSource(a authInfo) string {
+	for _, prefix := range []string{"token:", "cert:"} {
+		if name, ok := strings.CutPrefix(a.ID, prefix); ok {
+			return name
+		}
+	}
+	return ""
+}
 
 func handleSend(h *hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -351,34 +1424,91 @@ func handleSend(h *hub) http.HandlerFunc {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		var body struct {
-			Title  string `json:"title"`
-			Text   string `json:"text"`
-			Source string `json:"source"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			http.Error(w, "bad request", http.StatusBadRequest)
-			return
+		var body sendBody
+		limitBody(w, r)
+		var raw bytes.Buffer
+		in := io.Reader(r.Body)
+		if rawArchiveEnabled() {
+			in = io.TeeReader(r.Body, &raw)
 		}
-		if strings.TrimSpace(body.Text) == "" {
-			http.Error(w, "text is required", http.StatusBadRequest)
+		if err := json.NewDecoder(in).Decode(&body); err != nil {
+			if !bodyTooLarge(w, err) {
+				http.Error(w, "bad request", http.StatusBadRequest)
+			}
 			return
 		}
+		sendNotification(w, r, h, body, raw.Bytes())
+	}
+}
+
+// sendNotification checks, routes and publishes one notification for a
+// request whose body has been read, answering it. raw is the body as
+// received, for the raw payload archive.
+func sendNotification(w http.ResponseWriter, r *http.Request, h *hub, body sendBody, raw []byte) {
+	if e, err := body.check(); e != nil {
+		writeLimitError(w, *e)
+		log.Printf("send: rejected ip=%s: %s", clientIP(r), e.Error)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if shedPriority(w, cmp.Or(body.Priority, priorityDefault)) {
+		log.Printf("send: shed priority %d ip=%s", cmp.Or(body.Priority, priorityDefault), clientIP(r))
+		return
+	}
+
+	caller := authFrom(r).ID
+	ok, reset, err := countSend(caller, time.Now(), 1)
+	if err != nil {
+		log.Printf("usage: %v", err)
+	}
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+		http.Error(w, "daily quota exceeded for "+caller, http.StatusTooManyRequests)
+		log.Printf("send: quota exceeded for %s ip=%s", caller, clientIP(r))
+		return
+	}
 
-		n, err := insertNotification(body.Title, body.Text, body.Source)
+	n, matched, suppressedBy, digest := applyRoutes(nil, body.notification(authFrom(r)))
+	recordRuleHits(ruleKindRoute, matched)
+	if suppressedBy != "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"id": 0, "sent_to": 0, "suppressed_by": suppressedBy})
+		log.Printf("send: suppressed by rule %q ip=%s by=%s source=%q topic=%q title=%q", suppressedBy, clientIP(r), caller, n.Source, n.Topic, n.Title)
+		return
+	}
+	if len(matched) > 0 {
+		log.Printf("send: rules %s applied", strings.Join(matched, ", "))
+	}
+	if digest != nil {
+		count, due, err := holdForDigest(digest, n)
 		if err != nil {
-			log.Printf("insert notification: %v", err)
+			log.Printf("send: digest %q: %v", digest.Name, err)
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
-
-		broadcastNotification(h, n)
-
-		sentTo := h.connectedCount()
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{"id": n.ID, "sent_to": sentTo})
-		log.Printf("send: id=%d sent_to=%d source=%q title=%q", n.ID, sentTo, n.Source, n.Title)
+		json.NewEncoder(w).Encode(map[string]any{
+			"id": 0, "sent_to": 0, "digested_by": digest.Name, "digest_count": count, "digest_at": due.Format(time.RFC3339),
+		})
+		log.Printf("send: held for digest %q (%d so far) ip=%s by=%s source=%q title=%q", digest.Name, count, clientIP(r), caller, n.Source, n.Title)
+		return
+	}
+	n, err = publish(r.Context(), h, n)
+	if err != nil {
+		log.Printf("insert notification: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
 	}
+	if rawArchiveEnabled() {
+		archiveRaw(n.ID, r.Header.Get("Content-Type"), raw)
+	}
+
+	sentTo := h.connectedCount()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"id": n.ID, "sent_to": sentTo})
+	log.Printf("send: id=%d ip=%s by=%s sent_to=%d source=%q topic=%q priority=%d title=%q", n.ID, clientIP(r), caller, sentTo, n.Source, n.Topic, n.Priority, n.Title)
 }
 
 func handleHeartbeat(h *hub) http.HandlerFunc {
@@ -391,8 +1521,11 @@ func handleHeartbeat(h *hub) http.HandlerFunc {
 			Source   string `json:"source"`
 			Interval int    `json:"interval"`
 		}
+		limitBody(w, r)
 		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			http.Error(w, "bad request", http.StatusBadRequest)
+			if !bodyTooLarge(w, err) {
+				http.Error(w, "bad request", http.StatusBadRequest)
+			}
 			return
 		}
 		if strings.TrimSpace(body.Source) == "" {
@@ -428,15 +1561,14 @@ func handleHeartbeat(h *hub) http.HandlerFunc {
 
 		if wasAlerted {
 			// Send recovery notification.
-			n, err := insertNotification(
-				body.Source+" recovered",
-				"Heartbeat resumed after outage.",
-				"andrNoti",
-			)
+			_, err := publish(r.Context(), h, Notification{
+				Title:  body.Source + " recovered",
+				Text:   "Heartbeat resumed after outage.",
+				Source: "andrNoti",
+			})
 			if err != nil {
 				log.Printf("heartbeat: recovery notification for %q: %v", body.Source, err)
 			} else {
-				broadcastNotification(h, n)
 				log.Printf("heartbeat: source=%q recovered", body.Source)
 			}
 		} else {
@@ -467,7 +1599,20 @@ func handleHistory() http.HandlerFunc {
 			limit = 100
 		}
 
-		ns, err := queryHistory(limit, offset)
+		var ns []Notification
+		hidden := hiddenTopics(authFrom(r))
+		err := traceDB(r.Context(), "query history", func() (err error) {
+			if q.Get("snoozed") == "1" {
+				ns, err = snoozedNotifications()
+				source := q.Get("source")
+				ns = slices.DeleteFunc(ns, func(n Notification) bool {
+					return source != "" && n.Source != source || slices.Contains(hidden, n.Topic)
+				})
+			} else {
+				ns, err = queryHistory(limit, offset, q.Get("source"), hidden)
+			}
+			return err
+		})
 		if err != nil {
 			log.Printf("query history: %v", err)
 			http.Error(w, "internal error", http.StatusInternalServerError)
@@ -476,159 +1621,710 @@ func handleHistory() http.HandlerFunc {
 		if ns == nil {
 			ns = []Notification{}
 		}
+		if q.Get("html") == "1" {
+			for i := range ns {
+				ns[i] = withHTML(ns[i])
+			}
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(ns)
 	}
 }
 
-func handleMarkSeen() http.HandlerFunc {
+func handleMarkSeen(h *hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 		var body struct {
-			IDs []int64 `json:"ids"`
+			IDs    []int64 `json:"ids"`
+			By     string  `json:"by"`     // who read them, for receipts
+			Device string  `json:"device"` // which device read them, for receipts and the seen frame
 		}
 		json.NewDecoder(r.Body).Decode(&body)
+		if body.Device == "" {
+			body.Device = authFrom(r).ID
+		}
 
-		var (
-			res sql.Result
-			err error
-		)
+		now := time.Now()
+		query := `UPDATE notifications SET seen_at = ? WHERE seen_at IS NULL`
+		args := []any{sqliteTime(now)}
 		if len(body.IDs) > 0 {
-			placeholders := strings.Repeat("?,", len(body.IDs))
-			placeholders = placeholders[:len(placeholders)-1]
-			args := make([]any, len(body.IDs))
-			for i, id := range body.IDs {
-				args[i] = id
+			query += ` AND id IN (` + placeholders(len(body.IDs)) + `)`
+			for _, id := range body.IDs {
+				args = append(args, id)
 			}
-			res, err = db.Exec(
-				fmt.Sprintf(`UPDATE notifications SET seen_at = CURRENT_TIMESTAMP
-				             WHERE seen_at IS NULL AND id IN (%s)`, placeholders),
-				args...,
-			)
-		} else {
-			res, err = db.Exec(
-				`UPDATE notifications SET seen_at = CURRENT_TIMESTAMP WHERE seen_at IS NULL`,
-			)
 		}
+		var marked []noteRef
+		err := traceDB(r.Context(), "mark seen", func() error {
+			rows, err := db.Query(query+` RETURNING id, topic`, args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var n noteRef
+				if err := rows.Scan(&n.id, &n.topic); err != nil {
+					return err
+				}
+				marked = append(marked, n)
+			}
+			return rows.Err()
+		})
 		if err != nil {
 			log.Printf("mark-seen: %v", err)
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
-		count, _ := res.RowsAffected()
+
+		read := body.IDs
+		if len(read) == 0 {
+			for _, n := range marked {
+				read = append(read, n.id)
+			}
+		}
+		// Seen isn't acknowledged: incidents stay open until someone acks
+		// (see ack.go).
+		recordReceipts(read, body.Device, body.By)
+		broadcastSeen(h, marked, body.Device, now.UTC().Format(time.RFC3339))
+		publishSeen(marked, body.Device, now.UTC().Format(time.RFC3339))
+		cancelPushover(read)
+		resolveEscalations(read, cmp.Or(body.By, body.Device))
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{"marked": count})
-		log.Printf("mark-seen: %d notifications marked", count)
+		json.NewEncoder(w).Encode(map[string]any{"marked": len(marked)})
+		log.Printf("mark-seen: %d notifications marked by %s", len(marked), body.Device)
 	}
 }
 
-func handleDeleteNotifications() http.HandlerFunc {
+func handleDeleteNotifications(h *hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodDelete {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		_, err := db.Exec(`DELETE FROM notifications`)
+		// Rows that arrive while the held ones are exported are kept.
+		var last int64
+		if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM notifications`).Scan(&last); err != nil {
+			log.Printf("delete notifications: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		archive, held, err := exportHeld(r.Context(), "delete-all", `id <= ?`, []any{last})
+		if err != nil {
+			log.Printf("delete notifications: %v; nothing deleted", err)
+			http.Error(w, "could not export held notifications; nothing deleted", http.StatusInternalServerError)
+			return
+		}
+		res, err := db.Exec(`DELETE FROM notifications WHERE id <= ?`, last)
 		if err != nil {
 			log.Printf("delete notifications: %v", err)
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
+		deleted, _ := res.RowsAffected()
+		if deleted > 0 {
+			announceDeleted(h, nil, last)
+		}
+		audit(authFrom(r).ID, "delete-all", fmt.Sprintf("%d notifications deleted%s", deleted, heldNote(archive, held)), archive)
 		w.WriteHeader(http.StatusNoContent)
-		log.Printf("delete notifications: all records deleted")
+		log.Printf("delete notifications: all records deleted (%d)%s", deleted, heldNote(archive, held))
+	}
+}
+
+func handleStats(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		clients := h.clientStats()
+		live := collectLiveStats(h)
+		volume, err := collectVolumeStats(volumeWindow(r))
+		if err != nil {
+			log.Printf("stats: volume: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"connected":          len(clients),
+			"sends_per_min":      live.SendsPerMin,
+			"unseen":             live.Unseen,
+			"max_clients":        *flagMaxClients,
+			"client_buffer":      *flagClientBuffer,
+			"broadcast_queued":   len(h.bcast),
+			"broadcast_buffer":   cap(h.bcast),
+			"slow_client_policy": h.policy,
+			"dropped_total":      h.droppedTotal.Load(),
+			"slow_disconnects":   h.slowDisconnects.Load(),
+			"ws_admission":       admissionStats(),
+			"slo":                currentSLO(),
+			"clock":              clockStats(),
+			"syslog":             syslogStats(),
+			"nats":               natsStats(),
+			"clients":            clients,
+			"volume":             volume,
+		})
 	}
 }
 
 func handleWS(h *hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		token := r.URL.Query().Get("token")
-		if token != authToken {
+		ip := clientIP(r)
+		if !allowAttempt(w, ip) {
+			return
+		}
+		handshakeDone := beginHandshake(w, ip)
+		if handshakeDone == nil {
+			return
+		}
+		defer handshakeDone()
+
+		auth, ok := requestAuth(r, r.URL.Query().Get("token"))
+		if !ok {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		noteAuth(r, auth)
+
+		ping, err := pingInterval(r.URL.Query().Get("ping"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if d := r.URL.Query().Get("device"); d != "" && deviceRevoked(d) {
+			http.Error(w, "device revoked", http.StatusForbidden)
+			return
+		}
+		// A credential that names its user (a JWT's sub, a certificate's
+		// CN, a managed token's user) is that user; ?user= can't pick another
+		// one's topics and pages. A shared read credential can't pick one
+		// either, so it only sees topics without ACLs.
+		user := r.URL.Query().Get("user")
+		switch {
+		case auth.User != "":
+			if user != "" && user != auth.User {
+				http.Error(w, "user does not match the credential", http.StatusForbidden)
+				return
+			}
+			user = auth.User
+		case user != "" && auth.Scope < scopeFull:
+			http.Error(w, "this credential can't choose a user; use one issued to the user", http.StatusForbidden)
+			return
+		}
+		since, resume, err := replayStart(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		if h.connectedCount() >= 15 {
-			http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		if h.connectedCount() >= *flagMaxClients {
+			refuseFull(w, ip)
+			return
+		}
+		if !claimIP(w, ip) {
 			return
 		}
+		defer releaseIP(ip)
 
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Printf("ws upgrade: %v", err)
 			return
 		}
+		// No-op unless permessage-deflate was negotiated.
+		conn.SetCompressionLevel(*flagWSCompressLevel)
+
+		version := r.URL.Query().Get("version")
+		if *flagMinClientVersion != "" && version != "" && compareVersions(version, *flagMinClientVersion) < 0 {
+			log.Printf("ws: rejected client version %s from %s (minimum %s)", version, ip, *flagMinClientVersion)
+			rejectOldClient(conn, version, conn.Subprotocol() == wsProtoSubprotocol)
+			return
+		}
 
-		c := &client{conn: conn, send: make(chan []byte, 64)}
+		c := &client{
+			id:          h.nextID.Add(1),
+			conn:        conn,
+			send:        make(chan []byte, *flagClientBuffer),
+			user:        user,
+			ip:          ip,
+			version:     version,
+			html:        r.URL.Query().Get("html") == "1",
+			proto:       conn.Subprotocol() == wsProtoSubprotocol,
+			device:      r.URL.Query().Get("device"),
+			ping:        ping,
+			auth:        auth,
+			connectedAt: time.Now(),
+			compressed:  wsCompressed(r),
+		}
+		c.batch.Store(r.URL.Query().Get("batch") == "1")
+		if p, err := loadDevicePrefs(c.device); err != nil {
+			log.Printf("ws: device prefs %q: %v", c.device, err)
+		} else {
+			c.prefs.Store(p)
+		}
 		h.reg <- c
+		log.Printf("ws: client %d connected from %s (user=%q, auth=%s, ping=%s)", c.id, c.ip, c.user, auth.ID, ping)
 
-		ns, err := queryHistory(100, 0)
-		if err != nil {
-			log.Printf("ws history: %v", err)
+		visible := func(ns []Notification) []Notification {
+			out := []Notification{}
+			for _, n := range ns {
+				if !canSee(c.user, n.Topic) {
+					continue
+				}
+				if c.html {
+					n = withHTML(n)
+				}
+				out = append(out, n)
+			}
+			return out
 		}
-		if ns == nil {
-			ns = []Notification{}
+		// Registered before querying, so nothing falls between the two.
+		var first wsMessage
+		paused := shedActive.Load()
+		if paused {
+			log.Printf("ws: client %d gets no history while shedding load", c.id)
+		} else if resume {
+			ns, err := notificationsSince(since, wsReplayMax+1)
+			if err != nil {
+				log.Printf("ws replay: %v", err)
+			} else if len(ns) <= wsReplayMax {
+				first = wsMessage{Type: api.TypeNotifications, Notifications: visible(c.wanted(ns))}
+				log.Printf("ws: client %d resumed after id %d (%d missed)", c.id, since, len(ns))
+			}
 		}
-		histMsg := wsMessage{Type: "history", Notifications: ns}
-		data, _ := json.Marshal(histMsg)
-		select {
-		case c.send <- data:
-		default:
+		if first.Type == "" && !paused {
+			ns, err := queryHistory(100, 0, "", nil)
+			if err != nil {
+				log.Printf("ws history: %v", err)
+			}
+			first = wsMessage{Type: api.TypeHistory, Notifications: visible(ns)}
+		}
+		// The hub may already have dropped c (see trySend).
+		if !paused {
+			data, _ := json.Marshal(first)
+			c.trySend(data)
+		}
+		c.trySend(clientConfigMessage())
+		sendPendingUP(c)
+
+		if !auth.Expires.IsZero() {
+			// Expiring credentials don't outlive their token.
+			t := time.AfterFunc(time.Until(auth.Expires), func() {
+				c.conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(api.CloseTokenExpired, "token expired"),
+					time.Now().Add(5*time.Second))
+				c.conn.Close()
+			})
+			defer t.Stop()
 		}
 
+		handshakeDone()
 		go writePump(c)
 		go pingPump(c)
 		readPump(h, c)
-		log.Printf("ws: client disconnected from %s", conn.RemoteAddr())
+		log.Printf("ws: client %d disconnected from %s", c.id, c.ip)
 	}
 }
 
 // ── Main ──────────────────────────────────────────────────────────────────────
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "gen-clients":
+			runGenClients(os.Args[2:])
+			return
+		case "self-update":
+			runSelfUpdate(os.Args[2:])
+			return
+		case "healthcheck":
+			runHealthcheck(os.Args[2:])
+			return
+		case "agent":
+			runAgent(os.Args[2:])
+			return
+		case "version":
+			fmt.Println(serverVersion)
+			return
+		}
+	}
 	flag.Parse()
 
-	switch {
-	case *flagTokenFile != "":
-		raw, err := os.ReadFile(*flagTokenFile)
-		if err != nil {
-			log.Fatalf("read token file: %v", err)
-		}
-		authToken = strings.TrimSpace(string(raw))
-		if authToken == "" {
-			log.Fatal("token file is empty")
-		}
-	case *flagToken != "":
-		authToken = *flagToken
-	default:
+	var err error
+	authToken, err := loadToken(*flagTokenFile, *flagToken)
+	if err != nil {
+		log.Fatalf("read token file: %v", err)
+	}
+	if authToken == "" {
 		log.Fatal("one of --token-file or --token is required")
 	}
+	if readOnlyToken, err = loadToken(*flagReadOnlyFile, *flagReadOnlyToken); err != nil {
+		log.Fatalf("read read-only token file: %v", err)
+	}
+	if readOnlyToken != "" && readOnlyToken == authToken {
+		log.Fatal("the read-only token must differ from the main token")
+	}
+
+	if namedTokens, err = loadNamedTokens(*flagTokensFile); err != nil {
+		log.Fatalf("tokens file: %v", err)
+	}
+	for _, t := range namedTokens {
+		if t.token == authToken || t.token == readOnlyToken {
+			log.Fatalf("tokens file: %q reuses the main or read-only token", t.name)
+		}
+	}
+
+	if err := loadJWTKeys(); err != nil {
+		log.Fatalf("jwt keys: %v", err)
+	}
+	if err := loadAtRestKey(*flagEncryptKeyFile); err != nil {
+		log.Fatalf("--encryption-key-file: %v", err)
+	}
+	if hmacSecret, err = loadToken(*flagHMACSecretFile, ""); err != nil {
+		log.Fatalf("read hmac secret file: %v", err)
+	}
+	if githubSecret, err = loadToken(*flagGitHubSecretFile, ""); err != nil {
+		log.Fatalf("read github secret file: %v", err)
+	}
+
+	if *flagWSCompressLevel < 1 || *flagWSCompressLevel > 9 {
+		log.Fatal("--ws-compression-level must be between 1 and 9")
+	}
+	upgrader.EnableCompression = *flagWSCompression
+
+	if *flagMinClientVersion != "" && !validVersion(*flagMinClientVersion) {
+		log.Fatalf("--min-client-version %q is not a dotted version", *flagMinClientVersion)
+	}
+
+	for _, t := range splitList(*flagOnCallTopics) {
+		onCallTopics[t] = true
+	}
+	for _, t := range splitList(*flagHoldTopics) {
+		holdTopics[t] = true
+	}
+	if *flagMetricsTopics < 0 {
+		log.Fatal("--metrics-max-topics must not be negative")
+	}
+	if metricsLabels, err = parseMetricsLabels(*flagMetricsLabels); err != nil {
+		log.Fatalf("--metrics-labels: %v", err)
+	}
+	if amPriorities, err = parsePriorityMap(*flagAMPriorities); err != nil {
+		log.Fatalf("--alertmanager-priorities: %v", err)
+	}
+	if githubEvents, err = parseGitHubEvents(*flagGitHubEvents); err != nil {
+		log.Fatalf("--github-events: %v", err)
+	}
 
+	if *flagDBBusyTimeout < 0 {
+		log.Fatal("--db-busy-timeout must not be negative")
+	}
 	if err := initDB(*flagDB); err != nil {
 		log.Fatalf("init db: %v", err)
 	}
 	log.Printf("database: %s", *flagDB)
+	if err := checkAtRest(); err != nil {
+		log.Fatalf("encryption: %v", err)
+	}
+	loadPrimaryToken(authToken)
+	loadMaintenance()
+	loadDBMaintReport()
+	if err := loadVAPIDKey(*flagVAPIDKeyFile); err != nil {
+		log.Fatalf("vapid key: %v", err)
+	}
+	if v := *flagVAPIDSubject; v != "" && !strings.HasPrefix(v, "mailto:") && !strings.HasPrefix(v, "https://") {
+		log.Fatal("--vapid-subject must be a mailto: or https: URL")
+	}
+	if err := loadAPNsKey(*flagAPNsKeyFile); err != nil {
+		log.Fatalf("apns: %v", err)
+	}
+	if err := loadPushover(); err != nil {
+		log.Fatalf("pushover: %v", err)
+	}
+	if err := loadEscalation(); err != nil {
+		log.Fatalf("escalation: %v", err)
+	}
+	if err := loadFederation(); err != nil {
+		log.Fatalf("federation: %v", err)
+	}
+	if *flagDeliveryAttempts < 1 {
+		log.Fatal("--delivery-max-attempts must be at least 1")
+	}
+
+	switch *flagSlowClient {
+	case slowDropNewest, slowDropOldest, slowDisconnect:
+	default:
+		log.Fatalf("unknown --slow-client-policy %q", *flagSlowClient)
+	}
+
+	if trustedProxies, err = parseCIDRs(*flagTrustedProxies); err != nil {
+		log.Fatalf("--trusted-proxies: %v", err)
+	}
 
-	h := newHub()
+	if ipPolicy.allow, err = parseIPRules(*flagIPAllow); err != nil {
+		log.Fatalf("--ip-allow: %v", err)
+	}
+	if ipPolicy.deny, err = parseIPRules(*flagIPDeny); err != nil {
+		log.Fatalf("--ip-deny: %v", err)
+	}
+
+	if *flagPingMin <= 0 || *flagPingMax < *flagPingMin {
+		log.Fatal("--ping-min must be positive and no greater than --ping-max")
+	}
+	*flagPingInterval = min(max(*flagPingInterval, *flagPingMin), *flagPingMax)
+
+	if *flagMaxClients < 1 || *flagClientBuffer < 1 || *flagBroadcastBuffer < 1 {
+		log.Fatal("--max-clients, --client-buffer and --broadcast-buffer must be positive")
+	}
+
+	h := newHub(*flagSlowClient, *flagBroadcastBuffer)
 	go h.run()
+	startDeliveries()
+	go startFanOutRecovery(h)
+	startWSDeliveryLog()
+	if err := startBus(h, *flagRedisURL, *flagRedisChannel); err != nil {
+		log.Fatal(err)
+	}
+	if err := startNATS(h); err != nil {
+		log.Fatal(err)
+	}
 	go startHeartbeatChecker(h, *flagHeartbeatMissed)
+	go startStatsStream(h, *flagStatsInterval)
+	go startSnoozeWaker(h)
+	go startDigestFlusher(h)
+	go startQuietFlusher(h)
+	go startEscalator(h)
+	if sloEnabled() {
+		if *flagSLOTarget >= 100 || *flagSLOLatency <= 0 || *flagSLOWindow < time.Hour || *flagSLOBurnRate <= 0 {
+			log.Fatal("--slo-target must be below 100, --slo-latency and --slo-burn-rate positive and --slo-window at least 1h")
+		}
+		go startSLOMonitor(h)
+	}
+	if shedEnabled() {
+		if *flagShedMinPriority < 1 || *flagShedMinPriority > priorityUrgent {
+			log.Fatal("--shed-min-priority must be 1-5")
+		}
+		go startShedMonitor(h)
+	}
+	var jobs []*schedJob
+	if *flagLDAPURL != "" {
+		jobs = append(jobs, ldapSyncJob(*flagLDAPInterval))
+	}
+	if *flagDBMaintInterval > 0 {
+		jobs = append(jobs, dbMaintJob(*flagDBMaintInterval))
+	}
+	if rawArchiveEnabled() {
+		jobs = append(jobs, rawPruneJob(*flagRawRetention))
+	}
+	if *flagBackupDir != "" {
+		if *flagBackupInterval <= 0 || *flagBackupKeep < 1 {
+			log.Fatal("--backup-interval and --backup-keep must be positive")
+		}
+		jobs = append(jobs, backupJob(*flagBackupDir, *flagBackupInterval, *flagBackupKeep))
+	}
+	if *flagS3Bucket != "" {
+		if *flagS3ArchiveAfter <= 0 {
+			log.Fatal("--s3-archive-after must be positive")
+		}
+		if archiveStore, err = newS3Client(*flagS3Endpoint, *flagS3Bucket, *flagS3Region, *flagS3CredsFile); err != nil {
+			log.Fatalf("archive: %v", err)
+		}
+		if *flagS3ExpireDays > 0 {
+			if err := archiveStore.putLifecycle(context.Background(), *flagS3Prefix, *flagS3ExpireDays); err != nil {
+				log.Printf("archive: lifecycle: %v", err)
+			}
+		}
+		jobs = append(jobs, offloadJob(*flagS3ArchiveAfter, *flagS3Prefix))
+	}
+	if *flagIdempotencyTTL > 0 {
+		jobs = append(jobs, idempotencyPruneJob())
+	}
+	if *flagFeedPoll > 0 {
+		jobs = append(jobs, feedPollJob(*flagFeedPoll, h))
+	}
+	jobs = append(jobs, upPruneJob())
+	jobs = append(jobs, deliveryPruneJob(*flagDeadLetterKeep))
+	jobs = append(jobs, federationPruneJob())
+	jobs = append(jobs, reminderJob(h))
+	if ntpEnabled() {
+		jobs = append(jobs, ntpCheckJob(h))
+		go func() {
+			if err := checkClock(h); err != nil {
+				log.Printf("clock: %v", err)
+			}
+		}()
+	}
+	for _, j := range jobs {
+		if err := registerJob(j); err != nil {
+			log.Fatalf("scheduler: %s: %v", j.name, err)
+		}
+	}
+	go startScheduler()
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/send", requireBearer(handleSend(h)))
-	mux.HandleFunc("/heartbeat", requireBearer(handleHeartbeat(h)))
-	mux.HandleFunc("/history", requireBearer(handleHistory()))
-	mux.HandleFunc("/mark-seen", requireBearer(handleMarkSeen()))
-	mux.HandleFunc("/notifications", requireBearer(handleDeleteNotifications()))
+	mux.HandleFunc("/send", allowSigned(unlessMaintenance(idempotent(handleSend(h)))))
+	mux.HandleFunc("/send/batch", allowSigned(unlessMaintenance(idempotent(handleSendBatch(h)))))
+	mux.HandleFunc("/send/template/{name}", allowSigned(unlessMaintenance(idempotent(handleSendTemplate(h)))))
+	mux.HandleFunc("/ingest/alertmanager", allowSigned(unlessMaintenance(idempotent(handleIngest(h, "alertmanager", parseAlertmanager)))))
+	mux.HandleFunc("/ingest/grafana", allowSigned(unlessMaintenance(idempotent(handleIngest(h, "grafana", parseGrafana)))))
+	mux.HandleFunc("/ingest/github", allowGitHubSigned(unlessMaintenance(idempotent(handleIngest(h, "github", parseGitHub)))))
+	mux.HandleFunc("/ingest/hook/{name}", allowSigned(unlessMaintenance(idempotent(handleHookIngest(h)))))
+	mux.HandleFunc("/up/{token}", unlessMaintenance(handleUPPush(h)))
+	mux.HandleFunc("/_matrix/push/v1/notify", unlessMaintenance(handleMatrixPush(h)))
+	mux.HandleFunc("/unifiedpush/registrations", requireBearer(handleUPRegistrations()))
+	mux.HandleFunc("/unifiedpush/registrations/{token}", requireBearer(handleUPRegistration(h)))
+	mux.HandleFunc("/webpush/vapid-key", requireRead(handleVAPIDKey()))
+	mux.HandleFunc("/webpush/subscriptions", requireBearer(handleWebPushSubscriptions()))
+	mux.HandleFunc("/webpush/subscriptions/{id}", requireBearer(handleWebPushSubscription()))
+	mux.HandleFunc("/apns/devices", requireBearer(handleAPNsDevices()))
+	mux.HandleFunc("/apns/devices/{token}", requireBearer(handleAPNsDevice()))
+	mux.HandleFunc("/heartbeat", allowSigned(unlessMaintenance(handleHeartbeat(h))))
+	mux.HandleFunc("/history", requireRead(handleHistory()))
+	mux.HandleFunc("/mark-seen", requireBearer(handleMarkSeen(h)))
+	mux.HandleFunc("/notifications", requireBearer(handleDeleteNotifications(h)))
+	mux.HandleFunc("/notifications/{id}/snooze", requireBearer(handleSnooze(h)))
+	mux.HandleFunc("/notifications/{id}/ack", requireBearer(handleAck(h)))
+	mux.HandleFunc("/notifications/{id}/receipts", requireBearer(handleReceipts()))
+	mux.HandleFunc("/notifications/{id}/deliveries", requireBearer(handleNotificationDeliveries()))
+	mux.HandleFunc("/notifications/{id}/raw", requireBearer(handleRawPayload()))
+	mux.HandleFunc("/export", requireBearer(handleExport()))
+	mux.HandleFunc("/import", requireBearer(handleImport()))
+	mux.HandleFunc("/archive", requireBearer(handleArchive()))
+	mux.HandleFunc("/archive/{batch}", requireBearer(handleArchiveBatch()))
+	mux.HandleFunc("/archive/notifications/{id}", requireBearer(handleArchivedNotification()))
+	mux.HandleFunc("/reminders", requireBearer(handleReminders()))
+	mux.HandleFunc("/reminders/{name}", requireBearer(handleReminder()))
+	mux.HandleFunc("/oncall", requireBearer(handleOnCall()))
+	mux.HandleFunc("/oncall/rotation", requireBearer(handleOnCallRotation()))
+	mux.HandleFunc("/oncall/override", requireBearer(handleOnCallOverride()))
+	mux.HandleFunc("/oncall/overrides/{id}", requireBearer(handleOnCallOverrideDelete()))
+	mux.HandleFunc("/oncall/handoff", requireBearer(handleOnCallHandoff(h)))
+	mux.HandleFunc("/stats", requireRead(handleStats(h)))
+	mux.HandleFunc("/metrics", requireRead(handleMetrics(h)))
+	mux.HandleFunc("/incidents", requireBearer(handleIncidents()))
+	mux.HandleFunc("/escalations", requireBearer(handleEscalations()))
+	mux.HandleFunc("/incidents/leaderboard", requireBearer(handleIncidentLeaderboard()))
+	mux.HandleFunc("/incidents/{id}", requireBearer(handleIncident()))
+	mux.HandleFunc("/users", requireBearer(handleUsers()))
+	mux.HandleFunc("/users/sync", requireBearer(handleUserSync()))
+	mux.HandleFunc("/users/{name}", requireBearer(handleUser()))
+	mux.HandleFunc("/acls", requireBearer(handleACLs()))
+	mux.HandleFunc("/acls/{topic}", requireBearer(handleACL()))
+	mux.HandleFunc("/client-config", requireRead(handleClientConfig(h)))
+	mux.HandleFunc("/usage", requireBearer(handleUsage()))
+	mux.HandleFunc("/usage/quotas/{token}", requireBearer(handleUsageQuota()))
+	mux.HandleFunc("/admin/maintenance", requireBearer(handleMaintenance()))
+	mux.HandleFunc("/admin/quiet-hours", requireBearer(handleQuietHours()))
+	mux.HandleFunc("/admin/token/rotate", requireBearer(handleTokenRotate(h)))
+	mux.HandleFunc("/admin/rules", requireBearer(handleRules()))
+	mux.HandleFunc("/admin/devices", requireBearer(handleDevices()))
+	mux.HandleFunc("/admin/devices/{device}", requireBearer(handleDevice(h)))
+	mux.HandleFunc("/devices/{device}/preferences", requireBearer(handleDevicePrefs(h)))
+	mux.HandleFunc("/admin/tokens", requireBearer(handleTokens(h)))
+	mux.HandleFunc("/admin/tokens/{name}", requireBearer(handleToken(h)))
+	mux.HandleFunc("/admin/tokens/revoke-all", requireBearer(handleRevokeAll(h)))
+	mux.HandleFunc("/admin/jobs", requireBearer(handleJobs()))
+	mux.HandleFunc("/admin/jobs/{id}", requireBearer(handleJob()))
+	mux.HandleFunc("/admin/jobs/{name}/run", requireBearer(handleJobRun()))
+	mux.HandleFunc("/admin/bulk/{op}", requireBearer(handleBulk(h)))
+	mux.HandleFunc("/admin/retention/preview", requireBearer(handleRetentionPreview()))
+	mux.HandleFunc("/admin/audit", requireBearer(handleAudit()))
+	mux.HandleFunc("/admin/query", requireBearer(handleAdminQuery()))
+	mux.HandleFunc("/admin/templates", requireBearer(handleTemplates()))
+	mux.HandleFunc("/admin/templates/{name}", requireBearer(handleTemplate()))
+	mux.HandleFunc("/admin/templates/{name}/history", requireBearer(handleRuleHistory(ruleKindTemplate)))
+	mux.HandleFunc("/admin/templates/{name}/revert", requireBearer(handleRuleRevert(ruleKindTemplate, applyTemplate)))
+	mux.HandleFunc("/admin/hooks", requireBearer(handleHooks()))
+	mux.HandleFunc("/admin/hooks/{name}", requireBearer(handleHook()))
+	mux.HandleFunc("/admin/hooks/{name}/preview", requireBearer(handleHookPreview()))
+	mux.HandleFunc("/admin/hooks/{name}/history", requireBearer(handleRuleHistory(ruleKindHook)))
+	mux.HandleFunc("/admin/hooks/{name}/revert", requireBearer(handleRuleRevert(ruleKindHook, applyHook)))
+	mux.HandleFunc("/admin/feeds", requireBearer(handleFeeds()))
+	mux.HandleFunc("/admin/feeds/{name}", requireBearer(handleFeed()))
+	mux.HandleFunc("/admin/feeds/{name}/poll", requireBearer(handleFeedPoll(h)))
+	mux.HandleFunc("/admin/chat", requireBearer(handleChats()))
+	mux.HandleFunc("/admin/chat/{name}", requireBearer(handleChat()))
+	mux.HandleFunc("/admin/chat/{name}/test", requireBearer(handleChatTest()))
+	mux.HandleFunc("/admin/federation/peers", requireBearer(handlePeers()))
+	mux.HandleFunc("/admin/federation/peers/{name}", requireBearer(handlePeer()))
+	mux.HandleFunc("/federation/key", requireRead(handleFederationKey()))
+	mux.HandleFunc("/federation/receive", unlessMaintenance(handleFederationReceive(h)))
+	mux.HandleFunc("/admin/deliveries", requireBearer(handleDeliveries()))
+	mux.HandleFunc("/admin/deliveries/{id}", requireBearer(handleDelivery()))
+	mux.HandleFunc("/admin/deliveries/{id}/retry", requireBearer(handleDeliveryRetry()))
+	mux.HandleFunc("/deadletter", requireBearer(handleDeadLetters()))
+	mux.HandleFunc("/deadletter/{id}", requireBearer(handleDeadLetter()))
+	mux.HandleFunc("/deadletter/{id}/retry", requireBearer(handleDeadLetterRetry()))
+	mux.HandleFunc("/admin/notifications/merge", requireBearer(handleMerge(h)))
+	mux.HandleFunc("/admin/notifications/{id}/split", requireBearer(handleSplit(h)))
+	mux.HandleFunc("/admin/route/simulate", requireBearer(handleRouteSimulate(h)))
+	mux.HandleFunc("/admin/rules/{name}", requireBearer(handleRule()))
+	mux.HandleFunc("/admin/rules/{name}/history", requireBearer(handleRuleHistory(ruleKindRoute)))
+	mux.HandleFunc("/admin/rules/{name}/revert", requireBearer(handleRuleRevert(ruleKindRoute, applyRouteRules)))
+	mux.HandleFunc("/debug/sync", requireBearer(handleDebugSync(h)))
 	mux.HandleFunc("/ws", handleWS(h))
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
+	mux.HandleFunc("/schema/notification", handleSchema())
+	mux.HandleFunc("/schema/andrnoti.proto", handleProtoSchema())
+	mux.HandleFunc("/health", handleHealth(h))
+	mux.HandleFunc("/healthz", handleHealthz(h))
+	mux.HandleFunc("/readyz", handleReadyz(h))
+
+	tlsCfg, err := tlsConfig()
+	if err != nil {
+		log.Fatalf("tls: %v", err)
+	}
+	switch *flagClientCertScope {
+	case "read", "full":
+	default:
+		log.Fatalf("unknown --client-cert-scope %q", *flagClientCertScope)
+	}
 
-	addr := "127.0.0.1:" + *flagPort
+	addr := net.JoinHostPort(*flagBind, *flagPort)
 	log.Printf("andrNoti listening on %s (heartbeat-missed=%d)", addr, *flagHeartbeatMissed)
-	if err := http.ListenAndServe(addr, mux); err != nil {
+	lc := net.ListenConfig{KeepAlive: *flagTCPKeepAlive}
+	tcpLn, err := listen(lc, addr)
+	if err != nil {
 		log.Fatalf("listen: %v", err)
 	}
+	ln := tcpLn
+	if tlsCfg != nil {
+		ln = tls.NewListener(ln, tlsCfg)
+		log.Printf("tls: enabled (client certificates: %t)", tlsCfg.ClientCAs != nil)
+	}
+
+	if err := initAccessLog(*flagAccessLog, *flagAccessLogFormat); err != nil {
+		log.Fatalf("access log: %v", err)
+	}
+	if *flagOTLPEndpoint != "" {
+		if *flagTraceSample < 0 || *flagTraceSample > 1 {
+			log.Fatal("--trace-sample must be between 0 and 1")
+		}
+		headers, err := parseHeaders(*flagOTLPHeaders)
+		if err != nil {
+			log.Fatalf("--otlp-headers: %v", err)
+		}
+		startTracing(*flagOTLPEndpoint, headers)
+	}
+	if *flagSMTPListen != "" {
+		if err := startSMTP(h, tlsCfg); err != nil {
+			log.Fatalf("smtp: %v", err)
+		}
+	}
+	if *flagSyslogListen != "" {
+		if err := startSyslog(h); err != nil {
+			log.Fatalf("syslog: %v", err)
+		}
+	}
+	srv := &http.Server{Handler: accessLog(traceHTTP(ipFilter(mux)))}
+	handedOff := make(chan struct{})
+	go watchHandoff(h, srv, tcpLn, handedOff)
+	writePIDFile()
+	started.Store(true)
+	signalReady()
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		log.Fatalf("serve: %v", err)
+	}
+	<-handedOff
+	log.Printf("handoff: done, exiting")
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// testDB opens a fresh database for one test.
+func testDB(t *testing.T) {
+	t.Helper()
+	if err := initDB(filepath.Join(t.TempDir(), "notifications.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+}
+
+// testHub starts a hub that drops the newest frame for a full client.
+func testHub(t *testing.T) *hub {
+	t.Helper()
+	h := newHub(slowDropNewest, 256)
+	go h.run()
+	return h
+}
+
+// waitFor polls cond for up to a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestSlowDisconnectDuringGreeting(t *testing.T) {
+	testDB(t)
+	h := newHub(slowDisconnect, 16)
+	go h.run()
+	// A UnifiedPush message waiting for the device, sent as part of the
+	// greeting.
+	if _, err := db.Exec(`INSERT INTO up_registrations (token, device, app, created_by) VALUES ('tok', 'pixel', 'chat', 'primary')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO up_messages (token, body) VALUES ('tok', 'hi')`); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &client{id: 1, send: make(chan []byte, 1), device: "pixel", auth: authInfo{ID: "primary"}}
+	h.reg <- c
+	waitFor(t, "the client to register", func() bool { return h.connectedCount() == 1 })
+	history, _ := json.Marshal(wsMessage{Type: api.TypeHistory, Notifications: []Notification{}})
+	if !c.trySend(history) {
+		t.Fatal("history not queued")
+	}
+	// The buffer is full now, so a live frame makes the hub drop the client.
+	h.bcast <- envelope{data: []byte(`{"type":"notification"}`)}
+	waitFor(t, "the slow client to be dropped", func() bool { return h.connectedCount() == 0 })
+
+	// The rest of the greeting reaches a client the hub already closed.
+	if c.trySend(history) {
+		t.Error("history queued for a dropped client")
+	}
+	c.trySend(clientConfigMessage())
+	sendPendingUP(c)
+
+	if got := <-c.send; string(got) != string(history) {
+		t.Errorf("first frame = %s, want the history", got)
+	}
+	if _, ok := <-c.send; ok {
+		t.Error("send is still open")
+	}
+}
+
+// TestSlowDisconnectRacesGreeting sends to clients from outside the hub
+// while the hub drops them, as handleWS and sendPendingUP do.
+func TestSlowDisconnectRacesGreeting(t *testing.T) {
+	h := newHub(slowDisconnect, 16)
+	go h.run()
+	frame := []byte(`{"type":"history","notifications":[]}`)
+	for i := range 200 {
+		c := &client{id: int64(i), send: make(chan []byte, 1)}
+		h.reg <- c
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for range 50 {
+				c.trySend(frame)
+			}
+		}()
+		for range 5 {
+			h.bcast <- envelope{data: frame, to: func(x *client) bool { return x == c }}
+		}
+		<-done
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ── Maintenance Mode ──────────────────────────────────────────────────────────
+//
+// While maintenance is on, /send and /heartbeat answer 503 with Retry-After so
+// producers back off and retry, but WebSocket clients stay connected and
+// history, stats and admin endpoints keep working. Heartbeat alerting is
+// paused, and every source gets a fresh deadline when maintenance ends so
+// beats missed in the meantime don't page anyone. The state is kept in
+// settings and survives a restart.
+
+type maintenanceState struct {
+	Enabled    bool   `json:"enabled"`
+	Message    string `json:"message,omitempty"`
+	RetryAfter int    `json:"retry_after_seconds,omitempty"`
+	Since      string `json:"since,omitempty"`
+	By         string `json:"by,omitempty"`
+}
+
+var maintenance struct {
+	sync.RWMutex
+	state maintenanceState
+}
+
+func loadMaintenance() {
+	v := getSetting("maintenance")
+	if v == "" {
+		return
+	}
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	if err := json.Unmarshal([]byte(v), &maintenance.state); err != nil {
+		log.Printf("maintenance: %v", err)
+	}
+	if maintenance.state.Enabled {
+		log.Printf("maintenance: still enabled since %s", maintenance.state.Since)
+	}
+}
+
+func currentMaintenance() maintenanceState {
+	maintenance.RLock()
+	defer maintenance.RUnlock()
+	return maintenance.state
+}
+
+// unlessMaintenance rejects requests with 503 while maintenance is on.
+func unlessMaintenance(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m := currentMaintenance()
+		if !m.Enabled {
+			next(w, r)
+			return
+		}
+		msg := "server in maintenance"
+		if m.Message != "" {
+			msg += ": " + m.Message
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(m.RetryAfter))
+		http.Error(w, msg, http.StatusServiceUnavailable)
+	}
+}
+
+func handleMaintenance() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var body struct {
+				Enabled    bool   `json:"enabled"`
+				Message    string `json:"message"`
+				RetryAfter string `json:"retry_after"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			retry := 5 * time.Minute
+			if body.RetryAfter != "" {
+				d, err := time.ParseDuration(body.RetryAfter)
+				if err != nil || d <= 0 {
+					http.Error(w, "retry_after must be a positive duration like 10m", http.StatusBadRequest)
+					return
+				}
+				retry = d
+			}
+			state := maintenanceState{}
+			if body.Enabled {
+				state = maintenanceState{
+					Enabled:    true,
+					Message:    body.Message,
+					RetryAfter: int(retry.Seconds()),
+					Since:      time.Now().UTC().Format(time.RFC3339),
+					By:         authFrom(r).ID,
+				}
+			}
+			raw, _ := json.Marshal(state)
+			if err := setSetting("maintenance", string(raw)); err != nil {
+				log.Printf("maintenance: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			maintenance.Lock()
+			was := maintenance.state.Enabled
+			maintenance.state = state
+			maintenance.Unlock()
+
+			if was && !state.Enabled {
+				// Restart every heartbeat deadline so sources that couldn't
+				// beat during maintenance aren't reported down.
+				if _, err := db.Exec(`UPDATE heartbeats SET last_seen = CURRENT_TIMESTAMP WHERE alerted = 0`); err != nil {
+					log.Printf("maintenance: reset heartbeats: %v", err)
+				}
+			}
+			log.Printf("maintenance: enabled=%t by=%s message=%q", state.Enabled, authFrom(r).ID, state.Message)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(currentMaintenance())
+	}
+}
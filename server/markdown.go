@@ -0,0 +1,385 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ── Markdown ──────────────────────────────────────────────────────────────────
+//
+// A small Markdown renderer for notification bodies: headings, paragraphs,
+// emphasis, inline and fenced code, links (including bare URLs), lists,
+// blockquotes and rules. It produces sanitized HTML for web clients and a
+// plain-text fallback for everything else. Raw HTML in the source is never
+// passed through — every character of text is escaped — and links are only
+// emitted for http, https and mailto URLs, so the output is safe to inject.
+//
+// Notification text is untrusted, so rendering must stay linear in its
+// length: what the inline renderer would search ahead for is located up
+// front in inlineMarks, and markup nested deeper than mdMaxNesting is kept as
+// text. Both renderings are stored with the notification (see
+// execInsertNotification) rather than redone on every read.
+
+const (
+	formatPlain    = "plain"
+	formatMarkdown = "markdown"
+)
+
+const mdMaxNesting = 16
+
+// renderMarkdown returns sanitized HTML and a plain-text rendering of src.
+func renderMarkdown(src string) (htmlOut, plain string) {
+	var h, p []string
+	for _, b := range parseBlocks(strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n"), 0) {
+		h = append(h, b.html)
+		p = append(p, b.plain)
+	}
+	return strings.Join(h, "\n"), strings.Join(p, "\n\n")
+}
+
+type mdBlock struct{ html, plain string }
+
+var (
+	mdHeading = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	mdBullet  = regexp.MustCompile(`^\s{0,3}[-*+]\s+(.*)$`)
+	mdOrdered = regexp.MustCompile(`^\s{0,3}(\d{1,9})[.)]\s+(.*)$`)
+	mdRule    = regexp.MustCompile(`^\s{0,3}(?:(?:-\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,})$`)
+	mdFence   = regexp.MustCompile("^\\s{0,3}(```|~~~)\\s*([\\w+-]*)")
+	mdQuote   = regexp.MustCompile(`^\s{0,3}>\s?(.*)$`)
+)
+
+// parseBlocks renders lines, depth blockquotes deep.
+func parseBlocks(lines []string, depth int) []mdBlock {
+	var out []mdBlock
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+
+		case mdFence.MatchString(line):
+			m := mdFence.FindStringSubmatch(line)
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), m[1]); i++ {
+				code = append(code, lines[i])
+			}
+			i++ // closing fence (or end of input)
+			body := strings.Join(code, "\n")
+			class := ""
+			if m[2] != "" {
+				class = ` class="language-` + html.EscapeString(m[2]) + `"`
+			}
+			out = append(out, mdBlock{"<pre><code" + class + ">" + html.EscapeString(body) + "</code></pre>", body})
+
+		case mdHeading.MatchString(line):
+			m := mdHeading.FindStringSubmatch(line)
+			h, p := renderInline(m[2])
+			tag := "h" + strconv.Itoa(len(m[1]))
+			out = append(out, mdBlock{"<" + tag + ">" + h + "</" + tag + ">", p})
+			i++
+
+		case mdRule.MatchString(line):
+			out = append(out, mdBlock{"<hr>", "---"})
+			i++
+
+		case depth < mdMaxNesting && mdQuote.MatchString(line):
+			var inner []string
+			for ; i < len(lines) && mdQuote.MatchString(lines[i]); i++ {
+				inner = append(inner, mdQuote.FindStringSubmatch(lines[i])[1])
+			}
+			var h, p []string
+			for _, b := range parseBlocks(inner, depth+1) {
+				h = append(h, b.html)
+				p = append(p, b.plain)
+			}
+			plain := "> " + strings.ReplaceAll(strings.Join(p, "\n\n"), "\n", "\n> ")
+			out = append(out, mdBlock{"<blockquote>\n" + strings.Join(h, "\n") + "\n</blockquote>", plain})
+
+		case mdBullet.MatchString(line), mdOrdered.MatchString(line):
+			ordered := mdOrdered.MatchString(line)
+			var h, p []string
+			n := 1
+			if ordered {
+				n, _ = strconv.Atoi(mdOrdered.FindStringSubmatch(line)[1])
+			}
+			for i < len(lines) {
+				var item []string
+				if ordered && mdOrdered.MatchString(lines[i]) {
+					item = append(item, mdOrdered.FindStringSubmatch(lines[i])[2])
+				} else if !ordered && mdBullet.MatchString(lines[i]) {
+					item = append(item, mdBullet.FindStringSubmatch(lines[i])[1])
+				} else {
+					break
+				}
+				// Indented lines continue the item.
+				for i++; i < len(lines) && strings.HasPrefix(lines[i], "  ") && strings.TrimSpace(lines[i]) != ""; i++ {
+					item = append(item, strings.TrimSpace(lines[i]))
+				}
+				ih, ip := renderInline(strings.Join(item, "\n"))
+				h = append(h, "<li>"+strings.ReplaceAll(ih, "\n", "<br>\n")+"</li>")
+				marker := "• "
+				if ordered {
+					marker = strconv.Itoa(n) + ". "
+				}
+				p = append(p, marker+strings.ReplaceAll(ip, "\n", "\n  "))
+				n++
+			}
+			tag := "ul"
+			if ordered {
+				tag = "ol"
+			}
+			out = append(out, mdBlock{"<" + tag + ">\n" + strings.Join(h, "\n") + "\n</" + tag + ">", strings.Join(p, "\n")})
+
+		default:
+			// The first line may be a quote nested too deep to render as one.
+			para := []string{strings.TrimSpace(line)}
+			for i++; i < len(lines) && strings.TrimSpace(lines[i]) != "" && !startsBlock(lines[i]); i++ {
+				para = append(para, strings.TrimSpace(lines[i]))
+			}
+			h, p := renderInline(strings.Join(para, "\n"))
+			out = append(out, mdBlock{"<p>" + strings.ReplaceAll(h, "\n", "<br>\n") + "</p>", p})
+		}
+	}
+	return out
+}
+
+func startsBlock(line string) bool {
+	return mdFence.MatchString(line) || mdHeading.MatchString(line) || mdRule.MatchString(line) ||
+		mdQuote.MatchString(line) || mdBullet.MatchString(line) || mdOrdered.MatchString(line)
+}
+
+// renderInline handles code spans, links, emphasis and escapes.
+func renderInline(s string) (string, string) { return renderInlineAt(s, 0) }
+
+// renderInlineAt renders s, which is depth links or emphases deep. Past
+// mdMaxNesting it is escaped as it stands.
+func renderInlineAt(s string, depth int) (string, string) {
+	if depth >= mdMaxNesting {
+		return html.EscapeString(s), s
+	}
+	m := markInline(s)
+	var h, p strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_[]()<>#+-.!~|", s[i+1]) >= 0:
+			h.WriteString(html.EscapeString(s[i+1 : i+2]))
+			p.WriteByte(s[i+1])
+			i += 2
+			continue
+
+		case c == '`':
+			if j := m.codeEnd[i]; j > i {
+				code := s[i+1 : j]
+				h.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				p.WriteString(code)
+				i = j + 1
+				continue
+			}
+
+		case c == '[':
+			if text, href, n, ok := m.link(i); ok {
+				th, tp := renderInlineAt(text, depth+1)
+				if u, safe := safeURL(href); safe {
+					h.WriteString(`<a href="` + html.EscapeString(u) + `" rel="nofollow noopener">` + th + "</a>")
+				} else {
+					h.WriteString(th)
+				}
+				if tp == href {
+					p.WriteString(tp)
+				} else {
+					p.WriteString(tp + " (" + href + ")")
+				}
+				i += n
+				continue
+			}
+
+		case c == '<':
+			// An autolink holds no spaces or other angle brackets.
+			if j := m.nextAngle[i+1]; j < len(s) && s[j] == '>' {
+				if u, safe := safeURL(s[i+1 : j]); safe && strings.Contains(u, ":") {
+					h.WriteString(`<a href="` + html.EscapeString(u) + `" rel="nofollow noopener">` + html.EscapeString(u) + "</a>")
+					p.WriteString(u)
+					i = j + 1
+					continue
+				}
+			}
+
+		case (c == 'h' || c == 'H') && (i == 0 || !isWordByte(s[i-1])) &&
+			(hasPrefixFold(s[i:], "http://") || hasPrefixFold(s[i:], "https://")):
+			j := i
+			for j < len(s) && s[j] > ' ' && s[j] != '<' {
+				j++
+			}
+			for j > i && strings.IndexByte(".,;:!?)'\"", s[j-1]) >= 0 {
+				j--
+			}
+			u := s[i:j]
+			h.WriteString(`<a href="` + html.EscapeString(u) + `" rel="nofollow noopener">` + html.EscapeString(u) + "</a>")
+			p.WriteString(u)
+			i = j
+			continue
+
+		case c == '*' || c == '_':
+			double := i+1 < len(s) && s[i+1] == c
+			kind := delimKind(c, double)
+			delim := mdDelims[kind]
+			opensWord := i+len(delim) < len(s) && s[i+len(delim)] != ' '
+			leftOK := c == '*' || i == 0 || !isWordByte(s[i-1])
+			if opensWord && leftOK {
+				if j := m.closer[kind][i+len(delim)]; j > 0 {
+					ih, ip := renderInlineAt(s[i+len(delim):j], depth+1)
+					tag := "em"
+					if double {
+						tag = "strong"
+					}
+					h.WriteString("<" + tag + ">" + ih + "</" + tag + ">")
+					p.WriteString(ip)
+					i = j + len(delim)
+					continue
+				}
+			}
+		}
+		h.WriteString(html.EscapeString(s[i : i+1]))
+		p.WriteByte(c)
+		i++
+	}
+	return h.String(), p.String()
+}
+
+// mdDelims are the emphasis delimiters, indexed by delimKind.
+var mdDelims = [4]string{"*", "**", "_", "__"}
+
+func delimKind(c byte, double bool) int {
+	k := 0
+	if c == '_' {
+		k = 2
+	}
+	if double {
+		k++
+	}
+	return k
+}
+
+// inlineMarks holds what renderInline would otherwise search ahead for,
+// each found in one pass over the text.
+type inlineMarks struct {
+	s         string
+	match     []int    // '[' → its ']', '(' → its ')', on the same line; -1 if none
+	codeEnd   []int    // a code span's opening '`' → its closing one; -1 elsewhere
+	nextAngle []int    // i → the first of "<> \t\n" at or after i, or len(s)
+	closer    [4][]int // delimiter kind → i → the first closer at or after i, or -1
+}
+
+func markInline(s string) *inlineMarks {
+	n := len(s)
+	m := &inlineMarks{s: s, match: make([]int, n), codeEnd: make([]int, n), nextAngle: make([]int, n+1)}
+	var brackets, parens []int
+	inCode := make([]bool, n)
+	open := -1
+	for i := 0; i < n; i++ {
+		m.match[i], m.codeEnd[i] = -1, -1
+		switch s[i] {
+		case '`':
+			if open < 0 {
+				open = i
+			} else {
+				m.codeEnd[open] = i
+				for k := open; k <= i; k++ {
+					inCode[k] = true
+				}
+				open = -1
+			}
+		case '[':
+			brackets = append(brackets, i)
+		case ']':
+			if k := len(brackets); k > 0 {
+				m.match[brackets[k-1]] = i
+				brackets = brackets[:k-1]
+			}
+		case '(':
+			parens = append(parens, i)
+		case ')':
+			if k := len(parens); k > 0 {
+				m.match[parens[k-1]] = i
+				parens = parens[:k-1]
+			}
+		case '\n':
+			brackets, parens = brackets[:0], parens[:0]
+		}
+	}
+	m.nextAngle[n] = n
+	for i := n - 1; i >= 0; i-- {
+		m.nextAngle[i] = m.nextAngle[i+1]
+		if strings.IndexByte("<> \t\n", s[i]) >= 0 {
+			m.nextAngle[i] = i
+		}
+	}
+	for kind, delim := range mdDelims {
+		next := make([]int, n+1)
+		next[n] = -1
+		for j := n - 1; j >= 0; j-- {
+			next[j] = next[j+1]
+			if j > 0 && !inCode[j] && closesEmphasis(s, j, delim) {
+				next[j] = j
+			}
+		}
+		m.closer[kind] = next
+	}
+	return m
+}
+
+// closesEmphasis reports whether delim at j can close emphasis.
+func closesEmphasis(s string, j int, delim string) bool {
+	if !strings.HasPrefix(s[j:], delim) || s[j-1] == ' ' {
+		return false
+	}
+	end := j + len(delim)
+	if len(delim) == 1 && end < len(s) && s[end] == delim[0] {
+		return false // part of a double delimiter
+	}
+	if delim[0] == '_' && end < len(s) && isWordByte(s[end]) {
+		return false
+	}
+	return true
+}
+
+// link parses "[text](href)" at i, which holds a '['. The href may itself
+// contain balanced parentheses.
+func (m *inlineMarks) link(i int) (text, href string, n int, ok bool) {
+	end := m.match[i]
+	if end < 0 || end+1 >= len(m.s) || m.s[end+1] != '(' {
+		return "", "", 0, false
+	}
+	close := m.match[end+1]
+	if close < 0 {
+		return "", "", 0, false
+	}
+	return m.s[i+1 : end], strings.TrimSpace(m.s[end+2 : close]), close + 1 - i, true
+}
+
+// safeURL allows absolute http(s)/mailto URLs and relative references.
+func safeURL(raw string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || raw == "" {
+		return "", false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto":
+		return u.String(), true
+	case "":
+		return u.String(), u.Host == "" && !strings.Contains(raw, ":")
+	}
+	return "", false
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
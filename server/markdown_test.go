@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	for _, tc := range []struct {
+		src, html, plain string
+	}{
+		{"*em* **strong** _em_ __strong__", "<p><em>em</em> <strong>strong</strong> <em>em</em> <strong>strong</strong></p>", "em strong em strong"},
+		{"snake_case_name", "<p>snake_case_name</p>", "snake_case_name"},
+		{"`*not em*`", "<p><code>*not em*</code></p>", "*not em*"},
+		{"[docs](https://example.com/a_(b))", `<p><a href="https://example.com/a_(b)" rel="nofollow noopener">docs</a></p>`, "docs (https://example.com/a_(b))"},
+		{"see https://example.com/x.", `<p>see <a href="https://example.com/x" rel="nofollow noopener">https://example.com/x</a>.</p>`, "see https://example.com/x."},
+		{"<https://example.com>", `<p><a href="https://example.com" rel="nofollow noopener">https://example.com</a></p>`, "https://example.com"},
+		{"# Title #", "<h1>Title</h1>", "Title"},
+		{"- a\n  more\n- b", "<ul>\n<li>a<br>\nmore</li>\n<li>b</li>\n</ul>", "• a\n  more\n• b"},
+		{"3. x\n4. y", "<ol>\n<li>x</li>\n<li>y</li>\n</ol>", "3. x\n4. y"},
+		{"> quoted", "<blockquote>\n<p>quoted</p>\n</blockquote>", "> quoted"},
+		{"```go\na < b\n```", `<pre><code class="language-go">a &lt; b</code></pre>`, "a < b"},
+		{`\*literal\*`, "<p>*literal*</p>", "*literal*"},
+	} {
+		h, p := renderMarkdown(tc.src)
+		if h != tc.html || p != tc.plain {
+			t.Errorf("renderMarkdown(%q) =\n  %q, %q\nwant\n  %q, %q", tc.src, h, p, tc.html, tc.plain)
+		}
+	}
+}
+
+func TestRenderMarkdownSanitizes(t *testing.T) {
+	for _, src := range []string{
+		`<script>alert(1)</script>`,
+		`<img src=x onerror=alert(1)>`,
+		`[click](javascript:alert(1))`,
+		`[click](JaVaScRiPt:alert(1))`,
+		`[click](data:text/html;base64,PHNjcmlwdD4=)`,
+		`<javascript:alert(1)>`,
+		`[x](https://example.com/"onmouseover="alert(1))`,
+		"**<b>bold</b>**",
+		"```\n</code><script>x</script>\n```",
+		`[<script>](https://example.com)`,
+	} {
+		h, _ := renderMarkdown(src)
+		for _, bad := range []string{"<script", "<img", "<b>", `href="javascript`, `href="data`, `"onmouseover`} {
+			if strings.Contains(strings.ToLower(h), strings.ToLower(bad)) {
+				t.Errorf("renderMarkdown(%q) = %q, contains %s", src, h, bad)
+			}
+		}
+	}
+}
+
+// TestRenderMarkdownLinear renders inputs built to make a naive scanner
+// search ahead from every character, at two sizes four times apart, and
+// compares the times rather than bounding either: linear work takes about
+// four times as long for the larger input and quadratic work sixteen, so a
+// slow machine (or -race) doesn't fail it. Both sizes are past the point
+// where package regexp stops backtracking, which would skew the ratio, and
+// each takes the best of two runs so a GC pause doesn't count.
+func TestRenderMarkdownLinear(t *testing.T) {
+	const size, factor, bound = 32 << 10, 4, 10
+	best := func(src string) time.Duration {
+		var d time.Duration
+		for i := 0; i < 2; i++ {
+			start := time.Now()
+			renderMarkdown(src)
+			if e := time.Since(start); i == 0 || e < d {
+				d = e
+			}
+		}
+		return d
+	}
+	for name, unit := range map[string]string{
+		"open emphasis": "*a ",
+		"open strong":   "**a ",
+		"open under":    "_a ",
+		"brackets":      "[",
+		"closed links":  "[a](",
+		"nested links":  "[[",
+		"angles":        "<",
+		"angle urls":    "<http:",
+		"backticks":     "a`",
+		"quotes":        ">",
+		"list items":    "- a\n  b\n",
+		"emphasis run":  "*_",
+	} {
+		n := size / len(unit)
+		small := best(strings.Repeat(unit, n))
+		large := best(strings.Repeat(unit, factor*n))
+		if ratio := float64(large) / float64(max(small, time.Microsecond)); ratio > bound {
+			t.Errorf("%s: %d× the input took %.0f× as long (%s, %s)", name, factor, ratio, small, large)
+		}
+	}
+}
+
+func TestRenderMarkdownNestingLimit(t *testing.T) {
+	src := strings.Repeat("[", 40) + "x" + strings.Repeat("](https://example.com)", 40)
+	h, _ := renderMarkdown(src)
+	if n := strings.Count(h, "<a "); n != mdMaxNesting {
+		t.Errorf("%d nested links rendered, want %d", n, mdMaxNesting)
+	}
+	h, _ = renderMarkdown(strings.Repeat(">", 40) + " deep")
+	if n := strings.Count(h, "<blockquote>"); n != mdMaxNesting {
+		t.Errorf("%d nested quotes rendered, want %d", n, mdMaxNesting)
+	}
+}
+
+// TestMarkdownStoredRendered checks that reads use the renderings stored at
+// insert and fall back to rendering rows stored without them.
+func TestMarkdownStoredRendered(t *testing.T) {
+	testDB(t)
+	n, err := insertNotification(Notification{Title: "t", Text: "**hi**", Format: formatMarkdown, Priority: priorityDefault})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Text != "hi" || n.Markdown != "**hi**" {
+		t.Errorf("text, markdown = %q, %q", n.Text, n.Markdown)
+	}
+	if got := withHTML(n).HTML; got != "<p><strong>hi</strong></p>" {
+		t.Errorf("html = %q", got)
+	}
+
+	// A stored rendering is what readers get, whatever the source says now.
+	if _, err := db.Exec(`UPDATE notifications SET rendered_text = 'stored', rendered_html = '<p>stored</p>' WHERE id = ?`, n.ID); err != nil {
+		t.Fatal(err)
+	}
+	n, err = getNotification(n.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Text != "stored" || withHTML(n).HTML != "<p>stored</p>" {
+		t.Errorf("text, html = %q, %q; want the stored renderings", n.Text, withHTML(n).HTML)
+	}
+
+	if _, err := db.Exec(`UPDATE notifications SET rendered_text = NULL, rendered_html = NULL WHERE id = ?`, n.ID); err != nil {
+		t.Fatal(err)
+	}
+	n, err = getNotification(n.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Text != "hi" || withHTML(n).HTML != "<p><strong>hi</strong></p>" {
+		t.Errorf("text, html = %q, %q; want them rendered", n.Text, withHTML(n).HTML)
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ── Merge and Split ───────────────────────────────────────────────────────────
+//
+// Clean-up tools for when coalescing was configured wrong. POST
+// /admin/notifications/merge folds duplicates into one notification (by
+// default the oldest): it is seen if any of them was, as of the earliest
+// ack, it gets their read receipts, and their incidents are folded into one
+// whose step log keeps every step. The duplicates are then deleted.
+//
+// POST /admin/notifications/{id}/split undoes a digest: the events it was
+// made from are stored again as individual notifications, with the times
+// they arrived and the digest's seen state and receipts, and the digest is
+// deleted. Digests keep their events for this from now on; ones published
+// before can't be split.
+//
+// Both export held notifications before deleting anything (see Legal hold)
+// and are audited. Neither alerts: connected clients get "deleted" and
+// "updated" frames (see State Sync), and the rest the notifications they
+// leave with their next history frame.
+
+func initMergeTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS digest_events (
+			id              INTEGER PRIMARY KEY AUTOINCREMENT,
+			notification_id INTEGER NOT NULL REFERENCES notifications(id) ON DELETE CASCADE,
+			held_at         DATETIME NOT NULL,
+			body            TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_digest_events_notification ON digest_events (notification_id)
+	`)
+	return err
+}
+
+// keepDigestEvents stores the events digest id was made from, for a split.
+func keepDigestEvents(id int64, events []heldEvent) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, e := range events {
+		body, _ := json.Marshal(e.n)
+		if _, err := tx.Exec(`INSERT INTO digest_events (notification_id, held_at, body) VALUES (?, ?, ?)`,
+			id, e.heldAt, sealColumn("body", string(body))); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func handleMerge(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var body struct {
+			IDs  []int64 `json:"ids"`
+			Into int64   `json:"into"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, `body must be {"ids":[…],"into":id}`, http.StatusBadRequest)
+			return
+		}
+		slices.Sort(body.IDs)
+		body.IDs = slices.Compact(body.IDs)
+		if len(body.IDs) < 2 {
+			http.Error(w, "ids must name at least two notifications", http.StatusBadRequest)
+			return
+		}
+		if body.Into == 0 {
+			body.Into = body.IDs[0]
+		} else if !slices.Contains(body.IDs, body.Into) {
+			http.Error(w, "into must be one of ids", http.StatusBadRequest)
+			return
+		}
+		if missing, err := missingNotifications(body.IDs); err != nil {
+			log.Printf("merge: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		} else if len(missing) > 0 {
+			http.Error(w, "no such notifications: "+joinIDs(missing), http.StatusNotFound)
+			return
+		}
+		dups := slices.DeleteFunc(slices.Clone(body.IDs), func(id int64) bool { return id == body.Into })
+		where, args := idsClause("id", dups)
+		archive, held, err := exportHeld(r.Context(), "merge", where, args)
+		if err != nil {
+			log.Printf("merge: %v; nothing merged", err)
+			http.Error(w, "could not export held notifications; nothing merged", http.StatusInternalServerError)
+			return
+		}
+		refs, err := noteRefs(dups)
+		if err != nil {
+			log.Printf("merge: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if err := merge(r.Context(), body.Into, dups); err != nil {
+			log.Printf("merge: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		announceDeleted(h, refs, 0)
+		announceUpdated(h, []int64{body.Into})
+		n, err := getNotification(body.Into)
+		if err != nil {
+			log.Printf("merge: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		by := authFrom(r).ID
+		detail := fmt.Sprintf("notifications %s merged into %d%s", joinIDs(dups), body.Into, heldNote(archive, held))
+		audit(by, "merge", detail, archive)
+		log.Printf("merge: %s by=%s", detail, by)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"notification": n, "merged": dups})
+	}
+}
+
+// merge folds the acks, receipts, incidents and digest events of dups into
+// into, then deletes dups.
+func merge(ctx context.Context, into int64, dups []int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	where, args := idsClause("id", dups)
+	byNotification, _ := idsClause("notification_id", dups)
+	if _, err := tx.Exec(`
+		UPDATE notifications SET seen_at = (
+			SELECT MIN(seen_at) FROM notifications WHERE id = ? OR `+where+`
+		) WHERE id = ?`, append(append([]any{into}, args...), into)...); err != nil {
+		return err
+	}
+	// Each device keeps its earliest read.
+	if _, err := tx.Exec(`
+		INSERT INTO read_receipts (notification_id, device, by, seen_at)
+		SELECT ?, device, by, seen_at FROM read_receipts WHERE `+byNotification+` ORDER BY seen_at
+		ON CONFLICT (notification_id, device) DO UPDATE SET by = excluded.by, seen_at = excluded.seen_at
+		WHERE excluded.seen_at < read_receipts.seen_at`, append([]any{into}, args...)...); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE digest_events SET notification_id = ? WHERE `+byNotification,
+		append([]any{into}, args...)...); err != nil {
+		return err
+	}
+	if err := mergeIncidents(tx, into, dups); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM notifications WHERE `+where, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// mergeIncidents keeps one incident for into — its own, else the oldest of
+// the duplicates' — and moves the others' steps and earliest ack onto it.
+func mergeIncidents(tx *sql.Tx, into int64, dups []int64) error {
+	where, args := idsClause("notification_id", append([]int64{into}, dups...))
+	rows, err := tx.Query(`SELECT id FROM incidents WHERE `+where+`
+		ORDER BY notification_id = ? DESC, id`, append(args, into)...)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return err
+	}
+	keep, others := ids[0], ids[1:]
+	if len(others) > 0 {
+		where, args := idsClause("id", others)
+		bySteps, _ := idsClause("incident_id", others)
+		if _, err := tx.Exec(`
+			UPDATE incidents SET (acked_by, acked_at) = (
+				SELECT acked_by, acked_at FROM incidents WHERE acked_at IS NOT NULL AND (id = ? OR `+where+`)
+				ORDER BY acked_at LIMIT 1
+			) WHERE id = ? AND EXISTS (
+				SELECT 1 FROM incidents WHERE acked_at IS NOT NULL AND (id = ? OR `+where+`)
+			)`, slices.Concat([]any{keep}, args, []any{keep, keep}, args)...); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE incident_steps SET incident_id = ? WHERE `+bySteps,
+			append([]any{keep}, args...)...); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM incidents WHERE `+where, args...); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE incidents SET notification_id = ? WHERE id = ?`, into, keep); err != nil {
+		return err
+	}
+	detail := fmt.Sprintf("notifications %s merged in", joinIDs(dups))
+	if len(others) > 0 {
+		detail += fmt.Sprintf(", with incidents %s", joinIDs(others))
+	}
+	_, err = tx.Exec(`INSERT INTO incident_steps (incident_id, kind, detail) VALUES (?, 'merged', ?)`, keep, detail)
+	return err
+}
+
+func handleSplit(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		digest, err := getNotification(id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("split %d: %v", id, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		var events int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM digest_events WHERE notification_id = ?`, id).Scan(&events); err != nil {
+			log.Printf("split %d: %v", id, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if events == 0 {
+			http.Error(w, "not a digest with stored events (digests published before this version can't be split)", http.StatusConflict)
+			return
+		}
+		archive, held, err := exportHeld(r.Context(), "split", `id = ?`, []any{id})
+		if err != nil {
+			log.Printf("split %d: %v; nothing split", id, err)
+			http.Error(w, "could not export held notifications; nothing split", http.StatusInternalServerError)
+			return
+		}
+		ids, err := split(r.Context(), id)
+		if err != nil {
+			log.Printf("split %d: %v", id, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		announceDeleted(h, []noteRef{{id, digest.Topic}}, 0)
+		announceUpdated(h, ids)
+		by := authFrom(r).ID
+		detail := fmt.Sprintf("digest %d split into notifications %s%s", id, joinIDs(ids), heldNote(archive, held))
+		audit(by, "split", detail, archive)
+		log.Printf("split: %s by=%s", detail, by)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"ids": ids})
+	}
+}
+
+// split stores digest id's events as notifications and deletes the digest,
+// returning the new ids.
+func split(ctx context.Context, id int64) ([]int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var seenAt *string
+	if err := tx.QueryRow(`SELECT seen_at FROM notifications WHERE id = ?`, id).Scan(&seenAt); err != nil {
+		return nil, err
+	}
+	if seenAt != nil {
+		t, err := parseSQLiteTime(*seenAt)
+		if err != nil {
+			return nil, err
+		}
+		s := sqliteTime(t)
+		seenAt = &s
+	}
+	rows, err := tx.Query(`SELECT held_at, body FROM digest_events WHERE notification_id = ? ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+	var events []Notification
+	for rows.Next() {
+		var heldAt, body string
+		if err := rows.Scan(&heldAt, &body); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		var n Notification
+		plain, err := openColumn("body", body)
+		if err == nil {
+			err = json.Unmarshal([]byte(plain), &n)
+		}
+		var at time.Time
+		if err == nil {
+			at, err = parseSQLiteTime(heldAt)
+		}
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("digest event: %w", err)
+		}
+		n.ID, n.CreatedAt, n.SeenAt = 0, sqliteTime(at), seenAt
+		events = append(events, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var ids []int64
+	for _, n := range events {
+		if _, err := importNotification(ctx, tx, n, "reassign"); err != nil {
+			return nil, err
+		}
+		var newID int64
+		if err := tx.QueryRow(`SELECT last_insert_rowid()`).Scan(&newID); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO read_receipts (notification_id, device, by, seen_at)
+			SELECT ?, device, by, seen_at FROM read_receipts WHERE notification_id = ?`, newID, id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, newID)
+	}
+	var incident int64
+	switch err := tx.QueryRow(`SELECT id FROM incidents WHERE notification_id = ?`, id).Scan(&incident); {
+	case err == nil:
+		if _, err := tx.Exec(`INSERT INTO incident_steps (incident_id, kind, detail) VALUES (?, 'split', ?)`,
+			incident, "digest split into notifications "+joinIDs(ids)); err != nil {
+			return nil, err
+		}
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM notifications WHERE id = ?`, id); err != nil {
+		return nil, err
+	}
+	return ids, tx.Commit()
+}
+
+// missingNotifications returns those of ids with no notification.
+func missingNotifications(ids []int64) ([]int64, error) {
+	where, args := idsClause("id", ids)
+	rows, err := db.Query(`SELECT id FROM notifications WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	found := map[int64]bool{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		found[id] = true
+	}
+	return slices.DeleteFunc(slices.Clone(ids), func(id int64) bool { return found[id] }), rows.Err()
+}
+
+// idsClause is `column IN (?, …)` with its arguments.
+func idsClause(column string, ids []int64) (string, []any) {
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return column + ` IN (` + placeholders(len(ids)) + `)`, args
+}
+
+func joinIDs(ids []int64) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(s, ", ")
+}
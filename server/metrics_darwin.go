@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// loadAverage returns the 1-minute load average, from `sysctl -n vm.loadavg`
+// ("{ 1.52 1.61 1.70 }").
+func loadAverage() (float64, error) {
+	out, err := exec.Command("sysctl", "-n", "vm.loadavg").Output()
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(strings.Trim(strings.TrimSpace(string(out)), "{}"))
+	if len(fields) == 0 {
+		return 0, errors.New("unexpected vm.loadavg output")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// macOS exposes temperatures only through private SMC interfaces.
+func hottestSensor() (float64, error) { return 0, errors.ErrUnsupported }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// loadAverage returns the 1-minute load average.
+func loadAverage() (float64, error) {
+	raw, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(raw))
+	if len(fields) == 0 {
+		return 0, errors.New("empty /proc/loadavg")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// hottestSensor returns the highest reading in °C across the thermal zones
+// and hwmon sensors.
+func hottestSensor() (float64, error) {
+	paths, _ := filepath.Glob("/sys/class/thermal/thermal_zone*/temp")
+	hwmon, _ := filepath.Glob("/sys/class/hwmon/hwmon*/temp*_input")
+	hottest, found := 0.0, false
+	for _, p := range append(paths, hwmon...) {
+		raw, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		milli, err := strconv.ParseFloat(strings.TrimSpace(string(raw)), 64)
+		if err != nil {
+			continue
+		}
+		if c := milli / 1000; !found || c > hottest {
+			hottest, found = c, true
+		}
+	}
+	if !found {
+		return 0, errors.New("no readable temperature sensors")
+	}
+	return hottest, nil
+}
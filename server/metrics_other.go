@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// Windows has no load average, and neither it nor the BSDs expose
+// temperatures the agent can read without extra tooling.
+func loadAverage() (float64, error) { return 0, errors.ErrUnsupported }
+
+func hottestSensor() (float64, error) { return 0, errors.ErrUnsupported }
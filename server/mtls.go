@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// ── TLS & Client Certificates ─────────────────────────────────────────────────
+//
+// With --tls-cert/--tls-key the server terminates TLS itself. Adding
+// --client-ca turns on mutual TLS: a client presenting a certificate signed by
+// that CA is authenticated without any token, and the certificate's CN becomes
+// its device identity (used as the WebSocket user). Clients without a
+// certificate can still use tokens.
+
+// tlsConfig builds the listener config, or nil when TLS is off.
+func tlsConfig() (*tls.Config, error) {
+	if *flagTLSCert == "" && *flagTLSKey == "" {
+		if *flagClientCA != "" {
+			return nil, errors.New("--client-ca requires --tls-cert and --tls-key")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(*flagTLSCert, *flagTLSKey)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if *flagClientCA != "" {
+		pemBytes, err := os.ReadFile(*flagClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemBytes) {
+			return nil, fmt.Errorf("no certificates in %s", *flagClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if *flagClientCertReq {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return cfg, nil
+}
+
+// certAuth authenticates a request by its verified client certificate.
+func certAuth(r *http.Request) (authInfo, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return authInfo{}, false
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	cn := leaf.Subject.CommonName
+	if cn == "" {
+		return authInfo{}, false
+	}
+	a := authInfo{ID: "cert:" + cn, User: cn, Scope: scopeRead}
+	if *flagClientCertScope == "full" {
+		a.Scope = scopeFull
+	}
+	return a, true
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ── Archive Offload ───────────────────────────────────────────────────────────
+//
+// With --s3-bucket set, notifications older than --s3-archive-after are moved
+// to an S3-compatible bucket in batches of gzip-compressed JSONL (the /export
+// format, encrypted as a whole with --encryption-key-file) and deleted from
+// SQLite. A small index of the batches stays behind, so history is still
+// listed by GET /archive and fetched on demand: a whole batch with
+// GET /archive/{batch} (ready for POST /import) or one notification with
+// GET /archive/notifications/{id}. --s3-expire-days installs a bucket
+// lifecycle rule that expires the archived objects after that long.
+//
+// Notifications something is still waiting on — snoozed, held for quiet
+// hours, awaiting a required ack or escalating — stay in the database past
+// the cutoff: deleting them would cascade their pending state away with
+// them. They move in a later run, once that is over.
+
+const offloadBatch = 1000
+
+// offloadable is the condition on notifications rows that leaves out the
+// ones still pending.
+const offloadable = `snoozed_until IS NULL AND NOT (require_ack AND acked_at IS NULL)
+	AND id NOT IN (SELECT notification_id FROM quiet_held)
+	AND id NOT IN (SELECT notification_id FROM escalations WHERE resolved_at IS NULL)`
+
+var archiveStore *s3Client
+
+type archiveBatch struct {
+	ID         int64  `json:"id"`
+	Key        string `json:"key"`
+	FirstID    int64  `json:"first_id"`
+	LastID     int64  `json:"last_id"`
+	FirstAt    string `json:"first_at"`
+	LastAt     string `json:"last_at"`
+	Count      int    `json:"count"`
+	Size       int64  `json:"size"`
+	ArchivedAt string `json:"archived_at"`
+}
+
+func initArchiveTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS archive_batches (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			key         TEXT NOT NULL UNIQUE,
+			first_id    INTEGER NOT NULL,
+			last_id     INTEGER NOT NULL,
+			first_at    DATETIME NOT NULL,
+			last_at     DATETIME NOT NULL,
+			count       INTEGER NOT NULL,
+			size        INTEGER NOT NULL,
+			archived_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	return err
+}
+
+// offloadJob moves old notifications to the bucket every hour until none
+// are left past the cutoff.
+func offloadJob(after time.Duration, prefix string) *schedJob {
+	return &schedJob{
+		name:     "s3-archive",
+		interval: time.Hour,
+		run: func() error {
+			for !draining.Load() {
+				n, err := offloadOnce(context.Background(), time.Now().Add(-after), prefix)
+				if err != nil || n < offloadBatch {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// offloadOnce archives up to offloadBatch notifications created before cutoff
+// and returns how many it moved.
+func offloadOnce(ctx context.Context, cutoff time.Time, prefix string) (int, error) {
+	before := sqliteTime(cutoff)
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+notificationCols+` FROM notifications WHERE created_at < ? AND `+offloadable+` ORDER BY id LIMIT ?`,
+		before, offloadBatch)
+	if err != nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	var first, last Notification
+	var ids []any
+	count, held := 0, 0
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if count == 0 {
+			first = n
+		}
+		last = n
+		ids = append(ids, n.ID)
+		enc.Encode(n)
+		count++
+		if holdTopics[n.Topic] {
+			held++
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || count == 0 {
+		return 0, err
+	}
+	zw.Close()
+
+	key := fmt.Sprintf("%snotifications/%012d-%012d-%d.jsonl.gz", prefix, first.ID, last.ID, time.Now().Unix())
+	body := buf.Bytes()
+	if atRest != nil {
+		body = []byte(sealColumn("archive", string(body)))
+	}
+	if err := archiveStore.put(ctx, key, body, "application/octet-stream"); err != nil {
+		return 0, err
+	}
+
+	// Only what was uploaded is deleted, and only if it hasn't become
+	// pending (snoozed, say) since; a row that has stays, and is archived
+	// again later.
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO archive_batches (key, first_id, last_id, first_at, last_at, count, size) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		key, first.ID, last.ID, first.CreatedAt, last.CreatedAt, count, len(body),
+	); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM notifications WHERE id IN (?`+strings.Repeat(", ?", len(ids)-1)+`) AND `+offloadable, ids...,
+	); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	log.Printf("archive: moved %d notifications (ids %d–%d) to %s", count, first.ID, last.ID, key)
+	if held > 0 {
+		archive := "s3://" + *flagS3Bucket + "/" + key
+		audit("s3-archive", "retention", fmt.Sprintf("%d notifications moved, %d of them held", count, held), archive)
+	}
+	return count, nil
+}
+
+// fetchBatch downloads a batch and returns its JSONL.
+func fetchBatch(ctx context.Context, key string) ([]byte, error) {
+	if archiveStore == nil {
+		return nil, errors.New("no --s3-bucket configured")
+	}
+	body, err := archiveStore.get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := openColumn("archive", string(body))
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader([]byte(gz)))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(zr)
+}
+
+func scanArchiveBatch(s scanner) (archiveBatch, error) {
+	var b archiveBatch
+	err := s.Scan(&b.ID, &b.Key, &b.FirstID, &b.LastID, &b.FirstAt, &b.LastAt, &b.Count, &b.Size, &b.ArchivedAt)
+	return b, err
+}
+
+const archiveBatchCols = `id, key, first_id, last_id, first_at, last_at, count, size, archived_at`
+
+func handleArchive() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rows, err := db.Query(`SELECT ` + archiveBatchCols + ` FROM archive_batches ORDER BY first_id`)
+		if err != nil {
+			log.Printf("archive: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		out := []archiveBatch{}
+		for rows.Next() {
+			b, err := scanArchiveBatch(rows)
+			if err != nil {
+				log.Printf("archive: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, b)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+func handleArchiveBatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("batch"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid batch", http.StatusBadRequest)
+			return
+		}
+		b, err := scanArchiveBatch(db.QueryRow(`SELECT `+archiveBatchCols+` FROM archive_batches WHERE id = ?`, id))
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		var data []byte
+		if err == nil {
+			data, err = fetchBatch(r.Context(), b.Key)
+		}
+		if err != nil {
+			log.Printf("archive: batch %d: %v", id, err)
+			http.Error(w, "archive unavailable", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Write(data)
+	}
+}
+
+func handleArchivedNotification() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		b, err := scanArchiveBatch(db.QueryRow(
+			`SELECT `+archiveBatchCols+` FROM archive_batches WHERE ? BETWEEN first_id AND last_id ORDER BY id DESC LIMIT 1`, id))
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		var data []byte
+		if err == nil {
+			data, err = fetchBatch(r.Context(), b.Key)
+		}
+		if err != nil {
+			log.Printf("archive: notification %d: %v", id, err)
+			http.Error(w, "archive unavailable", http.StatusBadGateway)
+			return
+		}
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			var n Notification
+			if json.Unmarshal(line, &n) == nil && n.ID == id {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(n)
+				return
+			}
+		}
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ── On-call Rotation ──────────────────────────────────────────────────────────
+//
+// A single weekly rotation: the user list is walked one week at a time from
+// the configured start. Overrides (and handoffs, which are just overrides
+// ending at the current shift boundary) take precedence while active.
+
+const shiftLength = 7 * 24 * time.Hour
+
+// onCallTopics is populated from --oncall-topics at startup.
+var onCallTopics = map[string]bool{}
+
+type onCallState struct {
+	User       string `json:"user"`
+	Via        string `json:"via"` // "rotation" or "override"
+	Until      string `json:"until,omitempty"`
+	OverrideID int64  `json:"override_id,omitempty"`
+}
+
+type onCallShift struct {
+	User     string `json:"user"`
+	StartsAt string `json:"starts_at"`
+	EndsAt   string `json:"ends_at"`
+}
+
+type onCallOverride struct {
+	ID       int64  `json:"id"`
+	User     string `json:"user"`
+	StartsAt string `json:"starts_at"`
+	EndsAt   string `json:"ends_at"`
+	Reason   string `json:"reason"`
+}
+
+func initOnCallTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS oncall_rotation (
+			position INTEGER PRIMARY KEY,
+			user     TEXT NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS oncall_overrides (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			user       TEXT NOT NULL,
+			starts_at  DATETIME NOT NULL,
+			ends_at    DATETIME NOT NULL,
+			reason     TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	return err
+}
+
+func loadRotation() ([]string, time.Time, error) {
+	rows, err := db.Query(`SELECT user FROM oncall_rotation ORDER BY position`)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer rows.Close()
+	var users []string
+	for rows.Next() {
+		var u string
+		if err := rows.Scan(&u); err != nil {
+			return nil, time.Time{}, err
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, time.Time{}, err
+	}
+	var start time.Time
+	if v := getSetting("oncall_start"); v != "" {
+		start, err = parseSQLiteTime(v)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	return users, start, nil
+}
+
+// shiftAt returns the rotation shift covering t.
+func shiftAt(users []string, start, t time.Time) onCallShift {
+	if len(users) == 0 {
+		return onCallShift{}
+	}
+	d := t.Sub(start)
+	n := int64(d / shiftLength)
+	if d < 0 && d%shiftLength != 0 {
+		n-- // integer division truncates toward zero
+	}
+	idx := int(((n % int64(len(users))) + int64(len(users))) % int64(len(users)))
+	begin := start.Add(time.Duration(n) * shiftLength)
+	return onCallShift{
+		User:     users[idx],
+		StartsAt: sqliteTime(begin),
+		EndsAt:   sqliteTime(begin.Add(shiftLength)),
+	}
+}
+
+func onCallAt(t time.Time) (onCallState, error) {
+	var o onCallOverride
+	ts := sqliteTime(t)
+	err := db.QueryRow(
+		`SELECT id, user, ends_at FROM oncall_overrides
+		 WHERE starts_at <= ? AND ends_at > ? ORDER BY id DESC LIMIT 1`, ts, ts,
+	).Scan(&o.ID, &o.User, &o.EndsAt)
+	if err == nil {
+		return onCallState{User: o.User, Via: "override", Until: o.EndsAt, OverrideID: o.ID}, nil
+	}
+	if err != sql.ErrNoRows {
+		return onCallState{}, err
+	}
+	users, start, err := loadRotation()
+	if err != nil {
+		return onCallState{}, err
+	}
+	if len(users) == 0 {
+		return onCallState{}, nil
+	}
+	s := shiftAt(users, start, t)
+	return onCallState{User: s.User, Via: "rotation", Until: s.EndsAt}, nil
+}
+
+// onCallAssignee returns who an incoming notification should route to, or ""
+// if it is not on a designated topic or not urgent enough.
+func onCallAssignee(n Notification) string {
+	return onCallAssigneeAt(n, time.Now())
+}
+
+func onCallAssigneeAt(n Notification, at time.Time) string {
+	if !onCallTopics[n.Topic] || n.Priority < *flagOnCallPriority {
+		return ""
+	}
+	st, err := onCallAt(at)
+	if err != nil {
+		log.Printf("oncall: resolve: %v", err)
+		return ""
+	}
+	return st.User
+}
+
+func listOverrides(from time.Time) ([]onCallOverride, error) {
+	rows, err := db.Query(
+		`SELECT id, user, starts_at, ends_at, reason FROM oncall_overrides
+		 WHERE ends_at > ? ORDER BY starts_at`, sqliteTime(from),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []onCallOverride{}
+	for rows.Next() {
+		var o onCallOverride
+		if err := rows.Scan(&o.ID, &o.User, &o.StartsAt, &o.EndsAt, &o.Reason); err != nil {
+			return nil, err
+		}
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
+
+func insertOverride(user string, start, end time.Time, reason string) (onCallOverride, error) {
+	res, err := db.Exec(
+		`INSERT INTO oncall_overrides (user, starts_at, ends_at, reason) VALUES (?, ?, ?, ?)`,
+		user, sqliteTime(start), sqliteTime(end), reason,
+	)
+	if err != nil {
+		return onCallOverride{}, err
+	}
+	id, _ := res.LastInsertId()
+	return onCallOverride{ID: id, User: user, StartsAt: sqliteTime(start), EndsAt: sqliteTime(end), Reason: reason}, nil
+}
+
+// ── On-call Handlers ──────────────────────────────────────────────────────────
+
+func handleOnCall() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		now := time.Now()
+		st, err := onCallAt(now)
+		if err != nil {
+			log.Printf("oncall: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		users, start, err := loadRotation()
+		if err != nil {
+			log.Printf("oncall: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		overrides, err := listOverrides(now)
+		if err != nil {
+			log.Printf("oncall: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		schedule := []onCallShift{}
+		for i := 0; i < 4 && len(users) > 0; i++ {
+			schedule = append(schedule, shiftAt(users, start, now.Add(time.Duration(i)*shiftLength)))
+		}
+		topics := []string{}
+		for t := range onCallTopics {
+			topics = append(topics, t)
+		}
+		if users == nil {
+			users = []string{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"on_call":      st,
+			"rotation":     users,
+			"start":        sqliteTime(start),
+			"topics":       topics,
+			"min_priority": *flagOnCallPriority,
+			"schedule":     schedule,
+			"overrides":    overrides,
+		})
+	}
+}
+
+func handleOnCallRotation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var body struct {
+			Users []string   `json:"users"`
+			Start *time.Time `json:"start"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		for _, u := range body.Users {
+			if strings.TrimSpace(u) == "" {
+				http.Error(w, "user names must be non-empty", http.StatusBadRequest)
+				return
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("oncall rotation: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(`DELETE FROM oncall_rotation`); err != nil {
+			log.Printf("oncall rotation: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		for i, u := range body.Users {
+			if _, err := tx.Exec(`INSERT INTO oncall_rotation (position, user) VALUES (?, ?)`, i, u); err != nil {
+				log.Printf("oncall rotation: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+		}
+		// Keep the existing anchor unless a new one is given, so editing the
+		// user list doesn't silently shift everyone's weeks.
+		start := getSetting("oncall_start")
+		if body.Start != nil {
+			start = sqliteTime(*body.Start)
+		} else if start == "" {
+			start = sqliteTime(time.Now())
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO settings (key, value) VALUES ('oncall_start', ?)
+			ON CONFLICT(key) DO UPDATE SET value = excluded.value
+		`, start); err != nil {
+			log.Printf("oncall rotation: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("oncall rotation: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"rotation": body.Users, "start": start})
+		log.Printf("oncall: rotation set to %v starting %s", body.Users, start)
+	}
+}
+
+func handleOnCallOverride() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var body struct {
+			User     string     `json:"user"`
+			Start    *time.Time `json:"start"`
+			End      *time.Time `json:"end"`
+			Duration string     `json:"duration"`
+			Reason   string     `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(body.User) == "" {
+			http.Error(w, "user is required", http.StatusBadRequest)
+			return
+		}
+		start := time.Now()
+		if body.Start != nil {
+			start = *body.Start
+		}
+		var end time.Time
+		switch {
+		case body.End != nil:
+			end = *body.End
+		case body.Duration != "":
+			d, err := time.ParseDuration(body.Duration)
+			if err != nil {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+			end = start.Add(d)
+		default:
+			http.Error(w, "one of end or duration is required", http.StatusBadRequest)
+			return
+		}
+		if !end.After(start) {
+			http.Error(w, "end must be after start", http.StatusBadRequest)
+			return
+		}
+
+		o, err := insertOverride(body.User, start, end, body.Reason)
+		if err != nil {
+			log.Printf("oncall override: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(o)
+		log.Printf("oncall: override id=%d user=%q %s → %s", o.ID, o.User, o.StartsAt, o.EndsAt)
+	}
+}
+
+func handleOnCallOverrideDelete() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		res, err := db.Exec(`DELETE FROM oncall_overrides WHERE id = ?`, id)
+		if err != nil {
+			log.Printf("oncall override delete: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		log.Printf("oncall: override id=%d deleted", id)
+	}
+}
+
+// handleOnCallHandoff hands the pager to another user until the end of the
+// current rotation shift, and tells everyone about it.
+func handleOnCallHandoff(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var body struct {
+			User   string `json:"user"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(body.User) == "" {
+			http.Error(w, "user is required", http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		prev, err := onCallAt(now)
+		if err != nil {
+			log.Printf("oncall handoff: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		users, start, err := loadRotation()
+		if err != nil {
+			log.Printf("oncall handoff: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if len(users) == 0 {
+			http.Error(w, "no rotation configured", http.StatusConflict)
+			return
+		}
+		end, _ := parseSQLiteTime(shiftAt(users, start, now).EndsAt)
+
+		reason := "handoff"
+		if body.Reason != "" {
+			reason += ": " + body.Reason
+		}
+		o, err := insertOverride(body.User, now, end, reason)
+		if err != nil {
+			log.Printf("oncall handoff: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		text := fmt.Sprintf("%s is now on call until %s UTC.", body.User, o.EndsAt)
+		if prev.User != "" {
+			text = fmt.Sprintf("%s handed off to %s until %s UTC.", prev.User, body.User, o.EndsAt)
+		}
+		if body.Reason != "" {
+			text += " Reason: " + body.Reason
+		}
+		// Unassigned, so the whole team sees who holds the pager now, not only
+		// the incoming person.
+		if _, err := publish(r.Context(), h, Notification{
+			Title:  "On-call handoff",
+			Text:   text,
+			Source: "andrNoti",
+		}); err != nil {
+			log.Printf("oncall handoff: notify: %v", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"previous": prev.User, "override": o})
+		log.Printf("oncall: handoff %q → %q until %s", prev.User, body.User, o.EndsAt)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShiftAtCoversT(t *testing.T) {
+	users := []string{"alice", "bob", "carol"}
+	start := time.Date(2026, 1, 5, 9, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name string
+		at   time.Time
+		user string
+	}{
+		{"start", start, "alice"},
+		{"in the first shift", start.Add(time.Hour), "alice"},
+		{"second shift", start.Add(shiftLength), "bob"},
+		{"just before start", start.Add(-time.Second), "carol"},
+		{"one shift before start", start.Add(-shiftLength), "carol"},
+		{"two shifts before start", start.Add(-2 * shiftLength), "bob"},
+		{"three shifts before start", start.Add(-3 * shiftLength), "alice"},
+	} {
+		s := shiftAt(users, start, tc.at)
+		begin, _ := parseSQLiteTime(s.StartsAt)
+		end, _ := parseSQLiteTime(s.EndsAt)
+		if tc.at.Before(begin) || !tc.at.Before(end) {
+			t.Errorf("%s: shift [%s, %s) doesn't cover %s", tc.name, s.StartsAt, s.EndsAt, sqliteTime(tc.at))
+		}
+		if s.User != tc.user {
+			t.Errorf("%s: on call %q, want %q", tc.name, s.User, tc.user)
+		}
+	}
+}
@@ -0,0 +1,804 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// ── Delivery Queue ────────────────────────────────────────────────────────────
+//
+// Every push channel — Web Push, APNs, the Discord and Slack connectors,
+// Pushover, NATS and federation peers — sends through one persistent queue.
+// When a notification is published each channel names the targets it should
+// reach (subscriptions, device tokens, connectors, subjects, peers), and one
+// row per target goes into the deliveries table in one transaction. Dispatch
+// workers claim due rows and send them, so a slow push service never holds up
+// a broadcast and a restart or SIGUSR2 handoff picks up where the old process
+// left off. A row is claimed with a lease; one stuck in a process that was
+// killed is tried again when the lease runs out.
+//
+// A notification is stored together with a fan-out marker, which is cleared
+// once its deliveries are queued. A process killed in between leaves the
+// marker behind, and whichever instance finds it older than fanOutGrace
+// queues the deliveries then. Together that makes delivery to channels
+// at-least-once: a crash can repeat a send, never lose one.
+//
+// A failed attempt is retried with exponential backoff — 10s, 20s, 40s and
+// so on up to an hour, with jitter, or after the Retry-After the service
+// sent with a 429 or 5xx — until --delivery-max-attempts. Deliveries that run
+// out of attempts, or that the service refuses outright (any other 4xx), are
+// dead-lettered: kept with their last error for --dead-letter-retention and
+// listed by GET /admin/deliveries?state=dead. POST
+// /admin/deliveries/{id}/retry queues one again with fresh attempts. Targets
+// the service reports gone are removed, and their deliveries with them.
+//
+// Sent deliveries are kept for a day for inspection; the delivery-prune job
+// clears out both.
+
+const (
+	deliveryWorkers   = 8
+	deliveryLease     = 2 * time.Minute
+	deliveryPoll      = 2 * time.Second
+	deliveryBackoff   = 10 * time.Second
+	deliveryMaxDelay  = time.Hour
+	deliverySentTTL   = 24 * time.Hour
+	deliveryListLimit = 100
+	deliveryMaxLimit  = 1000
+	fanOutGrace       = 30 * time.Second
+
+	deliveryPending = "pending"
+	deliverySent    = "sent"
+	deliveryDead    = "dead"
+)
+
+// outChannel is one way out of the server.
+type outChannel struct {
+	name    string      // also the Prometheus channel label
+	enabled func() bool // nil when always on
+	// targets names who should get n. It runs at publish time.
+	targets func(h *hub, n Notification) ([]string, error)
+	// deliver sends n to one target and records the outcome on it.
+	deliver func(target string, n Notification) error
+}
+
+var outChannels = []outChannel{
+	{channelWebPush, nil, webPushTargets, deliverWebPush},
+	{channelAPNs, apnsEnabled, apnsTargets, deliverAPNs},
+	{chatDiscord, nil, chatTargets(chatDiscord), deliverChat},
+	{chatSlack, nil, chatTargets(chatSlack), deliverChat},
+	{channelPushover, pushoverEnabled, pushoverTargets, deliverPushover},
+	{channelEscalation, pushoverEnabled, escalationTargets, deliverEscalation},
+	{channelNATS, natsEnabled, natsTargets, deliverNATS},
+	{channelFederation, nil, federationTargets, deliverFederation},
+}
+
+func outChannelNamed(name string) (outChannel, bool) {
+	for _, c := range outChannels {
+		if c.name == name {
+			return c, c.enabled == nil || c.enabled()
+		}
+	}
+	return outChannel{}, false
+}
+
+// deliveryPoke wakes the dispatcher when new deliveries are queued.
+var deliveryPoke = make(chan struct{}, 1)
+
+func initDeliveryQueueTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS deliveries (
+			id              INTEGER PRIMARY KEY AUTOINCREMENT,
+			notification_id INTEGER NOT NULL,
+			channel         TEXT NOT NULL,
+			target          TEXT NOT NULL,
+			state           TEXT NOT NULL DEFAULT 'pending',
+			attempts        INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			lease_until     DATETIME,
+			last_error      TEXT NOT NULL DEFAULT '',
+			created_at      DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at      DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_deliveries_due ON deliveries(state, next_attempt_at)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS fanout_pending (
+			notification_id INTEGER PRIMARY KEY REFERENCES notifications(id) ON DELETE CASCADE,
+			created_at      DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	return err
+}
+
+// markFanOut records, in the transaction that stores notification id, that
+// its deliveries are yet to be queued.
+func markFanOut(tx *sql.Tx, id int64) error {
+	_, err := tx.Exec(`INSERT INTO fanout_pending (notification_id) VALUES (?)`, id)
+	return err
+}
+
+// fannedOut clears the fan-out markers of ids.
+func fannedOut(ids ...int64) {
+	if len(ids) == 0 {
+		return
+	}
+	where, args := idsClause("notification_id", ids)
+	if _, err := db.Exec(`DELETE FROM fanout_pending WHERE `+where, args...); err != nil {
+		log.Printf("deliveries: fan-out markers: %v", err)
+	}
+}
+
+// fanOut queues n for every push channel target that wants it.
+func fanOut(h *hub, n Notification) {
+	if fanOutVia(h, n, outChannels) == nil {
+		fannedOut(n.ID)
+	}
+}
+
+// startFanOutRecovery queues the deliveries of notifications whose fan-out
+// a killed process never got to.
+func startFanOutRecovery(h *hub) {
+	ticker := time.NewTicker(fanOutGrace)
+	for ; ; <-ticker.C {
+		if draining.Load() {
+			return
+		}
+		if err := recoverFanOut(h, fanOutGrace); err != nil {
+			log.Printf("deliveries: fan-out recovery: %v", err)
+		}
+	}
+}
+
+// recoverFanOut fans out the notifications whose marker is older than
+// grace, leaving alone those quiet hours hold. Claiming a marker renews it,
+// so another instance doesn't take it too, and a process killed while
+// recovering leaves it for the next pass.
+func recoverFanOut(h *hub, grace time.Duration) error {
+	now := time.Now()
+	rows, err := db.Query(`
+		UPDATE fanout_pending SET created_at = ?
+		WHERE created_at <= ? AND notification_id NOT IN (SELECT notification_id FROM quiet_held)
+		RETURNING notification_id`, sqliteTime(now), sqliteTime(now.Add(-grace)))
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	slices.Sort(ids)
+	for _, n := range loadNotifications(ids) {
+		fanOut(h, n)
+		log.Printf("deliveries: id=%d: queued after a restart", n.ID)
+	}
+	return nil
+}
+
+// deliveryJob is one queued send: a channel and the target it names.
+type deliveryJob struct{ channel, target string }
+
+// fanOutVia queues n for the targets of channels that want it. A channel
+// whose targets can't be listed fails the fan-out, after the other
+// channels' deliveries are queued, so the marker stays and recovery tries
+// again; the channels that did queue may then send twice.
+func fanOutVia(h *hub, n Notification, channels []outChannel) error {
+	var jobs []deliveryJob
+	var errs []error
+	for _, c := range channels {
+		if c.enabled != nil && !c.enabled() {
+			continue
+		}
+		targets, err := c.targets(h, n)
+		if err != nil {
+			log.Printf("%s: id=%d: %v", c.name, n.ID, err)
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+			continue
+		}
+		for _, t := range targets {
+			jobs = append(jobs, deliveryJob{c.name, t})
+		}
+	}
+	if err := queueDeliveries(n.ID, jobs); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// queueDeliveries adds jobs for notification id in one transaction and wakes
+// the dispatcher. A failure is logged as well as returned.
+func queueDeliveries(id int64, jobs []deliveryJob) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("deliveries: id=%d: %v", id, err)
+		return err
+	}
+	defer tx.Rollback()
+	for _, j := range jobs {
+		if _, err := tx.Exec(`INSERT INTO deliveries (notification_id, channel, target) VALUES (?, ?, ?)`,
+			id, j.channel, j.target); err != nil {
+			log.Printf("deliveries: id=%d: %v", id, err)
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("deliveries: id=%d: %v", id, err)
+		return err
+	}
+	pokeDeliveries()
+	return nil
+}
+
+func pokeDeliveries() {
+	select {
+	case deliveryPoke <- struct{}{}:
+	default:
+	}
+}
+
+// ── Dispatch ──
+
+type claimedDelivery struct {
+	id             int64
+	notificationID int64
+	channel        string
+	target         string
+	attempts       int
+}
+
+// startDeliveries starts the dispatcher and its workers. It stops claiming
+// once the process starts draining; what it hasn't claimed is left to the
+// new process.
+func startDeliveries() {
+	work := make(chan claimedDelivery)
+	for i := 0; i < deliveryWorkers; i++ {
+		go func() {
+			for d := range work {
+				runDelivery(d)
+			}
+		}()
+	}
+	go func() {
+		ticker := time.NewTicker(deliveryPoll)
+		defer ticker.Stop()
+		for !draining.Load() {
+			due, err := claimDeliveries(deliveryWorkers)
+			if err != nil {
+				log.Printf("deliveries: %v", err)
+			}
+			for _, d := range due {
+				work <- d
+			}
+			if len(due) < deliveryWorkers {
+				select {
+				case <-ticker.C:
+				case <-deliveryPoke:
+				}
+			}
+		}
+	}()
+}
+
+// claimDeliveries leases up to limit due deliveries, counting the attempt.
+func claimDeliveries(limit int) ([]claimedDelivery, error) {
+	now := time.Now()
+	rows, err := db.Query(`
+		UPDATE deliveries SET lease_until = ?, attempts = attempts + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id IN (
+			SELECT id FROM deliveries
+			WHERE state = 'pending' AND next_attempt_at <= ? AND (lease_until IS NULL OR lease_until < ?)
+			ORDER BY next_attempt_at, id LIMIT ?)
+		RETURNING id, notification_id, channel, target, attempts`,
+		sqliteTime(now.Add(deliveryLease)), sqliteTime(now), sqliteTime(now), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []claimedDelivery
+	for rows.Next() {
+		var d claimedDelivery
+		if err := rows.Scan(&d.id, &d.notificationID, &d.channel, &d.target, &d.attempts); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+func runDelivery(d claimedDelivery) {
+	c, ok := outChannelNamed(d.channel)
+	if !ok {
+		deadLetter(d, "", errors.New("channel not configured"))
+		return
+	}
+	n, err := getNotification(d.notificationID)
+	if err == sql.ErrNoRows {
+		deadLetter(d, "", errors.New("notification no longer stored"))
+		return
+	}
+	if err != nil {
+		retryDelivery(d, err)
+		return
+	}
+	start := time.Now()
+	err = c.deliver(d.target, n)
+	var de *deliveryError
+	switch {
+	case err == nil:
+		db.Exec(`UPDATE deliveries SET state = 'sent', lease_until = NULL, last_error = '', updated_at = CURRENT_TIMESTAMP WHERE id = ?`, d.id)
+		promMetrics.delivered([]string{n.Topic}, d.channel, start, 1, 0)
+	case errors.Is(err, errTargetGone):
+		db.Exec(`DELETE FROM deliveries WHERE id = ?`, d.id)
+		promMetrics.delivered([]string{n.Topic}, d.channel, start, 0, 1)
+	case errors.As(err, &de) && de.permanent, d.attempts >= *flagDeliveryAttempts:
+		deadLetter(d, n.Topic, err)
+	default:
+		retryDelivery(d, err)
+	}
+}
+
+// retryDelivery puts d back for a later attempt.
+func retryDelivery(d claimedDelivery, err error) {
+	wait := deliveryDelay(d.attempts)
+	var de *deliveryError
+	if errors.As(err, &de) && de.retryAfter > 0 {
+		wait = min(de.retryAfter, deliveryMaxDelay)
+	}
+	log.Printf("%s: delivery %d (attempt %d): %v; retrying in %s", d.channel, d.id, d.attempts, err, wait.Round(time.Second))
+	db.Exec(`UPDATE deliveries SET lease_until = NULL, next_attempt_at = ?, last_error = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		sqliteTime(time.Now().Add(wait)), err.Error(), d.id)
+}
+
+func deadLetter(d claimedDelivery, topic string, err error) {
+	log.Printf("%s: delivery %d dead after %d attempts: %v", d.channel, d.id, d.attempts, err)
+	db.Exec(`UPDATE deliveries SET state = 'dead', lease_until = NULL, last_error = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		err.Error(), d.id)
+	var topics []string
+	if topic != "" {
+		topics = []string{topic}
+	}
+	promMetrics.delivered(topics, d.channel, time.Now(), 0, 1)
+}
+
+// deliveryDelay is the backoff before attempt n+1: deliveryBackoff doubled
+// for each earlier attempt, capped at deliveryMaxDelay, give or take a fifth.
+func deliveryDelay(n int) time.Duration {
+	d := deliveryMaxDelay
+	if n <= 12 {
+		d = min(deliveryBackoff<<(n-1), deliveryMaxDelay)
+	}
+	return time.Duration(float64(d) * (0.8 + 0.4*rand.Float64()))
+}
+
+// ── Errors ──
+
+// errTargetGone is a channel saying its target no longer exists and has
+// been removed; the delivery is dropped.
+var errTargetGone = errors.New("target gone")
+
+// deliveryError says how a failed attempt is retried.
+type deliveryError struct {
+	err        error
+	permanent  bool          // dead-letter now; retrying won't help
+	retryAfter time.Duration // the service asked to wait this long
+}
+
+func (e *deliveryError) Error() string { return e.err.Error() }
+func (e *deliveryError) Unwrap() error { return e.err }
+
+// permanentError marks err as not worth retrying.
+func permanentError(err error) error { return &deliveryError{err: err, permanent: true} }
+
+// httpDeliveryError classifies a failed response: 408, 429 and 5xx are
+// retried, after Retry-After if the service sent one; any other 4xx is
+// permanent.
+func httpDeliveryError(resp *http.Response, detail string) error {
+	err := errors.New(resp.Status)
+	if detail != "" {
+		err = fmt.Errorf("%s: %s", resp.Status, detail)
+	}
+	switch code := resp.StatusCode; {
+	case code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500:
+		secs, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return &deliveryError{err: err, retryAfter: time.Duration(max(secs, 0)) * time.Second}
+	case code >= 400:
+		return permanentError(err)
+	}
+	return err
+}
+
+// ── Pruning ──
+
+func deliveryPruneJob(keepDead time.Duration) *schedJob {
+	return &schedJob{
+		name:     "delivery-prune",
+		interval: time.Hour,
+		run: func() error {
+			now := time.Now()
+			res, err := db.Exec(`DELETE FROM deliveries WHERE (state = 'sent' AND updated_at < ?) OR (state = 'dead' AND updated_at < ?)`,
+				sqliteTime(now.Add(-deliverySentTTL)), sqliteTime(now.Add(-keepDead)))
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				log.Printf("deliveries: pruned %d", n)
+			}
+			_, err = db.Exec(`DELETE FROM ws_deliveries WHERE at < ?`, sqliteTime(now.Add(-wsDeliveryTTL)))
+			return err
+		},
+	}
+}
+
+// ── Handlers ──
+
+type delivery struct {
+	ID             int64   `json:"id"`
+	NotificationID int64   `json:"notification_id"`
+	Channel        string  `json:"channel"`
+	Target         string  `json:"target"`
+	State          string  `json:"state"`
+	Attempts       int     `json:"attempts"`
+	NextAttemptAt  *string `json:"next_attempt_at,omitempty"`
+	LastError      string  `json:"last_error,omitempty"`
+	CreatedAt      string  `json:"created_at"`
+	UpdatedAt      string  `json:"updated_at"`
+}
+
+const deliveryCols = `id, notification_id, channel, target, state, attempts, next_attempt_at, last_error, created_at, updated_at`
+
+func scanDelivery(s scanner) (delivery, error) {
+	var d delivery
+	var next string
+	err := s.Scan(&d.ID, &d.NotificationID, &d.Channel, &d.Target, &d.State, &d.Attempts, &next, &d.LastError, &d.CreatedAt, &d.UpdatedAt)
+	if d.State == deliveryPending {
+		d.NextAttemptAt = &next
+	}
+	return d, err
+}
+
+// handleDeliveries lists deliveries newest first, optionally by ?state= and
+// ?channel=, with the number in each state per channel.
+func handleDeliveries() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		state, channel := q.Get("state"), q.Get("channel")
+		switch state {
+		case "", deliveryPending, deliverySent, deliveryDead:
+		default:
+			http.Error(w, "state must be pending, sent or dead", http.StatusBadRequest)
+			return
+		}
+		limit := deliveryListLimit
+		if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 {
+			limit = min(n, deliveryMaxLimit)
+		}
+		before := int64(1<<63 - 1)
+		if n, err := strconv.ParseInt(q.Get("before"), 10, 64); err == nil && n > 0 {
+			before = n
+		}
+		rows, err := db.Query(`SELECT `+deliveryCols+` FROM deliveries
+			WHERE id < ? AND (? = '' OR state = ?) AND (? = '' OR channel = ?)
+			ORDER BY id DESC LIMIT ?`, before, state, state, channel, channel, limit)
+		if err != nil {
+			log.Printf("deliveries: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		out := []delivery{}
+		for rows.Next() {
+			d, err := scanDelivery(rows)
+			if err != nil {
+				log.Printf("deliveries: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, d)
+		}
+		counts, err := deliveryCounts()
+		if err != nil {
+			log.Printf("deliveries: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"counts": counts, "deliveries": out})
+	}
+}
+
+// deliveryCounts is the number of deliveries per channel and state.
+func deliveryCounts() (map[string]map[string]int, error) {
+	rows, err := db.Query(`SELECT channel, state, COUNT(*) FROM deliveries GROUP BY channel, state`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[string]map[string]int{}
+	for rows.Next() {
+		var channel, state string
+		var n int
+		if err := rows.Scan(&channel, &state, &n); err != nil {
+			return nil, err
+		}
+		if out[channel] == nil {
+			out[channel] = map[string]int{}
+		}
+		out[channel][state] = n
+	}
+	return out, rows.Err()
+}
+
+// handleDelivery shows (GET) or discards (DELETE) one delivery.
+func handleDelivery() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			d, err := scanDelivery(db.QueryRow(`SELECT `+deliveryCols+` FROM deliveries WHERE id = ?`, id))
+			if err == sql.ErrNoRows {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Printf("delivery %d: %v", id, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(d)
+		case http.MethodDelete:
+			res, err := db.Exec(`DELETE FROM deliveries WHERE id = ?`, id)
+			if err != nil {
+				log.Printf("delivery %d: %v", id, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			audit(authFrom(r).ID, "delivery.delete", strconv.FormatInt(id, 10), "")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleDeliveryRetry queues a dead delivery again with fresh attempts.
+func handleDeliveryRetry() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		d, err := scanDelivery(db.QueryRow(`
+			UPDATE deliveries SET state = 'pending', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP,
+				lease_until = NULL, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ? AND state = 'dead' RETURNING `+deliveryCols, id))
+		if err == sql.ErrNoRows {
+			http.Error(w, "no dead delivery with that id", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("delivery %d: %v", id, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		audit(authFrom(r).ID, "delivery.retry", strconv.FormatInt(id, 10), d.Channel)
+		pokeDeliveries()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d)
+	}
+}
+
+// ── Dead Letters ──
+
+// deadLetterEntry is a notification with the deliveries of it that died.
+type deadLetterEntry struct {
+	NotificationID int64      `json:"notification_id"`
+	Title          string     `json:"title,omitempty"`
+	Topic          string     `json:"topic,omitempty"`
+	Priority       int        `json:"priority,omitempty"`
+	CreatedAt      string     `json:"created_at,omitempty"`
+	Deleted        bool       `json:"deleted,omitempty"` // the notification is no longer stored
+	Failures       []delivery `json:"failures"`
+}
+
+// deadLetters collects the dead deliveries of the given notifications.
+func deadLetters(ids []int64) ([]deadLetterEntry, error) {
+	out := make([]deadLetterEntry, 0, len(ids))
+	if len(ids) == 0 {
+		return out, nil
+	}
+	args := make([]any, len(ids))
+	index := map[int64]int{}
+	for i, id := range ids {
+		args[i] = id
+		index[id] = i
+		e := deadLetterEntry{NotificationID: id, Failures: []delivery{}}
+		n, err := getNotification(id)
+		switch {
+		case err == sql.ErrNoRows:
+			e.Deleted = true
+		case err != nil:
+			return nil, err
+		default:
+			e.Title, e.Topic, e.Priority, e.CreatedAt = n.Title, n.Topic, n.Priority, n.CreatedAt
+		}
+		out = append(out, e)
+	}
+	rows, err := db.Query(`SELECT `+deliveryCols+` FROM deliveries
+		WHERE state = 'dead' AND notification_id IN (`+placeholders(len(ids))+`) ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		e := &out[index[d.NotificationID]]
+		e.Failures = append(e.Failures, d)
+	}
+	return out, rows.Err()
+}
+
+// handleDeadLetters lists notifications with dead deliveries, newest first
+// (?limit=, ?before=<notification id>).
+func handleDeadLetters() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limit := deliveryListLimit
+		if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+			limit = min(n, deliveryMaxLimit)
+		}
+		before := int64(1<<63 - 1)
+		if n, err := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64); err == nil && n > 0 {
+			before = n
+		}
+		rows, err := db.Query(`SELECT DISTINCT notification_id FROM deliveries
+			WHERE state = 'dead' AND notification_id < ? ORDER BY notification_id DESC LIMIT ?`, before, limit)
+		if err != nil {
+			log.Printf("deadletter: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			if rows.Scan(&id) == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+		out, err := deadLetters(ids)
+		if err != nil {
+			log.Printf("deadletter: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// handleDeadLetter shows (GET) or discards (DELETE) a notification's dead
+// deliveries.
+func handleDeadLetter() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			out, err := deadLetters([]int64{id})
+			if err != nil {
+				log.Printf("deadletter %d: %v", id, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if len(out[0].Failures) == 0 {
+				http.Error(w, "no dead deliveries for that notification", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(out[0])
+		case http.MethodDelete:
+			res, err := db.Exec(`DELETE FROM deliveries WHERE notification_id = ? AND state = 'dead'`, id)
+			if err != nil {
+				log.Printf("deadletter %d: %v", id, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			n, _ := res.RowsAffected()
+			if n == 0 {
+				http.Error(w, "no dead deliveries for that notification", http.StatusNotFound)
+				return
+			}
+			audit(authFrom(r).ID, "deadletter.discard", strconv.FormatInt(id, 10), "")
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]int64{"discarded": n})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleDeadLetterRetry queues every dead delivery of a notification again
+// with fresh attempts.
+func handleDeadLetterRetry() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		res, err := db.Exec(`
+			UPDATE deliveries SET state = 'pending', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP,
+				lease_until = NULL, updated_at = CURRENT_TIMESTAMP
+			WHERE notification_id = ? AND state = 'dead'`, id)
+		if err != nil {
+			log.Printf("deadletter %d: %v", id, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		n, _ := res.RowsAffected()
+		if n == 0 {
+			http.Error(w, "no dead deliveries for that notification", http.StatusNotFound)
+			return
+		}
+		audit(authFrom(r).ID, "deadletter.retry", strconv.FormatInt(id, 10), strconv.FormatInt(n, 10)+" deliveries")
+		pokeDeliveries()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int64{"requeued": n})
+	}
+}
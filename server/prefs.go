@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// ── Device Preferences ────────────────────────────────────────────────────────
+//
+// A device can keep its filters on the server instead of throwing away
+// broadcasts it doesn't want: PUT /devices/{device}/preferences mutes topics,
+// sets a minimum priority and a nightly quiet window. The hub applies them to
+// each client connected with that ?device= before a notification frame is
+// queued for it, so a muted topic costs the device neither the bytes nor the
+// wake-up. The catch-up a resuming client gets is filtered the same way.
+//
+// Preferences shape live delivery only. /history, the history frame on
+// connect and the push channels still have everything, and what a device
+// skipped during its quiet hours is not sent when they end. The window is in
+// the server's local time, like the server's own quiet hours; notifications
+// that require an ack go through it. A change reaches the device's open
+// connections at once, on every instance sharing the database.
+
+type devicePrefs struct {
+	MutedTopics []string    `json:"muted_topics"`
+	MinPriority int         `json:"min_priority"` // 0: every priority
+	QuietHours  *quietHours `json:"quiet_hours,omitempty"`
+	UpdatedBy   string      `json:"updated_by,omitempty"`
+	UpdatedAt   string      `json:"updated_at,omitempty"`
+}
+
+func initDevicePrefsTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS device_prefs (
+			device TEXT PRIMARY KEY,
+			body   TEXT NOT NULL
+		)
+	`)
+	return err
+}
+
+// loadDevicePrefs returns device's preferences, or nil if it has none.
+func loadDevicePrefs(device string) (*devicePrefs, error) {
+	if device == "" {
+		return nil, nil
+	}
+	var body string
+	err := db.QueryRow(`SELECT body FROM device_prefs WHERE device = ?`, device).Scan(&body)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var p devicePrefs
+	if err := json.Unmarshal([]byte(body), &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// check validates p, defaulting its quiet hours' min_priority like the
+// server's.
+func (p *devicePrefs) check() error {
+	if p.MutedTopics == nil {
+		p.MutedTopics = []string{}
+	}
+	if slices.Contains(p.MutedTopics, "") {
+		return fmt.Errorf("muted_topics must not contain an empty topic")
+	}
+	if p.MinPriority != 0 && (p.MinPriority < priorityMin || p.MinPriority > priorityUrgent) {
+		return fmt.Errorf("min_priority must be %d-%d", priorityMin, priorityUrgent)
+	}
+	if p.QuietHours != nil {
+		if err := p.QuietHours.check(); err != nil {
+			return fmt.Errorf("quiet_hours: %w", err)
+		}
+	}
+	return nil
+}
+
+// allows reports whether a frame about n goes to the device at at.
+func (p *devicePrefs) allows(n Notification, at time.Time) bool {
+	switch {
+	case slices.Contains(p.MutedTopics, n.Topic):
+		return false
+	case n.Priority < p.MinPriority:
+		return false
+	case p.QuietHours != nil && !n.RequireAck && n.Priority < p.QuietHours.MinPriority && p.QuietHours.active(at):
+		return false
+	}
+	return true
+}
+
+// wants reports whether c's device preferences let a frame about n through
+// now; wantsAt, at at.
+func (c *client) wants(n Notification) bool { return c.wantsAt(n, time.Now()) }
+
+func (c *client) wantsAt(n Notification, at time.Time) bool {
+	p := c.prefs.Load()
+	return p == nil || p.allows(n, at)
+}
+
+// wanted returns the notes c wants, in order.
+func (c *client) wanted(notes []Notification) []Notification {
+	if c.prefs.Load() == nil {
+		return notes
+	}
+	var out []Notification
+	for _, n := range notes {
+		if c.wants(n) {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// setDevicePrefs applies p to device's connected clients and returns how
+// many there are.
+func (h *hub) setDevicePrefs(device string, p *devicePrefs) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n := 0
+	for c := range h.clients {
+		if c.device == device {
+			c.prefs.Store(p)
+			n++
+		}
+	}
+	return n
+}
+
+// reloadDevicePrefs applies device's stored preferences to its clients.
+func reloadDevicePrefs(h *hub, device string) {
+	p, err := loadDevicePrefs(device)
+	if err != nil {
+		log.Printf("device prefs %q: %v", device, err)
+		return
+	}
+	h.setDevicePrefs(device, p)
+}
+
+// handleDevicePrefs shows (GET), replaces (PUT) or removes (DELETE) a
+// device's preferences.
+func handleDevicePrefs(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		device, by := r.PathValue("device"), authFrom(r).ID
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var p devicePrefs
+			if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			if err := p.check(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			p.UpdatedBy, p.UpdatedAt = by, time.Now().UTC().Format(time.RFC3339)
+			body, _ := json.Marshal(p)
+			if _, err := db.Exec(`INSERT INTO device_prefs (device, body) VALUES (?, ?)
+				ON CONFLICT(device) DO UPDATE SET body = excluded.body`, device, string(body)); err != nil {
+				log.Printf("device prefs %q: %v", device, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			n := h.setDevicePrefs(device, &p)
+			busPublish(busEvent{Kind: busKindPrefs, Device: device})
+			log.Printf("device prefs %q: set by %s; %d clients connected", device, by, n)
+		case http.MethodDelete:
+			res, err := db.Exec(`DELETE FROM device_prefs WHERE device = ?`, device)
+			if err != nil {
+				log.Printf("device prefs %q: %v", device, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(w, "no preferences set", http.StatusNotFound)
+				return
+			}
+			h.setDevicePrefs(device, nil)
+			busPublish(busEvent{Kind: busKindPrefs, Device: device})
+			log.Printf("device prefs %q: removed by %s", device, by)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		p, err := loadDevicePrefs(device)
+		if err != nil {
+			log.Printf("device prefs %q: %v", device, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if p == nil {
+			http.Error(w, "no preferences set", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p)
+	}
+}
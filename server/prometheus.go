@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ── Prometheus Metrics ────────────────────────────────────────────────────────
+//
+// GET /metrics (read scope) serves counters in the Prometheus text format, so
+// a dashboard can break delivery health down by topic and channel without
+// scraping logs. Notifications stored and failed to store are counted per
+// topic; frames handed to clients, frames dropped for slow clients and the
+// time between a notification being stored and its frame reaching a client's
+// send buffer are counted per topic and delivery channel: "websocket", or
+// a push channel ("webpush", "apns", "discord", "slack", "pushover"), timed
+// from when the push was sent.
+//
+// Topics are label values, so they are capped: the first --metrics-max-topics
+// topics seen since start get their own series, later ones are counted under
+// topic="_other". --metrics-labels adds constant labels (env, region, …) to
+// every series, for setups whose service discovery doesn't add them.
+
+const (
+	metricsOtherTopic = "_other"
+	channelWebSocket  = "websocket"
+	channelWebPush    = "webpush"
+	channelAPNs       = "apns"
+	channelPushover   = "pushover"
+	channelEscalation = "pushover-emergency"
+	channelNATS       = "nats"
+	channelFederation = "federation"
+)
+
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+type deliveryKey struct{ topic, channel string }
+
+type deliverySeries struct {
+	sends, failures int64
+	buckets         []int64 // cumulative counts per latencyBuckets
+	count           int64
+	sum             float64
+}
+
+type topicMetrics struct {
+	mu        sync.Mutex
+	topics    map[string]bool // topics with series of their own
+	published map[string]int64
+	failed    map[string]int64
+	delivery  map[deliveryKey]*deliverySeries
+	folded    int64 // events counted under _other
+}
+
+var promMetrics = topicMetrics{
+	topics:    map[string]bool{},
+	published: map[string]int64{},
+	failed:    map[string]int64{},
+	delivery:  map[deliveryKey]*deliverySeries{},
+}
+
+// metricsLabels holds --metrics-labels, rendered once as `k="v",`.
+var metricsLabels string
+
+// label returns the series topic and caps the number of them. Caller holds mu.
+func (m *topicMetrics) label(topic string) string {
+	if m.topics[topic] {
+		return topic
+	}
+	if len(m.topics) < *flagMetricsTopics {
+		m.topics[topic] = true
+		return topic
+	}
+	m.folded++
+	return metricsOtherTopic
+}
+
+// stored counts a notification published, or failed to publish when err is set.
+func (m *topicMetrics) stored(topic string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.failed[m.label(topic)]++
+	} else {
+		m.published[m.label(topic)]++
+	}
+}
+
+// delivered counts one frame fanned out to sent clients and dropped for
+// dropped more. Frames for several notifications count for each topic.
+func (m *topicMetrics) delivered(topics []string, channel string, since time.Time, sent, dropped int) {
+	if sent == 0 && dropped == 0 {
+		return
+	}
+	secs := time.Since(since).Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, topic := range topics {
+		k := deliveryKey{m.label(topic), channel}
+		s := m.delivery[k]
+		if s == nil {
+			s = &deliverySeries{buckets: make([]int64, len(latencyBuckets))}
+			m.delivery[k] = s
+		}
+		s.sends += int64(sent)
+		s.failures += int64(dropped)
+		for i, le := range latencyBuckets {
+			if secs <= le {
+				s.buckets[i] += int64(sent)
+			}
+		}
+		s.count += int64(sent)
+		s.sum += secs * float64(sent)
+	}
+}
+
+// parseMetricsLabels checks --metrics-labels and renders it for every series.
+func parseMetricsLabels(s string) (string, error) {
+	kv, err := parseHeaders(s)
+	if err != nil {
+		return "", err
+	}
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		if !validLabelName(k) || k == "topic" || k == "channel" || k == "le" || k == "window" {
+			return "", fmt.Errorf("%q is not a usable label name", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%s,", k, labelValue(kv[k]))
+	}
+	return b.String(), nil
+}
+
+func validLabelName(s string) bool {
+	for i, r := range s {
+		if r != '_' && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (i == 0 || r < '0' || r > '9') {
+			return false
+		}
+	}
+	return s != "" && !strings.HasPrefix(s, "__")
+}
+
+func handleMetrics(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var unseen int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM notifications WHERE seen_at IS NULL AND snoozed_until IS NULL`).Scan(&unseen); err != nil {
+			log.Printf("metrics: unseen count: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		counts, err := deliveryCounts()
+		if err != nil {
+			log.Printf("metrics: delivery counts: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		var b strings.Builder
+		series := func(name, labels string, v any) {
+			if labels = strings.TrimSuffix(metricsLabels+labels, ","); labels != "" {
+				name += "{" + labels + "}"
+			}
+			fmt.Fprintf(&b, "%s %v\n", name, v)
+		}
+		help := func(name, typ, text string) {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, text, name, typ)
+		}
+
+		help("andrnoti_ws_clients", "gauge", "Connected WebSocket clients.")
+		series("andrnoti_ws_clients", "", h.connectedCount())
+		help("andrnoti_unseen_notifications", "gauge", "Notifications neither seen nor snoozed.")
+		series("andrnoti_unseen_notifications", "", unseen)
+		help("andrnoti_broadcast_queued", "gauge", "Frames waiting in the hub broadcast queue.")
+		series("andrnoti_broadcast_queued", "", len(h.bcast))
+		help("andrnoti_dead_letters", "gauge", "Push deliveries that gave up, by channel.")
+		for _, channel := range sortedKeys(counts) {
+			series("andrnoti_dead_letters", "channel="+labelValue(channel)+",", counts[channel][deliveryDead])
+		}
+		if st := currentSLO(); st != nil {
+			burning := 0
+			if st.Burning {
+				burning = 1
+			}
+			help("andrnoti_slo_compliance_ratio", "gauge", "Share of sends over --slo-window that met the objective.")
+			series("andrnoti_slo_compliance_ratio", "", st.Compliance)
+			help("andrnoti_slo_budget_remaining_ratio", "gauge", "Share of the SLO error budget left; negative once overspent.")
+			series("andrnoti_slo_budget_remaining_ratio", "", st.BudgetRemaining)
+			help("andrnoti_slo_burn_rate", "gauge", "How many times faster than sustainable the error budget is burning.")
+			series("andrnoti_slo_burn_rate", `window="1h",`, st.BurnRate1h)
+			series("andrnoti_slo_burn_rate", `window="5m",`, st.BurnRate5m)
+			help("andrnoti_slo_burning", "gauge", "1 while a budget burn alert is open.")
+			series("andrnoti_slo_burning", "", burning)
+		}
+
+		m := &promMetrics
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		counters := func(name, text string, values map[string]int64) {
+			help(name, "counter", text)
+			for _, t := range sortedKeys(values) {
+				series(name, topicLabel(t), values[t])
+			}
+		}
+		counters("andrnoti_notifications_published_total", "Notifications stored and broadcast, by topic.", m.published)
+		counters("andrnoti_notifications_failed_total", "Notifications that could not be stored, by topic.", m.failed)
+
+		keys := make([]deliveryKey, 0, len(m.delivery))
+		for k := range m.delivery {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].topic != keys[j].topic {
+				return keys[i].topic < keys[j].topic
+			}
+			return keys[i].channel < keys[j].channel
+		})
+		labels := func(k deliveryKey) string {
+			return topicLabel(k.topic) + "channel=" + labelValue(k.channel) + ","
+		}
+		help("andrnoti_sends_total", "counter", "Notification frames handed to clients, by topic and channel.")
+		for _, k := range keys {
+			series("andrnoti_sends_total", labels(k), m.delivery[k].sends)
+		}
+		help("andrnoti_send_failures_total", "counter", "Notification frames dropped for slow clients, by topic and channel.")
+		for _, k := range keys {
+			series("andrnoti_send_failures_total", labels(k), m.delivery[k].failures)
+		}
+		help("andrnoti_send_latency_seconds", "histogram", "Time from a notification being stored to its frame reaching a client's send buffer.")
+		for _, k := range keys {
+			s := m.delivery[k]
+			for i, le := range latencyBuckets {
+				series("andrnoti_send_latency_seconds_bucket", labels(k)+`le="`+strconv.FormatFloat(le, 'g', -1, 64)+`",`, s.buckets[i])
+			}
+			series("andrnoti_send_latency_seconds_bucket", labels(k)+`le="+Inf",`, s.count)
+			series("andrnoti_send_latency_seconds_sum", labels(k), s.sum)
+			series("andrnoti_send_latency_seconds_count", labels(k), s.count)
+		}
+		help("andrnoti_metrics_topics", "gauge", "Topics with series of their own (at most --metrics-max-topics).")
+		series("andrnoti_metrics_topics", "", len(m.topics))
+		help("andrnoti_metrics_folded_total", "counter", `Events counted under topic="_other" because the topic cap was reached.`)
+		series("andrnoti_metrics_folded_total", "", m.folded)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write([]byte(b.String()))
+	}
+}
+
+func topicLabel(topic string) string { return "topic=" + labelValue(topic) + "," }
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue quotes a label value the way the text format wants it.
+func labelValue(s string) string { return `"` + labelEscaper.Replace(s) + `"` }
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
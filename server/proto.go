@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+// ── Protobuf Frames ───────────────────────────────────────────────────────────
+//
+// A client that offers the WebSocket subprotocol andrnoti.v1+proto gets every
+// frame as a binary protobuf ServerMessage instead of JSON text: smaller and
+// cheaper to parse, which adds up for a phone on mobile data receiving a
+// history snapshot. The schema is generated from the api types, like the
+// JSON Schema: GET /schema/andrnoti.proto, or andr-noti gen-clients -proto.
+// Field numbers are the api structs' proto tags, which never change.
+//
+// The server builds frames as JSON either way; a proto connection's writer
+// transcodes each one, so the hub and everything feeding it are unaware of
+// the difference. The client may send binary ClientMessages or JSON text.
+//
+// Strings, bools and integers map to their proto3 scalars (Go int is
+// int32). Pointers to scalars are optional fields, so a null seen_at stays
+// distinct from an empty one; pointers to structs are messages. Slices are
+// repeated fields, packed for numbers. ClientConfig's free-form extra is a
+// JSON-encoded string.
+
+const (
+	wsProtoSubprotocol = "andrnoti.v1+proto"
+	protoPackage       = "andrnoti.v1"
+)
+
+// Protobuf wire types.
+const (
+	protoVarint = 0
+	protoI64    = 1
+	protoLen    = 2
+	protoI32    = 5
+)
+
+// protoFrame transcodes a JSON server frame into a protobuf ServerMessage.
+func protoFrame(data []byte) ([]byte, error) {
+	var m wsMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return protoMarshal(m), nil
+}
+
+// protoMarshal encodes a struct with proto-tagged fields.
+func protoMarshal(v any) []byte {
+	return appendProtoStruct(nil, reflect.ValueOf(v))
+}
+
+func protoNum(f reflect.StructField) int {
+	n, _ := strconv.Atoi(f.Tag.Get("proto"))
+	return n
+}
+
+func appendProtoStruct(b []byte, v reflect.Value) []byte {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if num := protoNum(t.Field(i)); num > 0 {
+			b = appendProtoField(b, num, v.Field(i), false)
+		}
+	}
+	return b
+}
+
+func appendProtoTag(b []byte, num, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(num)<<3|uint64(wire))
+}
+
+func appendProtoBytes(b []byte, num int, data []byte) []byte {
+	b = appendProtoTag(b, num, protoLen)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// appendProtoField encodes v as field num. Zero values are left out, as
+// proto3 does, unless present says the field was set (an optional field or
+// a repeated element).
+func appendProtoField(b []byte, num int, v reflect.Value, present bool) []byte {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return b
+		}
+		return appendProtoField(b, num, v.Elem(), true)
+	case reflect.String:
+		if v.Len() == 0 && !present {
+			return b
+		}
+		return appendProtoBytes(b, num, []byte(v.String()))
+	case reflect.Bool:
+		if !v.Bool() && !present {
+			return b
+		}
+		b = appendProtoTag(b, num, protoVarint)
+		if v.Bool() {
+			return append(b, 1)
+		}
+		return append(b, 0)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		if v.Int() == 0 && !present {
+			return b
+		}
+		b = appendProtoTag(b, num, protoVarint)
+		return binary.AppendUvarint(b, uint64(v.Int()))
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return b
+		}
+		switch v.Type().Elem().Kind() {
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			var packed []byte
+			for i := 0; i < v.Len(); i++ {
+				packed = binary.AppendUvarint(packed, uint64(v.Index(i).Int()))
+			}
+			return appendProtoBytes(b, num, packed)
+		}
+		for i := 0; i < v.Len(); i++ {
+			b = appendProtoField(b, num, v.Index(i), true)
+		}
+		return b
+	case reflect.Map:
+		if v.Len() == 0 {
+			return b
+		}
+		data, _ := json.Marshal(v.Interface())
+		return appendProtoBytes(b, num, data)
+	case reflect.Struct:
+		return appendProtoBytes(b, num, appendProtoStruct(nil, v))
+	}
+	return b
+}
+
+// protoUnmarshal decodes data into the struct ptr points to. Only scalar
+// and repeated string fields are filled in, which is all a ClientMessage
+// has; anything else is skipped.
+func protoUnmarshal(data []byte, ptr any) error {
+	v := reflect.ValueOf(ptr).Elem()
+	fields := map[uint64]reflect.Value{}
+	for i := 0; i < v.NumField(); i++ {
+		if num := protoNum(v.Type().Field(i)); num > 0 {
+			fields[uint64(num)] = v.Field(i)
+		}
+	}
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("proto: bad field key")
+		}
+		data = data[n:]
+		f, known := fields[key>>3]
+		switch key & 7 {
+		case protoVarint:
+			x, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("proto: bad varint")
+			}
+			data = data[n:]
+			switch {
+			case !known:
+			case f.Kind() == reflect.Bool:
+				f.SetBool(x != 0)
+			case f.CanInt():
+				f.SetInt(int64(x))
+			}
+		case protoLen:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return errors.New("proto: bad length")
+			}
+			s := string(data[n : n+int(l)])
+			switch {
+			case !known:
+			case f.Kind() == reflect.String:
+				f.SetString(s)
+			case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String:
+				f.Set(reflect.Append(f, reflect.ValueOf(s)))
+			}
+			data = data[n+int(l):]
+		case protoI64, protoI32:
+			size := 8
+			if key&7 == protoI32 {
+				size = 4
+			}
+			if len(data) < size {
+				return errors.New("proto: truncated field")
+			}
+			data = data[size:]
+		default:
+			return fmt.Errorf("proto: unsupported wire type %d", key&7)
+		}
+	}
+	return nil
+}
+
+// handleProtoSchema serves the .proto for proto clients.
+func handleProtoSchema() http.HandlerFunc {
+	schema := genProto()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(schema)
+	}
+}
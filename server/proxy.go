@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ── Trusted Proxies ───────────────────────────────────────────────────────────
+//
+// Behind nginx every request arrives from 127.0.0.1. When the direct peer is a
+// trusted proxy, the real client is the right-most X-Forwarded-For entry that
+// isn't itself a trusted proxy (entries further left are client-supplied and
+// can't be believed); if every entry is trusted, the left-most one is as far
+// as the chain can be followed. X-Real-IP is read only when there is no
+// X-Forwarded-For at all, since a proxy that appends to X-Forwarded-For may
+// pass a client's own X-Real-IP through untouched.
+
+var trustedProxies []*net.IPNet
+
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, s := range splitList(list) {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", s, err)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the real client for r.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !ipInNets(peer, trustedProxies) {
+		return host
+	}
+
+	xff := r.Header.Values("X-Forwarded-For")
+	if len(xff) == 0 {
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+			return ip.String()
+		}
+		return host
+	}
+	hops := strings.Split(strings.Join(xff, ","), ",")
+	client := host
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break // garbage: stop at the last hop we could trust
+		}
+		client = ip.String()
+		if !ipInNets(ip, trustedProxies) {
+			break
+		}
+	}
+	return client
+}
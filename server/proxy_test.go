@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	saved := trustedProxies
+	trustedProxies, _ = parseCIDRs("127.0.0.1,10.0.0.0/8")
+	t.Cleanup(func() { trustedProxies = saved })
+
+	for _, tc := range []struct {
+		name, peer, xff, realIP, want string
+	}{
+		{"direct", "203.0.113.5:1234", "", "", "203.0.113.5"},
+		{"untrusted peer's headers ignored", "203.0.113.5:1234", "198.51.100.1", "198.51.100.2", "203.0.113.5"},
+		{"forwarded", "127.0.0.1:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"forged left of the client", "127.0.0.1:1234", "192.0.2.66, 198.51.100.1, 10.0.0.2", "", "198.51.100.1"},
+		{"X-Real-IP without X-Forwarded-For", "127.0.0.1:1234", "", "198.51.100.1", "198.51.100.1"},
+		{"forged X-Real-IP", "127.0.0.1:1234", "198.51.100.1", "192.0.2.66", "198.51.100.1"},
+		{"forged X-Real-IP, all hops trusted", "127.0.0.1:1234", "10.0.0.3, 10.0.0.2", "192.0.2.66", "10.0.0.3"},
+		{"garbage hop", "127.0.0.1:1234", "nonsense, 10.0.0.2", "192.0.2.66", "10.0.0.2"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.peer
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if tc.realIP != "" {
+			r.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if got := clientIP(r); got != tc.want {
+			t.Errorf("%s: clientIP = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
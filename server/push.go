@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// ── Push Channels ─────────────────────────────────────────────────────────────
+//
+// Besides WebSocket clients, each new notification goes out through the push
+// channels — Web Push to browsers, APNs to iOS devices, the chat connectors,
+// the Pushover fallback, NATS and federation peers. Those send through the
+// delivery queue, so a slow push service never holds up a broadcast. What
+// else they share lives here: the filter every subscription carries, fitting
+// the text into a size-limited payload, and ES256 token signing.
+
+// pushFilter picks the notifications a push subscription gets.
+type pushFilter struct {
+	User        string   `json:"user,omitempty"`
+	Topics      []string `json:"topics,omitempty"`
+	MinPriority int      `json:"min_priority"`
+}
+
+// check fills in the default minimum priority and validates it.
+func (f *pushFilter) check() error {
+	if f.MinPriority == 0 {
+		f.MinPriority = priorityMin
+	}
+	if f.MinPriority < priorityMin || f.MinPriority > priorityUrgent {
+		return fmt.Errorf("min_priority must be %d-%d", priorityMin, priorityUrgent)
+	}
+	return nil
+}
+
+func (f pushFilter) wants(n Notification) bool {
+	return n.Priority >= f.MinPriority &&
+		(len(f.Topics) == 0 || slices.Contains(f.Topics, n.Topic)) &&
+		canSee(f.User, n.Topic)
+}
+
+// pushTargets keeps the subscriptions that want n. As with WebSocket
+// clients, an assigned notification goes only to the assignee's
+// subscriptions if there are any.
+func pushTargets[T any](n Notification, subs []T, filter func(T) pushFilter) []T {
+	subs = slices.DeleteFunc(subs, func(s T) bool { return !filter(s).wants(n) })
+	if n.Assignee != "" && slices.ContainsFunc(subs, func(s T) bool { return filter(s).User == n.Assignee }) {
+		subs = slices.DeleteFunc(subs, func(s T) bool { return filter(s).User != n.Assignee })
+	}
+	return subs
+}
+
+// fitPayload renders a payload with render, cutting text until the result
+// is at most max bytes. JSON escaping can make text longer than it is, so
+// it may take more than one cut.
+func fitPayload(text string, max int, render func(text string) []byte) []byte {
+	data := render(text)
+	for len(data) > max && text != "" {
+		limit := len(text) - (len(data) - max)
+		if limit <= 0 {
+			limit = len(text) * max / len(data)
+		}
+		if text = fitBytes(text, limit); limit == 0 {
+			text = ""
+		}
+		data = render(text)
+	}
+	return data
+}
+
+// signES256 returns a JWT with the given header fields and claims, signed
+// with key.
+func signES256(key *ecdsa.PrivateKey, header map[string]string, claims map[string]any) (string, error) {
+	header["alg"] = "ES256"
+	head, _ := json.Marshal(header)
+	body, _ := json.Marshal(claims)
+	signing := base64.RawURLEncoding.EncodeToString(head) + "." + base64.RawURLEncoding.EncodeToString(body)
+	sum := sha256.Sum256([]byte(signing))
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	if err != nil {
+		return "", err
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signing + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ── Pushover ──────────────────────────────────────────────────────────────────
+//
+// Pushover is the fallback for when the phone isn't connected: with
+// --pushover-token-file and --pushover-user, a notification of at least
+// --pushover-min-priority that no connected WebSocket client would receive
+// is relayed to Pushover as well. Whether anyone is online is decided when
+// the notification is published, with the same recipients as its broadcast.
+//
+// Priorities map onto Pushover's: 5 is an emergency, repeated every
+// --pushover-retry until acknowledged in Pushover or --pushover-expire
+// passes; 4 is high (bypasses quiet hours), 3 normal, 2 quiet and 1 lowest.
+// Marking the notification seen in andrNoti cancels the emergency retries,
+// so acknowledging on another device stops the repeats too.
+
+const (
+	pushoverAPI      = "https://api.pushover.net/1"
+	pushoverTimeout  = 10 * time.Second
+	pushoverMaxTitle = 250
+	pushoverMaxText  = 1024
+	pushoverMaxURL   = 512
+)
+
+var (
+	pushoverToken string
+	pushoverHTTP  = &http.Client{Timeout: pushoverTimeout}
+)
+
+func initPushoverTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS pushover_receipts (
+			notification_id INTEGER PRIMARY KEY,
+			receipt         TEXT NOT NULL,
+			expires_at      DATETIME NOT NULL
+		)
+	`)
+	return err
+}
+
+// loadPushover reads the app token and checks the other flags. Pushover
+// stays off without a token.
+func loadPushover() error {
+	token, err := loadToken(*flagPushoverToken, "")
+	if err != nil || token == "" {
+		return err
+	}
+	switch {
+	case *flagPushoverUser == "":
+		return fmt.Errorf("--pushover-user is required with --pushover-token-file")
+	case *flagPushoverRetry < 30*time.Second:
+		return fmt.Errorf("--pushover-retry must be at least 30s")
+	case *flagPushoverExpire <= 0 || *flagPushoverExpire > 3*time.Hour:
+		return fmt.Errorf("--pushover-expire must be between 1s and 3h")
+	}
+	pushoverToken = token
+	return nil
+}
+
+func pushoverEnabled() bool { return pushoverToken != "" }
+
+// pushoverTargets names the user key to relay n to, if it is urgent enough
+// and none of the clients it was broadcast to are connected.
+func pushoverTargets(h *hub, n Notification) ([]string, error) {
+	if n.Priority < *flagPushoverPriority || h.anyConnected(recipients(h, n)) {
+		return nil, nil
+	}
+	return []string{*flagPushoverUser}, nil
+}
+
+func deliverPushover(user string, n Notification) error {
+	if n.SeenAt != nil {
+		return nil // seen on another device while the relay was being retried
+	}
+	return sendPushover(user, n)
+}
+
+// pushoverPriority maps a priority onto Pushover's -2..2.
+func pushoverPriority(p int) int {
+	return min(max(p, priorityMin), priorityUrgent) - 3
+}
+
+func sendPushover(user string, n Notification) error {
+	msg := n.Text
+	if strings.TrimSpace(msg) == "" {
+		msg = n.Title // Pushover requires a message
+	}
+	form := url.Values{
+		"token":    {pushoverToken},
+		"user":     {user},
+		"title":    {excerpt(n.Title, pushoverMaxTitle)},
+		"message":  {excerpt(msg, pushoverMaxText)},
+		"priority": {strconv.Itoa(pushoverPriority(n.Priority))},
+	}
+	if t, err := time.Parse(time.RFC3339, n.CreatedAt); err == nil {
+		form.Set("timestamp", strconv.FormatInt(t.Unix(), 10))
+	}
+	if *flagPushoverDevice != "" {
+		form.Set("device", *flagPushoverDevice)
+	}
+	if n.ClickURL != "" && len(n.ClickURL) <= pushoverMaxURL {
+		form.Set("url", n.ClickURL)
+	}
+	emergency := pushoverPriority(n.Priority) == 2
+	if emergency {
+		form.Set("retry", strconv.Itoa(int(flagPushoverRetry.Seconds())))
+		form.Set("expire", strconv.Itoa(int(flagPushoverExpire.Seconds())))
+	}
+	var reply struct {
+		Receipt string `json:"receipt"`
+	}
+	if err := pushoverPost("/messages.json", form, &reply); err != nil {
+		return err
+	}
+	if emergency && reply.Receipt != "" {
+		if _, err := db.Exec(`INSERT OR REPLACE INTO pushover_receipts (notification_id, receipt, expires_at) VALUES (?, ?, ?)`,
+			n.ID, reply.Receipt, sqliteTime(time.Now().Add(*flagPushoverExpire))); err != nil {
+			log.Printf("pushover: receipt for id=%d: %v", n.ID, err)
+		}
+	}
+	return nil
+}
+
+// pushoverPost posts form to the API and decodes the reply into out,
+// turning a refusal into an error with Pushover's reasons.
+func pushoverPost(path string, form url.Values, out any) error {
+	resp, err := pushoverHTTP.PostForm(pushoverAPI+path, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		Status int      `json:"status"`
+		Errors []string `json:"errors"`
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return httpDeliveryError(resp, "unreadable reply")
+	}
+	json.Unmarshal(raw, &reply)
+	if resp.StatusCode != http.StatusOK || reply.Status != 1 {
+		return httpDeliveryError(resp, strings.Join(reply.Errors, "; "))
+	}
+	if out != nil {
+		return json.Unmarshal(raw, out)
+	}
+	return nil
+}
+
+// cancelPushover stops the emergency retries of notifications just marked
+// seen.
+func cancelPushover(ids []int64) {
+	if !pushoverEnabled() || len(ids) == 0 {
+		return
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := db.Query(`DELETE FROM pushover_receipts WHERE notification_id IN (`+placeholders(len(ids))+`)
+		AND expires_at > ? RETURNING notification_id, receipt`, append(args, sqliteTime(time.Now()))...)
+	if err != nil {
+		log.Printf("pushover: cancel: %v", err)
+		return
+	}
+	type receipt struct {
+		id      int64
+		receipt string
+	}
+	var cancel []receipt
+	for rows.Next() {
+		var r receipt
+		if rows.Scan(&r.id, &r.receipt) == nil {
+			cancel = append(cancel, r)
+		}
+	}
+	rows.Close()
+	db.Exec(`DELETE FROM pushover_receipts WHERE expires_at <= ?`, sqliteTime(time.Now()))
+	if len(cancel) == 0 {
+		return
+	}
+	go func() {
+		for _, r := range cancel {
+			if err := pushoverPost("/receipts/"+url.PathEscape(r.receipt)+"/cancel.json",
+				url.Values{"token": {pushoverToken}}, nil); err != nil {
+				log.Printf("pushover: cancel id=%d: %v", r.id, err)
+				continue
+			}
+			log.Printf("pushover: emergency retries for id=%d cancelled", r.id)
+		}
+	}()
+}
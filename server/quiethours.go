@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// ── Quiet Hours ───────────────────────────────────────────────────────────────
+//
+// PUT /admin/quiet-hours sets a nightly do-not-disturb window, enforced by
+// the server for everyone. During it, notifications below min_priority are
+// stored — /history has them — but not pushed: no live frames, no Web Push,
+// APNs, chat or other channels. Those that require an ack (see Escalation)
+// are the exception. When the window ends, what was held goes out as one
+// digest notification with the count and the titles, so a night of cron
+// noise is one buzz in the morning; a single held notification is delivered
+// as itself. Clients that speak protocol 2 also get the held notifications
+// in an "updated" frame, so they appear without alerting.
+//
+// Times are the server's local time (set TZ). This differs from the
+// quiet_hours client config hint, which each app applies on its own and
+// which silences rather than holds. Held notifications are kept in the
+// database, so a restart doesn't lose them, and flushing claims them, so
+// instances sharing the database deliver the digest once.
+
+const (
+	quietHoursSetting = "quiet_hours"
+	quietCheck        = 30 * time.Second
+)
+
+type quietHours struct {
+	Start       string `json:"start"`        // "22:00"
+	End         string `json:"end"`          // "07:00"
+	MinPriority int    `json:"min_priority"` // this and above are delivered as usual
+	UpdatedBy   string `json:"updated_by,omitempty"`
+	UpdatedAt   string `json:"updated_at,omitempty"`
+}
+
+func initQuietHoursTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS quiet_held (
+			notification_id INTEGER PRIMARY KEY REFERENCES notifications(id) ON DELETE CASCADE,
+			held_at         DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	return err
+}
+
+// currentQuietHours returns the configured window, if any.
+func currentQuietHours() (quietHours, bool) {
+	var q quietHours
+	v := getSetting(quietHoursSetting)
+	if v == "" {
+		return q, false
+	}
+	if err := json.Unmarshal([]byte(v), &q); err != nil {
+		log.Printf("quiet hours: %v", err)
+		return q, false
+	}
+	return q, true
+}
+
+// window returns the minutes of the day the window starts and ends at.
+func (q quietHours) window() (from, to int, err error) {
+	start, err := time.Parse("15:04", q.Start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("start must be HH:MM, like 22:00")
+	}
+	end, err := time.Parse("15:04", q.End)
+	if err != nil {
+		return 0, 0, fmt.Errorf("end must be HH:MM, like 07:00")
+	}
+	return start.Hour()*60 + start.Minute(), end.Hour()*60 + end.Minute(), nil
+}
+
+// active reports whether at falls inside the window.
+func (q quietHours) active(at time.Time) bool {
+	from, to, err := q.window()
+	if err != nil || from == to {
+		return false
+	}
+	local := at.Local()
+	now := local.Hour()*60 + local.Minute()
+	if from > to { // spans midnight
+		return now >= from || now < to
+	}
+	return from <= now && now < to
+}
+
+// check validates q, defaulting min_priority to high.
+func (q *quietHours) check() error {
+	from, to, err := q.window()
+	switch {
+	case err != nil:
+	case from == to:
+		err = fmt.Errorf("start and end must differ")
+	case q.MinPriority == 0:
+		q.MinPriority = priorityHigh
+	case q.MinPriority < priorityMin || q.MinPriority > priorityUrgent:
+		err = fmt.Errorf("min_priority must be %d-%d", priorityMin, priorityUrgent)
+	}
+	return err
+}
+
+// quietHold holds n back if quiet hours are on and it is below the
+// threshold and doesn't require an ack, and reports whether it did. n must
+// already be stored.
+func quietHold(n Notification) bool {
+	q, ok := currentQuietHours()
+	if !ok || n.Priority >= q.MinPriority || n.RequireAck || !q.active(time.Now()) {
+		return false
+	}
+	if _, err := db.Exec(`INSERT OR IGNORE INTO quiet_held (notification_id) VALUES (?)`, n.ID); err != nil {
+		log.Printf("quiet hours: id=%d: %v; delivering it now", n.ID, err)
+		return false
+	}
+	return true
+}
+
+// startQuietFlusher delivers what quiet hours held once the window ends.
+func startQuietFlusher(h *hub) {
+	ticker := time.NewTicker(quietCheck)
+	for range ticker.C {
+		if q, ok := currentQuietHours(); ok && q.active(time.Now()) {
+			continue
+		}
+		if err := flushQuietHours(h); err != nil {
+			log.Printf("quiet hours: %v", err)
+		}
+	}
+}
+
+// flushQuietHours claims everything held and delivers it: one notification
+// as itself, more as a digest.
+func flushQuietHours(h *hub) error {
+	rows, err := db.Query(`DELETE FROM quiet_held RETURNING notification_id`)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	slices.Sort(ids)
+	notes := loadNotifications(ids)
+	switch len(notes) {
+	case 0:
+		return nil
+	case 1:
+		broadcastNotification(h, notes[0])
+		log.Printf("quiet hours: delivered held id=%d", notes[0].ID)
+		return nil
+	}
+	announceUpdated(h, ids)
+	fannedOut(ids...) // the digest goes out in their place
+	events := make([]heldEvent, len(notes))
+	d := Notification{Source: "andrNoti"}
+	for i, n := range notes {
+		events[i] = heldEvent{id: n.ID, heldAt: n.CreatedAt, n: n}
+		d.Priority = max(d.Priority, n.Priority)
+	}
+	d.Title = fmt.Sprintf("Quiet hours: %d notifications", len(notes))
+	d.Text = fmt.Sprintf("%d notifications held between %s and %s UTC.\n", len(notes),
+		clockOf(notes[0].CreatedAt), clockOf(notes[len(notes)-1].CreatedAt)) + titleSummary(events)
+	d, err = publish(context.Background(), h, d)
+	if err != nil {
+		return err
+	}
+	log.Printf("quiet hours: digest id=%d of %d held notifications", d.ID, len(notes))
+	return nil
+}
+
+// handleQuietHours shows (GET), sets (PUT) or removes (DELETE) the window.
+func handleQuietHours() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		by := authFrom(r).ID
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var q quietHours
+			if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			if err := q.check(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			q.UpdatedBy, q.UpdatedAt = by, time.Now().UTC().Format(time.RFC3339)
+			raw, _ := json.Marshal(q)
+			if err := setSetting(quietHoursSetting, string(raw)); err != nil {
+				log.Printf("quiet hours: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("quiet hours: %s-%s below priority %d, set by %s", q.Start, q.End, q.MinPriority, by)
+		case http.MethodDelete:
+			if _, err := db.Exec(`DELETE FROM settings WHERE key = ?`, quietHoursSetting); err != nil {
+				log.Printf("quiet hours: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("quiet hours: removed by %s; anything held goes out at the next check", by)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q, ok := currentQuietHours()
+		if !ok {
+			http.Error(w, "no quiet hours set", http.StatusNotFound)
+			return
+		}
+		var held int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM quiet_held`).Scan(&held); err != nil {
+			log.Printf("quiet hours: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			quietHours
+			Active bool `json:"active"`
+			Held   int  `json:"held"`
+		}{q, q.active(time.Now()), held})
+	}
+}
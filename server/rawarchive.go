@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ── Raw Payload Archive ───────────────────────────────────────────────────────
+//
+// With --raw-archive-retention set, the request body that produced each
+// notification is kept gzip-compressed next to it, so when a producer's
+// mapping mangles something the original can be inspected with
+// GET /notifications/{id}/raw. Rows go when their notification is deleted or
+// when they are older than the retention. With --encryption-key-file they are
+// encrypted like the notification text.
+
+func initRawArchiveTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS raw_payloads (
+			notification_id INTEGER PRIMARY KEY REFERENCES notifications(id) ON DELETE CASCADE,
+			received_at     DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			content_type    TEXT NOT NULL DEFAULT '',
+			size            INTEGER NOT NULL,
+			body            BLOB NOT NULL
+		)
+	`)
+	return err
+}
+
+func rawArchiveEnabled() bool { return *flagRawRetention > 0 }
+
+// archiveRaw stores the payload notification id was created from.
+func archiveRaw(id int64, contentType string, payload []byte) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(payload)
+	zw.Close()
+	body := sealColumn("body", buf.String())
+	if _, err := db.Exec(
+		`INSERT OR REPLACE INTO raw_payloads (notification_id, content_type, size, body) VALUES (?, ?, ?, ?)`,
+		id, contentType, len(payload), []byte(body),
+	); err != nil {
+		log.Printf("raw archive: id=%d: %v", id, err)
+	}
+}
+
+// rawPruneJob deletes archived payloads past the retention every hour.
+func rawPruneJob(retention time.Duration) *schedJob {
+	return &schedJob{
+		name:     "raw-archive-prune",
+		interval: time.Hour,
+		run: func() error {
+			res, err := db.Exec(`DELETE FROM raw_payloads WHERE received_at < ?`, sqliteTime(time.Now().Add(-retention)))
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				log.Printf("raw archive: pruned %d payloads", n)
+			}
+			return nil
+		},
+	}
+}
+
+func handleRawPayload() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		var contentType, receivedAt string
+		var body []byte
+		err = db.QueryRow(
+			`SELECT content_type, received_at, body FROM raw_payloads WHERE notification_id = ?`, id,
+		).Scan(&contentType, &receivedAt, &body)
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		var payload []byte
+		if err == nil {
+			payload, err = unpackRaw(body)
+		}
+		if err != nil {
+			log.Printf("raw archive: id=%d: %v", id, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		// The payload is whatever the producer sent; never let a browser
+		// render it as a page of ours.
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		w.Header().Set("X-Received-At", receivedAt)
+		w.Write(payload)
+	}
+}
+
+func unpackRaw(body []byte) ([]byte, error) {
+	gz, err := openColumn("body", string(body))
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader([]byte(gz)))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(zr)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// ── Read Receipts ─────────────────────────────────────────────────────────────
+//
+// POST /mark-seen takes an optional "device" naming who read the
+// notifications (default: the caller's token or identity). Each device's
+// first read of a notification is kept as a receipt, listed by
+// GET /notifications/{id}/receipts. Notifications that become seen are
+// announced in a "seen" frame with their ids and the acting device, so other
+// connected clients clear their badges at once; the device that marked them
+// (a client connected with the same ?device=) doesn't get its own frame back.
+
+type readReceipt struct {
+	Device string `json:"device"`
+	By     string `json:"by,omitempty"`
+	SeenAt string `json:"seen_at"`
+}
+
+func initReceiptTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS read_receipts (
+			notification_id INTEGER NOT NULL REFERENCES notifications(id) ON DELETE CASCADE,
+			device          TEXT NOT NULL,
+			by              TEXT NOT NULL DEFAULT '',
+			seen_at         DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (notification_id, device)
+		)
+	`)
+	return err
+}
+
+// recordReceipts notes that device read ids, keeping the first read of each.
+func recordReceipts(ids []int64, device, by string) {
+	if len(ids) == 0 {
+		return
+	}
+	args := []any{device, by}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	if _, err := db.Exec(`INSERT OR IGNORE INTO read_receipts (notification_id, device, by)
+		SELECT id, ?, ? FROM notifications WHERE id IN (`+placeholders(len(ids))+`)`, args...); err != nil {
+		log.Printf("receipts: %v", err)
+	}
+}
+
+// broadcastSeen sends each client a "seen" frame with the newly seen ids it
+// may see, skipping the acting device.
+func broadcastSeen(h *hub, notes []noteRef, device, seenAt string) {
+	skip := func(c *client) bool { return c.device != "" && c.device == device }
+	broadcastIDs(h, notes, skip, func(ids []int64) wsMessage {
+		return wsMessage{Type: api.TypeSeen, IDs: ids, Device: device, SeenAt: &seenAt}
+	})
+}
+
+func handleReceipts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		rows, err := db.Query(`SELECT device, by, seen_at FROM read_receipts WHERE notification_id = ? ORDER BY seen_at, device`, id)
+		if err != nil {
+			log.Printf("receipts: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		out := []readReceipt{}
+		for rows.Next() {
+			var rr readReceipt
+			if err := rows.Scan(&rr.Device, &rr.By, &rr.SeenAt); err != nil {
+				log.Printf("receipts: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, rr)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
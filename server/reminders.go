@@ -0,0 +1,403 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// ── Reminders ─────────────────────────────────────────────────────────────────
+//
+// Reminders are notifications the server sends itself on a schedule — "water
+// the plants every Tuesday at 9" — managed under /reminders by name. A
+// schedule is either a five-field cron expression in the server's local time
+// (set TZ) or a fixed interval. The scheduler looks for due reminders every
+// reminderCheck, so one fires within that of its time; a reminder that came
+// due while the server was down or in maintenance fires once when it can,
+// and its next time is counted from then. Notifications are routed like a
+// /send, with source "reminder:<name>", so rules can reroute or mute them.
+
+const (
+	reminderCheck       = 30 * time.Second
+	reminderMinInterval = time.Minute
+)
+
+type reminder struct {
+	Name      string  `json:"name"`
+	Title     string  `json:"title,omitempty"`
+	Text      string  `json:"text"`
+	Topic     string  `json:"topic,omitempty"`
+	Priority  int     `json:"priority,omitempty"`
+	ClickURL  string  `json:"click_url,omitempty"`
+	Cron      string  `json:"cron,omitempty"`  // "0 9 * * TUE"
+	Every     string  `json:"every,omitempty"` // "36h", instead of cron
+	NextAt    string  `json:"next_at"`
+	LastAt    *string `json:"last_at"`
+	LastError string  `json:"last_error,omitempty"`
+	Fires     int64   `json:"fires"`
+	UpdatedBy string  `json:"updated_by"`
+}
+
+func initReminderTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS reminders (
+			name       TEXT PRIMARY KEY,
+			title      TEXT NOT NULL DEFAULT '',
+			text       TEXT NOT NULL,
+			topic      TEXT NOT NULL DEFAULT '',
+			priority   INTEGER NOT NULL DEFAULT 0,
+			click_url  TEXT NOT NULL DEFAULT '',
+			cron       TEXT NOT NULL DEFAULT '',
+			every_s    INTEGER NOT NULL DEFAULT 0,
+			next_at    DATETIME NOT NULL,
+			last_at    DATETIME,
+			last_error TEXT NOT NULL DEFAULT '',
+			fires      INTEGER NOT NULL DEFAULT 0,
+			updated_by TEXT NOT NULL DEFAULT ''
+		)
+	`)
+	return err
+}
+
+const reminderCols = `name, title, text, topic, priority, click_url, cron, every_s, next_at, last_at, last_error, fires, updated_by`
+
+func scanReminder(s interface{ Scan(...any) error }) (reminder, error) {
+	var rm reminder
+	var secs int64
+	err := s.Scan(&rm.Name, &rm.Title, &rm.Text, &rm.Topic, &rm.Priority, &rm.ClickURL, &rm.Cron, &secs,
+		&rm.NextAt, &rm.LastAt, &rm.LastError, &rm.Fires, &rm.UpdatedBy)
+	if secs > 0 {
+		rm.Every = (time.Duration(secs) * time.Second).String()
+	}
+	return rm, err
+}
+
+// next returns when rm fires after t.
+func (rm reminder) next(t time.Time) (time.Time, error) {
+	if rm.Every != "" {
+		d, err := time.ParseDuration(rm.Every)
+		if err != nil || d < reminderMinInterval {
+			return time.Time{}, fmt.Errorf("every must be a Go duration of at least %s", reminderMinInterval)
+		}
+		return t.Add(d), nil
+	}
+	c, err := parseCron(rm.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return c.next(t)
+}
+
+func reminderJob(h *hub) *schedJob {
+	return &schedJob{
+		name:     "reminders",
+		interval: reminderCheck,
+		run:      func() error { return fireDueReminders(h) },
+	}
+}
+
+// fireDueReminders sends every reminder whose time has come.
+func fireDueReminders(h *hub) error {
+	if currentMaintenance().Enabled {
+		return nil // due reminders fire after maintenance
+	}
+	rows, err := db.Query(`SELECT `+reminderCols+` FROM reminders WHERE next_at <= ? ORDER BY next_at`, sqliteTime(time.Now()))
+	if err != nil {
+		return err
+	}
+	var due []reminder
+	for rows.Next() {
+		rm, err := scanReminder(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, rm)
+	}
+	rows.Close()
+	var errs []error
+	for _, rm := range due {
+		if err := fireReminder(h, rm); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", rm.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// fireReminder sends rm and moves it to its next time.
+func fireReminder(h *hub, rm reminder) error {
+	now := time.Now()
+	next, err := rm.next(now)
+	if err != nil {
+		return err
+	}
+	_, sendErr := publishPolled(h, sendBody{
+		Title:    rm.Title,
+		Text:     rm.Text,
+		Source:   "reminder:" + rm.Name,
+		Topic:    rm.Topic,
+		Priority: rm.Priority,
+		ClickURL: rm.ClickURL,
+		Extras:   &api.Extras{Source: &api.SourceMeta{System: "reminder", ID: rm.Name}},
+	}, "reminders")
+	msg := ""
+	if sendErr != nil {
+		msg = sendErr.Error()
+	}
+	if _, err := db.Exec(`UPDATE reminders SET next_at = ?, last_at = ?, last_error = ?, fires = fires + 1 WHERE name = ?`,
+		sqliteTime(next), sqliteTime(now), msg, rm.Name); err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// ── Cron schedules ──
+
+// cronSpec is a parsed cron expression: the allowed values of each field.
+type cronSpec struct {
+	minute, hour, dom, month, dow [64]bool
+	anyDOM, anyDOW                bool
+}
+
+var (
+	cronMonths = strings.Fields("JAN FEB MAR APR MAY JUN JUL AUG SEP OCT NOV DEC")
+	cronDays   = strings.Fields("SUN MON TUE WED THU FRI SAT")
+)
+
+// parseCron parses "minute hour day-of-month month day-of-week". Fields
+// take *, numbers, ranges (1-5), steps (*/15, 8-18/2) and comma lists;
+// months and weekdays also take names (JAN, MON), and Sunday is 0 or 7. As
+// in cron, when both day fields are restricted a day matching either one
+// counts.
+func parseCron(expr string) (cronSpec, error) {
+	var c cronSpec
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return c, errors.New(`cron must have five fields: minute hour day-of-month month day-of-week, like "0 9 * * TUE"`)
+	}
+	for i, f := range []struct {
+		set      *[64]bool
+		min, max int
+		names    []string
+		name     string
+	}{
+		{&c.minute, 0, 59, nil, "minute"},
+		{&c.hour, 0, 23, nil, "hour"},
+		{&c.dom, 1, 31, nil, "day of month"},
+		{&c.month, 1, 12, cronMonths, "month"},
+		{&c.dow, 0, 7, cronDays, "day of week"},
+	} {
+		if err := parseCronField(fields[i], f.set, f.min, f.max, f.names); err != nil {
+			return c, fmt.Errorf("cron %s: %v", f.name, err)
+		}
+	}
+	if c.dow[7] {
+		c.dow[0] = true
+	}
+	c.anyDOM, c.anyDOW = fields[2] == "*", fields[4] == "*"
+	return c, nil
+}
+
+func parseCronField(field string, set *[64]bool, min, max int, names []string) error {
+	value := func(s string) (int, error) {
+		for i, n := range names {
+			if strings.EqualFold(s, n) {
+				return i + min, nil
+			}
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil || v < min || v > max {
+			return 0, fmt.Errorf("%q is not in %d-%d", s, min, max)
+		}
+		return v, nil
+	}
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, stepped := strings.Cut(part, "/")
+		step := 1
+		if stepped {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return fmt.Errorf("bad step %q", stepStr)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = value(from); err != nil {
+				return err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = value(to); err != nil {
+					return err
+				}
+			} else if stepped {
+				hi = max // "5/15" runs from 5 to the end
+			}
+			if lo > hi {
+				return fmt.Errorf("range %q runs backwards", rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+func (c cronSpec) day(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	switch {
+	case c.anyDOM && c.anyDOW:
+		return true
+	case c.anyDOM:
+		return dow
+	case c.anyDOW:
+		return dom
+	}
+	return dom || dow
+}
+
+// next returns the first matching minute after t, in local time.
+func (c cronSpec) next(t time.Time) (time.Time, error) {
+	t = t.Local().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !c.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.day(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !c.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !c.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("cron never matches")
+}
+
+// ── Reminder handlers ──
+
+func handleReminders() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rows, err := db.Query(`SELECT ` + reminderCols + ` FROM reminders ORDER BY next_at, name`)
+		if err != nil {
+			log.Printf("reminders: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		out := []reminder{}
+		for rows.Next() {
+			rm, err := scanReminder(rows)
+			if err != nil {
+				log.Printf("reminders: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, rm)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// handleReminder shows (GET), stores (PUT) or deletes (DELETE) a reminder.
+func handleReminder() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, by := r.PathValue("name"), authFrom(r).ID
+		switch r.Method {
+		case http.MethodGet:
+			rm, err := scanReminder(db.QueryRow(`SELECT `+reminderCols+` FROM reminders WHERE name = ?`, name))
+			if err == sql.ErrNoRows {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			} else if err != nil {
+				log.Printf("reminder %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(rm)
+		case http.MethodPut:
+			var rm reminder
+			if err := json.NewDecoder(r.Body).Decode(&rm); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			var next time.Time
+			var err error
+			switch {
+			case !templateNameRE.MatchString(name):
+				err = errors.New("name must be 1-64 letters, digits, '.', '_' or '-'")
+			case (rm.Cron == "") == (rm.Every == ""):
+				err = errors.New("give either cron or every")
+			case strings.TrimSpace(rm.Text) == "":
+				err = errors.New("text is required")
+			case rm.Priority < 0 || rm.Priority > priorityUrgent:
+				err = errors.New("priority must be 1-5")
+			default:
+				if err = checkClickURL(rm.ClickURL); err == nil {
+					next, err = rm.next(time.Now())
+				}
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var every int64
+			if rm.Every != "" {
+				d, _ := time.ParseDuration(rm.Every)
+				every = int64(d / time.Second)
+			}
+			_, err = db.Exec(`
+				INSERT INTO reminders (name, title, text, topic, priority, click_url, cron, every_s, next_at, updated_by)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT(name) DO UPDATE SET
+					title = excluded.title, text = excluded.text, topic = excluded.topic,
+					priority = excluded.priority, click_url = excluded.click_url, cron = excluded.cron,
+					every_s = excluded.every_s, next_at = excluded.next_at, last_error = '',
+					updated_by = excluded.updated_by`,
+				name, rm.Title, rm.Text, rm.Topic, rm.Priority, rm.ClickURL, strings.Join(strings.Fields(rm.Cron), " "),
+				every, sqliteTime(next), by)
+			if err != nil {
+				log.Printf("reminder %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("reminders: %q saved by %s, next at %s", name, by, next.Format(time.RFC3339))
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			res, err := db.Exec(`DELETE FROM reminders WHERE name = ?`, name)
+			if err != nil {
+				log.Printf("reminder %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("reminders: %q deleted by %s", name, by)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
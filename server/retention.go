@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ── Retention Preview ─────────────────────────────────────────────────────────
+//
+// GET /admin/retention/preview?days=N counts what a retention cutoff of N
+// days would take out of the database — by topic, by priority and seen or
+// unseen — without touching anything, so a policy can be checked before it
+// is switched on. Without days it previews the cutoff in force,
+// --s3-archive-after. Unseen notifications at priority 4 and above are
+// counted separately: they are the ones nobody has looked at yet. Like the
+// archive, it leaves out notifications still pending (see offloadable) and
+// reports how many of those are past the cutoff.
+
+const retentionMaxDays = 3650
+
+type retentionCount struct {
+	Seen   int64 `json:"seen"`
+	Unseen int64 `json:"unseen"`
+}
+
+type retentionTopic struct {
+	Topic string `json:"topic"`
+	retentionCount
+}
+
+type retentionPriority struct {
+	Priority int `json:"priority"`
+	retentionCount
+}
+
+type retentionPreview struct {
+	Cutoff          string              `json:"cutoff"`
+	Days            float64             `json:"days"`
+	Offload         bool                `json:"offload"` // rows would go to --s3-bucket rather than be lost
+	Total           int64               `json:"total"`
+	Seen            int64               `json:"seen"`
+	Unseen          int64               `json:"unseen"`
+	UnseenHigh      int64               `json:"unseen_high_priority"`
+	Pending         int64               `json:"pending"` // past the cutoff but kept until no longer pending
+	Oldest          *string             `json:"oldest"`
+	Newest          *string             `json:"newest"`
+	ByTopic         []retentionTopic    `json:"by_topic"`
+	ByPriority      []retentionPriority `json:"by_priority"`
+	RemainingTotal  int64               `json:"remaining_total"`
+	RemainingUnseen int64               `json:"remaining_unseen"`
+}
+
+func handleRetentionPreview() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		age := *flagS3ArchiveAfter
+		if v := r.URL.Query().Get("days"); v != "" {
+			days, err := strconv.Atoi(v)
+			if err != nil || days < 1 || days > retentionMaxDays {
+				http.Error(w, "days must be 1-3650", http.StatusBadRequest)
+				return
+			}
+			age = time.Duration(days) * 24 * time.Hour
+		}
+		p, err := previewRetention(time.Now().Add(-age))
+		if err != nil {
+			log.Printf("retention preview: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		p.Days = age.Hours() / 24
+		p.Offload = archiveStore != nil
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p)
+	}
+}
+
+// previewRetention counts the notifications created before cutoff.
+func previewRetention(cutoff time.Time) (retentionPreview, error) {
+	p := retentionPreview{
+		Cutoff:     cutoff.UTC().Format(time.RFC3339),
+		ByTopic:    []retentionTopic{},
+		ByPriority: []retentionPriority{},
+	}
+	before := sqliteTime(cutoff)
+	rows, err := db.Query(`
+		SELECT topic, priority, seen_at IS NOT NULL, COUNT(*) FROM notifications
+		WHERE created_at < ? AND `+offloadable+` GROUP BY 1, 2, 3`, before)
+	if err != nil {
+		return p, err
+	}
+	defer rows.Close()
+	topics, priorities := map[string]*retentionCount{}, map[int]*retentionCount{}
+	count := func(c *retentionCount) int64 { return c.Seen + c.Unseen }
+	for rows.Next() {
+		var topic string
+		var priority int
+		var seen bool
+		var n int64
+		if err := rows.Scan(&topic, &priority, &seen, &n); err != nil {
+			return p, err
+		}
+		t, ok := topics[topic]
+		if !ok {
+			t = &retentionCount{}
+			topics[topic] = t
+		}
+		pr, ok := priorities[priority]
+		if !ok {
+			pr = &retentionCount{}
+			priorities[priority] = pr
+		}
+		p.Total += n
+		if seen {
+			p.Seen, t.Seen, pr.Seen = p.Seen+n, t.Seen+n, pr.Seen+n
+		} else {
+			p.Unseen, t.Unseen, pr.Unseen = p.Unseen+n, t.Unseen+n, pr.Unseen+n
+			if priority >= priorityHigh {
+				p.UnseenHigh += n
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return p, err
+	}
+	for topic, t := range topics {
+		p.ByTopic = append(p.ByTopic, retentionTopic{topic, *t})
+	}
+	sort.Slice(p.ByTopic, func(i, j int) bool {
+		a, b := &p.ByTopic[i], &p.ByTopic[j]
+		if count(&a.retentionCount) != count(&b.retentionCount) {
+			return count(&a.retentionCount) > count(&b.retentionCount)
+		}
+		return a.Topic < b.Topic
+	})
+	for priority, pr := range priorities {
+		p.ByPriority = append(p.ByPriority, retentionPriority{priority, *pr})
+	}
+	sort.Slice(p.ByPriority, func(i, j int) bool { return p.ByPriority[i].Priority > p.ByPriority[j].Priority })
+
+	var oldest, newest *string
+	if err := db.QueryRow(
+		`SELECT MIN(created_at), MAX(created_at) FROM notifications WHERE created_at < ? AND `+offloadable, before,
+	).Scan(&oldest, &newest); err != nil {
+		return p, err
+	}
+	p.Oldest, p.Newest = rfc3339(oldest), rfc3339(newest)
+	if err := db.QueryRow(
+		`SELECT COUNT(*) FROM notifications WHERE created_at < ? AND NOT (`+offloadable+`)`, before,
+	).Scan(&p.Pending); err != nil {
+		return p, err
+	}
+	err = db.QueryRow(
+		`SELECT COUNT(*), COUNT(*) - COUNT(seen_at) FROM notifications WHERE created_at >= ? OR NOT (`+offloadable+`)`, before,
+	).Scan(&p.RemainingTotal, &p.RemainingUnseen)
+	return p, err
+}
+
+// rfc3339 reformats an aggregated SQLite time, which comes back untyped.
+func rfc3339(ts *string) *string {
+	if ts == nil {
+		return nil
+	}
+	if t, err := parseSQLiteTime(*ts); err == nil {
+		s := t.Format(time.RFC3339)
+		return &s
+	}
+	return ts
+}
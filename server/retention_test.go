@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRetentionKeepsPending checks that notifications something still waits
+// on are left out of what the archive would move.
+func TestRetentionKeepsPending(t *testing.T) {
+	testDB(t)
+	var ids []int64
+	for _, ack := range []bool{false, false, true, false, false, true} {
+		n, err := insertNotification(Notification{Title: "old", Text: "x", Priority: 3, RequireAck: ack})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, n.ID)
+	}
+	old := sqliteTime(time.Now().Add(-48 * time.Hour))
+	for _, q := range []struct {
+		sql  string
+		args []any
+	}{
+		{`UPDATE notifications SET created_at = ?`, []any{old}},
+		{`UPDATE notifications SET snoozed_until = ? WHERE id = ?`, []any{sqliteTime(time.Now().Add(time.Hour)), ids[1]}},
+		{`INSERT INTO quiet_held (notification_id) VALUES (?)`, []any{ids[3]}},
+		{`INSERT INTO escalations (notification_id, deadline_at) VALUES (?, ?)`, []any{ids[4], old}},
+		{`UPDATE notifications SET acked_at = ? WHERE id = ?`, []any{old, ids[5]}},
+	} {
+		if _, err := db.Exec(q.sql, q.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, err := previewRetention(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Moved: the plain one and the acked one. Kept: snoozed, unacked,
+	// quiet-held and escalating.
+	if p.Total != 2 || p.Pending != 4 || p.RemainingTotal != 4 {
+		t.Errorf("total %d, pending %d, remaining %d; want 2, 4, 4", p.Total, p.Pending, p.RemainingTotal)
+	}
+}
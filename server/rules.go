@@ -0,0 +1,529 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ── Rule Store ────────────────────────────────────────────────────────────────
+//
+// Rules live in the database and take effect as soon as they are saved. Every
+// change — create, edit, delete, revert — appends a version recording who made
+// it, so the history can be reviewed and any version restored. Versions are
+// keyed by kind: routing rules are read from the store itself, while
+// templates and ingest mappings keep their own tables and record each change
+// here too.
+//
+// Routing rules are applied in position order to notifications posted to
+// /send. Each rule whose match conditions all hold may change the topic or
+// priority, suppress the notification (nothing is stored or delivered), hold
+// it for a digest (digest.go), or stop evaluation. Server-generated
+// notifications (heartbeat alerts, on-call handoffs) bypass the rules so a
+// greedy match can't hide them.
+//
+// Every match is counted per rule with the time of the last one, so rules
+// that never fire and suppressions that fire too often show up in the
+// listing. Counters survive edits; deleting a rule clears them.
+
+const ruleKindRoute = "route"
+
+type routeMatch struct {
+	Topic       string `json:"topic,omitempty"`  // glob, e.g. "ci-*"
+	Source      string `json:"source,omitempty"` // glob
+	MinPriority int    `json:"min_priority,omitempty"`
+	MaxPriority int    `json:"max_priority,omitempty"`
+	TitleRegex  string `json:"title_regex,omitempty"`
+	TextRegex   string `json:"text_regex,omitempty"`
+}
+
+type routeAction struct {
+	Topic    string `json:"topic,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Suppress bool   `json:"suppress,omitempty"`
+	Digest   string `json:"digest,omitempty"` // window, e.g. "5m"
+	Stop     bool   `json:"stop,omitempty"`
+}
+
+type routeRule struct {
+	Name     string      `json:"name"`
+	Enabled  bool        `json:"enabled"`
+	Position int         `json:"position"`
+	Match    routeMatch  `json:"match"`
+	Action   routeAction `json:"action"`
+
+	title, text *regexp.Regexp
+	window      time.Duration // parsed Action.Digest
+}
+
+type ruleVersion struct {
+	Version   int             `json:"version"`
+	Deleted   bool            `json:"deleted"`
+	Body      json.RawMessage `json:"body,omitempty"`
+	ChangedBy string          `json:"changed_by"`
+	ChangedAt string          `json:"changed_at"`
+}
+
+// routeRules is the compiled, ordered set in force. Reloaded on every change.
+var routeRules = struct {
+	sync.RWMutex
+	list []*routeRule
+}{}
+
+func initRuleTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS rule_versions (
+			kind       TEXT NOT NULL,
+			name       TEXT NOT NULL,
+			version    INTEGER NOT NULL,
+			deleted    INTEGER NOT NULL DEFAULT 0,
+			body       TEXT NOT NULL DEFAULT '',
+			changed_by TEXT NOT NULL DEFAULT '',
+			changed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (kind, name, version)
+		);
+		CREATE TABLE IF NOT EXISTS rule_hits (
+			kind          TEXT NOT NULL,
+			name          TEXT NOT NULL,
+			hits          INTEGER NOT NULL DEFAULT 0,
+			last_match_at DATETIME,
+			since         DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (kind, name)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	return reloadRouteRules()
+}
+
+// currentRules returns the latest non-deleted body of every rule of kind.
+func currentRules(kind string) (map[string]string, error) {
+	rows, err := db.Query(`
+		SELECT v.name, v.body FROM rule_versions v
+		WHERE v.kind = ? AND v.deleted = 0 AND v.version = (
+			SELECT MAX(version) FROM rule_versions WHERE kind = v.kind AND name = v.name
+		)`, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[string]string{}
+	for rows.Next() {
+		var name, body string
+		if err := rows.Scan(&name, &body); err != nil {
+			return nil, err
+		}
+		out[name] = body
+	}
+	return out, rows.Err()
+}
+
+// saveRuleVersion appends a version; body "" with deleted marks a deletion.
+func saveRuleVersion(kind, name, body string, deleted bool, by string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var latest int
+	if err := tx.QueryRow(
+		`SELECT COALESCE(MAX(version), 0) FROM rule_versions WHERE kind = ? AND name = ?`, kind, name,
+	).Scan(&latest); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO rule_versions (kind, name, version, deleted, body, changed_by) VALUES (?, ?, ?, ?, ?, ?)`,
+		kind, name, latest+1, deleted, body, by,
+	); err != nil {
+		return 0, err
+	}
+	return latest + 1, tx.Commit()
+}
+
+func ruleHistory(kind, name string) ([]ruleVersion, error) {
+	rows, err := db.Query(`
+		SELECT version, deleted, body, changed_by, changed_at FROM rule_versions
+		WHERE kind = ? AND name = ? ORDER BY version DESC`, kind, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []ruleVersion{}
+	for rows.Next() {
+		var v ruleVersion
+		var body string
+		if err := rows.Scan(&v.Version, &v.Deleted, &body, &v.ChangedBy, &v.ChangedAt); err != nil {
+			return nil, err
+		}
+		if body != "" {
+			v.Body = json.RawMessage(body)
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+// recordRuleHits counts a match for each named rule.
+func recordRuleHits(kind string, names []string) {
+	for _, name := range names {
+		if _, err := db.Exec(`
+			INSERT INTO rule_hits (kind, name, hits, last_match_at) VALUES (?, ?, 1, CURRENT_TIMESTAMP)
+			ON CONFLICT(kind, name) DO UPDATE SET hits = hits + 1, last_match_at = excluded.last_match_at
+		`, kind, name); err != nil {
+			log.Printf("rules: hit %q: %v", name, err)
+		}
+	}
+}
+
+type ruleHits struct {
+	Hits        int64   `json:"hits"`
+	LastMatchAt *string `json:"last_match_at"`
+	Since       string  `json:"since,omitempty"`
+}
+
+func loadRuleHits(kind string) (map[string]ruleHits, error) {
+	rows, err := db.Query(`SELECT name, hits, last_match_at, since FROM rule_hits WHERE kind = ?`, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[string]ruleHits{}
+	for rows.Next() {
+		var name string
+		var h ruleHits
+		if err := rows.Scan(&name, &h.Hits, &h.LastMatchAt, &h.Since); err != nil {
+			return nil, err
+		}
+		out[name] = h
+	}
+	return out, rows.Err()
+}
+
+// ── Routing Rules ─────────────────────────────────────────────────────────────
+
+// compile validates r and prepares its regexes.
+func (r *routeRule) compile() error {
+	var err error
+	for _, g := range []string{r.Match.Topic, r.Match.Source} {
+		if _, err := path.Match(g, ""); err != nil {
+			return fmt.Errorf("bad glob %q", g)
+		}
+	}
+	if r.Match.TitleRegex != "" {
+		if r.title, err = regexp.Compile(r.Match.TitleRegex); err != nil {
+			return fmt.Errorf("title_regex: %v", err)
+		}
+	}
+	if r.Match.TextRegex != "" {
+		if r.text, err = regexp.Compile(r.Match.TextRegex); err != nil {
+			return fmt.Errorf("text_regex: %v", err)
+		}
+	}
+	if r.Action.Priority < 0 || r.Action.Priority > priorityUrgent {
+		return errors.New("action.priority must be 1-5")
+	}
+	if r.Action.Digest != "" {
+		if r.window, err = time.ParseDuration(r.Action.Digest); err != nil || r.window < time.Second || r.window > digestMaxWindow {
+			return errors.New("action.digest must be a duration between 1s and 24h")
+		}
+		if r.Action.Suppress {
+			return errors.New("action.digest and action.suppress exclude each other")
+		}
+	}
+	return nil
+}
+
+func (r *routeRule) matches(n Notification) bool {
+	m := r.Match
+	if m.Topic != "" {
+		if ok, _ := path.Match(m.Topic, n.Topic); !ok {
+			return false
+		}
+	}
+	if m.Source != "" {
+		if ok, _ := path.Match(m.Source, n.Source); !ok {
+			return false
+		}
+	}
+	if m.MinPriority > 0 && n.Priority < m.MinPriority {
+		return false
+	}
+	if m.MaxPriority > 0 && n.Priority > m.MaxPriority {
+		return false
+	}
+	if r.title != nil && !r.title.MatchString(n.Title) {
+		return false
+	}
+	if r.text != nil && !r.text.MatchString(n.Text) {
+		return false
+	}
+	return true
+}
+
+func reloadRouteRules() error {
+	bodies, err := currentRules(ruleKindRoute)
+	if err != nil {
+		return err
+	}
+	var list []*routeRule
+	for name, body := range bodies {
+		r := &routeRule{}
+		err := json.Unmarshal([]byte(body), r)
+		if err == nil {
+			err = r.compile()
+		}
+		if err != nil {
+			log.Printf("rules: skipping %q: %v", name, err)
+			continue
+		}
+		r.Name = name
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Position != list[j].Position {
+			return list[i].Position < list[j].Position
+		}
+		return list[i].Name < list[j].Name
+	})
+	routeRules.Lock()
+	routeRules.list = list
+	routeRules.Unlock()
+	return nil
+}
+
+// routeStep is one rule's part in a routing decision, for simulations.
+type routeStep struct {
+	Rule    string   `json:"rule"`
+	Result  string   `json:"result"` // matched, no match, disabled, not reached
+	Changes []string `json:"changes,omitempty"`
+}
+
+// applyRoutes runs the routing rules over n. It returns the possibly
+// rewritten notification, the names of the rules that matched, the name of
+// the rule that suppressed it and the rule that holds it for a digest, if
+// any. A non-nil trace is called once per rule, in order.
+func applyRoutes(trace func(routeStep), n Notification) (Notification, []string, string, *routeRule) {
+	if n.Priority == 0 {
+		n.Priority = priorityDefault
+	}
+	routeRules.RLock()
+	defer routeRules.RUnlock()
+	var matched []string
+	suppressedBy, stopped := "", false
+	var digest *routeRule
+	for _, r := range routeRules.list {
+		step := routeStep{Rule: r.Name}
+		switch {
+		case stopped || suppressedBy != "" || digest != nil:
+			step.Result = "not reached"
+		case !r.Enabled:
+			step.Result = "disabled"
+		case !r.matches(n):
+			step.Result = "no match"
+		default:
+			step.Result = "matched"
+			matched = append(matched, r.Name)
+			if r.Action.Suppress {
+				suppressedBy = r.Name
+				step.Changes = append(step.Changes, "suppressed")
+				break
+			}
+			if r.Action.Topic != "" && r.Action.Topic != n.Topic {
+				step.Changes = append(step.Changes, fmt.Sprintf("topic %q → %q", n.Topic, r.Action.Topic))
+				n.Topic = r.Action.Topic
+			}
+			if r.Action.Priority != 0 && r.Action.Priority != n.Priority {
+				step.Changes = append(step.Changes, fmt.Sprintf("priority %d → %d", n.Priority, r.Action.Priority))
+				n.Priority = r.Action.Priority
+			}
+			if r.Action.Digest != "" {
+				digest = r
+				step.Changes = append(step.Changes, "digest every "+r.window.String())
+			} else if r.Action.Stop {
+				stopped = true
+				step.Changes = append(step.Changes, "stop")
+			}
+		}
+		if trace == nil && step.Result == "not reached" {
+			break
+		}
+		if trace != nil {
+			trace(step)
+		}
+	}
+	return n, matched, suppressedBy, digest
+}
+
+// ── Rule Handlers ─────────────────────────────────────────────────────────────
+
+func handleRules() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		hits, err := loadRuleHits(ruleKindRoute)
+		if err != nil {
+			log.Printf("rules: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		type listed struct {
+			routeRule
+			ruleHits
+		}
+		routeRules.RLock()
+		out := make([]listed, 0, len(routeRules.list))
+		for _, rule := range routeRules.list {
+			out = append(out, listed{*rule, hits[rule.Name]})
+		}
+		routeRules.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// handleRule creates or replaces (PUT) or deletes (DELETE) a routing rule.
+// Either way a new version is recorded.
+func handleRule() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		by := authFrom(r).ID
+		var body string
+		switch r.Method {
+		case http.MethodPut:
+			var rule routeRule
+			if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			if err := rule.compile(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			rule.Name = name
+			raw, _ := json.Marshal(rule)
+			body = string(raw)
+		case http.MethodDelete:
+			current, err := currentRules(ruleKindRoute)
+			if err != nil {
+				log.Printf("rule %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if _, ok := current[name]; !ok {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		version, err := saveRuleVersion(ruleKindRoute, name, body, body == "", by)
+		if err == nil && body == "" {
+			_, err = db.Exec(`DELETE FROM rule_hits WHERE kind = ? AND name = ?`, ruleKindRoute, name)
+		}
+		if err != nil {
+			log.Printf("rule %q: %v", name, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if err := reloadRouteRules(); err != nil {
+			log.Printf("rules reload: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"name": name, "version": version})
+		log.Printf("rules: %q %s by %s (version %d)", name, strings.ToLower(r.Method), by, version)
+	}
+}
+
+// applyRouteRules puts a reverted routing rule in force. The version store
+// is where rules are read from, so reloading it is all there is to do.
+func applyRouteRules(name, body, by string) error {
+	if err := reloadRouteRules(); err != nil {
+		log.Printf("rules reload: %v", err)
+	}
+	return nil
+}
+
+// handleRuleHistory lists every version of a definition of kind, newest
+// first.
+func handleRuleHistory(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.PathValue("name")
+		versions, err := ruleHistory(kind, name)
+		if err != nil {
+			log.Printf("%s %q history: %v", kind, name, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if len(versions) == 0 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versions)
+	}
+}
+
+// handleRuleRevert restores the body of an earlier version of a definition
+// of kind as a new version, then has apply put it in force (body "" deletes
+// it).
+func handleRuleRevert(kind string, apply func(name, body, by string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.PathValue("name")
+		var body struct {
+			Version int `json:"version"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Version < 1 {
+			http.Error(w, "version is required", http.StatusBadRequest)
+			return
+		}
+		var old string
+		var deleted bool
+		err := db.QueryRow(
+			`SELECT body, deleted FROM rule_versions WHERE kind = ? AND name = ? AND version = ?`,
+			kind, name, body.Version,
+		).Scan(&old, &deleted)
+		if err == sql.ErrNoRows {
+			http.Error(w, "no such version", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("%s %q revert: %v", kind, name, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		by := authFrom(r).ID
+		version, err := saveRuleVersion(kind, name, old, deleted, by)
+		if err == nil {
+			err = apply(name, old, by)
+		}
+		if err != nil {
+			log.Printf("%s %q revert: %v", kind, name, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"name": name, "version": version})
+		log.Printf("rules: %s %q reverted to version %d by %s (version %d)", kind, name, body.Version, by, version)
+	}
+}
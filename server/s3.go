@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ── S3 Client ─────────────────────────────────────────────────────────────────
+//
+// Just enough of the S3 API for the archive: put and get objects and set a
+// bucket lifecycle rule, signed with AWS Signature Version 4. Buckets are
+// addressed path-style (endpoint/bucket/key), which MinIO, Garage, Ceph and
+// AWS itself all accept.
+
+type s3Client struct {
+	endpoint *url.URL
+	bucket   string
+	region   string
+	access   string
+	secret   string
+	http     *http.Client
+}
+
+// newS3Client reads credentials as "ACCESS_KEY SECRET_KEY" (space or newline
+// separated) from credsFile, or from AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY
+// when credsFile is empty.
+func newS3Client(endpoint, bucket, region, credsFile string) (*s3Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("s3 endpoint %q must be an http(s) URL", endpoint)
+	}
+	c := &s3Client{
+		endpoint: u,
+		bucket:   bucket,
+		region:   region,
+		access:   os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret:   os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		http:     &http.Client{Timeout: 5 * time.Minute},
+	}
+	if credsFile != "" {
+		raw, err := os.ReadFile(credsFile)
+		if err != nil {
+			return nil, err
+		}
+		f := strings.Fields(string(raw))
+		if len(f) != 2 {
+			return nil, fmt.Errorf("%s: want \"ACCESS_KEY SECRET_KEY\"", credsFile)
+		}
+		c.access, c.secret = f[0], f[1]
+	}
+	if c.access == "" || c.secret == "" {
+		return nil, errors.New("no S3 credentials (--s3-credentials-file or AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY)")
+	}
+	return c, nil
+}
+
+func (c *s3Client) put(ctx context.Context, key string, body []byte, contentType string) error {
+	_, err := c.do(ctx, http.MethodPut, key, "", body, map[string]string{"Content-Type": contentType})
+	return err
+}
+
+func (c *s3Client) get(ctx context.Context, key string) ([]byte, error) {
+	return c.do(ctx, http.MethodGet, key, "", nil, nil)
+}
+
+// putLifecycle replaces the bucket's lifecycle configuration with one rule
+// expiring objects under prefix after days.
+func (c *s3Client) putLifecycle(ctx context.Context, prefix string, days int) error {
+	body := []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<LifecycleConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
+  <Rule>
+    <ID>andrnoti-archive-expiry</ID>
+    <Filter><Prefix>%s</Prefix></Filter>
+    <Status>Enabled</Status>
+    <Expiration><Days>%d</Days></Expiration>
+  </Rule>
+</LifecycleConfiguration>`, html.EscapeString(prefix), days))
+	sum := md5.Sum(body)
+	_, err := c.do(ctx, http.MethodPut, "", "lifecycle=", body, map[string]string{
+		"Content-Type": "application/xml",
+		"Content-MD5":  base64.StdEncoding.EncodeToString(sum[:]),
+	})
+	return err
+}
+
+func (c *s3Client) do(ctx context.Context, method, key, query string, body []byte, headers map[string]string) ([]byte, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = query
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	c.sign(req, body, time.Now())
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, u.Path, resp.Status, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
+
+// sign adds a Signature Version 4 Authorization header to req.
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	payload := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+
+	signed := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		signed[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(signed))
+	for k := range signed {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + signed[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payload[:]),
+	}, "\n")
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	creq := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(creq[:])
+
+	k := hmacSHA256([]byte("AWS4"+c.secret), day)
+	k = hmacSHA256(k, c.region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.access+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+sig)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, as
+// Signature Version 4 requires.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if 'A' <= ch && ch <= 'Z' || 'a' <= ch && ch <= 'z' || '0' <= ch && ch <= '9' ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, s := range parts {
+		parts[i] = s3Escape(s)
+	}
+	return strings.Join(parts, "/")
+}
+
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ── Scheduler ─────────────────────────────────────────────────────────────────
+//
+// Periodic background work — LDAP sync, database maintenance, backups, raw
+// payload pruning, S3 archiving — is registered here instead of each running
+// its own loop. The schedule lives in the database: every job has its last
+// run, result and next run in scheduled_jobs, so restarts and handoffs pick
+// up where the previous process left off, and GET /admin/jobs shows it all.
+//
+// Only one process runs jobs at a time. The runner holds a lease row it
+// renews every few seconds; another process sharing the database (the new
+// one during a SIGUSR2 handoff, or a second instance by mistake) takes over
+// only once the lease lapses or is released.
+
+const (
+	schedTick     = 5 * time.Second
+	schedLeaseTTL = 30 * time.Second
+)
+
+type schedJob struct {
+	name     string
+	interval time.Duration
+	first    time.Duration    // delay before the first ever run
+	lastRun  func() time.Time // optional: when it last ran before the scheduler tracked it
+	run      func() error
+}
+
+type schedStatus struct {
+	Name         string  `json:"name"`
+	Interval     string  `json:"interval"`
+	Running      bool    `json:"running"`
+	LastRunAt    *string `json:"last_run_at"`
+	LastDuration int64   `json:"last_duration_ms"`
+	LastStatus   string  `json:"last_status,omitempty"` // ok or error
+	LastError    string  `json:"last_error,omitempty"`
+	NextRunAt    string  `json:"next_run_at"`
+	Runs         int64   `json:"runs"`
+	Failures     int64   `json:"failures"`
+}
+
+var scheduler = struct {
+	sync.Mutex
+	jobs    []*schedJob
+	running map[string]bool
+	holder  string
+	leader  bool
+	poke    chan struct{}
+}{running: map[string]bool{}, poke: make(chan struct{}, 1)}
+
+func initSchedulerTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS scheduled_jobs (
+			name             TEXT PRIMARY KEY,
+			interval_s       INTEGER NOT NULL,
+			last_run_at      DATETIME,
+			last_duration_ms INTEGER NOT NULL DEFAULT 0,
+			last_status      TEXT NOT NULL DEFAULT '',
+			last_error       TEXT NOT NULL DEFAULT '',
+			next_run_at      DATETIME NOT NULL,
+			runs             INTEGER NOT NULL DEFAULT 0,
+			failures         INTEGER NOT NULL DEFAULT 0
+		);
+		CREATE TABLE IF NOT EXISTS scheduler_lease (
+			id         INTEGER PRIMARY KEY CHECK (id = 1),
+			holder     TEXT NOT NULL,
+			expires_at DATETIME NOT NULL
+		);
+		INSERT OR IGNORE INTO scheduler_lease (id, holder, expires_at) VALUES (1, '', '1970-01-01 00:00:00');
+	`)
+	return err
+}
+
+// registerJob adds a periodic job. Call before startScheduler.
+func registerJob(j *schedJob) error {
+	next := time.Now().Add(j.first)
+	if j.lastRun != nil {
+		if t := j.lastRun(); !t.IsZero() {
+			next = t.Add(j.interval)
+		}
+	}
+	// A changed interval applies from the last run.
+	_, err := db.Exec(`
+		INSERT INTO scheduled_jobs (name, interval_s, next_run_at) VALUES (?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET interval_s = excluded.interval_s,
+			next_run_at = CASE WHEN last_run_at IS NULL THEN next_run_at
+				ELSE datetime(last_run_at, '+' || excluded.interval_s || ' seconds') END
+	`, j.name, int64(j.interval/time.Second), sqliteTime(next))
+	if err != nil {
+		return err
+	}
+	scheduler.Lock()
+	scheduler.jobs = append(scheduler.jobs, j)
+	scheduler.Unlock()
+	return nil
+}
+
+func startScheduler() {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	scheduler.Lock()
+	scheduler.holder = fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(suffix))
+	scheduler.Unlock()
+
+	t := time.NewTicker(schedTick)
+	defer t.Stop()
+	for {
+		if draining.Load() {
+			releaseLease()
+			return
+		}
+		if holdLease() {
+			runDueJobs()
+		}
+		select {
+		case <-t.C:
+		case <-scheduler.poke:
+		}
+	}
+}
+
+// holdLease takes or renews the runner lease and reports whether this
+// process holds it.
+func holdLease() bool {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	now := time.Now()
+	res, err := db.Exec(`UPDATE scheduler_lease SET holder = ?, expires_at = ? WHERE id = 1 AND (holder = ? OR expires_at < ?)`,
+		scheduler.holder, sqliteTime(now.Add(schedLeaseTTL)), scheduler.holder, sqliteTime(now))
+	if err != nil {
+		log.Printf("scheduler: lease: %v", err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	if leader := n == 1; leader != scheduler.leader {
+		scheduler.leader = leader
+		if leader {
+			log.Printf("scheduler: running jobs as %s", scheduler.holder)
+		} else {
+			log.Printf("scheduler: lease lost; another process runs jobs")
+		}
+	}
+	return scheduler.leader
+}
+
+func releaseLease() {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	if scheduler.leader {
+		db.Exec(`UPDATE scheduler_lease SET expires_at = '1970-01-01 00:00:00' WHERE id = 1 AND holder = ?`, scheduler.holder)
+		scheduler.leader = false
+	}
+}
+
+func runDueJobs() {
+	now := sqliteTime(time.Now())
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	for _, j := range scheduler.jobs {
+		if scheduler.running[j.name] {
+			continue
+		}
+		var due bool
+		if err := db.QueryRow(`SELECT next_run_at <= ? FROM scheduled_jobs WHERE name = ?`, now, j.name).Scan(&due); err != nil {
+			log.Printf("scheduler: %s: %v", j.name, err)
+			continue
+		}
+		if due {
+			scheduler.running[j.name] = true
+			go runJob(j)
+		}
+	}
+}
+
+func runJob(j *schedJob) {
+	start := time.Now()
+	err := j.run()
+	status, msg := "ok", ""
+	if err != nil {
+		status, msg = "error", err.Error()
+		log.Printf("job %s: %v", j.name, err)
+	}
+	if _, dbErr := db.Exec(`
+		UPDATE scheduled_jobs SET last_run_at = ?, last_duration_ms = ?, last_status = ?, last_error = ?,
+			next_run_at = ?, runs = runs + 1, failures = failures + ?
+		WHERE name = ?`,
+		sqliteTime(start), time.Since(start).Milliseconds(), status, msg,
+		sqliteTime(start.Add(j.interval)), map[bool]int{true: 1}[err != nil], j.name,
+	); dbErr != nil {
+		log.Printf("scheduler: %s: %v", j.name, dbErr)
+	}
+	scheduler.Lock()
+	delete(scheduler.running, j.name)
+	scheduler.Unlock()
+}
+
+func scheduledJobs() ([]schedStatus, error) {
+	rows, err := db.Query(`SELECT name, interval_s, last_run_at, last_duration_ms, last_status, last_error,
+		next_run_at, runs, failures FROM scheduled_jobs ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	scheduler.Lock()
+	registered := map[string]bool{}
+	for _, j := range scheduler.jobs {
+		registered[j.name] = true
+	}
+	scheduler.Unlock()
+	out := []schedStatus{}
+	for rows.Next() {
+		var s schedStatus
+		var interval int64
+		if err := rows.Scan(&s.Name, &interval, &s.LastRunAt, &s.LastDuration, &s.LastStatus, &s.LastError,
+			&s.NextRunAt, &s.Runs, &s.Failures); err != nil {
+			return nil, err
+		}
+		if !registered[s.Name] {
+			continue // job no longer configured
+		}
+		s.Interval = (time.Duration(interval) * time.Second).String()
+		scheduler.Lock()
+		s.Running = scheduler.running[s.Name]
+		scheduler.Unlock()
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, rows.Err()
+}
+
+// handleJobRun makes a scheduled job due now.
+func handleJobRun() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.PathValue("name")
+		res, err := db.Exec(`UPDATE scheduled_jobs SET next_run_at = ? WHERE name = ?`, sqliteTime(time.Now()), name)
+		if err != nil {
+			log.Printf("scheduler: %s: %v", name, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "no such job", http.StatusNotFound)
+			return
+		}
+		select {
+		case scheduler.poke <- struct{}{}:
+		default:
+		}
+		w.WriteHeader(http.StatusAccepted)
+		log.Printf("scheduler: %s triggered by %s", name, authFrom(r).ID)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// ── JSON Schema ───────────────────────────────────────────────────────────────
+//
+// GET /schema/notification describes the Notification model and every
+// WebSocket frame as JSON Schema (draft 2020-12), generated from the Go
+// structs so it can't drift from what the server actually sends.
+
+// schemaTypes are the published definitions, by schema name.
+var schemaTypes = []struct {
+	name string
+	v    any
+}{
+	{"Notification", Notification{}},
+	{"Extras", api.Extras{}},
+	{"SourceMeta", api.SourceMeta{}},
+	{"Origin", api.Origin{}},
+	{"Hints", api.Hints{}},
+	{"ServerMessage", wsMessage{}},
+	{"ClientMessage", wsClientMessage{}},
+	{"ClientConfig", clientConfig{}},
+	{"QuietHours", quietHoursHint{}},
+	{"LiveStats", liveStats{}},
+	{"Reauth", api.Reauth{}},
+	{"UPMessage", api.UPMessage{}},
+	{"Hello", api.Hello{}},
+	{"ApiError", api.Error{}},
+}
+
+// schemaEnums documents fields whose values reflection can't see.
+var schemaEnums = map[string][]string{
+	"ServerMessage.type":   {api.TypeHistory, api.TypeNotification, api.TypeNotifications, api.TypeSnoozed, api.TypeSeen, api.TypeStats, api.TypeConfig, api.TypeReauth, api.TypeUnifiedPush, api.TypeHello, api.TypeDeleted, api.TypeUpdated, api.TypeAcked},
+	"ClientMessage.type":   {api.TypeSubscribe, api.TypeUnsubscribe, api.TypeAck, api.TypeUPAck, api.TypeHello},
+	"ClientMessage.stream": {api.StreamStats},
+	"Hello.features":       wsFeatures,
+	"Hints.sound":          {api.SoundDefault, api.SoundAlarm, api.SoundNone},
+	"Hints.vibrate":        {api.VibrateDefault, api.VibrateShort, api.VibrateLong, api.VibrateNone},
+}
+
+type schemaBuilder struct {
+	names map[reflect.Type]string
+	defs  map[string]any
+}
+
+func buildSchema() map[string]any {
+	b := schemaBuilder{names: map[reflect.Type]string{}, defs: map[string]any{}}
+	for _, t := range schemaTypes {
+		b.names[reflect.TypeOf(t.v)] = t.name
+	}
+	for _, t := range schemaTypes {
+		b.defs[t.name] = b.object(reflect.TypeOf(t.v), t.name)
+	}
+	return map[string]any{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$id":     "/schema/notification",
+		"title":   "andrNoti notification and WebSocket message types",
+		"$ref":    "#/$defs/Notification",
+		"$defs":   b.defs,
+	}
+}
+
+func (b *schemaBuilder) object(t reflect.Type, name string) map[string]any {
+	props := map[string]any{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		field, opts, _ := strings.Cut(tag, ",")
+		if field == "" {
+			field = f.Name
+		}
+		ft := f.Type
+		omitempty := strings.Contains(opts, "omitempty")
+		if omitempty && ft.Kind() == reflect.Pointer {
+			ft = ft.Elem() // omitted rather than null
+		}
+		s := b.schemaFor(ft)
+		if enum, ok := schemaEnums[name+"."+field]; ok && ft.Kind() == reflect.Slice {
+			s["items"] = map[string]any{"type": "string", "enum": enum}
+		} else if ok {
+			s["enum"] = enum
+		}
+		props[field] = s
+		if !omitempty {
+			required = append(required, field)
+		}
+	}
+	return map[string]any{
+		"type":       "object",
+		"properties": props,
+		"required":   required,
+	}
+}
+
+func (b *schemaBuilder) schemaFor(t reflect.Type) map[string]any {
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		inner := b.schemaFor(t.Elem())
+		return map[string]any{"anyOf": []any{inner, map[string]any{"type": "null"}}}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": b.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if name, ok := b.names[t]; ok {
+			return map[string]any{"$ref": "#/$defs/" + name}
+		}
+		return b.object(t, t.Name())
+	}
+	return map[string]any{} // interface{}: anything
+}
+
+func handleSchema() http.HandlerFunc {
+	schema, _ := json.MarshalIndent(buildSchema(), "", "  ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/schema+json")
+		w.Write(schema)
+	}
+}
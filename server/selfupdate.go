@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ── Self-Update ───────────────────────────────────────────────────────────────
+//
+//	andr-noti self-update -url https://…/manifest.json -public-key <base64> [-pid-file …]
+//
+// For installs without a package manager. The release manifest lists one
+// binary per platform with its SHA-256:
+//
+//	{"version":"0.5.0","binaries":{"linux/amd64":{"url":"…","sha256":"…"}}}
+//
+// and <manifest-url>.sig holds a base64 Ed25519 signature of the manifest
+// bytes. The new binary replaces the running one in place and, with
+// -pid-file, the server is sent SIGUSR2 so it restarts through the socket
+// handoff without dropping clients. A build without a version (dev) can't
+// tell a newer release from an older one, so it only installs with -force.
+
+// Download caps: nothing is trusted until the signature checks out.
+const (
+	maxManifestBytes  = 1 << 20
+	maxSignatureBytes = 4 << 10
+	maxBinaryBytes    = 512 << 20
+)
+
+// serverVersion is set at build time with -ldflags "-X main.serverVersion=…".
+var serverVersion = "dev"
+
+type releaseManifest struct {
+	Version  string `json:"version"`
+	Binaries map[string]struct {
+		URL    string `json:"url"`
+		SHA256 string `json:"sha256"`
+	} `json:"binaries"`
+}
+
+func runSelfUpdate(args []string) {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	manifestURL := fs.String("url", "", "Release manifest URL (required)")
+	pubKey := fs.String("public-key", "", "Base64 Ed25519 public key the manifest must be signed with")
+	pubKeyFile := fs.String("public-key-file", "", "Path to file containing the public key")
+	binary := fs.String("binary", "", "Binary to replace (default: this executable)")
+	pidFile := fs.String("pid-file", "", "Server --pid-file; the server is sent SIGUSR2 after the swap")
+	check := fs.Bool("check", false, "Only report whether an update is available")
+	force := fs.Bool("force", false, "Install even if the release is not newer")
+	fs.Parse(args)
+
+	if *manifestURL == "" {
+		log.Fatal("self-update: -url is required")
+	}
+	key, err := loadToken(*pubKeyFile, *pubKey)
+	if err != nil {
+		log.Fatalf("self-update: read public key: %v", err)
+	}
+	pub, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		log.Fatal("self-update: -public-key or -public-key-file must hold a base64 Ed25519 public key")
+	}
+
+	hc := &http.Client{Timeout: 5 * time.Minute}
+	raw, err := fetch(hc, *manifestURL, maxManifestBytes)
+	if err != nil {
+		log.Fatalf("self-update: manifest: %v", err)
+	}
+	sig, err := fetch(hc, *manifestURL+".sig", maxSignatureBytes)
+	if err != nil {
+		log.Fatalf("self-update: signature: %v", err)
+	}
+	sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || !ed25519.Verify(pub, raw, sig) {
+		log.Fatal("self-update: manifest signature does not verify")
+	}
+	var m releaseManifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		log.Fatalf("self-update: manifest: %v", err)
+	}
+	if !validVersion(m.Version) {
+		log.Fatalf("self-update: manifest version %q is not a dotted version", m.Version)
+	}
+
+	comparable := validVersion(serverVersion)
+	newer := comparable && compareVersions(m.Version, serverVersion) > 0
+	log.Printf("self-update: running %s, latest %s", serverVersion, m.Version)
+	if *check {
+		switch {
+		case !comparable:
+			fmt.Printf("running version %s can't be compared; latest is %s\n", serverVersion, m.Version)
+		case newer:
+			fmt.Println("update available:", m.Version)
+		default:
+			fmt.Println("up to date")
+		}
+		return
+	}
+	switch {
+	case *force:
+	case !comparable:
+		// Could be a downgrade; don't guess.
+		log.Fatalf("self-update: running version %q can't be compared with %s; use -force to install it", serverVersion, m.Version)
+	case !newer:
+		log.Printf("self-update: already up to date")
+		return
+	}
+
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	asset, ok := m.Binaries[platform]
+	if !ok {
+		log.Fatalf("self-update: release %s has no binary for %s", m.Version, platform)
+	}
+	want, err := hex.DecodeString(asset.SHA256)
+	if err != nil || len(want) != sha256.Size {
+		log.Fatalf("self-update: bad sha256 for %s", platform)
+	}
+	binURL, err := url.Parse(*manifestURL)
+	if err == nil {
+		binURL, err = binURL.Parse(asset.URL)
+	}
+	if err != nil {
+		log.Fatalf("self-update: binary url: %v", err)
+	}
+	bin, err := fetch(hc, binURL.String(), maxBinaryBytes)
+	if err != nil {
+		log.Fatalf("self-update: download: %v", err)
+	}
+	if sum := sha256.Sum256(bin); !bytes.Equal(sum[:], want) {
+		log.Fatal("self-update: downloaded binary does not match the manifest sha256")
+	}
+
+	target := *binary
+	if target == "" {
+		if target, err = os.Executable(); err != nil {
+			log.Fatalf("self-update: %v", err)
+		}
+	}
+	if target, err = filepath.EvalSymlinks(target); err != nil {
+		log.Fatalf("self-update: %v", err)
+	}
+	if err := replaceBinary(target, bin, m.Version); err != nil {
+		log.Fatalf("self-update: %v", err)
+	}
+	log.Printf("self-update: installed %s at %s", m.Version, target)
+
+	if *pidFile == "" {
+		log.Printf("self-update: send SIGUSR2 to the server (or restart it) to run the new version")
+		return
+	}
+	if err := signalHandoff(*pidFile); err != nil {
+		log.Fatalf("self-update: restart: %v", err)
+	}
+	log.Printf("self-update: server asked to hand off to the new binary")
+}
+
+// fetch downloads u, refusing bodies over limit bytes.
+func fetch(hc *http.Client, u string, limit int64) ([]byte, error) {
+	resp, err := hc.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("GET %s: larger than %d bytes", u, limit)
+	}
+	return data, nil
+}
+
+// replaceBinary writes bin next to target, checks that it runs and reports
+// the expected version, then renames it over target. The rename is atomic,
+// so a running server keeps its old image until it re-executes.
+func replaceBinary(target string, bin []byte, version string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".andr-noti-update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bin); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o755); err != nil {
+		return err
+	}
+	out, err := exec.Command(tmp.Name(), "version").Output()
+	if err != nil {
+		return fmt.Errorf("new binary does not run: %w", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != version {
+		return fmt.Errorf("new binary reports version %q, manifest says %q", got, version)
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// signalHandoff sends the handoff signal to the pid in pidFile.
+func signalHandoff(pidFile string) error {
+	sigs := handoffSignals()
+	if len(sigs) == 0 {
+		return fmt.Errorf("socket handoff is not supported on %s; restart the server", runtime.GOOS)
+	}
+	raw, err := os.ReadFile(pidFile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return fmt.Errorf("%s: %w", pidFile, err)
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(sigs[0])
+}
+
+// writePIDFile records this process as the server for self-update. After a
+// handoff the new process overwrites it.
+func writePIDFile() {
+	if *flagPIDFile == "" {
+		return
+	}
+	if err := os.WriteFile(*flagPIDFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+		log.Printf("pid file: %v", err)
+	}
+}
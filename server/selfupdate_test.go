@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer srv.Close()
+
+	if data, err := fetch(srv.Client(), srv.URL, 100); err != nil || len(data) != 100 {
+		t.Errorf("fetch at the limit = %d bytes, %v", len(data), err)
+	}
+	if _, err := fetch(srv.Client(), srv.URL, 99); err == nil {
+		t.Error("fetch over the limit succeeded")
+	}
+}
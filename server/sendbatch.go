@@ -0,0 +1,273 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// ── Batch Send ────────────────────────────────────────────────────────────────
+//
+// POST /send/batch takes a JSON array of up to sendBatchMax notifications,
+// each as /send would. The whole batch is validated first and stored in one
+// transaction, so it is accepted or refused as a unit. Clients that connected
+// with ?batch=1 receive it as a single "notifications" frame holding what
+// they may see; others get the usual one frame per notification. Routing
+// rules, quotas (one send per notification), on-call and incidents apply to
+// each item.
+
+const sendBatchMax = 100
+
+type suppressedItem struct {
+	Index int    `json:"index"`
+	Rule  string `json:"rule"`
+}
+
+func handleSendBatch(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limitBody(w, r)
+		var items []json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+			if !bodyTooLarge(w, err) {
+				http.Error(w, "body must be a JSON array of notifications", http.StatusBadRequest)
+			}
+			return
+		}
+		if len(items) == 0 || len(items) > sendBatchMax {
+			http.Error(w, fmt.Sprintf("batch must hold 1-%d notifications", sendBatchMax), http.StatusBadRequest)
+			return
+		}
+		bodies := make([]sendBody, len(items))
+		for i, raw := range items {
+			if err := json.Unmarshal(raw, &bodies[i]); err != nil {
+				http.Error(w, fmt.Sprintf("[%d]: bad notification", i), http.StatusBadRequest)
+				return
+			}
+			if e, err := bodies[i].check(); e != nil {
+				e.Field = fmt.Sprintf("[%d].%s", i, e.Field)
+				writeLimitError(w, *e)
+				log.Printf("send batch: rejected ip=%s: %s %s", clientIP(r), e.Field, e.Error)
+				return
+			} else if err != nil {
+				http.Error(w, fmt.Sprintf("[%d]: %v", i, err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		for i := range bodies {
+			if shedPriority(w, cmp.Or(bodies[i].Priority, priorityDefault)) {
+				log.Printf("send batch: shed ([%d] priority %d) ip=%s", i, cmp.Or(bodies[i].Priority, priorityDefault), clientIP(r))
+				return
+			}
+		}
+
+		caller := authFrom(r).ID
+		ok, reset, err := countSend(caller, time.Now(), len(bodies))
+		if err != nil {
+			log.Printf("usage: %v", err)
+		}
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+			http.Error(w, "daily quota exceeded for "+caller, http.StatusTooManyRequests)
+			log.Printf("send batch: quota exceeded for %s ip=%s", caller, clientIP(r))
+			return
+		}
+
+		var notes []Notification
+		var rawFor [][]byte
+		suppressed, digested := []suppressedItem{}, []suppressedItem{}
+		for i := range bodies {
+			n, matched, suppressedBy, digest := applyRoutes(nil, bodies[i].notification(authFrom(r)))
+			recordRuleHits(ruleKindRoute, matched)
+			if suppressedBy != "" {
+				suppressed = append(suppressed, suppressedItem{Index: i, Rule: suppressedBy})
+				continue
+			}
+			if digest != nil {
+				if _, _, err := holdForDigest(digest, n); err != nil {
+					log.Printf("send batch: digest %q: %v", digest.Name, err)
+					http.Error(w, "internal error", http.StatusInternalServerError)
+					return
+				}
+				digested = append(digested, suppressedItem{Index: i, Rule: digest.Name})
+				continue
+			}
+			notes = append(notes, n)
+			rawFor = append(rawFor, items[i])
+		}
+
+		notes, err = publishBatch(r.Context(), h, notes)
+		if err != nil {
+			log.Printf("send batch: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		ids := make([]int64, len(notes))
+		for i, n := range notes {
+			ids[i] = n.ID
+			if rawArchiveEnabled() {
+				archiveRaw(n.ID, r.Header.Get("Content-Type"), rawFor[i])
+			}
+		}
+
+		sentTo := h.connectedCount()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"ids": ids, "sent_to": sentTo, "suppressed": suppressed, "digested": digested})
+		log.Printf("send batch: %d stored, %d suppressed, %d held for digests ip=%s by=%s sent_to=%d", len(notes), len(suppressed), len(digested), clientIP(r), caller, sentTo)
+	}
+}
+
+// publishBatch is publish for several notifications: one transaction, and
+// one frame per batch-capable client.
+func publishBatch(ctx context.Context, h *hub, notes []Notification) ([]Notification, error) {
+	if len(notes) == 0 {
+		return notes, nil
+	}
+	ctx, s := startSpan(ctx, "publish batch", spanInternal)
+	defer s.end()
+	s.set("batch.size", len(notes))
+	start := time.Now()
+	ids := make([]int64, len(notes))
+	err := traceDB(ctx, "insert notifications", func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		stmt := tx.Stmt(stmtInsertNotification)
+		for i, n := range notes {
+			if n.Assignee == "" {
+				n.Assignee = onCallAssignee(n)
+			}
+			if ids[i], err = execInsertNotification(stmt, n); err != nil {
+				return err
+			}
+			if err := markFanOut(tx, ids[i]); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		for i, id := range ids {
+			if notes[i], err = getNotification(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for _, n := range notes {
+		promMetrics.stored(n.Topic, err)
+		if err != nil {
+			observeSLO(time.Since(start), err)
+		}
+	}
+	if err != nil {
+		s.fail(err)
+		return nil, err
+	}
+
+	newTopic := false
+	live := slices.DeleteFunc(slices.Clone(notes), quietHold)
+	traceBroadcast(ctx, len(live), func() {
+		broadcastNotifications(h, live)
+		for _, n := range live {
+			fanOut(h, n)
+		}
+	})
+	if len(live) > 0 {
+		liveIDs := make([]int64, len(live))
+		for i, n := range live {
+			liveIDs[i] = n.ID
+		}
+		busPublish(busEvent{Kind: busKindBatch, IDs: liveIDs})
+	}
+	for range notes {
+		observeSLO(time.Since(start), nil)
+	}
+	for _, n := range notes {
+		openIncident(n)
+		startEscalation(n)
+		newTopic = noteTopic(n.Topic) || newTopic
+	}
+	sendRate.add(len(notes))
+	if newTopic {
+		pushClientConfig(h)
+	}
+	return notes, nil
+}
+
+// broadcastBatch sends each batch-capable client one "notifications" frame
+// with the notifications its filters let through. Clients that would get the
+// same frame share one encoding.
+// broadcastNotifications sends a batch to this instance's clients: one
+// frame per notification, or one "notifications" frame to ?batch=1 clients.
+func broadcastNotifications(h *hub, notes []Notification) {
+	filters := make([]func(*client) bool, len(notes))
+	for i, n := range notes {
+		to := recipients(h, n)
+		filters[i] = func(c *client) bool { return to(c) && c.wants(n) }
+		broadcastTo(h, n, func(c *client) bool { return !c.batch.Load() && to(c) })
+	}
+	broadcastBatch(h, notes, filters)
+}
+
+func broadcastBatch(h *hub, notes []Notification, filters []func(*client) bool) {
+	groups := map[string][]*client{}
+	now := time.Now()
+	h.mu.RLock()
+	for c := range h.clients {
+		if !c.batch.Load() {
+			continue
+		}
+		var key strings.Builder
+		if c.html {
+			key.WriteString("h")
+		}
+		for i, to := range filters {
+			if to(c) {
+				key.WriteString("," + strconv.Itoa(i))
+			}
+		}
+		if strings.Contains(key.String(), ",") {
+			groups[key.String()] = append(groups[key.String()], c)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, members := range groups {
+		html := members[0].html
+		var list []Notification
+		var topics []string
+		var ids []int64
+		for i, n := range notes {
+			if filters[i](members[0]) {
+				if html {
+					n = withHTML(n)
+				}
+				list = append(list, n)
+				topics = append(topics, n.Topic)
+				ids = append(ids, n.ID)
+			}
+		}
+		data, _ := json.Marshal(wsMessage{Type: api.TypeNotifications, Notifications: list})
+		set := map[*client]bool{}
+		for _, c := range members {
+			set[c] = true
+		}
+		h.bcast <- envelope{data: data, to: func(c *client) bool { return set[c] }, topics: topics, ids: ids, since: now}
+	}
+}
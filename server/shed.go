@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ── Load Shedding ─────────────────────────────────────────────────────────────
+//
+// When the live heap passes --shed-memory-mb or database latency passes
+// --shed-db-latency, the server sheds load so urgent alerts still get
+// through a flood: sends below --shed-min-priority are refused with 503,
+// /import is refused, and WebSocket clients that connect get no history or
+// replay frame (they keep what they have and catch up on a later connect).
+// Entering and leaving the mode each publish a notification. Latency is the
+// slower of a probe query and the slowest notification insert since the last
+// check. The mode ends once both readings stay below 80% of their thresholds
+// for shedCalmChecks checks in a row.
+
+const (
+	shedCheck      = 5 * time.Second
+	shedCalmChecks = 3
+)
+
+var shedActive atomic.Bool
+
+var shed struct {
+	sync.Mutex
+	reason  string
+	since   time.Time
+	calm    int
+	slowest time.Duration // slowest insert since the last check
+	memory  uint64        // last readings
+	latency time.Duration
+}
+
+type shedStatus struct {
+	Active    bool   `json:"active"`
+	Reason    string `json:"reason,omitempty"`
+	Since     string `json:"since,omitempty"`
+	HeapMB    uint64 `json:"heap_mb"`
+	DBLatency string `json:"db_latency"`
+}
+
+func shedEnabled() bool { return *flagShedMemoryMB > 0 || *flagShedDBLatency > 0 }
+
+// observeDBLatency records how long a notification insert took.
+func observeDBLatency(d time.Duration) {
+	shed.Lock()
+	shed.slowest = max(shed.slowest, d)
+	shed.Unlock()
+}
+
+// shedPriority reports whether a send of priority p should be refused now,
+// answering 503 if so.
+func shedPriority(w http.ResponseWriter, p int) bool {
+	if !shedActive.Load() || p >= *flagShedMinPriority {
+		return false
+	}
+	setRetryAfter(w, 1)
+	http.Error(w, fmt.Sprintf("server is shedding load: only priority %d and above accepted", *flagShedMinPriority), http.StatusServiceUnavailable)
+	return true
+}
+
+func currentShedStatus() shedStatus {
+	shed.Lock()
+	defer shed.Unlock()
+	s := shedStatus{
+		Active:    shedActive.Load(),
+		HeapMB:    shed.memory >> 20,
+		DBLatency: shed.latency.Round(time.Microsecond).String(),
+	}
+	if s.Active {
+		s.Reason = shed.reason
+		s.Since = shed.since.UTC().Format(time.RFC3339)
+	}
+	return s
+}
+
+func startShedMonitor(h *hub) {
+	ticker := time.NewTicker(shedCheck)
+	for range ticker.C {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		latency := probeDBLatency()
+
+		shed.Lock()
+		latency = max(latency, shed.slowest)
+		shed.slowest = 0
+		shed.memory, shed.latency = ms.HeapAlloc, latency
+		shed.Unlock()
+
+		memLimit := uint64(*flagShedMemoryMB) << 20
+		var over []string
+		calm := true
+		if memLimit > 0 {
+			if ms.HeapAlloc > memLimit {
+				over = append(over, fmt.Sprintf("heap %d MB over %d MB", ms.HeapAlloc>>20, *flagShedMemoryMB))
+			}
+			calm = calm && ms.HeapAlloc < memLimit/10*8
+		}
+		if *flagShedDBLatency > 0 {
+			if latency > *flagShedDBLatency {
+				over = append(over, fmt.Sprintf("database latency %s over %s", latency.Round(time.Microsecond), *flagShedDBLatency))
+			}
+			calm = calm && latency < *flagShedDBLatency/10*8
+		}
+
+		switch {
+		case len(over) > 0 && !shedActive.Load():
+			reason := strings.Join(over, ", ")
+			shed.Lock()
+			shed.reason, shed.since, shed.calm = reason, time.Now(), 0
+			shed.Unlock()
+			shedActive.Store(true)
+			log.Printf("shed: on: %s", reason)
+			notifyShed(h, "Load shedding on",
+				fmt.Sprintf("%s. Refusing sends below priority %d and pausing history replays.", reason, *flagShedMinPriority))
+		case len(over) > 0:
+			shed.Lock()
+			shed.calm = 0
+			shed.Unlock()
+		case shedActive.Load():
+			shed.Lock()
+			if calm {
+				shed.calm++
+			} else {
+				shed.calm = 0
+			}
+			done, lasted := shed.calm >= shedCalmChecks, time.Since(shed.since).Round(time.Second)
+			shed.Unlock()
+			if done {
+				shedActive.Store(false)
+				log.Printf("shed: off after %s", lasted)
+				notifyShed(h, "Load shedding off", fmt.Sprintf("Back to normal after %s.", lasted))
+			}
+		}
+	}
+}
+
+// probeDBLatency times a cheap read that still has to get a connection from
+// the pool.
+func probeDBLatency() time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	var id int64
+	db.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM notifications`).Scan(&id)
+	return time.Since(start)
+}
+
+func notifyShed(h *hub, title, text string) {
+	if _, err := publish(context.Background(), h, Notification{
+		Title:    title,
+		Text:     text,
+		Source:   "andrNoti",
+		Priority: priorityHigh,
+	}); err != nil {
+		log.Printf("shed: notify: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ── HMAC-Signed Requests ──────────────────────────────────────────────────────
+//
+// Webhook sources that can sign but can't set Authorization send
+//
+//	X-Timestamp: <unix seconds>
+//	X-Signature: sha256=<hex HMAC-SHA256(secret, timestamp + "." + path + "." + body)>
+//
+// where path is the request path with its query string, so a request signed
+// for one endpoint can't be sent to another. Timestamps outside
+// --hmac-max-skew are rejected, and each signature is accepted only once
+// within that window, so captured requests can't be replayed. The rejection
+// says how far off the sender's clock was, and /stats keeps the skew signed
+// requests show (see clock.go).
+
+var hmacSecret string
+
+// seenSignatures remembers accepted signatures until they fall out of the
+// skew window.
+var seenSignatures = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: map[string]time.Time{}}
+
+// verifySignature checks a signed request with the given body and returns
+// what is wrong with it, or "".
+func verifySignature(r *http.Request, body []byte, now time.Time) string {
+	sig, ok := strings.CutPrefix(r.Header.Get("X-Signature"), "sha256=")
+	if !ok {
+		return "X-Signature must be sha256=<hex>"
+	}
+	ts, err := strconv.ParseInt(r.Header.Get("X-Timestamp"), 10, 64)
+	if err != nil {
+		return "X-Timestamp must be unix seconds"
+	}
+	skew := time.Unix(ts, 0).Sub(now)
+	if skew.Abs() > *flagHMACMaxSkew {
+		noteSenderSkew(skew, false)
+		return fmt.Sprintf("timestamp outside allowed window: sender clock is %s server time (max %s)",
+			describeSkew(skew), *flagHMACMaxSkew)
+	}
+	want, err := hex.DecodeString(sig)
+	if err != nil {
+		return "bad signature"
+	}
+	mac := hmac.New(sha256.New, []byte(hmacSecret))
+	mac.Write([]byte(strconv.FormatInt(ts, 10) + "." + r.URL.RequestURI() + "."))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), want) {
+		return "bad signature"
+	}
+
+	seenSignatures.Lock()
+	defer seenSignatures.Unlock()
+	for s, exp := range seenSignatures.m {
+		if now.After(exp) {
+			delete(seenSignatures.m, s)
+		}
+	}
+	// Keyed on the MAC, not its hex, which may be spelled in either case.
+	if _, dup := seenSignatures.m[string(want)]; dup {
+		return "signature already used"
+	}
+	seenSignatures.m[string(want)] = now.Add(2 * *flagHMACMaxSkew)
+	noteSenderSkew(skew, true)
+	return ""
+}
+
+// allowSigned accepts an HMAC-signed request as full access in place of a
+// Bearer token; unsigned requests fall through to requireBearer.
+func allowSigned(next http.HandlerFunc) http.HandlerFunc {
+	bearer := requireBearer(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Signature") == "" || hmacSecret == "" {
+			bearer(w, r)
+			return
+		}
+		limitBody(w, r)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			if !bodyTooLarge(w, err) {
+				http.Error(w, "bad request", http.StatusBadRequest)
+			}
+			return
+		}
+		if problem := verifySignature(r, body, time.Now()); problem != "" {
+			http.Error(w, "Unauthorized: "+problem, http.StatusUnauthorized)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		a := authInfo{ID: "hmac", Scope: scopeFull}
+		noteAuth(r, a)
+		next(w, r.WithContext(context.WithValue(r.Context(), authKey, a)))
+	}
+}
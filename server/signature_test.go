@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sign returns the hex HMAC a webhook source sends for body at ts to /send.
+func sign(secret string, ts int64, body string) string {
+	return signFor(secret, ts, "/send", body)
+}
+
+func signFor(secret string, ts int64, path, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(ts, 10) + "." + path + "." + body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func signedRequest(ts int64, sig, body string) *http.Request {
+	return signedRequestTo("/send", ts, sig, body)
+}
+
+func signedRequestTo(path string, ts int64, sig, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.Header.Set("X-Timestamp", strconv.FormatInt(ts, 10))
+	r.Header.Set("X-Signature", "sha256="+sig)
+	return r
+}
+
+// useHMACSecret sets the shared secret for one test and forgets the
+// signatures it accepted.
+func useHMACSecret(t *testing.T, secret string) {
+	t.Helper()
+	saved := hmacSecret
+	hmacSecret = secret
+	t.Cleanup(func() {
+		hmacSecret = saved
+		seenSignatures.Lock()
+		clear(seenSignatures.m)
+		seenSignatures.Unlock()
+	})
+}
+
+func TestVerifySignature(t *testing.T) {
+	useHMACSecret(t, "s3cret")
+	now := time.Now()
+	ts := now.Unix()
+	body := `{"title":"t","text":"x"}`
+	sig := sign("s3cret", ts, body)
+
+	for _, tc := range []struct {
+		name    string
+		r       *http.Request
+		problem string
+	}{
+		{"wrong secret", signedRequest(ts, sign("other", ts, body), body), "bad signature"},
+		{"body changed", signedRequest(ts, sig, body+" "), "bad signature"},
+		{"not hex", signedRequest(ts, "zz"+sig[2:], body), "bad signature"},
+		{"too old", signedRequest(ts-3600, sign("s3cret", ts-3600, body), body), "timestamp outside allowed window"},
+		{"other endpoint", signedRequestTo("/heartbeat", ts, sig, body), "bad signature"},
+		{"signed for a hook", signedRequest(ts, signFor("s3cret", ts, "/ingest/hook/a", body), body), "bad signature"},
+		{"valid", signedRequest(ts, sig, body), ""},
+	} {
+		sent, _ := io.ReadAll(tc.r.Body)
+		problem := verifySignature(tc.r, sent, now)
+		if !strings.HasPrefix(problem, tc.problem) || (tc.problem == "") != (problem == "") {
+			t.Errorf("%s: problem = %q, want %q", tc.name, problem, tc.problem)
+		}
+	}
+}
+
+// TestVerifySignatureReplay resends an accepted request, also with its hex
+// signature spelled in another case.
+func TestVerifySignatureReplay(t *testing.T) {
+	useHMACSecret(t, "s3cret")
+	now := time.Now()
+	ts := now.Unix()
+	body := `{"title":"t","text":"x"}`
+	sig := sign("s3cret", ts, body)
+
+	if problem := verifySignature(signedRequest(ts, sig, body), []byte(body), now); problem != "" {
+		t.Fatalf("first request: %s", problem)
+	}
+	for _, replay := range []string{sig, strings.ToUpper(sig)} {
+		if problem := verifySignature(signedRequest(ts, replay, body), []byte(body), now.Add(time.Second)); problem != "signature already used" {
+			t.Errorf("replay with %s: problem = %q", replay, problem)
+		}
+	}
+}
+
+func TestSignedBodyTooLarge(t *testing.T) {
+	useHMACSecret(t, "s3cret")
+	saved := *flagMaxBody
+	*flagMaxBody = 16
+	t.Cleanup(func() { *flagMaxBody = saved })
+
+	ts := time.Now().Unix()
+	body := `{"title":"t","text":"far more than sixteen bytes"}`
+	w := httptest.NewRecorder()
+	allowSigned(func(http.ResponseWriter, *http.Request) {
+		t.Error("oversized body reached the handler")
+	})(w, signedRequest(ts, sign("s3cret", ts, body), body))
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), `"limit":16`) {
+		t.Errorf("oversized signed body: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ── Routing Simulation ────────────────────────────────────────────────────────
+//
+// POST /admin/route/simulate runs a hypothetical notification through the
+// same steps /send would — maintenance, size limits, routing rules, on-call
+// assignment, incidents, recipient selection, device preferences, the
+// server's quiet hours and the clients' — and reports each decision without
+// storing, delivering or counting anything. Recipients are the clients
+// connected right now.
+
+type simRecipient struct {
+	ID     int64  `json:"id"`
+	Remote string `json:"remote"`
+	User   string `json:"user,omitempty"`
+	HTML   bool   `json:"html,omitempty"`
+}
+
+type simResult struct {
+	At                    string         `json:"at"`
+	Rejected              string         `json:"rejected,omitempty"`
+	Rules                 []routeStep    `json:"rules"`
+	SuppressedBy          string         `json:"suppressed_by,omitempty"`
+	DigestedBy            string         `json:"digested_by,omitempty"`
+	Topic                 string         `json:"topic"`
+	Priority              int            `json:"priority"`
+	OnCall                string         `json:"oncall,omitempty"`
+	Assignee              string         `json:"assignee,omitempty"`
+	Incident              bool           `json:"incident"`
+	Delivery              string         `json:"delivery,omitempty"`
+	Recipients            []simRecipient `json:"recipients"`
+	HiddenByACL           int            `json:"hidden_by_acl"`
+	FilteredByDevicePrefs int            `json:"filtered_by_device_prefs"`
+	QuietHours            string         `json:"quiet_hours,omitempty"`
+}
+
+func handleRouteSimulate(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var body struct {
+			Title    string `json:"title"`
+			Text     string `json:"text"`
+			Source   string `json:"source"`
+			Topic    string `json:"topic"`
+			Priority int    `json:"priority"`
+			At       string `json:"at"` // RFC 3339; default now
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if body.Priority < 0 || body.Priority > priorityUrgent {
+			http.Error(w, "priority must be 1-5", http.StatusBadRequest)
+			return
+		}
+		at := time.Now()
+		if body.At != "" {
+			t, err := time.Parse(time.RFC3339, body.At)
+			if err != nil {
+				http.Error(w, "at must be RFC 3339", http.StatusBadRequest)
+				return
+			}
+			at = t
+		}
+		res := simulateRoute(h, Notification{
+			Title:    body.Title,
+			Text:     body.Text,
+			Source:   body.Source,
+			Topic:    body.Topic,
+			Priority: body.Priority,
+		}, at)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+func simulateRoute(h *hub, n Notification, at time.Time) simResult {
+	res := simResult{At: at.UTC().Format(time.RFC3339), Rules: []routeStep{}, Recipients: []simRecipient{}}
+	if m := currentMaintenance(); m.Enabled {
+		res.Rejected = "server in maintenance (503)"
+	} else if e := checkSizes(n.Title, n.Text); e != nil {
+		res.Rejected = e.Error + " (413)"
+	} else if strings.TrimSpace(n.Text) == "" {
+		res.Rejected = "text is required (400)"
+	}
+
+	var digest *routeRule
+	n, _, res.SuppressedBy, digest = applyRoutes(func(s routeStep) { res.Rules = append(res.Rules, s) }, n)
+	if digest != nil {
+		res.DigestedBy = digest.Name
+	}
+	res.Topic, res.Priority = n.Topic, n.Priority
+	if res.Rejected != "" || res.SuppressedBy != "" {
+		return res
+	}
+
+	switch {
+	case !onCallTopics[n.Topic]:
+		res.OnCall = "topic is not an on-call topic"
+	case n.Priority < *flagOnCallPriority:
+		res.OnCall = fmt.Sprintf("priority below %d", *flagOnCallPriority)
+	default:
+		if st, err := onCallAt(at); err != nil {
+			res.OnCall = "could not resolve: " + err.Error()
+		} else if st.User == "" {
+			res.OnCall = "nobody on call"
+		} else {
+			res.OnCall = "assigned via " + st.Via
+		}
+		n.Assignee = onCallAssigneeAt(n, at)
+	}
+	res.Assignee = n.Assignee
+	res.Incident = n.Priority >= *flagIncidentPriority
+
+	switch {
+	case n.Assignee == "":
+		res.Delivery = "broadcast"
+	case h.userConnected(n.Assignee):
+		res.Delivery = "assignee only"
+	default:
+		res.Delivery = "broadcast (assignee not connected)"
+	}
+	if q, ok := currentQuietHours(); ok && n.Priority < q.MinPriority && q.active(at) {
+		res.Delivery = "held until quiet hours end at " + q.End + " (server time)"
+	}
+	to := recipients(h, n)
+	h.mu.RLock()
+	for c := range h.clients {
+		switch {
+		case to(c) && !c.wantsAt(n, at):
+			res.FilteredByDevicePrefs++
+		case to(c):
+			res.Recipients = append(res.Recipients, simRecipient{ID: c.id, Remote: c.ip, User: c.user, HTML: c.html})
+		case !canSee(c.user, n.Topic):
+			res.HiddenByACL++
+		}
+	}
+	h.mu.RUnlock()
+	sort.Slice(res.Recipients, func(i, j int) bool { return res.Recipients[i].ID < res.Recipients[j].ID })
+
+	if q := storedClientConfig().QuietHours; q != nil {
+		res.QuietHours = quietHoursVerdict(q, n.Priority, at)
+	}
+	return res
+}
+
+// quietHoursVerdict says whether clients would silence a notification of
+// priority at time at. Clients apply quiet hours in their own time zone; this
+// uses the server's.
+func quietHoursVerdict(q *quietHoursHint, priority int, at time.Time) string {
+	start, err1 := time.Parse("15:04", q.Start)
+	end, err2 := time.Parse("15:04", q.End)
+	if err1 != nil || err2 != nil {
+		return "invalid quiet hours " + q.Start + "–" + q.End
+	}
+	local := at.Local()
+	now := local.Hour()*60 + local.Minute()
+	from, to := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+	inside := from <= now && now < to
+	if from > to { // spans midnight
+		inside = now >= from || now < to
+	}
+	window := q.Start + "–" + q.End + " (server time)"
+	switch {
+	case !inside:
+		return "outside " + window
+	case q.MinPriority > 0 && priority >= q.MinPriority:
+		return fmt.Sprintf("inside %s, but priority %d breaks through", window, priority)
+	default:
+		return "silenced: inside " + window
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ── Delivery SLO ──────────────────────────────────────────────────────────────
+//
+// --slo-target sets an objective for sends: that percentage of notifications
+// is stored and queued for broadcast within --slo-latency. Every published
+// notification is one event, bad if it took longer or could not be stored.
+// The error budget is the rest of the events over --slo-window. Each minute
+// the server works out how fast the budget is burning over the last hour and
+// the last five minutes — the bad share divided by the share the budget
+// allows — and when both exceed --slo-burn-rate it publishes a notification,
+// then another once the last five minutes are back under it. Needing both
+// windows keeps a short blip from alerting and a cleared problem from
+// alerting for the rest of the hour. Counts are kept per minute in memory
+// for the burn rates and per hour in the database for the budget, so a
+// restart forgets the burn rates but not the budget. Status is in /stats
+// under "slo" and on /metrics.
+
+const (
+	sloCheck       = time.Minute
+	sloLongWindow  = time.Hour
+	sloShortWindow = 5 * time.Minute
+	sloMinEvents   = 10 // fewer events in the last hour never alert
+)
+
+type sloMinute struct {
+	at         int64 // unix minute the counts are for
+	total, bad int64
+}
+
+var slo struct {
+	sync.Mutex
+	minutes     [60]sloMinute
+	pendTotal   int64 // counted since the last write to slo_hours
+	pendBad     int64
+	windowTotal int64 // slo_hours over --slo-window, as of the last check
+	windowBad   int64
+	burning     bool
+	since       time.Time
+	long, short float64 // burn rates at the last check
+}
+
+type sloStatus struct {
+	Target          float64 `json:"target"`
+	Latency         string  `json:"latency"`
+	Window          string  `json:"window"`
+	Events          int64   `json:"events"`
+	Bad             int64   `json:"bad"`
+	Compliance      float64 `json:"compliance"`       // good / events over the window; 1 when empty
+	BudgetRemaining float64 `json:"budget_remaining"` // share of the error budget left, negative once overspent
+	BurnRate1h      float64 `json:"burn_rate_1h"`
+	BurnRate5m      float64 `json:"burn_rate_5m"`
+	Burning         bool    `json:"burning"`
+	Since           string  `json:"since,omitempty"`
+}
+
+func sloEnabled() bool { return *flagSLOTarget > 0 }
+
+func initSLOTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS slo_hours (
+			hour  TEXT PRIMARY KEY,
+			total INTEGER NOT NULL DEFAULT 0,
+			bad   INTEGER NOT NULL DEFAULT 0
+		)
+	`)
+	return err
+}
+
+// observeSLO records one published notification that took took.
+func observeSLO(took time.Duration, err error) {
+	if !sloEnabled() {
+		return
+	}
+	var bad int64
+	if err != nil || took > *flagSLOLatency {
+		bad = 1
+	}
+	minute := time.Now().Unix() / 60
+	slo.Lock()
+	defer slo.Unlock()
+	m := &slo.minutes[minute%60]
+	if m.at != minute {
+		*m = sloMinute{at: minute}
+	}
+	m.total++
+	m.bad += bad
+	slo.pendTotal++
+	slo.pendBad += bad
+}
+
+// sloCounts sums the minutes within window. Caller holds the lock.
+func sloCounts(window time.Duration) (total, bad int64) {
+	now := time.Now().Unix() / 60
+	for _, m := range slo.minutes {
+		if now-m.at < int64(window/time.Minute) {
+			total += m.total
+			bad += m.bad
+		}
+	}
+	return total, bad
+}
+
+// burnRate is how many times faster than the budget allows bad events occur.
+func burnRate(total, bad int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(bad) / float64(total) / (1 - *flagSLOTarget/100)
+}
+
+func startSLOMonitor(h *hub) {
+	if err := saveSLOHour(0, 0); err != nil {
+		log.Printf("slo: %v", err)
+	}
+	ticker := time.NewTicker(sloCheck)
+	for range ticker.C {
+		checkSLO(h)
+	}
+}
+
+func checkSLO(h *hub) {
+	slo.Lock()
+	pendTotal, pendBad := slo.pendTotal, slo.pendBad
+	slo.pendTotal, slo.pendBad = 0, 0
+	longTotal, longBad := sloCounts(sloLongWindow)
+	slo.long = burnRate(longTotal, longBad)
+	slo.short = burnRate(sloCounts(sloShortWindow))
+	slo.Unlock()
+
+	err := saveSLOHour(pendTotal, pendBad)
+	if err != nil {
+		// Keep the counts for the next check rather than lose them.
+		slo.Lock()
+		slo.pendTotal += pendTotal
+		slo.pendBad += pendBad
+		slo.Unlock()
+		log.Printf("slo: %v", err)
+	}
+
+	slo.Lock()
+	st := currentSLOLocked()
+	fire := !slo.burning && longTotal >= sloMinEvents &&
+		slo.long > *flagSLOBurnRate && slo.short > *flagSLOBurnRate
+	clear := slo.burning && slo.short <= *flagSLOBurnRate
+	var lasted time.Duration
+	switch {
+	case fire:
+		slo.burning, slo.since = true, time.Now()
+	case clear:
+		lasted = time.Since(slo.since).Round(time.Minute)
+		slo.burning, slo.since = false, time.Time{}
+	}
+	slo.Unlock()
+
+	objective := fmt.Sprintf("%g%% of sends within %s", *flagSLOTarget, *flagSLOLatency)
+	switch {
+	case fire:
+		log.Printf("slo: burning budget (1h %.1fx, 5m %.1fx)", st.BurnRate1h, st.BurnRate5m)
+		notifySLO(h, "Delivery SLO budget burning", fmt.Sprintf(
+			"%d of %d sends in the last hour missed the objective (%s): %.1f× the rate the budget allows. %s",
+			longBad, longTotal, objective, st.BurnRate1h, budgetLeft(st)))
+	case clear:
+		log.Printf("slo: back within budget after %s", lasted)
+		notifySLO(h, "Delivery SLO back on track", fmt.Sprintf(
+			"Sends have met the objective (%s) for the last five minutes, after %s. %s",
+			objective, lasted, budgetLeft(st)))
+	}
+}
+
+// saveSLOHour adds counts to the current hour and refreshes the window
+// totals, dropping hours that have left the window.
+func saveSLOHour(total, bad int64) error {
+	now := time.Now().UTC()
+	if total > 0 {
+		if _, err := db.Exec(`
+			INSERT INTO slo_hours (hour, total, bad) VALUES (?, ?, ?)
+			ON CONFLICT(hour) DO UPDATE SET total = total + excluded.total, bad = bad + excluded.bad`,
+			now.Format("2006-01-02T15"), total, bad); err != nil {
+			return err
+		}
+	}
+	from := now.Add(-*flagSLOWindow).Format("2006-01-02T15")
+	if _, err := db.Exec(`DELETE FROM slo_hours WHERE hour < ?`, from); err != nil {
+		return err
+	}
+	var windowTotal, windowBad int64
+	if err := db.QueryRow(`SELECT COALESCE(SUM(total), 0), COALESCE(SUM(bad), 0) FROM slo_hours`).Scan(&windowTotal, &windowBad); err != nil {
+		return err
+	}
+	slo.Lock()
+	slo.windowTotal, slo.windowBad = windowTotal, windowBad
+	slo.Unlock()
+	return nil
+}
+
+func currentSLO() *sloStatus {
+	if !sloEnabled() {
+		return nil
+	}
+	slo.Lock()
+	defer slo.Unlock()
+	st := currentSLOLocked()
+	return &st
+}
+
+func currentSLOLocked() sloStatus {
+	total, bad := slo.windowTotal+slo.pendTotal, slo.windowBad+slo.pendBad
+	st := sloStatus{
+		Target:          *flagSLOTarget,
+		Latency:         flagSLOLatency.String(),
+		Window:          flagSLOWindow.String(),
+		Events:          total,
+		Bad:             bad,
+		Compliance:      1,
+		BudgetRemaining: 1,
+		BurnRate1h:      slo.long,
+		BurnRate5m:      slo.short,
+		Burning:         slo.burning,
+	}
+	if total > 0 {
+		st.Compliance = 1 - float64(bad)/float64(total)
+		st.BudgetRemaining = 1 - burnRate(total, bad)
+	}
+	if slo.burning {
+		st.Since = slo.since.UTC().Format(time.RFC3339)
+	}
+	return st
+}
+
+func budgetLeft(st sloStatus) string {
+	if st.BudgetRemaining <= 0 {
+		return fmt.Sprintf("The %s error budget is spent.", sloWindowName())
+	}
+	return fmt.Sprintf("%.1f%% of the %s error budget is left.", st.BudgetRemaining*100, sloWindowName())
+}
+
+// sloWindowName says "30-day" rather than "720h0m0s" where it can.
+func sloWindowName() string {
+	if d := *flagSLOWindow; d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%d-day", d/(24*time.Hour))
+	}
+	return flagSLOWindow.String()
+}
+
+func notifySLO(h *hub, title, text string) {
+	if _, err := publish(context.Background(), h, Notification{
+		Title:    title,
+		Text:     text,
+		Source:   "andrNoti",
+		Priority: priorityHigh,
+	}); err != nil {
+		log.Printf("slo: notify: %v", err)
+	}
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// ── Email Gateway ─────────────────────────────────────────────────────────────
+//
+// With --smtp-listen set the server also takes mail, so things that can only
+// report by email (a NAS, a UPS, cron's MAILTO, a router) can use it as their
+// smarthost and each message becomes a notification. It is a final
+// destination, not a relay: every recipient is accepted and nothing is sent
+// on. There is no SMTP AUTH; --smtp-allow-nets limits who may connect and
+// --smtp-allow-from which envelope senders are taken. STARTTLS is offered
+// when the server has a TLS certificate.
+//
+// The subject becomes the title and the text/plain part (or the text of the
+// HTML part) the text. The source is "email:" and the sender's address, so
+// routing rules can map senders ("email:*@nas.lan") and subjects (a title
+// regex) to topics and priorities, or drop mail. A +tag on the recipient
+// (alerts+backups@…) sets the topic, and X-Priority or Importance the
+// priority. Attachments are listed by name and size; with the raw payload
+// archive on, the whole message is kept and GET /notifications/{id}/raw
+// returns it, attachments included.
+
+const (
+	smtpTimeout     = 5 * time.Minute  // per command
+	smtpDataTimeout = 10 * time.Minute // for the message itself
+	smtpMaxSessions = 16
+	smtpMaxRcpts    = 100
+	smtpMaxErrors   = 10 // bad commands before the connection is closed
+	smtpMaxDepth    = 8  // nested multiparts
+)
+
+type smtpServer struct {
+	h         *hub
+	host      string
+	nets      []*net.IPNet
+	allowFrom []string
+	tls       *tls.Config
+	sessions  chan struct{}
+}
+
+// startSMTP checks the --smtp-* flags and serves --smtp-listen in the
+// background.
+func startSMTP(h *hub, tlsCfg *tls.Config) error {
+	nets, err := parseCIDRs(*flagSMTPAllowNets)
+	if err != nil {
+		return fmt.Errorf("--smtp-allow-nets: %w", err)
+	}
+	allowFrom := splitList(strings.ToLower(*flagSMTPAllowFrom))
+	for _, g := range allowFrom {
+		if _, err := path.Match(g, ""); err != nil {
+			return fmt.Errorf("--smtp-allow-from: %q: %w", g, err)
+		}
+	}
+	if *flagSMTPMaxSize <= 0 {
+		return errors.New("--smtp-max-size must be positive")
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "andrnoti"
+	}
+	if tlsCfg != nil {
+		tlsCfg = tlsCfg.Clone()
+		tlsCfg.ClientAuth = tls.NoClientCert
+	}
+	s := &smtpServer{
+		h:         h,
+		host:      host,
+		nets:      nets,
+		allowFrom: allowFrom,
+		tls:       tlsCfg,
+		sessions:  make(chan struct{}, smtpMaxSessions),
+	}
+	go s.run()
+	return nil
+}
+
+func (s *smtpServer) run() {
+	ln, ok := bindSide("smtp", func() (net.Listener, error) { return net.Listen("tcp", *flagSMTPListen) })
+	if !ok {
+		return
+	}
+	log.Printf("smtp: listening on %s (STARTTLS: %t)", ln.Addr(), s.tls != nil)
+
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("smtp: accept: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go s.serve(conn)
+	}
+}
+
+// smtpSession is one connection's state.
+type smtpSession struct {
+	srv    *smtpServer
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	ip     net.IP
+	helo   string
+	tls    bool
+	from   string
+	rcpts  []string
+	inMail bool // MAIL accepted, so from (which may be empty) is set
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &smtpSession{srv: s}
+	c.attach(conn)
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		c.ip = addr.IP
+	}
+	if !ipInNets(c.ip, s.nets) {
+		log.Printf("smtp: refused %s (not in --smtp-allow-nets)", c.ip)
+		c.reply(554, "5.7.1 %s may not send mail here", c.ip)
+		return
+	}
+	select {
+	case s.sessions <- struct{}{}:
+		defer func() { <-s.sessions }()
+	default:
+		c.reply(421, "4.3.2 too many connections, try again later")
+		return
+	}
+	c.reply(220, "%s ESMTP andrNoti", s.host)
+
+	for errs := 0; errs < smtpMaxErrors; {
+		c.conn.SetDeadline(time.Now().Add(smtpTimeout))
+		line, err := c.r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			c.reply(500, "5.5.6 line too long")
+			return
+		}
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), " ")
+		ok, quit := c.command(strings.ToUpper(verb), strings.TrimSpace(arg))
+		if quit {
+			return
+		}
+		if !ok {
+			errs++
+		}
+	}
+	c.reply(421, "4.7.0 too many errors")
+}
+
+// attach reads and writes the session through conn.
+func (c *smtpSession) attach(conn net.Conn) {
+	c.conn, c.r, c.w = conn, bufio.NewReader(conn), bufio.NewWriter(conn)
+}
+
+func (c *smtpSession) reset() {
+	c.from, c.rcpts, c.inMail = "", nil, false
+}
+
+func (c *smtpSession) reply(code int, format string, args ...any) {
+	fmt.Fprintf(c.w, "%d %s\r\n", code, fmt.Sprintf(format, args...))
+	c.w.Flush()
+}
+
+// command runs one command and reports whether it was acceptable and
+// whether the session is over.
+func (c *smtpSession) command(verb, arg string) (ok, quit bool) {
+	switch verb {
+	case "HELO", "EHLO":
+		if arg == "" {
+			c.reply(501, "5.5.4 %s needs a domain", verb)
+			return false, false
+		}
+		c.helo = arg
+		c.reset()
+		if verb == "HELO" {
+			c.reply(250, "%s", c.srv.host)
+			return true, false
+		}
+		ext := []string{c.srv.host, "8BITMIME", "SIZE " + strconv.FormatInt(*flagSMTPMaxSize, 10), "ENHANCEDSTATUSCODES"}
+		if c.srv.tls != nil && !c.tls {
+			ext = append(ext, "STARTTLS")
+		}
+		for i, e := range ext {
+			sep := "-"
+			if i == len(ext)-1 {
+				sep = " "
+			}
+			fmt.Fprintf(c.w, "250%s%s\r\n", sep, e)
+		}
+		c.w.Flush()
+
+	case "STARTTLS":
+		if c.srv.tls == nil || c.tls {
+			c.reply(502, "5.5.1 STARTTLS not available")
+			return false, false
+		}
+		c.reply(220, "2.0.0 ready to start TLS")
+		conn := tls.Server(c.conn, c.srv.tls)
+		if err := conn.Handshake(); err != nil {
+			log.Printf("smtp: %s: TLS handshake: %v", c.ip, err)
+			return false, true
+		}
+		// Nothing said before the handshake counts (RFC 3207).
+		c.attach(conn)
+		c.tls, c.helo = true, ""
+		c.reset()
+
+	case "MAIL":
+		from, params, good := smtpPath(arg, "FROM:")
+		switch {
+		case c.helo == "":
+			c.reply(503, "5.5.1 say EHLO first")
+			return false, false
+		case c.inMail:
+			c.reply(503, "5.5.1 MAIL already given")
+			return false, false
+		case !good:
+			c.reply(501, "5.5.4 syntax: MAIL FROM:<address>")
+			return false, false
+		case currentMaintenance().Enabled:
+			c.reply(421, "4.3.0 in maintenance, try again later")
+			return true, true
+		case !c.srv.senderAllowed(from):
+			log.Printf("smtp: %s: refused sender %q (not in --smtp-allow-from)", c.ip, from)
+			c.reply(550, "5.7.1 sender not accepted")
+			return true, false
+		}
+		for _, p := range params {
+			if k, v, _ := strings.Cut(p, "="); strings.EqualFold(k, "SIZE") {
+				if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > *flagSMTPMaxSize {
+					c.reply(552, "5.3.4 message larger than %d bytes", *flagSMTPMaxSize)
+					return true, false
+				}
+			}
+		}
+		c.from, c.inMail = from, true
+		c.reply(250, "2.1.0 OK")
+
+	case "RCPT":
+		to, _, good := smtpPath(arg, "TO:")
+		switch {
+		case !c.inMail:
+			c.reply(503, "5.5.1 need MAIL first")
+			return false, false
+		case !good || to == "":
+			c.reply(501, "5.5.4 syntax: RCPT TO:<address>")
+			return false, false
+		case len(c.rcpts) >= smtpMaxRcpts:
+			c.reply(452, "4.5.3 too many recipients")
+			return true, false
+		}
+		c.rcpts = append(c.rcpts, to)
+		c.reply(250, "2.1.5 OK")
+
+	case "DATA":
+		if len(c.rcpts) == 0 {
+			c.reply(503, "5.5.1 need RCPT first")
+			return false, false
+		}
+		c.reply(354, "end with <CRLF>.<CRLF>")
+		c.conn.SetDeadline(time.Now().Add(smtpDataTimeout))
+		dot := textproto.NewReader(c.r).DotReader()
+		raw, err := io.ReadAll(io.LimitReader(dot, *flagSMTPMaxSize+1))
+		if err == nil && int64(len(raw)) > *flagSMTPMaxSize {
+			_, err = io.Copy(io.Discard, dot)
+			if err == nil {
+				c.reply(552, "5.3.4 message larger than %d bytes", *flagSMTPMaxSize)
+			}
+		} else if err == nil {
+			code, msg := c.deliver(raw)
+			c.reply(code, "%s", msg)
+		}
+		c.reset()
+		return err == nil, err != nil
+
+	case "RSET":
+		c.reset()
+		c.reply(250, "2.0.0 OK")
+	case "NOOP":
+		c.reply(250, "2.0.0 OK")
+	case "VRFY":
+		c.reply(252, "2.5.0 cannot verify, but will accept the message")
+	case "QUIT":
+		c.reply(221, "2.0.0 bye")
+		return true, true
+	default:
+		c.reply(500, "5.5.2 command not recognised")
+		return false, false
+	}
+	return true, false
+}
+
+// smtpPath parses a MAIL or RCPT argument ("FROM:<addr> SIZE=123") into the
+// address and the ESMTP parameters.
+func smtpPath(arg, prefix string) (addr string, params []string, ok bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	end := strings.IndexByte(rest, '>')
+	if !strings.HasPrefix(rest, "<") || end < 0 {
+		return "", nil, false
+	}
+	addr = rest[1:end]
+	// Drop an obsolete source route: <@relay:user@host>.
+	if strings.HasPrefix(addr, "@") {
+		if i := strings.IndexByte(addr, ':'); i >= 0 {
+			addr = addr[i+1:]
+		}
+	}
+	return addr, strings.Fields(rest[end+1:]), true
+}
+
+func (s *smtpServer) senderAllowed(from string) bool {
+	if len(s.allowFrom) == 0 {
+		return true
+	}
+	from = strings.ToLower(from)
+	for _, g := range s.allowFrom {
+		if ok, _ := path.Match(g, from); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver turns a received message into a notification and returns the
+// reply to the DATA command.
+func (c *smtpSession) deliver(raw []byte) (int, string) {
+	body, err := parseMail(raw, c.from, c.rcpts)
+	if err != nil {
+		log.Printf("smtp: %s: from %q: %v", c.ip, c.from, err)
+		return 554, "5.6.0 cannot read the message: " + err.Error()
+	}
+	if e, err := body.check(); e != nil {
+		return 552, "5.3.4 " + e.Error
+	} else if err != nil {
+		return 554, "5.6.0 " + err.Error()
+	}
+	id, err := publishPolled(c.srv.h, body, "smtp")
+	if err != nil {
+		log.Printf("smtp: %s: %v", c.ip, err)
+		return 451, "4.3.0 could not store the notification, try again later"
+	}
+	if id == 0 {
+		return 250, "2.0.0 OK"
+	}
+	if rawArchiveEnabled() {
+		with := "ESMTP"
+		if c.tls {
+			with = "ESMTPS"
+		}
+		received := fmt.Sprintf("Received: from %s (%s) by %s with %s; %s\r\n",
+			c.helo, c.ip, c.srv.host, with, time.Now().Format(time.RFC1123Z))
+		archiveRaw(id, "message/rfc822", append([]byte(received), raw...))
+	}
+	return 250, fmt.Sprintf("2.0.0 OK id=%d", id)
+}
+
+// ── Message parsing ──
+
+// parseMail builds the notification for a message sent by from to rcpts.
+func parseMail(raw []byte, from string, rcpts []string) (sendBody, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return sendBody{}, err
+	}
+	dec := &mime.WordDecoder{CharsetReader: charsetReader}
+	subject := msg.Header.Get("Subject")
+	if s, err := dec.DecodeHeader(subject); err == nil {
+		subject = s
+	}
+	if a, err := (&mail.AddressParser{WordDecoder: dec}).Parse(msg.Header.Get("From")); err == nil {
+		from = a.Address
+	}
+
+	m := mailContent{dec: dec}
+	if err := m.walk(textproto.MIMEHeader(msg.Header), msg.Body, 0); err != nil {
+		return sendBody{}, err
+	}
+	text := strings.TrimSpace(m.plain)
+	if text == "" {
+		text = htmlText(m.html)
+	}
+	var list string
+	if len(m.attachments) > 0 {
+		list = "Attachments: " + strings.Join(m.attachments, ", ")
+		if text != "" {
+			list = "\n\n" + list
+		}
+	}
+	text = cmp.Or(fitBytes(text, *flagMaxText-len(list))+list, "(empty message)")
+
+	b := sendBody{
+		Title:    fitBytes(cmp.Or(strings.Join(strings.Fields(subject), " "), "(no subject)"), *flagMaxTitle),
+		Text:     text,
+		Source:   "email:" + strings.ToLower(cmp.Or(from, "unknown")),
+		Priority: mailPriority(msg.Header),
+		Extras: &api.Extras{Source: &api.SourceMeta{
+			System: "smtp",
+			ID:     strings.Trim(msg.Header.Get("Message-Id"), "<> "),
+		}},
+	}
+	for _, to := range rcpts {
+		local, _, _ := strings.Cut(to, "@")
+		if _, tag, ok := strings.Cut(local, "+"); ok && tag != "" {
+			b.Topic = strings.ToLower(tag)
+			break
+		}
+	}
+	return b, nil
+}
+
+// mailPriority maps X-Priority (1 highest – 5 lowest) or Importance.
+func mailPriority(h mail.Header) int {
+	if v := strings.TrimSpace(h.Get("X-Priority")); v != "" {
+		switch v[0] {
+		case '1', '2':
+			return priorityHigh
+		case '4', '5':
+			return priorityLow
+		}
+		return priorityDefault
+	}
+	switch strings.ToLower(strings.TrimSpace(cmp.Or(h.Get("Importance"), h.Get("Priority")))) {
+	case "high", "urgent":
+		return priorityHigh
+	case "low", "non-urgent":
+		return priorityLow
+	}
+	return priorityDefault
+}
+
+// mailContent collects the readable parts of a message.
+type mailContent struct {
+	dec         *mime.WordDecoder
+	plain, html string
+	attachments []string // "name (size)"
+}
+
+func (m *mailContent) walk(h textproto.MIMEHeader, body io.Reader, depth int) error {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= smtpMaxDepth {
+			return errors.New("multipart nested too deeply")
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := m.walk(p.Header, p, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	disposition, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	name := cmp.Or(dparams["filename"], params["name"])
+	if s, err := m.dec.DecodeHeader(name); err == nil {
+		name = s
+	}
+	if disposition != "attachment" && name == "" && (mediaType == "text/plain" || mediaType == "text/html") {
+		if cs := strings.ToLower(params["charset"]); cs != "" && cs != "utf-8" {
+			if r, err := charsetReader(cs, body); err == nil {
+				body = r
+			}
+		}
+		b, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		s := strings.ToValidUTF8(string(b), "\uFFFD")
+		if mediaType == "text/plain" {
+			m.plain = strings.TrimSpace(m.plain + "\n\n" + s)
+		} else {
+			m.html += s
+		}
+		return nil
+	}
+	n, err := io.Copy(io.Discard, body)
+	if err != nil {
+		return err
+	}
+	m.attachments = append(m.attachments, fmt.Sprintf("%s (%s)", cmp.Or(name, mediaType), mailSize(n)))
+	return nil
+}
+
+func mailSize(n int64) string {
+	switch {
+	case n < 1<<10:
+		return fmt.Sprintf("%d B", n)
+	case n < 1<<20:
+		return fmt.Sprintf("%d KB", (n+1<<10-1)>>10)
+	}
+	return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+}
+
+// fitBytes cuts s to at most n bytes (n <= 0 = no limit), at a line or word
+// boundary where it can.
+func fitBytes(s string, n int) string {
+	const more = " …"
+	if n <= 0 || len(s) <= n {
+		return s
+	}
+	if n <= len(more) {
+		return ""
+	}
+	cut := s[:n-len(more)]
+	for !utf8.ValidString(cut) {
+		cut = cut[:len(cut)-1]
+	}
+	if i := strings.LastIndexAny(cut, "\n "); i > len(cut)/2 {
+		cut = cut[:i]
+	}
+	return strings.TrimSpace(cut) + more
+}
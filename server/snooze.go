@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// ── Snooze ────────────────────────────────────────────────────────────────────
+//
+// POST /notifications/{id}/snooze hides a notification until a later time, so
+// "remind me in 2 hours" holds on every device. Connected clients get a
+// "snoozed" frame to drop it; while snoozed it is left out of /history, the
+// WebSocket history and replay, and the unseen count. When the snooze runs
+// out it becomes unseen again and is broadcast as a new "notification" frame.
+// DELETE on the same path wakes it right away.
+
+const (
+	snoozeCheck = 15 * time.Second
+	snoozeMax   = 30 * 24 * time.Hour
+)
+
+func handleSnooze(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodPost:
+			var body struct {
+				Duration string `json:"duration"` // e.g. "2h", "30m"
+				Until    string `json:"until"`    // RFC 3339, instead of duration
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			var until time.Time
+			switch {
+			case body.Duration != "" && body.Until == "":
+				d, err := time.ParseDuration(body.Duration)
+				if err != nil {
+					http.Error(w, "duration must be a Go duration such as 2h", http.StatusBadRequest)
+					return
+				}
+				until = time.Now().Add(d)
+			case body.Until != "" && body.Duration == "":
+				if until, err = time.Parse(time.RFC3339, body.Until); err != nil {
+					http.Error(w, "until must be RFC 3339", http.StatusBadRequest)
+					return
+				}
+			default:
+				http.Error(w, "give either duration or until", http.StatusBadRequest)
+				return
+			}
+			if d := time.Until(until); d <= 0 || d > snoozeMax {
+				http.Error(w, "snooze must end in the future and within 30 days", http.StatusBadRequest)
+				return
+			}
+			n, err := snooze(h, id, until)
+			if err == sql.ErrNoRows {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Printf("snooze %d: %v", id, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(n)
+			log.Printf("snooze: %d until %s by %s", id, *n.SnoozedUntil, authFrom(r).ID)
+		case http.MethodDelete:
+			woke, err := wake(h, id)
+			if err != nil {
+				log.Printf("snooze %d: %v", id, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if !woke {
+				http.Error(w, "not snoozed", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// snooze hides notification id until until and tells the clients that can
+// see it.
+func snooze(h *hub, id int64, until time.Time) (Notification, error) {
+	res, err := db.Exec(`UPDATE notifications SET snoozed_until = ? WHERE id = ?`, sqliteTime(until), id)
+	if err != nil {
+		return Notification{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Notification{}, sql.ErrNoRows
+	}
+	n, err := getNotification(id)
+	if err != nil {
+		return n, err
+	}
+	data, _ := json.Marshal(wsMessage{Type: api.TypeSnoozed, ID: id, SnoozedUntil: n.SnoozedUntil})
+	h.bcast <- envelope{data: data, to: func(c *client) bool { return c.sees(n.Topic) }}
+	busPublish(busEvent{Kind: busKindFrame, Frame: data, Topic: n.Topic})
+	return n, nil
+}
+
+// wake ends a snooze: the notification is unseen again and delivered as if
+// new. It reports false if id wasn't snoozed, so concurrent wakers deliver it
+// once.
+func wake(h *hub, id int64) (bool, error) {
+	res, err := db.Exec(`UPDATE notifications SET snoozed_until = NULL, seen_at = NULL WHERE id = ? AND snoozed_until IS NOT NULL`, id)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	n, err := getNotification(id)
+	if err != nil {
+		return true, err
+	}
+	broadcastNotification(h, n)
+	return true, nil
+}
+
+// startSnoozeWaker wakes notifications whose snooze has run out.
+func startSnoozeWaker(h *hub) {
+	ticker := time.NewTicker(snoozeCheck)
+	for range ticker.C {
+		rows, err := db.Query(`SELECT id FROM notifications WHERE snoozed_until <= ?`, sqliteTime(time.Now()))
+		if err != nil {
+			log.Printf("snooze: %v", err)
+			continue
+		}
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			if rows.Scan(&id) == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+		for _, id := range ids {
+			if woke, err := wake(h, id); err != nil {
+				log.Printf("snooze: wake %d: %v", id, err)
+			} else if woke {
+				log.Printf("snooze: %d is due", id)
+			}
+		}
+	}
+}
+
+// snoozedNotifications lists what is snoozed, soonest to wake first.
+func snoozedNotifications() ([]Notification, error) {
+	rows, err := db.Query(`SELECT ` + notificationCols + ` FROM notifications WHERE snoozed_until IS NOT NULL ORDER BY snoozed_until, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ns []Notification
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+	return ns, rows.Err()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// ── State Sync ────────────────────────────────────────────────────────────────
+//
+// Connected clients hear about changes to the notifications they hold, so
+// every open UI stays in step without polling /history:
+//
+//   - "seen" when notifications are marked seen (see Read Receipts);
+//   - "deleted" with the ids a bulk delete, merge or split removed, or with
+//     only an id when DELETE /notifications removed everything up to it;
+//   - "updated" with the current state of notifications changed in place
+//     (what a merge keeps) or added without alerting (a split's parts).
+//     Clients replace their copies by id, or add them, and don't alert.
+//
+// Deleted and updated frames are protocol 2: they go only to clients whose
+// hello agreed on it, since an older app may not expect them. As with seen
+// frames, a client only hears about topics it may see, and the other
+// instances are told over the bus.
+
+// noteRef identifies a notification and its topic, which decides who may
+// hear about it.
+type noteRef struct {
+	id    int64
+	topic string
+}
+
+// noteRefs looks up the topics of ids, skipping any that don't exist.
+func noteRefs(ids []int64) ([]noteRef, error) {
+	where, args := idsClause("id", ids)
+	rows, err := db.Query(`SELECT id, topic FROM notifications WHERE `+where+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []noteRef
+	for rows.Next() {
+		var n noteRef
+		if err := rows.Scan(&n.id, &n.topic); err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, rows.Err()
+}
+
+// broadcastIDs sends each client that may see some of notes one frame, made
+// by frame from the ids it may see. skip, if set, leaves clients out.
+// Clients that get the same ids share one encoding.
+func broadcastIDs(h *hub, notes []noteRef, skip func(*client) bool, frame func(ids []int64) wsMessage) {
+	groups := map[string][]*client{}
+	h.mu.RLock()
+	for c := range h.clients {
+		if skip != nil && skip(c) {
+			continue
+		}
+		var key strings.Builder
+		for i, n := range notes {
+			if c.sees(n.topic) {
+				key.WriteString("," + strconv.Itoa(i))
+			}
+		}
+		if key.Len() > 0 {
+			groups[key.String()] = append(groups[key.String()], c)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, members := range groups {
+		var ids []int64
+		for _, n := range notes {
+			if members[0].sees(n.topic) {
+				ids = append(ids, n.id)
+			}
+		}
+		data, _ := json.Marshal(frame(ids))
+		set := map[*client]bool{}
+		for _, c := range members {
+			set[c] = true
+		}
+		h.bcast <- envelope{data: data, to: func(c *client) bool { return set[c] }}
+	}
+}
+
+// announceDeleted tells clients here and on the other instances that notes
+// were deleted, or, with through, every notification up to that id.
+func announceDeleted(h *hub, notes []noteRef, through int64) {
+	broadcastDeleted(h, notes, through)
+	e := busEvent{Kind: busKindDeleted, Through: through}
+	for _, n := range notes {
+		e.IDs = append(e.IDs, n.id)
+		e.Topics = append(e.Topics, n.topic)
+	}
+	busPublish(e)
+}
+
+func broadcastDeleted(h *hub, notes []noteRef, through int64) {
+	if through > 0 {
+		data, _ := json.Marshal(wsMessage{Type: api.TypeDeleted, ID: through})
+		h.bcast <- envelope{data: data, to: func(c *client) bool { return c.speaks(2) }}
+		return
+	}
+	broadcastIDs(h, notes, func(c *client) bool { return !c.speaks(2) }, func(ids []int64) wsMessage {
+		return wsMessage{Type: api.TypeDeleted, IDs: ids}
+	})
+}
+
+// announceUpdated sends the current state of ids to clients here and on the
+// other instances.
+func announceUpdated(h *hub, ids []int64) {
+	broadcastUpdated(h, loadNotifications(ids))
+	busPublish(busEvent{Kind: busKindUpdated, IDs: ids})
+}
+
+// broadcastUpdated sends each client an "updated" frame with those of notes
+// it may see. Clients that get the same list share one encoding.
+func broadcastUpdated(h *hub, notes []Notification) {
+	groups := map[string][]*client{}
+	h.mu.RLock()
+	for c := range h.clients {
+		if !c.speaks(2) {
+			continue
+		}
+		var key strings.Builder
+		if c.html {
+			key.WriteString("h")
+		}
+		for i, n := range notes {
+			if c.sees(n.Topic) {
+				key.WriteString("," + strconv.Itoa(i))
+			}
+		}
+		if strings.Contains(key.String(), ",") {
+			groups[key.String()] = append(groups[key.String()], c)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, members := range groups {
+		var list []Notification
+		for _, n := range notes {
+			if members[0].sees(n.Topic) {
+				if members[0].html {
+					n = withHTML(n)
+				}
+				list = append(list, n)
+			}
+		}
+		data, _ := json.Marshal(wsMessage{Type: api.TypeUpdated, Notifications: list})
+		set := map[*client]bool{}
+		for _, c := range members {
+			set[c] = true
+		}
+		h.bcast <- envelope{data: data, to: func(c *client) bool { return set[c] }}
+	}
+}
+
+// loadNotifications reads ids, logging and skipping any it can't.
+func loadNotifications(ids []int64) []Notification {
+	var out []Notification
+	for _, id := range ids {
+		n, err := getNotification(id)
+		if err != nil {
+			log.Printf("notification %d: %v", id, err)
+			continue
+		}
+		out = append(out, n)
+	}
+	return out
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ── Live Stats Stream ─────────────────────────────────────────────────────────
+//
+// WebSocket clients can send {"type":"subscribe","stream":"stats"} to receive
+// a {"type":"stats"} frame every --stats-interval, instead of polling /stats.
+
+// rateCounter counts events over a sliding one-minute window in one-second
+// buckets.
+type rateCounter struct {
+	mu      sync.Mutex
+	buckets [60]int
+	stamps  [60]int64 // unix second each bucket was last reset for
+}
+
+func (rc *rateCounter) add(n int) {
+	now := time.Now().Unix()
+	i := now % 60
+	rc.mu.Lock()
+	if rc.stamps[i] != now {
+		rc.stamps[i], rc.buckets[i] = now, 0
+	}
+	rc.buckets[i] += n
+	rc.mu.Unlock()
+}
+
+// perMinute returns the number of events in the last 60 seconds.
+func (rc *rateCounter) perMinute() int {
+	now := time.Now().Unix()
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	total := 0
+	for i, ts := range rc.stamps {
+		if now-ts < 60 {
+			total += rc.buckets[i]
+		}
+	}
+	return total
+}
+
+var sendRate rateCounter
+
+func collectLiveStats(h *hub) liveStats {
+	var unseen int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM notifications WHERE seen_at IS NULL AND snoozed_until IS NULL`).Scan(&unseen); err != nil {
+		log.Printf("stats: unseen count: %v", err)
+	}
+	return liveStats{
+		Connected:   h.connectedCount(),
+		SendsPerMin: sendRate.perMinute(),
+		Unseen:      unseen,
+		Dropped:     h.droppedTotal.Load(),
+		At:          time.Now().Unix(),
+	}
+}
+
+func startStatsStream(h *hub, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !h.anyStatsSubscriber() {
+			continue
+		}
+		st := collectLiveStats(h)
+		data, _ := json.Marshal(wsMessage{Type: "stats", Stats: &st})
+		h.bcast <- envelope{data: data, to: func(c *client) bool { return c.statsSub.Load() }}
+	}
+}
+
+func (h *hub) anyStatsSubscriber() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.clients {
+		if c.statsSub.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// ── Volume Stats ──────────────────────────────────────────────────────────────
+//
+// GET /stats also reports how many notifications arrived, for a dashboard
+// panel about alert volume: per UTC day over ?days= (default 30, at most
+// 365), per hour over the last ?hours= (default 24, at most 168), and per
+// topic, per priority and seen versus unseen over the same days. Day and hour
+// series list every bucket, including empty ones, oldest first.
+
+const (
+	volumeDays    = 30
+	volumeMaxDays = 365
+	volumeHours   = 24
+	volumeMaxHrs  = 7 * 24
+)
+
+type countBucket struct {
+	Start string `json:"start"`
+	Count int    `json:"count"`
+}
+
+type topicCount struct {
+	Topic string `json:"topic"`
+	Count int    `json:"count"`
+}
+
+type priorityCount struct {
+	Priority int `json:"priority"`
+	Count    int `json:"count"`
+}
+
+type volumeStats struct {
+	Days        int             `json:"days"`
+	Hours       int             `json:"hours"`
+	PerDay      []countBucket   `json:"per_day"`
+	PerHour     []countBucket   `json:"per_hour"`
+	PerTopic    []topicCount    `json:"per_topic"`    // busiest first
+	PerPriority []priorityCount `json:"per_priority"` // lowest first
+	Seen        int             `json:"seen"`
+	Unseen      int             `json:"unseen"`
+	SeenRatio   float64         `json:"seen_ratio"` // seen / total, 0 when empty
+}
+
+func collectVolumeStats(days, hours int) (volumeStats, error) {
+	now := time.Now().UTC()
+	v := volumeStats{Days: days, Hours: hours, PerTopic: []topicCount{}, PerPriority: []priorityCount{}}
+	dayStart := now.Truncate(24*time.Hour).AddDate(0, 0, -(days - 1))
+	hourStart := now.Truncate(time.Hour).Add(-time.Duration(hours-1) * time.Hour)
+
+	var err error
+	if v.PerDay, err = bucketCounts(`%Y-%m-%d 00:00:00`, dayStart, days, 24*time.Hour); err != nil {
+		return v, err
+	}
+	if v.PerHour, err = bucketCounts(`%Y-%m-%d %H:00:00`, hourStart, hours, time.Hour); err != nil {
+		return v, err
+	}
+
+	since := sqliteTime(dayStart)
+	rows, err := db.Query(`SELECT topic, COUNT(*) FROM notifications WHERE created_at >= ?
+		GROUP BY topic ORDER BY COUNT(*) DESC, topic`, since)
+	if err != nil {
+		return v, err
+	}
+	for rows.Next() {
+		var t topicCount
+		if err := rows.Scan(&t.Topic, &t.Count); err != nil {
+			rows.Close()
+			return v, err
+		}
+		v.PerTopic = append(v.PerTopic, t)
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT priority, COUNT(*) FROM notifications WHERE created_at >= ?
+		GROUP BY priority ORDER BY priority`, since)
+	if err != nil {
+		return v, err
+	}
+	for rows.Next() {
+		var p priorityCount
+		if err := rows.Scan(&p.Priority, &p.Count); err != nil {
+			rows.Close()
+			return v, err
+		}
+		v.PerPriority = append(v.PerPriority, p)
+	}
+	rows.Close()
+
+	if err := db.QueryRow(`SELECT COUNT(seen_at), COUNT(*) - COUNT(seen_at) FROM notifications WHERE created_at >= ?`,
+		since).Scan(&v.Seen, &v.Unseen); err != nil {
+		return v, err
+	}
+	if total := v.Seen + v.Unseen; total > 0 {
+		v.SeenRatio = float64(v.Seen) / float64(total)
+	}
+	return v, nil
+}
+
+// bucketCounts counts notifications in n buckets of width step from start,
+// grouping created_at with the strftime format layout.
+func bucketCounts(layout string, start time.Time, n int, step time.Duration) ([]countBucket, error) {
+	rows, err := db.Query(`SELECT strftime(?, created_at), COUNT(*) FROM notifications
+		WHERE created_at >= ? GROUP BY 1`, layout, sqliteTime(start))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		var k string
+		var c int
+		if err := rows.Scan(&k, &c); err != nil {
+			return nil, err
+		}
+		counts[k] = c
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	out := make([]countBucket, n)
+	for i := range n {
+		t := start.Add(time.Duration(i) * step)
+		out[i] = countBucket{Start: t.Format(time.RFC3339), Count: counts[sqliteTime(t)]}
+	}
+	return out, nil
+}
+
+// volumeWindow reads ?days= and ?hours=, falling back to the defaults and
+// clamping to the maximums.
+func volumeWindow(r *http.Request) (days, hours int) {
+	days, hours = volumeDays, volumeHours
+	if n, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && n > 0 {
+		days = min(n, volumeMaxDays)
+	}
+	if n, err := strconv.Atoi(r.URL.Query().Get("hours")); err == nil && n > 0 {
+		hours = min(n, volumeMaxHrs)
+	}
+	return days, hours
+}
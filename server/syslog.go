@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// ── Syslog ────────────────────────────────────────────────────────────────────
+//
+// With --syslog-listen set the server takes syslog over UDP and TCP on that
+// address, for routers, NAS boxes and the like that can send nothing else.
+// Both RFC 3164 (BSD) and RFC 5424 messages are understood, and TCP takes
+// newline-delimited or octet-counted framing (RFC 6587).
+//
+// Only lines that make it through three filters become notifications:
+// their severity must be listed in --syslog-priorities, which also gives the
+// priority; --syslog-match, if set, must match the tag and message
+// ("sshd: Failed password for root…"); and --syslog-ignore must not. A host
+// is held to syslogHostRate notifications a minute, since a device in
+// trouble can log the same line many times a second. The title is the host
+// and tag, the source "syslog:" and the host, so routing rules can take it
+// from there. Lines that arrive during maintenance are dropped: syslog has
+// no way to ask a sender to retry.
+
+const (
+	syslogMaxLine     = 8 << 10 // longest TCP line or frame kept
+	syslogIdleTimeout = time.Hour
+	syslogMaxConns    = 32
+	syslogHostRate    = 30 // notifications per host per minute
+)
+
+// syslogSeverities are the RFC 5424 severity names, by code.
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+type syslogServer struct {
+	h          *hub
+	nets       []*net.IPNet
+	priorities map[int]int // severity code → priority; unlisted severities are dropped
+	match      *regexp.Regexp
+	ignore     *regexp.Regexp
+	conns      chan struct{}
+
+	mu    sync.Mutex
+	hosts map[string]*syslogHost
+}
+
+// syslogHost is a host's notifications in the current minute.
+type syslogHost struct {
+	window  time.Time
+	sent    int
+	dropped int
+}
+
+var syslogCounts struct {
+	received, notified, filtered, dropped, malformed atomic.Int64
+}
+
+func syslogStats() map[string]any {
+	if *flagSyslogListen == "" {
+		return nil
+	}
+	return map[string]any{
+		"received":  syslogCounts.received.Load(),
+		"notified":  syslogCounts.notified.Load(),
+		"filtered":  syslogCounts.filtered.Load(),
+		"dropped":   syslogCounts.dropped.Load(),
+		"malformed": syslogCounts.malformed.Load(),
+	}
+}
+
+// startSyslog checks the --syslog-* flags and serves --syslog-listen in the
+// background.
+func startSyslog(h *hub) error {
+	s := &syslogServer{h: h, conns: make(chan struct{}, syslogMaxConns), hosts: map[string]*syslogHost{}}
+	var err error
+	if s.nets, err = parseCIDRs(*flagSyslogAllowNets); err != nil {
+		return fmt.Errorf("--syslog-allow-nets: %w", err)
+	}
+	byName, err := parsePriorityMap(*flagSyslogPriorities)
+	if err != nil {
+		return fmt.Errorf("--syslog-priorities: %w", err)
+	}
+	s.priorities = map[int]int{}
+	for name, p := range byName {
+		code := slices.Index(syslogSeverities, name)
+		if code < 0 {
+			return fmt.Errorf("--syslog-priorities: unknown severity %q (want one of %s)", name, strings.Join(syslogSeverities, ", "))
+		}
+		s.priorities[code] = p
+	}
+	if *flagSyslogMatch != "" {
+		if s.match, err = regexp.Compile(*flagSyslogMatch); err != nil {
+			return fmt.Errorf("--syslog-match: %w", err)
+		}
+	}
+	if *flagSyslogIgnore != "" {
+		if s.ignore, err = regexp.Compile(*flagSyslogIgnore); err != nil {
+			return fmt.Errorf("--syslog-ignore: %w", err)
+		}
+	}
+	go s.serveUDP()
+	go s.serveTCP()
+	return nil
+}
+
+func (s *syslogServer) serveUDP() {
+	pc, ok := bindSide("syslog", func() (net.PacketConn, error) { return net.ListenPacket("udp", *flagSyslogListen) })
+	if !ok {
+		return
+	}
+	log.Printf("syslog: listening on udp %s", pc.LocalAddr())
+	buf := make([]byte, 64<<10)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("syslog: udp: %v", err)
+			continue
+		}
+		ip := addrIP(addr)
+		if !ipInNets(ip, s.nets) {
+			continue
+		}
+		s.handle(buf[:n], ip)
+	}
+}
+
+func (s *syslogServer) serveTCP() {
+	ln, ok := bindSide("syslog", func() (net.Listener, error) { return net.Listen("tcp", *flagSyslogListen) })
+	if !ok {
+		return
+	}
+	log.Printf("syslog: listening on tcp %s", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("syslog: accept: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *syslogServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	ip := addrIP(conn.RemoteAddr())
+	if !ipInNets(ip, s.nets) {
+		log.Printf("syslog: refused %s (not in --syslog-allow-nets)", ip)
+		return
+	}
+	select {
+	case s.conns <- struct{}{}:
+		defer func() { <-s.conns }()
+	default:
+		log.Printf("syslog: refused %s (%d connections open)", ip, syslogMaxConns)
+		return
+	}
+	r := bufio.NewReaderSize(conn, syslogMaxLine)
+	for {
+		conn.SetReadDeadline(time.Now().Add(syslogIdleTimeout))
+		line, err := readSyslogFrame(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("syslog: %s: %v", ip, err)
+			}
+			return
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			s.handle(line, ip)
+		}
+	}
+}
+
+// readSyslogFrame reads one message: "LEN MSG" when the stream starts with
+// a digit (octet counting), otherwise a line. Overlong lines are cut.
+func readSyslogFrame(r *bufio.Reader) ([]byte, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] >= '0' && b[0] <= '9' {
+		n, err := r.ReadString(' ')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(n))
+		if err != nil || size <= 0 || size > 1<<20 {
+			return nil, fmt.Errorf("bad frame length %q", strings.TrimSpace(n))
+		}
+		msg := make([]byte, min(size, syslogMaxLine))
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return nil, err
+		}
+		_, err = r.Discard(size - len(msg))
+		return msg, err
+	}
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		line = slices.Clone(line)
+		for errors.Is(err, bufio.ErrBufferFull) {
+			_, err = r.ReadSlice('\n')
+		}
+	}
+	if err != nil && !(errors.Is(err, io.EOF) && len(line) > 0) {
+		return nil, err
+	}
+	return line, nil
+}
+
+func addrIP(a net.Addr) net.IP {
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// handle filters one message from ip and notifies about it.
+func (s *syslogServer) handle(line []byte, ip net.IP) {
+	syslogCounts.received.Add(1)
+	m, err := parseSyslog(line)
+	if err != nil {
+		syslogCounts.malformed.Add(1)
+		return
+	}
+	m.host = strings.ToLower(cmp.Or(m.host, ip.String()))
+	p, ok := s.priorities[m.severity]
+	tagged := m.text
+	if m.app != "" {
+		tagged = m.app + ": " + m.text
+	}
+	if !ok || s.match != nil && !s.match.MatchString(tagged) || s.ignore != nil && s.ignore.MatchString(tagged) {
+		syslogCounts.filtered.Add(1)
+		return
+	}
+	if currentMaintenance().Enabled || !s.allow(m.host) {
+		syslogCounts.dropped.Add(1)
+		return
+	}
+
+	b := sendBody{
+		Title:    fitBytes(m.host+": "+cmp.Or(m.app, syslogSeverities[m.severity]), *flagMaxTitle),
+		Text:     fitBytes(cmp.Or(m.text, "(empty message)"), *flagMaxText),
+		Source:   "syslog:" + m.host,
+		Priority: p,
+		Extras:   &api.Extras{Source: &api.SourceMeta{System: "syslog", ID: m.msgID}},
+	}
+	if _, err := publishPolled(s.h, b, "syslog"); err != nil {
+		log.Printf("syslog: %s: %v", m.host, err)
+		return
+	}
+	syslogCounts.notified.Add(1)
+}
+
+// allow counts a notification against host's rate and reports whether it
+// may be sent.
+func (s *syslogServer) allow(host string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	hs := s.hosts[host]
+	if hs == nil {
+		hs = &syslogHost{}
+		s.hosts[host] = hs
+	}
+	if now.Sub(hs.window) >= time.Minute {
+		if hs.dropped > 0 {
+			log.Printf("syslog: %s: dropped %d lines over %d a minute", host, hs.dropped, syslogHostRate)
+		}
+		hs.window, hs.sent, hs.dropped = now, 0, 0
+	}
+	if hs.sent >= syslogHostRate {
+		hs.dropped++
+		return false
+	}
+	hs.sent++
+	return true
+}
+
+// ── Message parsing ──
+
+type syslogMsg struct {
+	severity int
+	host     string
+	app      string
+	msgID    string
+	text     string
+}
+
+// parseSyslog reads an RFC 5424 or RFC 3164 message. Only the <PRI> is
+// required; senders leave out or mangle the rest often enough.
+func parseSyslog(line []byte) (syslogMsg, error) {
+	s := strings.TrimRight(strings.ToValidUTF8(string(line), "\uFFFD"), "\r\n\x00")
+	end := strings.IndexByte(s, '>')
+	if !strings.HasPrefix(s, "<") || end < 2 || end > 4 {
+		return syslogMsg{}, errors.New("no <PRI>")
+	}
+	pri, err := strconv.Atoi(s[1:end])
+	if err != nil || pri > 191 {
+		return syslogMsg{}, fmt.Errorf("bad PRI %q", s[1:end])
+	}
+	m := syslogMsg{severity: pri % 8}
+	s = s[end+1:]
+	if rest, ok := strings.CutPrefix(s, "1 "); ok {
+		parseRFC5424(&m, rest)
+	} else {
+		parseRFC3164(&m, s)
+	}
+	m.text = strings.TrimSpace(strings.TrimPrefix(m.text, "\ufeff")) // RFC 5424 allows a BOM
+	return m, nil
+}
+
+// parseRFC5424 reads "TIMESTAMP HOST APP PROCID MSGID SD MSG".
+func parseRFC5424(m *syslogMsg, s string) {
+	f := strings.SplitN(s, " ", 6)
+	nilValue := func(i int) string {
+		if i >= len(f) || f[i] == "-" {
+			return ""
+		}
+		return f[i]
+	}
+	m.host, m.app, m.msgID = nilValue(1), nilValue(2), nilValue(4)
+	if len(f) < 6 {
+		return
+	}
+	rest := f[5]
+	if strings.HasPrefix(rest, "-") {
+		m.text = strings.TrimPrefix(rest[1:], " ")
+		return
+	}
+	// Skip structured data: [id k="v" …][…], where values may escape ] and ".
+	inElem, inQuote := false, false
+	for i := 0; i < len(rest); i++ {
+		switch c := rest[i]; {
+		case inQuote && c == '\\':
+			i++
+		case c == '"' && inElem:
+			inQuote = !inQuote
+		case inQuote:
+		case c == '[':
+			inElem = true
+		case c == ']':
+			inElem = false
+		case !inElem:
+			m.text = strings.TrimPrefix(rest[i:], " ")
+			return
+		}
+	}
+}
+
+// parseRFC3164 reads "Mmm dd hh:mm:ss HOST TAG[PID]: MSG", where the
+// timestamp and host may be missing.
+func parseRFC3164(m *syslogMsg, s string) {
+	stamped := false
+	if len(s) > len(time.Stamp) {
+		if _, err := time.Parse(time.Stamp, s[:len(time.Stamp)]); err == nil {
+			s, stamped = strings.TrimLeft(s[len(time.Stamp):], " "), true
+		}
+	}
+	if !stamped {
+		if first, rest, ok := strings.Cut(s, " "); ok {
+			if _, err := time.Parse(time.RFC3339, first); err == nil {
+				s, stamped = rest, true
+			}
+		}
+	}
+	// The host follows a timestamp, unless what follows is already the tag.
+	// Without a timestamp, a word is only taken as the host when a tag
+	// ("dnsmasq:", "sshd[9]:") comes after it.
+	if first, rest, ok := strings.Cut(s, " "); ok && !strings.ContainsAny(first, ":[") {
+		next, _, _ := strings.Cut(rest, " ")
+		if stamped || strings.HasSuffix(next, ":") && !strings.HasPrefix(next, "[") {
+			m.host, s = first, rest
+		}
+	}
+	if tag, rest, ok := strings.Cut(s, ":"); ok && len(tag) <= 48 && !strings.ContainsAny(tag, " \t") {
+		if i := strings.IndexByte(tag, '['); i > 0 {
+			tag = tag[:i]
+		}
+		m.app, s = tag, rest
+	}
+	m.text = s
+}
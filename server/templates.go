@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// ── Templates ─────────────────────────────────────────────────────────────────
+//
+// Scripts that send the same kind of message keep its wording on the server:
+// PUT /admin/templates/{name} stores a template whose title, text and
+// click_url are Go text/templates, with defaults for the other fields, and
+// POST /send/template/{name} with {"vars":{…}} renders it and sends the
+// result exactly as /send would — same checks, rules, quotas and archive. A
+// variable the template uses but the request doesn't set is an error, so a
+// typo fails the send instead of delivering "<no value>". Every save and
+// delete is recorded in the rule version store (rules.go), so a template can
+// be reverted like a rule.
+
+const ruleKindTemplate = "template"
+
+var templateNameRE = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type notificationTemplate struct {
+	Name      string `json:"name"`
+	Title     string `json:"title"`
+	Text      string `json:"text"`
+	Format    string `json:"format,omitempty"`
+	Source    string `json:"source,omitempty"`
+	Topic     string `json:"topic,omitempty"`
+	Priority  int    `json:"priority,omitempty"`
+	ClickURL  string `json:"click_url,omitempty"`
+	UpdatedBy string `json:"updated_by,omitempty"`
+	UpdatedAt string `json:"updated_at,omitempty"`
+}
+
+func initTemplateTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS templates (
+			name       TEXT PRIMARY KEY,
+			title      TEXT NOT NULL DEFAULT '',
+			text       TEXT NOT NULL,
+			format     TEXT NOT NULL DEFAULT '',
+			source     TEXT NOT NULL DEFAULT '',
+			topic      TEXT NOT NULL DEFAULT '',
+			priority   INTEGER NOT NULL DEFAULT 0,
+			click_url  TEXT NOT NULL DEFAULT '',
+			updated_by TEXT NOT NULL DEFAULT '',
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	return err
+}
+
+const templateCols = `name, title, text, format, source, topic, priority, click_url, updated_by, updated_at`
+
+func scanTemplate(s interface{ Scan(...any) error }) (notificationTemplate, error) {
+	var t notificationTemplate
+	err := s.Scan(&t.Name, &t.Title, &t.Text, &t.Format, &t.Source, &t.Topic, &t.Priority, &t.ClickURL, &t.UpdatedBy, &t.UpdatedAt)
+	return t, err
+}
+
+// upsertTemplate stores t, replacing any template of the same name.
+func upsertTemplate(t notificationTemplate, by string) error {
+	_, err := db.Exec(`
+		INSERT INTO templates (name, title, text, format, source, topic, priority, click_url, updated_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET title = excluded.title, text = excluded.text, format = excluded.format,
+			source = excluded.source, topic = excluded.topic, priority = excluded.priority,
+			click_url = excluded.click_url, updated_by = excluded.updated_by, updated_at = CURRENT_TIMESTAMP`,
+		t.Name, t.Title, t.Text, t.Format, t.Source, t.Topic, t.Priority, t.ClickURL, by)
+	return err
+}
+
+// templateVersion is the body recorded for a save: the template without its
+// updated_by and updated_at, which the version carries itself.
+func templateVersion(t notificationTemplate) string {
+	t.UpdatedBy, t.UpdatedAt = "", ""
+	raw, _ := json.Marshal(t)
+	return string(raw)
+}
+
+// applyTemplate puts a reverted version of a template in force.
+func applyTemplate(name, body, by string) error {
+	if body == "" {
+		_, err := db.Exec(`DELETE FROM templates WHERE name = ?`, name)
+		return err
+	}
+	var t notificationTemplate
+	if err := json.Unmarshal([]byte(body), &t); err != nil {
+		return err
+	}
+	t.Name = name
+	return upsertTemplate(t, by)
+}
+
+// parse compiles the templated fields.
+func (t notificationTemplate) parse() (title, text, clickURL *template.Template, err error) {
+	compile := func(field, src string) *template.Template {
+		if err != nil {
+			return nil
+		}
+		var tmpl *template.Template
+		tmpl, err = template.New(field).Option("missingkey=error").Parse(src)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", field, err)
+		}
+		return tmpl
+	}
+	return compile("title", t.Title), compile("text", t.Text), compile("click_url", t.ClickURL), err
+}
+
+// render fills the template in with vars.
+func (t notificationTemplate) render(vars map[string]any) (sendBody, error) {
+	title, text, clickURL, err := t.parse()
+	if err != nil {
+		return sendBody{}, err
+	}
+	b := sendBody{Format: t.Format, Source: t.Source, Topic: t.Topic, Priority: t.Priority}
+	for _, f := range []struct {
+		tmpl *template.Template
+		out  *string
+	}{{title, &b.Title}, {text, &b.Text}, {clickURL, &b.ClickURL}} {
+		var buf bytes.Buffer
+		if err := f.tmpl.Execute(&buf, vars); err != nil {
+			return sendBody{}, err
+		}
+		*f.out = buf.String()
+	}
+	return b, nil
+}
+
+func handleTemplates() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rows, err := db.Query(`SELECT ` + templateCols + ` FROM templates ORDER BY name`)
+		if err != nil {
+			log.Printf("templates: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		out := []notificationTemplate{}
+		for rows.Next() {
+			t, err := scanTemplate(rows)
+			if err != nil {
+				log.Printf("templates: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, t)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// handleTemplate shows (GET), stores (PUT) or deletes (DELETE) a template.
+func handleTemplate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, by := r.PathValue("name"), authFrom(r).ID
+		switch r.Method {
+		case http.MethodGet:
+			t, err := scanTemplate(db.QueryRow(`SELECT `+templateCols+` FROM templates WHERE name = ?`, name))
+			if err == sql.ErrNoRows {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			} else if err != nil {
+				log.Printf("template %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(t)
+		case http.MethodPut:
+			var t notificationTemplate
+			if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			if err := checkTemplate(name, t); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			t.Name = name
+			err := upsertTemplate(t, by)
+			var version int
+			if err == nil {
+				version, err = saveRuleVersion(ruleKindTemplate, name, templateVersion(t), false, by)
+			}
+			if err != nil {
+				log.Printf("template %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("templates: %q saved by %s (version %d)", name, by, version)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			res, err := db.Exec(`DELETE FROM templates WHERE name = ?`, name)
+			if err != nil {
+				log.Printf("template %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			version, err := saveRuleVersion(ruleKindTemplate, name, "", true, by)
+			if err != nil {
+				log.Printf("template %q: %v", name, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("templates: %q deleted by %s (version %d)", name, by, version)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func checkTemplate(name string, t notificationTemplate) error {
+	if !templateNameRE.MatchString(name) {
+		return errors.New("name must be 1-64 letters, digits, '.', '_' or '-'")
+	}
+	if strings.TrimSpace(t.Text) == "" {
+		return errors.New("text is required")
+	}
+	switch t.Format {
+	case "", formatPlain, formatMarkdown:
+	default:
+		return errors.New("format must be plain or markdown")
+	}
+	if t.Priority < 0 || t.Priority > priorityUrgent {
+		return errors.New("priority must be 1-5")
+	}
+	_, _, _, err := t.parse()
+	return err
+}
+
+func handleSendTemplate(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Vars     map[string]any `json:"vars"`
+			Topic    string         `json:"topic"`
+			Priority int            `json:"priority"`
+		}
+		limitBody(w, r)
+		var raw bytes.Buffer
+		in := io.Reader(r.Body)
+		if rawArchiveEnabled() {
+			in = io.TeeReader(r.Body, &raw)
+		}
+		if err := json.NewDecoder(in).Decode(&req); err != nil {
+			if !bodyTooLarge(w, err) {
+				http.Error(w, `body must be {"vars":{…}}`, http.StatusBadRequest)
+			}
+			return
+		}
+		name := r.PathValue("name")
+		t, err := scanTemplate(db.QueryRow(`SELECT `+templateCols+` FROM templates WHERE name = ?`, name))
+		if err == sql.ErrNoRows {
+			http.Error(w, "no such template", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("send template %q: %v", name, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		body, err := t.render(req.Vars)
+		if err != nil {
+			http.Error(w, "template "+name+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Topic != "" {
+			body.Topic = req.Topic
+		}
+		if req.Priority != 0 {
+			body.Priority = req.Priority
+		}
+		sendNotification(w, r, h, body, raw.Bytes())
+	}
+}
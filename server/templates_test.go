@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// adminCall runs handler for a request on the definition called name, as
+// caller "primary".
+func adminCall(handler http.HandlerFunc, method, name, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/admin/"+name, strings.NewReader(body))
+	r.SetPathValue("name", name)
+	r = r.WithContext(context.WithValue(r.Context(), authKey, authInfo{ID: "primary", Scope: scopeFull}))
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestTemplateHistoryAndRevert(t *testing.T) {
+	testDB(t)
+	template := handleTemplate()
+	history := handleRuleHistory(ruleKindTemplate)
+	revert := handleRuleRevert(ruleKindTemplate, applyTemplate)
+	text := func() string {
+		w := adminCall(template, http.MethodGet, "deploy", "")
+		var got notificationTemplate
+		json.NewDecoder(w.Body).Decode(&got)
+		return got.Text
+	}
+
+	for _, body := range []string{`{"text":"v1"}`, `{"text":"v2"}`} {
+		if w := adminCall(template, http.MethodPut, "deploy", body); w.Code != http.StatusNoContent {
+			t.Fatalf("PUT %s: %d %s", body, w.Code, w.Body)
+		}
+	}
+	if w := adminCall(template, http.MethodDelete, "deploy", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d %s", w.Code, w.Body)
+	}
+
+	var versions []ruleVersion
+	json.NewDecoder(adminCall(history, http.MethodGet, "deploy", "").Body).Decode(&versions)
+	if len(versions) != 3 || !versions[0].Deleted || versions[2].ChangedBy != "primary" {
+		t.Fatalf("history: %+v", versions)
+	}
+
+	if w := adminCall(revert, http.MethodPost, "deploy", `{"version":1}`); w.Code != http.StatusOK {
+		t.Fatalf("revert to 1: %d %s", w.Code, w.Body)
+	}
+	if got := text(); got != "v1" {
+		t.Errorf("after reverting to version 1: text %q", got)
+	}
+	if w := adminCall(revert, http.MethodPost, "deploy", `{"version":3}`); w.Code != http.StatusOK {
+		t.Fatalf("revert to 3: %d %s", w.Code, w.Body)
+	}
+	if w := adminCall(template, http.MethodGet, "deploy", ""); w.Code != http.StatusNotFound {
+		t.Errorf("after reverting to the deletion: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// ── Managed Tokens ────────────────────────────────────────────────────────────
+//
+// Besides the flag and --tokens-file credentials, tokens can be created and
+// revoked over the API without a restart. GET /admin/tokens lists every
+// credential the server accepts; POST creates a token (its secret is shown
+// once; only a hash is stored), PATCH /admin/tokens/{name} changes its label
+// and DELETE revokes it, closing WebSocket clients that use it with 4401.
+// Managed tokens authenticate as token:<name>, like file tokens, so usage and
+// quotas work the same. A token created with a "user" is that user's, as a
+// JWT's sub is: it is the WebSocket user and its topic ACLs apply. Flag and
+// file credentials are listed but can only be changed where they are
+// configured.
+//
+// POST /admin/tokens/revoke-all is the panic button: every managed token is
+// revoked, the primary token is rotated with no grace period, JWTs issued
+// before now are refused and every WebSocket client is disconnected, so each
+// has to come back with a credential that is still valid.
+
+type managedToken struct {
+	Name      string  `json:"name"`
+	Scope     string  `json:"scope"`
+	Label     string  `json:"label,omitempty"`
+	User      string  `json:"user,omitempty"`
+	CreatedBy string  `json:"created_by"`
+	CreatedAt string  `json:"created_at"`
+	UsedAt    *string `json:"last_used_at"`
+	RevokedAt *string `json:"revoked_at,omitempty"`
+
+	scope    scope
+	lastSeen atomic.Int64 // unix seconds of the last recorded use
+}
+
+var managedTokens = struct {
+	sync.RWMutex
+	byHash map[string]*managedToken
+}{byHash: map[string]*managedToken{}}
+
+// jwtRevokedBefore refuses JWTs issued (iat) before this unix time; 0 = off.
+var jwtRevokedBefore atomic.Int64
+
+var tokenNameRE = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func initTokenTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS api_tokens (
+			name       TEXT PRIMARY KEY,
+			hash       TEXT NOT NULL UNIQUE,
+			scope      TEXT NOT NULL,
+			label      TEXT NOT NULL DEFAULT '',
+			user       TEXT NOT NULL DEFAULT '',
+			created_by TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			used_at    DATETIME,
+			revoked_at DATETIME
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, _ = db.Exec(`ALTER TABLE api_tokens ADD COLUMN user TEXT NOT NULL DEFAULT ''`)
+	if v, err := strconv.ParseInt(getSetting("jwt_revoked_before"), 10, 64); err == nil {
+		jwtRevokedBefore.Store(v)
+	}
+	return reloadManagedTokens()
+}
+
+// reloadManagedTokens caches the tokens that are not revoked.
+func reloadManagedTokens() error {
+	rows, err := db.Query(`SELECT name, hash, scope, user FROM api_tokens WHERE revoked_at IS NULL`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	byHash := map[string]*managedToken{}
+	for rows.Next() {
+		t := &managedToken{}
+		var hash string
+		if err := rows.Scan(&t.Name, &hash, &t.Scope, &t.User); err != nil {
+			return err
+		}
+		t.scope = scopeFull
+		if t.Scope == "read" {
+			t.scope = scopeRead
+		}
+		byHash[hash] = t
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	managedTokens.Lock()
+	managedTokens.byHash = byHash
+	managedTokens.Unlock()
+	return nil
+}
+
+func matchManagedToken(token string) (authInfo, bool) {
+	managedTokens.RLock()
+	t, ok := managedTokens.byHash[tokenHash(token)]
+	managedTokens.RUnlock()
+	if !ok {
+		return authInfo{}, false
+	}
+	// Record use at most once a minute, off the request path.
+	now := time.Now().Unix()
+	if last := t.lastSeen.Load(); now-last >= 60 && t.lastSeen.CompareAndSwap(last, now) {
+		go db.Exec(`UPDATE api_tokens SET used_at = CURRENT_TIMESTAMP WHERE name = ?`, t.Name)
+	}
+	return authInfo{ID: "token:" + t.Name, Scope: t.scope, User: t.User}, true
+}
+
+// tokenListing is one credential in GET /admin/tokens.
+type tokenListing struct {
+	ID        string `json:"id"`     // as in logs and usage, e.g. token:grafana
+	Source    string `json:"source"` // flag, file or api
+	Scope     string `json:"scope"`
+	Connected int    `json:"connected"` // WebSocket clients using it
+	*managedToken
+}
+
+func scopeName(s scope) string {
+	if s == scopeRead {
+		return "read"
+	}
+	return "full"
+}
+
+func handleTokens(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			listTokens(w, h)
+		case http.MethodPost:
+			createToken(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func listTokens(w http.ResponseWriter, h *hub) {
+	connected := map[string]int{}
+	h.mu.RLock()
+	for c := range h.clients {
+		connected[c.auth.ID]++
+	}
+	h.mu.RUnlock()
+
+	out := []tokenListing{{ID: "primary", Source: "flag", Scope: "full", Connected: connected["primary"]}}
+	if readOnlyToken != "" {
+		out = append(out, tokenListing{ID: "readonly", Source: "flag", Scope: "read", Connected: connected["readonly"]})
+	}
+	for _, t := range namedTokens {
+		id := "token:" + t.name
+		out = append(out, tokenListing{ID: id, Source: "file", Scope: scopeName(t.scope), Connected: connected[id]})
+	}
+	rows, err := db.Query(`
+		SELECT name, scope, label, user, created_by, created_at, used_at, revoked_at
+		FROM api_tokens ORDER BY revoked_at IS NOT NULL, name`)
+	if err != nil {
+		log.Printf("tokens: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t := &managedToken{}
+		if err := rows.Scan(&t.Name, &t.Scope, &t.Label, &t.User, &t.CreatedBy, &t.CreatedAt, &t.UsedAt, &t.RevokedAt); err != nil {
+			log.Printf("tokens: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		id := "token:" + t.Name
+		out = append(out, tokenListing{ID: id, Source: "api", Scope: t.Scope, Connected: connected[id], managedToken: t})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func createToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name  string `json:"name"`
+		Scope string `json:"scope"`
+		Label string `json:"label"`
+		User  string `json:"user"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if !tokenNameRE.MatchString(body.Name) || body.Name == "revoke-all" {
+		http.Error(w, "name must be 1-64 letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+		return
+	}
+	switch body.Scope {
+	case "":
+		body.Scope = "full"
+	case "read", "full":
+	default:
+		http.Error(w, "scope must be read or full", http.StatusBadRequest)
+		return
+	}
+	for _, t := range namedTokens {
+		if t.name == body.Name {
+			http.Error(w, "a --tokens-file token has that name", http.StatusConflict)
+			return
+		}
+	}
+	secret, by := generateToken(), authFrom(r).ID
+	_, err := db.Exec(`INSERT INTO api_tokens (name, hash, scope, label, user, created_by) VALUES (?, ?, ?, ?, ?, ?)`,
+		body.Name, tokenHash(secret), body.Scope, body.Label, body.User, by)
+	if err != nil {
+		var exists int
+		if db.QueryRow(`SELECT 1 FROM api_tokens WHERE name = ?`, body.Name).Scan(&exists) == nil {
+			http.Error(w, "a token with that name exists (names of revoked tokens are not reused)", http.StatusConflict)
+			return
+		}
+		log.Printf("tokens: create %q: %v", body.Name, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := reloadManagedTokens(); err != nil {
+		log.Printf("tokens: %v", err)
+	}
+	audit(by, "token-create", fmt.Sprintf("token:%s (%s)", body.Name, body.Scope), "")
+	log.Printf("tokens: %q (%s) created by %s", body.Name, body.Scope, by)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id": "token:" + body.Name, "name": body.Name, "token": secret, "scope": body.Scope, "label": body.Label, "user": body.User,
+	})
+}
+
+// handleToken labels (PATCH) or revokes (DELETE) a managed token.
+func handleToken(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, by := r.PathValue("name"), authFrom(r).ID
+		var res sql.Result
+		var err error
+		switch r.Method {
+		case http.MethodPatch:
+			var body struct {
+				Label *string `json:"label"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Label == nil {
+				http.Error(w, `body must be {"label":"…"}`, http.StatusBadRequest)
+				return
+			}
+			res, err = db.Exec(`UPDATE api_tokens SET label = ? WHERE name = ?`, *body.Label, name)
+		case http.MethodDelete:
+			res, err = db.Exec(`UPDATE api_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE name = ? AND revoked_at IS NULL`, name)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			log.Printf("tokens: %q: %v", name, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "no such managed token (flag and file tokens can't be changed here)", http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			if err := reloadManagedTokens(); err != nil {
+				log.Printf("tokens: %v", err)
+			}
+			id := "token:" + name
+			closed := h.closeWhere(func(c *client) bool { return c.auth.ID == id }, api.CloseTokenExpired, "token revoked")
+			audit(by, "token-revoke", fmt.Sprintf("%s; %d WebSocket clients closed", id, closed), "")
+			log.Printf("tokens: %q revoked by %s; %d clients closed", name, by, closed)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleRevokeAll revokes every credential that can be revoked at runtime
+// and disconnects every WebSocket client.
+func handleRevokeAll(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		by, now := authFrom(r).ID, time.Now()
+		res, err := db.Exec(`UPDATE api_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE revoked_at IS NULL`)
+		if err == nil {
+			err = reloadManagedTokens()
+		}
+		if err != nil {
+			log.Printf("tokens: revoke all: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		revoked, _ := res.RowsAffected()
+		next := generateToken()
+		if _, err := rotatePrimaryToken(next, 0); err != nil {
+			log.Printf("tokens: revoke all: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		jwtRevokedBefore.Store(now.Unix())
+		if err := setSetting("jwt_revoked_before", strconv.FormatInt(now.Unix(), 10)); err != nil {
+			log.Printf("tokens: revoke all: %v", err)
+		}
+		closed := h.closeWhere(func(*client) bool { return true }, api.CloseTokenExpired, "credentials revoked")
+
+		// What only a config change can revoke.
+		kept := []string{}
+		if readOnlyToken != "" {
+			kept = append(kept, "readonly")
+		}
+		for _, t := range namedTokens {
+			kept = append(kept, "token:"+t.name)
+		}
+		if *flagClientCA != "" {
+			kept = append(kept, "client certificates")
+		}
+		if *flagHMACSecretFile != "" {
+			kept = append(kept, "hmac")
+		}
+		sort.Strings(kept)
+		audit(by, "revoke-all", fmt.Sprintf("%d managed tokens revoked, primary token rotated, JWTs before %s refused, %d WebSocket clients closed",
+			revoked, now.UTC().Format(time.RFC3339), closed), "")
+		log.Printf("tokens: all credentials revoked by %s (%d managed tokens, %d clients closed)", by, revoked, closed)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"token":              next,
+			"revoked_tokens":     revoked,
+			"jwt_revoked_before": now.UTC().Format(time.RFC3339),
+			"clients_closed":     closed,
+			"kept":               kept,
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"ilios.dev/andrnoti/api"
+)
+
+// ── Token Rotation ────────────────────────────────────────────────────────────
+//
+// POST /admin/token/rotate replaces the primary token without a restart. The
+// old token keeps working for a grace period so devices can move over; when
+// it ends, WebSocket clients still using it are closed with
+// api.CloseTokenExpired. Connected clients get a "reauth" frame, which carries
+// the new token only for clients that authenticated with the primary token.
+//
+// The rotated token is kept in settings together with a hash of the flag
+// token it replaced. If --token/--token-file later changes, the flag wins and
+// the stored rotation is discarded.
+
+var primaryToken struct {
+	sync.RWMutex
+	current       string
+	previous      string
+	previousUntil time.Time
+}
+
+// matchPrimary checks token against the current and, during the grace
+// period, the previous primary token.
+func matchPrimary(token string) (authInfo, bool) {
+	primaryToken.RLock()
+	defer primaryToken.RUnlock()
+	if tokenEqual(token, primaryToken.current) {
+		return authInfo{ID: "primary", Scope: scopeFull}, true
+	}
+	if time.Now().Before(primaryToken.previousUntil) && tokenEqual(token, primaryToken.previous) {
+		return authInfo{ID: "primary-previous", Scope: scopeFull, Expires: primaryToken.previousUntil}, true
+	}
+	return authInfo{}, false
+}
+
+func tokenHash(t string) string {
+	sum := sha256.Sum256([]byte(t))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadPrimaryToken installs the flag token, or a rotation of it stored in
+// settings. Must run after initDB.
+func loadPrimaryToken(flagToken string) {
+	primaryToken.Lock()
+	defer primaryToken.Unlock()
+	primaryToken.current = flagToken
+	stored := getSetting("token_current")
+	if stored == "" {
+		return
+	}
+	if getSetting("token_base") != tokenHash(flagToken) {
+		log.Printf("token: configured token changed since last rotation; discarding rotated token")
+		for _, k := range []string{"token_current", "token_previous", "token_previous_until", "token_base"} {
+			setSetting(k, "")
+		}
+		return
+	}
+	primaryToken.current = stored
+	primaryToken.previous = getSetting("token_previous")
+	primaryToken.previousUntil, _ = time.Parse(time.RFC3339, getSetting("token_previous_until"))
+	log.Printf("token: using rotated primary token (previous valid until %s)", getSetting("token_previous_until"))
+}
+
+func generateToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// rotatePrimaryToken makes next the primary token and returns when the old
+// one stops working.
+func rotatePrimaryToken(next string, grace time.Duration) (time.Time, error) {
+	primaryToken.Lock()
+	defer primaryToken.Unlock()
+	until := time.Now().Add(grace).UTC().Truncate(time.Second)
+	base := getSetting("token_base")
+	if base == "" {
+		base = tokenHash(primaryToken.current) // first rotation: current is the flag token
+	}
+	for k, v := range map[string]string{
+		"token_current":        next,
+		"token_previous":       primaryToken.current,
+		"token_previous_until": until.Format(time.RFC3339),
+		"token_base":           base,
+	} {
+		if err := setSetting(k, v); err != nil {
+			return time.Time{}, err
+		}
+	}
+	primaryToken.previous, primaryToken.current, primaryToken.previousUntil = primaryToken.current, next, until
+	return until, nil
+}
+
+// closeWhere closes every client matching pred with the given close code.
+func (h *hub) closeWhere(pred func(*client) bool, code int, reason string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n := 0
+	for c := range h.clients {
+		if pred(c) {
+			c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason),
+				time.Now().Add(5*time.Second))
+			c.conn.Close()
+			n++
+		}
+	}
+	return n
+}
+
+func handleTokenRotate(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var body struct {
+			Token string `json:"token"`
+			Grace string `json:"grace"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+		}
+		grace := *flagTokenGrace
+		if body.Grace != "" {
+			d, err := time.ParseDuration(body.Grace)
+			if err != nil || d < 0 {
+				http.Error(w, "grace must be a duration like 24h", http.StatusBadRequest)
+				return
+			}
+			grace = d
+		}
+		next := body.Token
+		if next == "" {
+			next = generateToken()
+		}
+		if len(next) < 16 {
+			http.Error(w, "token must be at least 16 characters", http.StatusBadRequest)
+			return
+		}
+		_, named := matchNamedToken(next)
+		if _, managed := matchManagedToken(next); named || managed || next == readOnlyToken {
+			http.Error(w, "token must differ from the read-only and named tokens", http.StatusBadRequest)
+			return
+		}
+
+		rotatedAt := time.Now()
+		until, err := rotatePrimaryToken(next, grace)
+		if err != nil {
+			log.Printf("token rotate: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		// Clients that connected with the old primary token are now on the
+		// previous one: hand them the new token and cut them off at the end
+		// of the grace period. Everyone else is told to re-authenticate.
+		oldPrimary := func(c *client) bool {
+			return c.auth.ID == "primary" && c.connectedAt.Before(rotatedAt)
+		}
+		reauth := api.Reauth{Reason: "token rotated", PreviousValidUntil: until.Format(time.RFC3339)}
+		others, _ := json.Marshal(wsMessage{Type: api.TypeReauth, Reauth: &reauth})
+		reauth.Token = next
+		withToken, _ := json.Marshal(wsMessage{Type: api.TypeReauth, Reauth: &reauth})
+		h.bcast <- envelope{data: withToken, to: oldPrimary}
+		h.bcast <- envelope{data: others, to: func(c *client) bool { return !oldPrimary(c) }}
+		time.AfterFunc(time.Until(until), func() {
+			if n := h.closeWhere(oldPrimary, api.CloseTokenExpired, "token rotated"); n > 0 {
+				log.Printf("token: closed %d clients still on the previous token", n)
+			}
+		})
+
+		log.Printf("token: primary token rotated by %s (previous valid until %s)", authFrom(r).ID, until.Format(time.RFC3339))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"token":                next,
+			"previous_valid_until": until.Format(time.RFC3339),
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ── Tracing ───────────────────────────────────────────────────────────────────
+//
+// With --otlp-endpoint set, requests are traced and the spans exported to an
+// OpenTelemetry collector over OTLP/HTTP (JSON encoding, POST
+// <endpoint>/v1/traces), so a slow send can be followed from the HTTP
+// handler through the database insert to the hand-off to the WebSocket hub.
+// Every HTTP request gets a server span; publishing, notification inserts,
+// history queries, mark-seen updates and broadcasts get child spans. An
+// incoming W3C traceparent header continues the caller's trace and its
+// sampling decision; new traces are kept with probability --trace-sample.
+// Spans are batched and sent every 5 s or 512 spans; if the collector falls
+// behind, spans are dropped and counted rather than slowing requests down.
+// The trace id also appears in the JSON access log.
+
+const (
+	traceBatch    = 512
+	traceQueue    = 4096
+	traceInterval = 5 * time.Second
+	spanKey       = ctxKey(2)
+)
+
+// OTLP span kinds and status codes.
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+	spanProducer = 4
+
+	statusError = 2
+)
+
+type span struct {
+	traceID   [16]byte
+	spanID    [8]byte
+	parentID  [8]byte
+	name      string
+	kind      int
+	start     time.Time
+	attrs     map[string]any
+	statusErr string
+	ended     time.Time
+}
+
+var tracer struct {
+	queue   chan *span
+	dropped atomic.Int64
+}
+
+// tracingOn reports whether spans are being recorded at all.
+func tracingOn() bool { return tracer.queue != nil }
+
+func startTracing(endpoint string, headers map[string]string) {
+	tracer.queue = make(chan *span, traceQueue)
+	go exportSpans(strings.TrimSuffix(endpoint, "/")+"/v1/traces", headers)
+	log.Printf("tracing: exporting to %s (sample %g)", endpoint, *flagTraceSample)
+}
+
+// startSpan starts a child of the span in ctx. Without a sampled parent it
+// returns a nil span, whose methods do nothing.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	parent, _ := ctx.Value(spanKey).(*span)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := &span{traceID: parent.traceID, parentID: parent.spanID, name: name, kind: kind, start: time.Now()}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+// startRootSpan starts a trace for an incoming request, continuing the
+// caller's trace from a traceparent header when there is one.
+func startRootSpan(r *http.Request, name string) (context.Context, *span) {
+	s := &span{name: name, kind: spanServer, start: time.Now()}
+	sampled := false
+	if tid, pid, flags, ok := parseTraceparent(r.Header.Get("Traceparent")); ok {
+		s.traceID, s.parentID, sampled = tid, pid, flags&1 == 1
+	} else {
+		rand.Read(s.traceID[:])
+		sampled = float64(binary.BigEndian.Uint64(s.traceID[8:])>>11)/(1<<53) < *flagTraceSample
+	}
+	if !sampled {
+		return r.Context(), nil
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(r.Context(), spanKey, s), s
+}
+
+// parseTraceparent reads a W3C trace context header:
+// 00-<32 hex trace id>-<16 hex parent id>-<2 hex flags>.
+func parseTraceparent(v string) (tid [16]byte, pid [8]byte, flags byte, ok bool) {
+	parts := strings.Split(v, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return tid, pid, 0, false
+	}
+	if _, err := hex.Decode(tid[:], []byte(parts[1])); err != nil || tid == [16]byte{} {
+		return tid, pid, 0, false
+	}
+	if _, err := hex.Decode(pid[:], []byte(parts[2])); err != nil || pid == [8]byte{} {
+		return tid, pid, 0, false
+	}
+	f, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return tid, pid, 0, false
+	}
+	return tid, pid, byte(f), true
+}
+
+func (s *span) set(key string, value any) {
+	if s == nil {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = map[string]any{}
+	}
+	s.attrs[key] = value
+}
+
+// fail marks the span as failed if err is not nil.
+func (s *span) fail(err error) {
+	if s != nil && err != nil {
+		s.statusErr = err.Error()
+	}
+}
+
+func (s *span) end() {
+	if s == nil || !s.ended.IsZero() {
+		return
+	}
+	s.ended = time.Now()
+	select {
+	case tracer.queue <- s:
+	default:
+		tracer.dropped.Add(1)
+	}
+}
+
+// traceHTTP gives every request a server span.
+func traceHTTP(next http.Handler) http.Handler {
+	if !tracingOn() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, s := startRootSpan(r, spanName(r))
+		if s == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if e, ok := r.Context().Value(accessKey).(*accessEntry); ok {
+			e.TraceID = hex.EncodeToString(s.traceID[:])
+		}
+		s.set("http.request.method", r.Method)
+		s.set("url.path", r.URL.Path)
+		s.set("client.address", clientIP(r))
+		aw := &accessWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(ctx))
+		status := cmp.Or(aw.status, http.StatusOK)
+		s.set("http.response.status_code", status)
+		if status >= 500 {
+			s.statusErr = http.StatusText(status)
+		}
+		s.end()
+	})
+}
+
+// traceBroadcast times handing n notifications to the hub. The broadcast
+// queue blocks once the hub falls behind, so this is where a busy server's
+// sends wait.
+func traceBroadcast(ctx context.Context, n int, fn func()) {
+	_, s := startSpan(ctx, "ws broadcast", spanProducer)
+	s.set("notifications", n)
+	fn()
+	s.end()
+}
+
+// spanName names a request span by method and path, with numeric path
+// segments (ids) replaced by {id} so names stay few.
+func spanName(r *http.Request) string {
+	segs := strings.Split(r.URL.Path, "/")
+	for i, seg := range segs {
+		if _, err := strconv.ParseInt(seg, 10, 64); err == nil {
+			segs[i] = "{id}"
+		}
+	}
+	return r.Method + " " + strings.Join(segs, "/")
+}
+
+// traceDB runs a database operation in a client span.
+func traceDB(ctx context.Context, op string, fn func() error) error {
+	_, s := startSpan(ctx, "db "+op, spanClient)
+	s.set("db.system", "sqlite")
+	s.set("db.operation.name", op)
+	err := fn()
+	s.fail(err)
+	s.end()
+	return err
+}
+
+// Spans are sent in the OTLP/HTTP JSON encoding.
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func otlpAttrs(m map[string]any) []otlpAttr {
+	out := make([]otlpAttr, 0, len(m))
+	for k, v := range m {
+		var val otlpValue
+		switch v := v.(type) {
+		case int:
+			s := strconv.Itoa(v)
+			val.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			val.IntValue = &s
+		case float64:
+			val.DoubleValue = &v
+		case bool:
+			val.BoolValue = &v
+		default:
+			s := fmt.Sprint(v)
+			val.StringValue = &s
+		}
+		out = append(out, otlpAttr{Key: k, Value: val})
+	}
+	return out
+}
+
+func (s *span) otlp() otlpSpan {
+	o := otlpSpan{
+		TraceID:    hex.EncodeToString(s.traceID[:]),
+		SpanID:     hex.EncodeToString(s.spanID[:]),
+		Name:       s.name,
+		Kind:       s.kind,
+		Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+		End:        strconv.FormatInt(s.ended.UnixNano(), 10),
+		Attributes: otlpAttrs(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.statusErr != "" {
+		o.Status.Code, o.Status.Message = statusError, s.statusErr
+	}
+	return o
+}
+
+func exportSpans(url string, headers map[string]string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(traceInterval)
+	var batch []otlpSpan
+	var reported int64
+	flush := func() {
+		if n := tracer.dropped.Load(); n != reported {
+			log.Printf("tracing: %d spans dropped so far (collector too slow or unreachable)", n)
+			reported = n
+		}
+		if len(batch) == 0 {
+			return
+		}
+		service := "andr-noti"
+		body, _ := json.Marshal(map[string]any{
+			"resourceSpans": []any{map[string]any{
+				"resource": map[string]any{"attributes": otlpAttrs(map[string]any{
+					"service.name":    service,
+					"service.version": serverVersion,
+				})},
+				"scopeSpans": []any{map[string]any{
+					"scope": map[string]any{"name": service, "version": serverVersion},
+					"spans": batch,
+				}},
+			}},
+		})
+		batch = batch[:0]
+		req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("tracing: export: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("tracing: export: %s", resp.Status)
+		}
+	}
+	for {
+		select {
+		case s := <-tracer.queue:
+			batch = append(batch, s.otlp())
+			if len(batch) >= traceBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// parseHeaders reads "key=value,key=value" as for --otlp-headers.
+func parseHeaders(s string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, kv := range splitList(s) {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("%q is not key=value", kv)
+		}
+		out[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return out, nil
+}
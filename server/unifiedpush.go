@@ -0,0 +1,435 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"ilios.dev/andrnoti/api"
+)
+
+// ── UnifiedPush ───────────────────────────────────────────────────────────────
+//
+// The server is a UnifiedPush push server, so a client connected with
+// ?device= can act as the distributor for other apps on its phone. The
+// distributor registers each app with POST /unifiedpush/registrations and
+// hands the app the endpoint it gets back; the app's own server then POSTs
+// messages (at most 4096 bytes, as the spec allows) to that endpoint with no
+// credentials — the unguessable token in the URL is the credential.
+//
+// Messages are kept until the device acks them and reach its WebSocket
+// connections as "unifiedpush" frames, live or on the next connect. The
+// client acks with {"type":"up_ack","id":N} once it has handed everything up
+// to N to the apps. Unacked messages go after upMessageTTL, and a
+// registration keeps at most upMaxQueued of them, dropping the oldest.
+// Deleting a registration sends the device a frame with "unregistered" set
+// so it can tell the app.
+//
+// POST /_matrix/push/v1/notify is the Matrix push gateway UnifiedPush Matrix
+// clients expect: each pushkey is an endpoint of this server, and the
+// notification is queued for every one that exists.
+
+const (
+	upMaxMessage = 4096
+	upMaxQueued  = 100
+	upMessageTTL = 7 * 24 * time.Hour
+)
+
+func initUnifiedPushTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS up_registrations (
+			token        TEXT PRIMARY KEY,
+			device       TEXT NOT NULL,
+			app          TEXT NOT NULL,
+			instance     TEXT NOT NULL DEFAULT '',
+			created_by   TEXT NOT NULL DEFAULT '',
+			created_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			last_push_at DATETIME,
+			pushes       INTEGER NOT NULL DEFAULT 0,
+			UNIQUE (device, app, instance)
+		);
+		CREATE TABLE IF NOT EXISTS up_messages (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			token      TEXT NOT NULL REFERENCES up_registrations(token) ON DELETE CASCADE,
+			body       BLOB NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS up_messages_token ON up_messages(token, id);
+	`)
+	return err
+}
+
+type upRegistration struct {
+	Token      string  `json:"token"`
+	Endpoint   string  `json:"endpoint,omitempty"`
+	Device     string  `json:"device"`
+	App        string  `json:"app"`
+	Instance   string  `json:"instance,omitempty"`
+	CreatedBy  string  `json:"created_by"`
+	CreatedAt  string  `json:"created_at"`
+	LastPushAt *string `json:"last_push_at"`
+	Pushes     int64   `json:"pushes"`
+	Pending    int64   `json:"pending"`
+}
+
+const upRegistrationCols = `token, device, app, instance, created_by, created_at, last_push_at, pushes,
+	(SELECT COUNT(*) FROM up_messages m WHERE m.token = up_registrations.token)`
+
+func scanUPRegistration(s interface{ Scan(...any) error }) (upRegistration, error) {
+	var u upRegistration
+	var last sql.NullString
+	err := s.Scan(&u.Token, &u.Device, &u.App, &u.Instance, &u.CreatedBy, &u.CreatedAt, &last, &u.Pushes, &u.Pending)
+	if last.Valid {
+		u.LastPushAt = &last.String
+	}
+	return u, err
+}
+
+func getUPRegistration(token string) (upRegistration, error) {
+	return scanUPRegistration(db.QueryRow(`SELECT `+upRegistrationCols+` FROM up_registrations WHERE token = ?`, token))
+}
+
+// publicBase is the server's URL as seen by r's sender: --public-url, or the
+// scheme and Host the request came in with.
+func publicBase(r *http.Request) string {
+	if *flagPublicURL != "" {
+		return strings.TrimSuffix(*flagPublicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil && ipInNets(net.ParseIP(host), trustedProxies) {
+		if p := r.Header.Get("X-Forwarded-Proto"); p == "https" || p == "http" {
+			scheme = p
+		}
+	}
+	return scheme + "://" + r.Host
+}
+
+// upDeviceClients selects the connections of the device a registration
+// belongs to, made with the credential that registered it.
+func upDeviceClients(u upRegistration) func(*client) bool {
+	return func(c *client) bool { return c.device == u.Device && c.auth.ID == u.CreatedBy }
+}
+
+// ── Registration handlers ──
+
+// handleUPRegistrations lists (GET) or creates (POST) registrations.
+// Registering the same device, app and instance again returns the existing
+// endpoint.
+func handleUPRegistrations() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			q := `SELECT ` + upRegistrationCols + ` FROM up_registrations`
+			var args []any
+			if d := r.URL.Query().Get("device"); d != "" {
+				q += ` WHERE device = ?`
+				args = append(args, d)
+			}
+			rows, err := db.Query(q+` ORDER BY device, app, created_at`, args...)
+			if err != nil {
+				log.Printf("unifiedpush: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+			out := []upRegistration{}
+			base := publicBase(r)
+			for rows.Next() {
+				u, err := scanUPRegistration(rows)
+				if err != nil {
+					log.Printf("unifiedpush: %v", err)
+					http.Error(w, "internal error", http.StatusInternalServerError)
+					return
+				}
+				u.Endpoint = base + "/up/" + u.Token
+				out = append(out, u)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"registrations": out})
+		case http.MethodPost:
+			var body struct {
+				Device   string `json:"device"`
+				App      string `json:"app"`
+				Instance string `json:"instance"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			switch {
+			case body.Device == "" || body.App == "":
+				http.Error(w, "device and app are required", http.StatusBadRequest)
+				return
+			case deviceRevoked(body.Device):
+				http.Error(w, "device revoked", http.StatusForbidden)
+				return
+			}
+			by := authFrom(r).ID
+			status := http.StatusOK
+			res, err := db.Exec(`INSERT INTO up_registrations (token, device, app, instance, created_by) VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT(device, app, instance) DO NOTHING`, generateToken(), body.Device, body.App, body.Instance, by)
+			var u upRegistration
+			if err == nil {
+				if n, _ := res.RowsAffected(); n == 1 {
+					status = http.StatusCreated
+				}
+				u, err = scanUPRegistration(db.QueryRow(`SELECT `+upRegistrationCols+` FROM up_registrations
+					WHERE device = ? AND app = ? AND instance = ?`, body.Device, body.App, body.Instance))
+			}
+			if err != nil {
+				log.Printf("unifiedpush: register %s/%s: %v", body.Device, body.App, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if u.CreatedBy != by {
+				// Messages only reach the credential that registered.
+				http.Error(w, "registered by another credential; delete it first", http.StatusConflict)
+				return
+			}
+			if status == http.StatusCreated {
+				log.Printf("unifiedpush: %s registered %s on %s", by, body.App, body.Device)
+			}
+			u.Endpoint = publicBase(r) + "/up/" + u.Token
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(u)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleUPRegistration shows (GET) or deletes (DELETE) a registration.
+func handleUPRegistration(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.PathValue("token")
+		u, err := getUPRegistration(token)
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("unifiedpush: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			u.Endpoint = publicBase(r) + "/up/" + u.Token
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(u)
+		case http.MethodDelete:
+			if _, err := db.Exec(`DELETE FROM up_registrations WHERE token = ?`, token); err != nil {
+				log.Printf("unifiedpush: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("unifiedpush: %s unregistered %s on %s", authFrom(r).ID, u.App, u.Device)
+			data, _ := json.Marshal(wsMessage{Type: api.TypeUnifiedPush, UnifiedPush: &api.UPMessage{
+				Token: u.Token, App: u.App, Instance: u.Instance, Unregistered: true,
+			}})
+			h.bcast <- envelope{data: data, to: upDeviceClients(u)}
+			busPublish(busEvent{Kind: busKindFrame, Frame: data, Device: u.Device, Auth: u.CreatedBy})
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// ── Push endpoints ──
+
+// handleUPPush is a registration's endpoint. POST queues a message; GET
+// answers the discovery request app servers may make first.
+func handleUPPush(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if _, err := getUPRegistration(r.PathValue("token")); err != nil {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"unifiedpush":{"version":1}}`+"\n")
+		case http.MethodPost, http.MethodPut:
+			body, err := io.ReadAll(io.LimitReader(r.Body, upMaxMessage+1))
+			if err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			if len(body) > upMaxMessage {
+				http.Error(w, "message larger than 4096 bytes", http.StatusRequestEntityTooLarge)
+				return
+			}
+			switch err := queueUPMessage(h, r.PathValue("token"), body); {
+			case err == sql.ErrNoRows:
+				http.Error(w, "not found", http.StatusNotFound)
+			case err != nil:
+				log.Printf("unifiedpush: push: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+			default:
+				w.WriteHeader(http.StatusCreated)
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleMatrixPush is the Matrix push gateway: POST queues the notification
+// for each pushkey that is one of this server's endpoints and lists the
+// others as rejected, so the homeserver stops using them.
+func handleMatrixPush(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"unifiedpush":{"gateway":"matrix"}}`+"\n")
+			return
+		case http.MethodPost:
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, upMaxMessage+1))
+		if err != nil || len(body) > upMaxMessage {
+			http.Error(w, "message larger than 4096 bytes", http.StatusRequestEntityTooLarge)
+			return
+		}
+		var req struct {
+			Notification struct {
+				Devices []struct {
+					Pushkey string `json:"pushkey"`
+				} `json:"devices"`
+			} `json:"notification"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		rejected := []string{}
+		for _, d := range req.Notification.Devices {
+			_, token, ok := strings.Cut(d.Pushkey, "/up/")
+			if ok {
+				err = queueUPMessage(h, token, body)
+			}
+			if !ok || err == sql.ErrNoRows {
+				rejected = append(rejected, d.Pushkey)
+			} else if err != nil {
+				log.Printf("unifiedpush: matrix push: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"rejected": rejected})
+	}
+}
+
+// queueUPMessage stores a message for the registration token and sends it
+// to the device's connections. It returns sql.ErrNoRows for an unknown
+// token.
+func queueUPMessage(h *hub, token string, body []byte) error {
+	u, err := getUPRegistration(token)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO up_messages (token, body) VALUES (?, ?)`, token, body)
+	if err != nil {
+		return err
+	}
+	id, _ := res.LastInsertId()
+	if _, err := tx.Exec(`DELETE FROM up_messages WHERE token = ? AND id <= (
+		SELECT id FROM up_messages WHERE token = ? ORDER BY id DESC LIMIT 1 OFFSET ?)`, token, token, upMaxQueued); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE up_registrations SET pushes = pushes + 1, last_push_at = CURRENT_TIMESTAMP WHERE token = ?`, token); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	data := upFrame(id, u, body)
+	h.bcast <- envelope{data: data, to: upDeviceClients(u)}
+	busPublish(busEvent{Kind: busKindFrame, Frame: data, Device: u.Device, Auth: u.CreatedBy})
+	return nil
+}
+
+func upFrame(id int64, u upRegistration, body []byte) []byte {
+	data, _ := json.Marshal(wsMessage{Type: api.TypeUnifiedPush, ID: id, UnifiedPush: &api.UPMessage{
+		Token:    u.Token,
+		App:      u.App,
+		Instance: u.Instance,
+		Message:  base64.StdEncoding.EncodeToString(body),
+	}})
+	return data
+}
+
+// ── Delivery ──
+
+// sendPendingUP queues the messages a connecting device hasn't acked.
+// Anything that doesn't fit in its buffer goes on the next connect.
+func sendPendingUP(c *client) {
+	if c.device == "" {
+		return
+	}
+	rows, err := db.Query(`
+		SELECT m.id, m.body, r.token, r.app, r.instance
+		FROM up_messages m JOIN up_registrations r ON r.token = m.token
+		WHERE r.device = ? AND r.created_by = ? ORDER BY m.id LIMIT ?`, c.device, c.auth.ID, upMaxQueued)
+	if err != nil {
+		log.Printf("unifiedpush: pending for %s: %v", c.device, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var body []byte
+		var u upRegistration
+		if err := rows.Scan(&id, &body, &u.Token, &u.App, &u.Instance); err != nil {
+			log.Printf("unifiedpush: pending for %s: %v", c.device, err)
+			return
+		}
+		if !c.trySend(upFrame(id, u, body)) {
+			return
+		}
+	}
+}
+
+// ackUP drops a device's messages up to id.
+func ackUP(device, by string, id int64) {
+	if _, err := db.Exec(`DELETE FROM up_messages WHERE id <= ? AND token IN (
+		SELECT token FROM up_registrations WHERE device = ? AND created_by = ?)`, id, device, by); err != nil {
+		log.Printf("unifiedpush: ack %s: %v", device, err)
+	}
+}
+
+// upPruneJob drops messages no device acked within upMessageTTL.
+func upPruneJob() *schedJob {
+	return &schedJob{
+		name:     "unifiedpush-prune",
+		interval: time.Hour,
+		run: func() error {
+			res, err := db.Exec(`DELETE FROM up_messages WHERE created_at < ?`, sqliteTime(time.Now().Add(-upMessageTTL)))
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				log.Printf("unifiedpush: dropped %d messages unacked for %s", n, upMessageTTL)
+			}
+			return nil
+		},
+	}
+}
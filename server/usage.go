@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ── Named Tokens ──────────────────────────────────────────────────────────────
+//
+// --tokens-file gives each script its own credential so usage can be
+// attributed. One token per line:
+//
+//	# name      token                              scope (read|full, default full)
+//	backup-cron 7f3c…                              full
+//	grafana     91ab…
+
+type namedToken struct {
+	name  string
+	token string
+	scope scope
+}
+
+var namedTokens []namedToken
+
+func loadNamedTokens(path string) ([]namedToken, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []namedToken
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: want \"name token [read|full]\"", path, line)
+		}
+		t := namedToken{name: fields[0], token: fields[1], scope: scopeFull}
+		if len(fields) == 3 {
+			switch fields[2] {
+			case "read":
+				t.scope = scopeRead
+			case "full":
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown scope %q", path, line, fields[2])
+			}
+		}
+		if seen[t.name] {
+			return nil, fmt.Errorf("%s:%d: duplicate name %q", path, line, t.name)
+		}
+		seen[t.name] = true
+		out = append(out, t)
+	}
+	return out, sc.Err()
+}
+
+func matchNamedToken(token string) (authInfo, bool) {
+	for _, t := range namedTokens {
+		if tokenEqual(token, t.token) {
+			return authInfo{ID: "token:" + t.name, Scope: t.scope}, true
+		}
+	}
+	return authInfo{}, false
+}
+
+// ── Usage & Quotas ────────────────────────────────────────────────────────────
+//
+// Every /send is counted per caller identity (authInfo.ID) and UTC day.
+// A caller over its daily quota gets 429 until midnight UTC. Quotas default
+// to --daily-quota (0 = unlimited) and can be overridden per identity. The
+// previous primary token, accepted during a rotation's grace period, counts
+// as "primary": it is the same caller.
+
+var usageMu sync.Mutex
+
+func initUsageTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS token_usage (
+			token_id TEXT NOT NULL,
+			day      TEXT NOT NULL,
+			sends    INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (token_id, day)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS token_quotas (
+			token_id    TEXT PRIMARY KEY,
+			daily_limit INTEGER NOT NULL
+		)
+	`)
+	return err
+}
+
+func quotaFor(id string) int {
+	limit := *flagDailyQuota
+	db.QueryRow(`SELECT daily_limit FROM token_quotas WHERE token_id = ?`, id).Scan(&limit)
+	return limit
+}
+
+// usageID is the identity sends by id are counted under.
+func usageID(id string) string {
+	if id == "primary-previous" {
+		return "primary"
+	}
+	return id
+}
+
+// countSend records n sends for id unless that would exceed its quota. It
+// returns false with the time the quota resets when the caller is over.
+func countSend(id string, now time.Time, n int) (bool, time.Time, error) {
+	id = usageID(id)
+	day := now.UTC().Format("2006-01-02")
+	reset := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	if limit := quotaFor(id); limit > 0 {
+		var used int
+		db.QueryRow(`SELECT sends FROM token_usage WHERE token_id = ? AND day = ?`, id, day).Scan(&used)
+		if used+n > limit {
+			return false, reset, nil
+		}
+	}
+	_, err := db.Exec(`
+		INSERT INTO token_usage (token_id, day, sends) VALUES (?, ?, ?)
+		ON CONFLICT(token_id, day) DO UPDATE SET sends = sends + excluded.sends
+	`, id, day, n)
+	return true, reset, err
+}
+
+// ── Usage Handlers ────────────────────────────────────────────────────────────
+
+// handleUsage reports per-identity sends for the last ?days= days (default 7)
+// with each identity's quota and what is left of it today.
+func handleUsage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		days := 7
+		if v := r.URL.Query().Get("days"); v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				days = n
+			}
+		}
+		now := time.Now().UTC()
+		today := now.Format("2006-01-02")
+		since := now.AddDate(0, 0, -(days - 1)).Format("2006-01-02")
+
+		rows, err := db.Query(`
+			SELECT token_id, day, sends FROM token_usage WHERE day >= ?
+			ORDER BY token_id, day DESC
+		`, since)
+		if err != nil {
+			log.Printf("usage: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		type entry struct {
+			Token      string         `json:"token"`
+			Total      int            `json:"total"`
+			Today      int            `json:"today"`
+			DailyQuota int            `json:"daily_quota"`
+			Remaining  *int           `json:"remaining_today"`
+			Days       map[string]int `json:"days"`
+		}
+		byID := map[string]*entry{}
+		var order []string
+		for rows.Next() {
+			var id, day string
+			var sends int
+			if err := rows.Scan(&id, &day, &sends); err != nil {
+				log.Printf("usage: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			e := byID[id]
+			if e == nil {
+				e = &entry{Token: id, Days: map[string]int{}}
+				byID[id] = e
+				order = append(order, id)
+			}
+			e.Days[day] = sends
+			e.Total += sends
+			if day == today {
+				e.Today = sends
+			}
+		}
+		rows.Close()
+
+		out := make([]entry, 0, len(order))
+		for _, id := range order {
+			e := byID[id]
+			e.DailyQuota = quotaFor(id)
+			if e.DailyQuota > 0 {
+				left := max(e.DailyQuota-e.Today, 0)
+				e.Remaining = &left
+			}
+			out = append(out, *e)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"since":         since,
+			"default_quota": *flagDailyQuota,
+			"tokens":        out,
+		})
+	}
+}
+
+// handleUsageQuota sets (PUT) or clears (DELETE) one identity's daily quota.
+func handleUsageQuota() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("token")
+		switch r.Method {
+		case http.MethodPut:
+			var body struct {
+				DailyLimit *int `json:"daily_limit"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.DailyLimit == nil || *body.DailyLimit < 0 {
+				http.Error(w, "daily_limit (0 = unlimited) is required", http.StatusBadRequest)
+				return
+			}
+			if _, err := db.Exec(`
+				INSERT INTO token_quotas (token_id, daily_limit) VALUES (?, ?)
+				ON CONFLICT(token_id) DO UPDATE SET daily_limit = excluded.daily_limit
+			`, id, *body.DailyLimit); err != nil {
+				log.Printf("usage quota %q: %v", id, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("usage: quota for %q set to %d/day", id, *body.DailyLimit)
+		case http.MethodDelete:
+			if _, err := db.Exec(`DELETE FROM token_quotas WHERE token_id = ?`, id); err != nil {
+				log.Printf("usage quota %q: %v", id, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("usage: quota for %q reset to default", id)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
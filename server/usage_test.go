@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPreviousPrimaryCountsAsPrimary(t *testing.T) {
+	testDB(t)
+	if _, err := db.Exec(`INSERT INTO token_quotas (token_id, daily_limit) VALUES ('primary', 2)`); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, id := range []string{"primary", "primary-previous", "primary-previous"} {
+		ok, _, err := countSend(id, now, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i < 2; ok != want {
+			t.Errorf("send %d as %s: allowed %v, want %v", i+1, id, ok, want)
+		}
+	}
+	var ids int
+	if err := db.QueryRow(`SELECT COUNT(DISTINCT token_id) FROM token_usage`).Scan(&ids); err != nil {
+		t.Fatal(err)
+	}
+	if ids != 1 {
+		t.Errorf("usage split across %d identities, want 1", ids)
+	}
+}
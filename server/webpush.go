@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ── Web Push ──────────────────────────────────────────────────────────────────
+//
+// Browsers can receive notifications through the Web Push protocol, so a
+// desktop gets them with no tab open. A page asks for the server's VAPID
+// public key (GET /webpush/vapid-key), subscribes through its service worker
+// with it as the applicationServerKey, and POSTs the resulting
+// PushSubscription to /webpush/subscriptions. Each new notification is then
+// encrypted for every matching subscription (RFC 8291) and posted to its
+// push service, signed with the VAPID key (RFC 8292).
+//
+// A subscription can be limited to a user (topic ACLs apply as for
+// WebSocket clients, and assigned notifications go only to the assignee's
+// subscriptions when there are any), to a list of topics and to a minimum
+// priority. Push services answer 404 or 410 for subscriptions the browser
+// dropped; those are deleted. Other failures are counted on the
+// subscription and retried by the delivery queue.
+//
+// The VAPID key is read from --vapid-key-file, or generated on first start
+// and kept in the settings table. Changing it invalidates every existing
+// subscription.
+
+const (
+	webPushTTL        = 24 * time.Hour
+	webPushTimeout    = 10 * time.Second
+	webPushRecord     = 4096
+	webPushMaxPayload = 3000 // bytes, leaving room for the record overhead
+	webPushKeySetting = "vapid_private_key"
+)
+
+var (
+	vapidKey    *ecdsa.PrivateKey
+	webPushHTTP = &http.Client{Timeout: webPushTimeout}
+)
+
+func initWebPushTables() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS webpush_subscriptions (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			endpoint     TEXT NOT NULL UNIQUE,
+			p256dh       TEXT NOT NULL,
+			auth         TEXT NOT NULL,
+			label        TEXT NOT NULL DEFAULT '',
+			user         TEXT NOT NULL DEFAULT '',
+			topics       TEXT NOT NULL DEFAULT '',
+			min_priority INTEGER NOT NULL DEFAULT 1,
+			created_by   TEXT NOT NULL DEFAULT '',
+			created_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			last_sent_at DATETIME,
+			sent         INTEGER NOT NULL DEFAULT 0,
+			failures     INTEGER NOT NULL DEFAULT 0,
+			last_error   TEXT NOT NULL DEFAULT ''
+		)
+	`)
+	return err
+}
+
+// loadVAPIDKey reads the key from file, or from the settings table,
+// generating and storing it there the first time.
+func loadVAPIDKey(file string) error {
+	if file != "" {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		block, _ := pem.Decode(raw)
+		if block == nil {
+			return errors.New("no PEM block in VAPID key file")
+		}
+		var key any
+		if block.Type == "EC PRIVATE KEY" {
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		} else {
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return err
+		}
+		k, ok := key.(*ecdsa.PrivateKey)
+		if !ok || k.Curve != elliptic.P256() {
+			return errors.New("VAPID key is not a P-256 EC private key")
+		}
+		vapidKey = k
+		return nil
+	}
+	if getSetting(webPushKeySetting) == "" {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		// Another process sharing the database may have stored one first.
+		if _, err := db.Exec(`INSERT OR IGNORE INTO settings (key, value) VALUES (?, ?)`,
+			webPushKeySetting, base64.RawURLEncoding.EncodeToString(k.D.FillBytes(make([]byte, 32)))); err != nil {
+			return err
+		}
+	}
+	d, err := base64.RawURLEncoding.DecodeString(getSetting(webPushKeySetting))
+	if err != nil || len(d) != 32 {
+		return errors.New("stored VAPID key is malformed")
+	}
+	k := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	k.Curve = elliptic.P256()
+	k.X, k.Y = k.Curve.ScalarBaseMult(d)
+	vapidKey = k
+	return nil
+}
+
+// vapidPublicKey is the uncompressed public key, base64url-encoded as
+// browsers take it for applicationServerKey.
+func vapidPublicKey() string {
+	pub, _ := vapidKey.PublicKey.ECDH()
+	return base64.RawURLEncoding.EncodeToString(pub.Bytes())
+}
+
+type webPushSubscription struct {
+	ID       int64  `json:"id"`
+	Endpoint string `json:"endpoint"`
+	P256dh   string `json:"-"`
+	Auth     string `json:"-"`
+	Label    string `json:"label,omitempty"`
+	pushFilter
+	CreatedBy  string  `json:"created_by"`
+	CreatedAt  string  `json:"created_at"`
+	LastSentAt *string `json:"last_sent_at"`
+	Sent       int64   `json:"sent"`
+	Failures   int64   `json:"failures"`
+	LastError  string  `json:"last_error,omitempty"`
+}
+
+const webPushCols = `id, endpoint, p256dh, auth, label, user, topics, min_priority, created_by, created_at, last_sent_at, sent, failures, last_error`
+
+func scanWebPush(s scanner) (webPushSubscription, error) {
+	var w webPushSubscription
+	var topics string
+	var last *string
+	err := s.Scan(&w.ID, &w.Endpoint, &w.P256dh, &w.Auth, &w.Label, &w.User, &topics, &w.MinPriority,
+		&w.CreatedBy, &w.CreatedAt, &last, &w.Sent, &w.Failures, &w.LastError)
+	w.Topics, w.LastSentAt = splitList(topics), last
+	return w, err
+}
+
+func listWebPush() ([]webPushSubscription, error) {
+	rows, err := db.Query(`SELECT ` + webPushCols + ` FROM webpush_subscriptions ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []webPushSubscription{}
+	for rows.Next() {
+		s, err := scanWebPush(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// ── Handlers ──
+
+// handleVAPIDKey serves the public key pages subscribe with.
+func handleVAPIDKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"public_key": vapidPublicKey()})
+	}
+}
+
+// handleWebPushSubscriptions lists (GET) or adds (POST) subscriptions. The
+// POST body is the browser's PushSubscription JSON plus optional filters;
+// posting an endpoint again replaces its keys and filters.
+func handleWebPushSubscriptions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			subs, err := listWebPush()
+			if err != nil {
+				log.Printf("webpush: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"subscriptions": subs})
+		case http.MethodPost:
+			var body struct {
+				Endpoint string `json:"endpoint"`
+				Keys     struct {
+					P256dh string `json:"p256dh"`
+					Auth   string `json:"auth"`
+				} `json:"keys"`
+				Label string `json:"label"`
+				pushFilter
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			if u, err := url.Parse(body.Endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+				http.Error(w, "endpoint must be an https URL", http.StatusBadRequest)
+				return
+			}
+			if _, err := webPushKeys(body.Keys.P256dh, body.Keys.Auth); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := body.check(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			by := authFrom(r).ID
+			var id int64
+			err := db.QueryRow(`
+				INSERT INTO webpush_subscriptions (endpoint, p256dh, auth, label, user, topics, min_priority, created_by)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT(endpoint) DO UPDATE SET p256dh = excluded.p256dh, auth = excluded.auth,
+					label = excluded.label, user = excluded.user, topics = excluded.topics,
+					min_priority = excluded.min_priority, created_by = excluded.created_by, failures = 0, last_error = ''
+				RETURNING id`,
+				body.Endpoint, body.Keys.P256dh, body.Keys.Auth, body.Label, body.User,
+				strings.Join(body.Topics, ","), body.MinPriority, by).Scan(&id)
+			var s webPushSubscription
+			if err == nil {
+				s, err = scanWebPush(db.QueryRow(`SELECT `+webPushCols+` FROM webpush_subscriptions WHERE id = ?`, id))
+			}
+			if err != nil {
+				log.Printf("webpush: subscribe: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			audit(by, "webpush.subscribe", strconv.FormatInt(id, 10), endpointHost(body.Endpoint))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(s)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleWebPushSubscription deletes a subscription.
+func handleWebPushSubscription() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+		res, err := db.Exec(`DELETE FROM webpush_subscriptions WHERE id = ?`, id)
+		if err != nil {
+			log.Printf("webpush: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		audit(authFrom(r).ID, "webpush.unsubscribe", strconv.FormatInt(id, 10), "")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func endpointHost(endpoint string) string {
+	if u, err := url.Parse(endpoint); err == nil {
+		return u.Host
+	}
+	return ""
+}
+
+// ── Delivery ──
+
+// webPushTargets lists the subscriptions that want n, by id.
+func webPushTargets(h *hub, n Notification) ([]string, error) {
+	subs, err := listWebPush()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, s := range pushTargets(n, subs, func(s webPushSubscription) pushFilter { return s.pushFilter }) {
+		ids = append(ids, strconv.FormatInt(s.ID, 10))
+	}
+	return ids, nil
+}
+
+func deliverWebPush(target string, n Notification) error {
+	s, err := scanWebPush(db.QueryRow(`SELECT `+webPushCols+` FROM webpush_subscriptions WHERE id = ?`, target))
+	if err == sql.ErrNoRows {
+		return errTargetGone // unsubscribed since
+	}
+	if err != nil {
+		return err
+	}
+	err = sendWebPush(s, webPushPayload(n), n.Priority)
+	switch {
+	case err == errTargetGone:
+		log.Printf("webpush: subscription %d (%s) expired, removing", s.ID, endpointHost(s.Endpoint))
+		db.Exec(`DELETE FROM webpush_subscriptions WHERE id = ?`, s.ID)
+	case err != nil:
+		db.Exec(`UPDATE webpush_subscriptions SET failures = failures + 1, last_error = ? WHERE id = ?`, err.Error(), s.ID)
+	default:
+		db.Exec(`UPDATE webpush_subscriptions SET sent = sent + 1, last_sent_at = CURRENT_TIMESTAMP WHERE id = ?`, s.ID)
+	}
+	return err
+}
+
+// webPushPayload is what the service worker gets: the notification's
+// fields, with the text cut to fit a single push record.
+func webPushPayload(n Notification) []byte {
+	p := map[string]any{
+		"id":         n.ID,
+		"title":      n.Title,
+		"text":       n.Text,
+		"source":     n.Source,
+		"topic":      n.Topic,
+		"priority":   n.Priority,
+		"created_at": n.CreatedAt,
+	}
+	if n.ClickURL != "" {
+		p["click_url"] = n.ClickURL
+	}
+	return fitPayload(n.Text, webPushMaxPayload, func(text string) []byte {
+		p["text"] = text
+		data, _ := json.Marshal(p)
+		return data
+	})
+}
+
+// webPushUrgency maps priority onto the Urgency header, which lets a
+// battery-saving push service hold back low-priority messages.
+func webPushUrgency(priority int) string {
+	switch {
+	case priority >= 4:
+		return "high"
+	case priority == 3:
+		return "normal"
+	default:
+		return "low"
+	}
+}
+
+func sendWebPush(s webPushSubscription, payload []byte, priority int) error {
+	keys, err := webPushKeys(s.P256dh, s.Auth)
+	if err != nil {
+		return err
+	}
+	body, err := webPushEncrypt(keys, payload)
+	if err != nil {
+		return err
+	}
+	auth, err := vapidAuthorization(s.Endpoint, time.Now())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(webPushTTL.Seconds())))
+	req.Header.Set("Urgency", webPushUrgency(priority))
+	resp, err := webPushHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errTargetGone
+	case resp.StatusCode/100 != 2:
+		return httpDeliveryError(resp, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// ── Encryption and VAPID ──
+
+type webPushKeySet struct {
+	pub  *ecdh.PublicKey
+	auth []byte
+}
+
+// webPushKeys decodes a subscription's p256dh and auth keys.
+func webPushKeys(p256dh, auth string) (webPushKeySet, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(p256dh, "="))
+	if err != nil {
+		return webPushKeySet{}, errors.New("keys.p256dh is not base64url")
+	}
+	pub, err := ecdh.P256().NewPublicKey(raw)
+	if err != nil {
+		return webPushKeySet{}, errors.New("keys.p256dh is not a P-256 public key")
+	}
+	secret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(auth, "="))
+	if err != nil || len(secret) != 16 {
+		return webPushKeySet{}, errors.New("keys.auth must be 16 bytes of base64url")
+	}
+	return webPushKeySet{pub, secret}, nil
+}
+
+// webPushEncrypt encrypts payload as a single aes128gcm record (RFC 8188)
+// with keys derived as RFC 8291 describes.
+func webPushEncrypt(keys webPushKeySet, payload []byte) ([]byte, error) {
+	local, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := local.ECDH(keys.pub)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	localPub := local.PublicKey().Bytes()
+	keyInfo := append(append([]byte("WebPush: info\x00"), keys.pub.Bytes()...), localPub...)
+	ikm := hkdf(keys.auth, shared, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, 21+len(localPub))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecord)
+	header = append(header, byte(len(localPub)))
+	header = append(header, localPub...)
+	// 0x02 marks the last (here, only) record.
+	return gcm.Seal(header, nonce, append(payload, 0x02), nil), nil
+}
+
+// hkdf is HKDF-SHA256 (RFC 5869) for outputs of at most one hash length.
+func hkdf(salt, secret, info []byte, n int) []byte {
+	ext := hmac.New(sha256.New, salt)
+	ext.Write(secret)
+	exp := hmac.New(sha256.New, ext.Sum(nil))
+	exp.Write(info)
+	exp.Write([]byte{1})
+	return exp.Sum(nil)[:n]
+}
+
+// vapidAuthorization is the Authorization header for a push to endpoint: a
+// 12-hour ES256 JWT for the push service's origin, and the public key.
+func vapidAuthorization(endpoint string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	claims := map[string]any{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(12 * time.Hour).Unix(),
+	}
+	if *flagVAPIDSubject != "" {
+		claims["sub"] = *flagVAPIDSubject
+	}
+	token, err := signES256(vapidKey, map[string]string{"typ": "JWT"}, claims)
+	if err != nil {
+		return "", err
+	}
+	return "vapid t=" + token + ", k=" + vapidPublicKey(), nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ── WebSocket Admission ───────────────────────────────────────────────────────
+//
+// --max-clients caps connections overall, which lets one client stuck in a
+// reconnect loop crowd out everyone else. Three further limits stop that: at
+// most --ws-max-per-ip connections from one address (behind a reverse proxy
+// this needs --trusted-proxies to see real addresses); at most
+// --ws-attempts-per-ip connection attempts per address and minute, so a
+// client busy-looping on a bad token or a full server is turned away before
+// any work is done; and at most --ws-max-handshakes upgrades in progress at
+// once — authentication, the upgrade and the history query — so a storm of
+// reconnects can't starve the database. Refusals answer 429 or 503 with a
+// jittered Retry-After (the load-based hint of backoff.go, or for the attempt
+// limit the time until another attempt is allowed, up to doubled), are
+// counted in /stats and are logged at most once a minute per address.
+
+var wsAdmission = struct {
+	sync.Mutex
+	handshakes int
+	perIP      map[string]int
+	attempts   map[string]*attemptBucket
+	sweptAt    time.Time
+	loggedAt   map[string]time.Time
+
+	rejectedHandshakes atomic.Int64
+	rejectedPerIP      atomic.Int64
+	rejectedAttempts   atomic.Int64
+	rejectedFull       atomic.Int64
+}{perIP: map[string]int{}, attempts: map[string]*attemptBucket{}, loggedAt: map[string]time.Time{}}
+
+// attemptBucket is a token bucket of connection attempts: it holds up to
+// --ws-attempts-per-ip and refills at that many per minute.
+type attemptBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// allowAttempt takes an attempt for ip, or answers 429 and returns false.
+func allowAttempt(w http.ResponseWriter, ip string) bool {
+	limit := float64(*flagWSAttemptsPerIP)
+	if limit <= 0 {
+		return true
+	}
+	a := &wsAdmission
+	a.Lock()
+	now := time.Now()
+	if now.Sub(a.sweptAt) >= time.Minute {
+		// A bucket untouched for a minute is full again; forget it.
+		for k, b := range a.attempts {
+			if now.Sub(b.at) >= time.Minute {
+				delete(a.attempts, k)
+			}
+		}
+		a.sweptAt = now
+	}
+	b, ok := a.attempts[ip]
+	if !ok {
+		b = &attemptBucket{tokens: limit, at: now}
+		a.attempts[ip] = b
+	}
+	b.tokens = min(limit, b.tokens+now.Sub(b.at).Minutes()*limit)
+	b.at = now
+	if b.tokens >= 1 {
+		b.tokens--
+		a.Unlock()
+		return true
+	}
+	wait := (1 - b.tokens) / limit * 60 // seconds until the next token
+	a.Unlock()
+	a.rejectedAttempts.Add(1)
+	logAdmission(ip, "too many connection attempts")
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait+rand.Float64()*wait)+1))
+	http.Error(w, "too many connection attempts from your address, slow down", http.StatusTooManyRequests)
+	return false
+}
+
+// beginHandshake claims a handshake slot, or answers 503 and returns nil.
+// The returned func frees the slot and may be called more than once.
+func beginHandshake(w http.ResponseWriter, ip string) func() {
+	a := &wsAdmission
+	a.Lock()
+	if *flagWSMaxHandshakes > 0 && a.handshakes >= *flagWSMaxHandshakes {
+		a.Unlock()
+		a.rejectedHandshakes.Add(1)
+		logAdmission(ip, "too many handshakes in progress")
+		setRetryAfter(w, 1)
+		http.Error(w, "too many connection attempts, retry shortly", http.StatusServiceUnavailable)
+		return nil
+	}
+	a.handshakes++
+	a.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.Lock()
+			a.handshakes--
+			a.Unlock()
+		})
+	}
+}
+
+// claimIP reserves a connection for ip, or answers 429 and returns false.
+// Pair with releaseIP once the connection ends.
+func claimIP(w http.ResponseWriter, ip string) bool {
+	a := &wsAdmission
+	a.Lock()
+	if *flagWSMaxPerIP > 0 && a.perIP[ip] >= *flagWSMaxPerIP {
+		a.Unlock()
+		a.rejectedPerIP.Add(1)
+		logAdmission(ip, "connection limit for address reached")
+		setRetryAfter(w, 1)
+		http.Error(w, "too many connections from your address", http.StatusTooManyRequests)
+		return false
+	}
+	a.perIP[ip]++
+	a.Unlock()
+	return true
+}
+
+// refuseFull answers 503 when --max-clients is reached.
+func refuseFull(w http.ResponseWriter, ip string) {
+	wsAdmission.rejectedFull.Add(1)
+	logAdmission(ip, "server full (--max-clients)")
+	setRetryAfter(w, 1)
+	http.Error(w, "too many connections", http.StatusServiceUnavailable)
+}
+
+func releaseIP(ip string) {
+	a := &wsAdmission
+	a.Lock()
+	if a.perIP[ip]--; a.perIP[ip] <= 0 {
+		delete(a.perIP, ip)
+	}
+	a.Unlock()
+}
+
+// logAdmission logs a refusal unless ip was already logged in the last minute.
+func logAdmission(ip, reason string) {
+	a := &wsAdmission
+	a.Lock()
+	defer a.Unlock()
+	now := time.Now()
+	if now.Sub(a.loggedAt[ip]) < time.Minute {
+		return
+	}
+	for k, t := range a.loggedAt {
+		if now.Sub(t) >= time.Minute {
+			delete(a.loggedAt, k)
+		}
+	}
+	a.loggedAt[ip] = now
+	log.Printf("ws: refused %s: %s (further refusals logged after a minute)", ip, reason)
+}
+
+func admissionStats() map[string]any {
+	a := &wsAdmission
+	a.Lock()
+	defer a.Unlock()
+	return map[string]any{
+		"handshakes":          a.handshakes,
+		"max_handshakes":      *flagWSMaxHandshakes,
+		"max_per_ip":          *flagWSMaxPerIP,
+		"attempts_per_ip":     *flagWSAttemptsPerIP,
+		"rejected_handshakes": a.rejectedHandshakes.Load(),
+		"rejected_per_ip":     a.rejectedPerIP.Load(),
+		"rejected_attempts":   a.rejectedAttempts.Load(),
+		"rejected_full":       a.rejectedFull.Load(),
+	}
+}